@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLog receives one record per HTTP request; it defaults to the main logger
+var accessLog = slog.Default
+
+// logRequests records method, path, status, response size, latency and client IP of every request
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.RequestURI,
+			"status", rec.status,
+			"size", rec.bytes,
+			"latency", time.Since(start),
+			"client_ip", clientIP,
+			"user_agent", r.UserAgent(),
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			attrs = append(attrs, "forwarded_for", forwarded)
+		}
+		accessLog().InfoContext(r.Context(), "HTTP request", attrs...)
+	})
+}
+
+// setupAccessLog sends access records to a size-rotated file instead of the main log
+func setupAccessLog(path string, maxSizeMB, maxBackups int) error {
+	file, err := openRotatingFile(path, int64(maxSizeMB)<<20, maxBackups)
+	if err != nil {
+		return err
+	}
+	var handler slog.Handler
+	if config.LogFormat == "json" {
+		handler = slog.NewJSONHandler(file, nil)
+	} else {
+		handler = slog.NewTextHandler(file, nil)
+	}
+	logger := slog.New(contextHandler{handler})
+	accessLog = func() *slog.Logger { return logger }
+	return nil
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1, path.2, ...
+// once it grows past maxSize, keeping at most maxBackups old files
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the existing backups up by one and starts a fresh file
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(rf.path, 0); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+var _ io.Writer = (*rotatingFile)(nil)
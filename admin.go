@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isAdmin reports whether the request may use the admin dashboard: accounts listed
+// in -admins, or, when that list is empty, only clients on the loopback interface.
+// Behind a reverse proxy, which -base-path and -trust-forwarded-for are for,
+// every visitor connects from the proxy, often on the same host, so there
+// nobody is an administrator until -admins names them.
+func isAdmin(r *http.Request) bool {
+	cfg := liveConfig()
+	if cfg.Admins == "" {
+		if cfg.TrustForwardedFor || cfg.BasePath != "" {
+			return false
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr) // Never X-Forwarded-For, which a client can forge
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	name := memberName(r)
+	if name == "" {
+		return false
+	}
+	for _, admin := range strings.Split(cfg.Admins, ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin refuses everyone but administrators
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			writePlainError(w, &requestError{Status: http.StatusForbidden, Code: "forbidden", Message: "The admin dashboard is restricted to administrators"})
+			return
+		}
+		next(w, r)
+	})
+}
+
+// hourlyThroughput counts jobs and frames finished in each of the last 24 hours, oldest first
+func hourlyThroughput(now time.Time) (jobCounts, frameCounts [24]int) {
+	since := now.Add(-24 * time.Hour)
+	for _, j := range jobs.list(func(j *job) bool { return j.Status == jobDone && j.Finished.After(since) }) {
+		// Finished in the future by the clock of the instance that ran it counts in this hour
+		hour := 23 - max(int(now.Sub(j.Finished)/time.Hour), 0)
+		jobCounts[hour]++
+		frameCounts[hour] += j.Frames
+	}
+	return jobCounts, frameCounts
+}
+
+// purgeResults deletes stored results of jobs finished before cutoff and returns
+// how many were removed and the bytes freed
+func purgeResults(cutoff time.Time) (count int, freed int64) {
+	old := jobs.list(func(j *job) bool { return j.Result != "" && j.Finished.Before(cutoff) })
+	for _, j := range old {
+		if err := removeStoredResult(context.Background(), j); err != nil {
+			slog.Error("Error purging result", "job_id", j.ID, "error", err)
+			continue
+		}
+		removeTiles(j.ID)
+		jobs.setResult(j.ID, "", 0)
+		count++
+		freed += j.ResultSize
+	}
+	return count, freed
+}
+
+// adminPageHandler renders the dashboard
+func adminPageHandler(w http.ResponseWriter, r *http.Request) {
+	token := csrfToken(w, r)
+	now := time.Now()
+	health, _ := collectHealth(true)
+
+	var b strings.Builder
+	st := health.Jobs
+	fmt.Fprintf(&b, `<h4>%s</h4><p>%s`, tr(r, "Queue"), trf(r, "%d queued of %d slots &middot; %d running &middot; %d of %d workers alive",
+		st.Queued, st.QueueSize, st.Running, st.WorkersAlive, len(st.Workers)))
+	if st.Draining {
+		fmt.Fprintf(&b, ` &middot; <strong>%s</strong>`, tr(r, "draining"))
+	}
+	fmt.Fprintf(&b, ` &middot; %s</p>`, trf(r, "accumulation memory %s", formatMB(metrics.accumulatorBytes.Load())))
+
+	// Active jobs with a cancel button each
+	b.WriteString(localize(r, `<h4>{{Active jobs}}</h4><table class="table table-sm"><tr><th>{{Job}}</th><th>{{Owner}}</th><th>{{Status}}</th><th>{{Frames}}</th><th>{{Scale}}</th><th>{{Memory}}</th><th>{{Age}}</th><th></th></tr>`))
+	active := jobs.list(func(j *job) bool { return j.Status == jobQueued || j.Status == jobRunning })
+	slices.Reverse(active) // Oldest first, in queue order
+	for _, j := range active {
+		fmt.Fprintf(&b, `<tr><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%dx</td><td>%s</td><td>%s</td><td>`,
+			j.ID, html.EscapeString(j.Owner), tr(r, string(j.Status)), j.Frames, j.Scale, formatMB(j.Memory), now.Sub(j.Created).Round(time.Second))
+		fmt.Fprintf(&b, `<form action="%s" method="post"><input type="hidden" name="csrf_token" value="%s"><button type="submit" class="btn btn-sm btn-outline-danger">%s</button></form></td></tr>`,
+			config.url("/admin/jobs/"+j.ID+"/cancel"), token, tr(r, "Cancel"))
+	}
+	if len(active) == 0 {
+		fmt.Fprintf(&b, `<tr><td colspan="8" class="text-muted">%s</td></tr>`, tr(r, "No active jobs"))
+	}
+	b.WriteString(`</table>`)
+
+	// Recent jobs with their resource usage
+	b.WriteString(localize(r, `<h4>{{Recent jobs}}</h4><table class="table table-sm"><tr><th>{{Job}}</th><th>{{Owner}}</th><th>{{Status}}</th><th>{{Frames}}</th><th>{{Scale}}</th><th>{{Memory}}</th><th>{{Processing time}}</th><th>{{Result}}</th></tr>`))
+	recent := jobs.list(func(j *job) bool { return j.Status != jobQueued && j.Status != jobRunning })
+	for _, j := range recent[:min(len(recent), 20)] {
+		processing := "-"
+		if !j.Started.IsZero() {
+			processing = j.Finished.Sub(j.Started).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(&b, `<tr><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%dx</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+			j.ID, html.EscapeString(j.Owner), tr(r, string(j.Status)), j.Frames, j.Scale, formatMB(j.Memory), processing, formatMB(j.ResultSize))
+	}
+	b.WriteString(`</table>`)
+
+	// Throughput per hour as a bar chart
+	jobCounts, frameCounts := hourlyThroughput(now)
+	peak := max(slices.Max(jobCounts[:]), 1)
+	fmt.Fprintf(&b, `<h4>%s</h4><div class="d-flex align-items-end" style="height:120px;gap:2px">`, tr(r, "Throughput, last 24 hours"))
+	for hour, count := range jobCounts {
+		fmt.Fprintf(&b, `<div title="%s" style="flex:1;background:var(--bs-primary);height:%d%%;min-height:1px"></div>`,
+			trf(r, "%d jobs, %d frames, %d h ago", count, frameCounts[hour], 23-hour), count*100/peak)
+	}
+	fmt.Fprintf(&b, `</div><p class="text-muted small">%s</p>`, trf(r, "Hover a bar for details. Tallest bar: %d jobs.", peak))
+
+	// Disk usage of the working directories and stored results
+	b.WriteString(localize(r, `<h4>{{Disk}}</h4><table class="table table-sm"><tr><th>{{Directory}}</th><th>{{Free}}</th><th>{{Total}}</th></tr>`))
+	for _, d := range health.Disks {
+		if d.Error != "" {
+			fmt.Fprintf(&b, `<tr><td>%s</td><td colspan="2">%s</td></tr>`, html.EscapeString(d.Path), html.EscapeString(d.Error))
+			continue
+		}
+		fmt.Fprintf(&b, `<tr><td>%s</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(d.Path), formatMB(int64(d.FreeBytes)), formatMB(int64(d.TotalBytes)))
+	}
+	b.WriteString(`</table>`)
+	if used, budget := diskBudgetUsage(); budget > 0 {
+		fmt.Fprintf(&b, `<p>%s</p>`, trf(r, "Disk budget: %s of %d MB used or reserved.", formatMB(used), budget>>20))
+	}
+	if config.ResultsDir != "" {
+		var stored int64
+		var count int
+		for _, j := range jobs.list(func(j *job) bool { return j.Result != "" }) {
+			stored += j.ResultSize
+			count++
+		}
+		fmt.Fprintf(&b, `<p>%s</p>`, trf(r, "%d stored results use %s.", count, formatMB(stored)))
+		fmt.Fprintf(&b, `<form action="%s" method="post" class="d-flex gap-2 align-items-center"><input type="hidden" name="csrf_token" value="%s">%s <input type="number" name="days" value="30" min="0" class="form-control form-control-sm w-auto"> %s <button type="submit" class="btn btn-sm btn-danger">%s</button></form>`,
+			config.url("/admin/purge"), token, tr(r, "Delete results older than"), tr(r, "days"), tr(r, "Purge"))
+	}
+
+	const adminPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<meta http-equiv="refresh" content="30">
+	<title>{{Admin}}</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Admin}}</h1>
+	%s
+	<div class="bg-body p-4 rounded shadow">%s</div>
+	</div>
+	%s
+	</body>
+	</html>
+	`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(w, localize(r, adminPageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), b.String(), pageFooter(r))
+}
+
+// adminCancelHandler cancels a queued or running job
+func adminCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	id := r.PathValue("id")
+	if !jobs.cancelJob(id) {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No active job with this ID"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Job canceled by administrator", "canceled_job", id)
+	http.Redirect(w, r, config.url("/admin"), http.StatusSeeOther)
+}
+
+// adminPurgeHandler deletes stored results older than the submitted number of days
+func adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 0 {
+		writePlainError(w, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "Parameter days must be a non-negative integer"})
+		return
+	}
+	count, freed := purgeResults(time.Now().AddDate(0, 0, -days))
+	slog.InfoContext(r.Context(), "Results purged by administrator", "older_than_days", days, "count", count, "freed_bytes", freed)
+	http.Redirect(w, r, config.url("/admin"), http.StatusSeeOther)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// alignedFrame describes one frame written by the align command, in the shifts file
+type alignedFrame struct {
+	Index  int    `json:"index"`            // Position of the frame among the arguments, from 0
+	File   string `json:"file"`             // Name of the aligned frame in the output directory
+	Source string `json:"source,omitempty"` // Path it was read from, empty for standard input
+	frameReport
+}
+
+// alignCommand runs only the alignment stage: it shifts every frame of a burst
+// onto the reference and writes the aligned frames and their shifts to a
+// directory, for stacking tools that do their own fusion
+func alignCommand(args []string) int {
+	fs := flag.NewFlagSet("align", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s align -output <dir> [flags] <frame>...\n\nWrites every frame aligned with the reference as frame-NNN.png, in argument order, and the shifts to shifts.json.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "", "directory the aligned frames and shifts.json are written to (required)")
+	reference := fs.Int("reference", 0, "index of the frame the others are aligned to, from 0 in argument order")
+	fit := fs.String("fit", "", fitFlagUsage)
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	clip := videoFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if *output == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return exitBadInput
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	events := jsonEvents(false)
+	start := time.Now()
+	frames, err := alignBurst(ctx, fs.Args(), *clip, *reference, *fit, *output, events)
+	if err != nil {
+		slog.Error("Error aligning burst", "error", err)
+		events.emit("error", "", map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+		return exitCode(err)
+	}
+	slog.Info("Burst aligned", "frames", len(frames), "output", *output, "duration", time.Since(start).Round(time.Millisecond))
+	events.emit("result", "", map[string]any{"path": *output, "frames": frames, "duration_seconds": time.Since(start).Seconds()})
+	return exitOK
+}
+
+// alignBurst aligns the frames at paths, those of videos as clip selects, with
+// the one at index reference, once fit has brought them to a common size, and
+// writes them and shifts.json to dir
+func alignBurst(ctx context.Context, paths []string, clip videoClip, reference int, fit string, dir string, events *commandEvents) ([]alignedFrame, error) {
+	images, _, err := decodeFrameFiles(ctx, paths, clip)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]image.Point, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds().Size()
+	}
+	if _, err := checkBurst(sizes, frameNames(paths, len(images)), superResolutionRequestV1{Scale: 1, Reference: reference, Fit: fit}); err != nil {
+		return nil, err
+	}
+	if fit != "" {
+		images, _ = fitFrames(images, reference, fit)
+	}
+	if events != nil {
+		events.emit("start", "", map[string]any{"frames": len(images)})
+		ctx = withProgressFunc(ctx, func(stage string, done, total int) {
+			events.emit("progress", "", map[string]any{"stage": stage, "done": done, "total": total})
+		})
+	}
+
+	// Frames are aligned with the reference first, then written back in argument order
+	order := make([]int, len(images))
+	for i := range order {
+		order[i] = i
+	}
+	order = referenceFirst(order, reference)
+	ordered := make([]image.Image, len(order))
+	for i, index := range order {
+		ordered[i] = images[index]
+	}
+	aligned, shifts := findAndAlignImages(ctx, ordered, processOptions{})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, &commandError{exitInternal, err}
+	}
+	frames := make([]alignedFrame, len(images))
+	for i, index := range order {
+		f := alignedFrame{
+			Index:       index,
+			File:        fmt.Sprintf("frame-%03d.png", index+1),
+			frameReport: frameReport{Width: sizes[index].X, Height: sizes[index].Y, ShiftX: shifts[i].X, ShiftY: shifts[i].Y},
+		}
+		if len(paths) == len(images) && !slices.Contains(paths, stdioPath) {
+			f.Source = paths[index]
+		}
+		if err := writeResultFile(filepath.Join(dir, f.File), aligned[i], processOptions{Format: formatPNG}); err != nil {
+			return nil, &commandError{exitInternal, err}
+		}
+		frames[index] = f
+	}
+
+	data, err := json.MarshalIndent(map[string]any{"reference": reference, "frames": frames}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "shifts.json"), append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		return nil, &commandError{exitInternal, err}
+	}
+	return frames, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	_ "embed" // Required for embedding
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// wasmExecJS is the loader of Go WebAssembly modules from the Go distribution
+// (lib/wasm/wasm_exec.js). It must come from the Go version the -preview-wasm
+// module is built with.
+//
+//go:embed static/wasm_exec.js
+var wasmExecJS string
+
+// browserModule runs instead of the server when it is set: the js/wasm build sets
+// it to the alignment preview loaded by the upload page
+var browserModule func()
+
+// previewSearch is how far previewAlignment searches on the small copies of the
+// frames, in their pixels
+const previewSearch = 8
+
+// previewMismatchRMS is the difference per colour channel, 0-255, above which an
+// aligned frame is taken for a different scene than the reference
+const previewMismatchRMS = 40
+
+// alignmentPreview is the approximate shift of a frame against the reference, in
+// pixels of the full frame, with a warning when the frame will not fuse well
+type alignmentPreview struct {
+	DX, DY     int
+	Difference float64 // RMS difference per colour channel after alignment
+	Warning    string  // English text for the upload page to translate, empty when the frame looks fine
+}
+
+// previewAlignment estimates the shift of frame against reference on small copies
+// of both, drawn at the same scale by the upload page before anything is uploaded.
+// referenceSize and frameSize are the sizes of the full frames.
+func previewAlignment(reference, frame image.Image, referenceSize, frameSize image.Point) alignmentPreview {
+	if frameSize != referenceSize {
+		return alignmentPreview{Warning: "Different size than the reference frame"}
+	}
+	best := alignmentPreview{Difference: math.Inf(1)}
+	ref, small := newColourPlane(reference), newColourPlane(frame)
+	for dy := -previewSearch; dy <= previewSearch; dy++ {
+		for dx := -previewSearch; dx <= previewSearch; dx++ {
+			if diff := calculateDifference(context.Background(), ref, small, dx, dy); diff < best.Difference {
+				best = alignmentPreview{DX: dx, DY: dy, Difference: diff}
+			}
+		}
+	}
+	atLimit := max(best.DX, -best.DX, best.DY, -best.DY) == previewSearch
+
+	scale := float64(referenceSize.X) / float64(max(reference.Bounds().Dx(), 1))
+	best.DX = int(math.Round(float64(best.DX) * scale))
+	best.DY = int(math.Round(float64(best.DY) * scale))
+	best.Difference = math.Sqrt(best.Difference / 3)
+	switch {
+	case atLimit || max(best.DX, -best.DX, best.DY, -best.DY) > maxAlignShift:
+		best.Warning = "Moved further than the server can align"
+	case best.Difference > previewMismatchRMS:
+		best.Warning = "Looks like a different scene than the reference frame"
+	}
+	return best
+}
+
+// alignPreviewAttributes renders the attributes of the upload page's file input
+// that point its script at the alignment preview, when -preview-wasm is set
+func alignPreviewAttributes() string {
+	if config.PreviewWasm == "" {
+		return ""
+	}
+	return fmt.Sprintf(` data-align-preview="%s" data-wasm-exec="%s"`, config.url("/align-preview.wasm"), config.url("/wasm_exec.js"))
+}
+
+// compressedPreview reads the -preview-wasm module once and compresses it: the
+// module is the whole program, which shrinks to a quarter with gzip
+var compressedPreview = sync.OnceValues(func() ([]byte, error) {
+	module, err := os.ReadFile(config.PreviewWasm)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	_, _ = zw.Write(module)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+})
+
+// alignPreviewHandler serves the -preview-wasm module, compressed for browsers
+// that accept it
+func alignPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	compressed, err := compressedPreview()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not load the alignment preview", "path", config.PreviewWasm, "error", err)
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "The alignment preview is not available"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/wasm")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed)
+		return
+	}
+	http.ServeFile(w, r, config.PreviewWasm)
+}
+
+// wasmExecHandler serves the loader the upload page starts the preview with
+func wasmExecHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, _ = w.Write([]byte(wasmExecJS))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"image"
+	"syscall/js"
+)
+
+func init() {
+	browserModule = runAlignPreview
+}
+
+// runAlignPreview exposes previewAlignment to the upload page as
+// chichaAlignPreview(reference, frame) and keeps the module running for its calls
+func runAlignPreview() {
+	js.Global().Set("chichaAlignPreview", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 2 {
+			return js.Null()
+		}
+		reference, referenceSize := jsFrame(args[0])
+		frame, frameSize := jsFrame(args[1])
+		p := previewAlignment(reference, frame, referenceSize, frameSize)
+		return map[string]any{"dx": p.DX, "dy": p.DY, "difference": p.Difference, "warning": p.Warning}
+	}))
+	select {}
+}
+
+// jsFrame copies a small frame from the page: the width, height and data of a
+// canvas ImageData, with the fullWidth and fullHeight of the file it was drawn from
+func jsFrame(v js.Value) (*image.RGBA, image.Point) {
+	img := image.NewRGBA(image.Rect(0, 0, v.Get("width").Int(), v.Get("height").Int()))
+	js.CopyBytesToGo(img.Pix, v.Get("data"))
+	return img, image.Pt(v.Get("fullWidth").Int(), v.Get("fullHeight").Int())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	analyzeExposure  = 0.5 // Exposure difference from the reference, in EV, above which a frame is excluded
+	analyzeDuplicate = 1.0 // Mean squared difference, 0-255 levels, below which two frames count as the same
+)
+
+// Reasons the analyze command recommends leaving a frame out
+const (
+	excludeSize      = "size"      // Another size than the reference
+	excludeUnmatched = "unmatched" // Nothing in it lines up with the reference
+	excludeDuplicate = "duplicate" // The same picture as an earlier frame
+	excludeSoft      = "soft"      // Much softer than the sharpest frame
+	excludeExposure  = "exposure"  // Much brighter or darker than the reference
+)
+
+// frameAnalysis is what the analyze command found out about one frame
+type frameAnalysis struct {
+	Index       int     `json:"index"` // Position among the arguments, from 0
+	Source      string  `json:"source,omitempty"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Sharpness   float64 `json:"sharpness"` // Variance of the Laplacian of the centre, as on the upload page
+	Noise       float64 `json:"noise"`     // Noise standard deviation, 0-255
+	Matched     bool    `json:"matched"`   // Whether its shift against the reference could be measured
+	ShiftX      float64 `json:"shift_x"`   // Position against the reference in pixels, to a fraction of a pixel
+	ShiftY      float64 `json:"shift_y"`
+	ExposureEV  float64 `json:"exposure_ev"`            // Brightness against the reference, in stops
+	DuplicateOf *int    `json:"duplicate_of,omitempty"` // Earlier frame with the same picture
+	Exclude     string  `json:"exclude,omitempty"`      // Why leaving it out is recommended, one of the exclude reasons
+}
+
+// burstAnalysis is the report of the analyze command
+type burstAnalysis struct {
+	Reference        int             `json:"reference"`
+	Frames           []frameAnalysis `json:"frames"`
+	Exclude          []int           `json:"exclude"` // Frames to leave out, by index
+	RecommendedScale int             `json:"recommended_scale"`
+	Benefit          string          `json:"benefit"` // Expected benefit of fusing the other frames, as in the pre-flight check
+	Notes            []string        `json:"notes"`
+}
+
+// analyzeCommand reports on a burst without fusing it: the sharpness, shift,
+// exposure and noise of every frame, duplicates, and the scale and frames to
+// leave out it recommends
+func analyzeCommand(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze [flags] <frame>...\n\nReports on a burst without processing it.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	reference := fs.Int("reference", 0, "index of the frame the others are measured against, from 0 in argument order")
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	clip := videoFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitBadInput
+	}
+
+	events := jsonEvents(false)
+	paths := fs.Args()
+	images, _, err := decodeFrameFiles(context.Background(), paths, *clip)
+	if err == nil && len(images) == 0 {
+		err = &commandError{exitFewFrames, fmt.Errorf("no frames: expected JPEG, PNG, GIF or TIFF files")}
+	}
+	if err == nil && (*reference < 0 || *reference >= len(images)) {
+		err = &commandError{exitBadInput, fmt.Errorf("-reference must be the index of one of the %d frames, from 0", len(images))}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		events.emit("error", "", map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+		return exitCode(err)
+	}
+	a := analyzeBurst(images, *reference)
+	if len(paths) == len(images) && !slices.Contains(paths, stdioPath) {
+		for i := range a.Frames {
+			a.Frames[i].Source = paths[i]
+		}
+	}
+	if events != nil {
+		events.emit("analysis", "", map[string]any{"analysis": a})
+		return exitOK
+	}
+	a.print(os.Stdout)
+	return exitOK
+}
+
+// analyzeBurst measures every frame against the one at index reference and
+// picks the frames worth leaving out
+func analyzeBurst(images []image.Image, reference int) burstAnalysis {
+	a := burstAnalysis{Reference: reference, Frames: make([]frameAnalysis, len(images)), Exclude: []int{}}
+	patches := make([]grayPatch, len(images))
+	refSize := images[reference].Bounds().Size()
+	for i, img := range images {
+		patches[i] = centerPatch(img, assessPatch)
+		a.Frames[i] = frameAnalysis{
+			Index:     i,
+			Width:     img.Bounds().Dx(),
+			Height:    img.Bounds().Dy(),
+			Sharpness: patchSharpness(patches[i]),
+			Noise:     patchNoise(patches[i]),
+		}
+	}
+
+	ref := patches[reference]
+	refMean := patchMean(ref)
+	for i := range a.Frames {
+		f := &a.Frames[i]
+		if mean := patchMean(patches[i]); mean > 0 && refMean > 0 {
+			f.ExposureEV = math.Log2(mean / refMean)
+		}
+		switch {
+		case i == reference:
+			f.Matched = true
+		case images[i].Bounds().Size() != refSize:
+			f.Exclude = excludeSize
+		default:
+			f.ShiftX, f.ShiftY, f.Matched = subpixelShift(ref, patches[i])
+			if !f.Matched {
+				f.Exclude = excludeUnmatched
+			}
+		}
+		if f.Exclude != "" || i == reference {
+			continue
+		}
+		// The reference and the first of identical frames are kept
+		candidates := []int{reference}
+		for j := range i {
+			if j != reference && a.Frames[j].Exclude == "" && a.Frames[j].DuplicateOf == nil {
+				candidates = append(candidates, j)
+			}
+		}
+		for _, j := range candidates {
+			if patchDifference(patches[j], patches[i], 0, 0) < analyzeDuplicate {
+				f.DuplicateOf = &j
+				break
+			}
+		}
+	}
+
+	// Sharpness and exposure are judged among the frames that line up at all
+	sharpest := 0.0
+	for _, f := range a.Frames {
+		if f.Exclude == "" {
+			sharpest = max(sharpest, f.Sharpness)
+		}
+	}
+	for i := range a.Frames {
+		f := &a.Frames[i]
+		switch {
+		case i == reference || f.Exclude != "":
+		case f.DuplicateOf != nil:
+			f.Exclude = excludeDuplicate
+		case f.Sharpness < assessSoft*sharpest:
+			f.Exclude = excludeSoft
+		case math.Abs(f.ExposureEV) > analyzeExposure:
+			f.Exclude = excludeExposure
+		}
+		if f.Exclude != "" {
+			a.Exclude = append(a.Exclude, i)
+		}
+	}
+
+	// The recommendation is that of the pre-flight check on the frames kept
+	kept := []image.Image{images[reference]}
+	for i, img := range images {
+		if i != reference && a.Frames[i].Exclude == "" {
+			kept = append(kept, img)
+		}
+	}
+	assessment := assessBurst(kept)
+	a.RecommendedScale, a.Benefit, a.Notes = assessment.RecommendedScale, assessment.Benefit, assessment.Notes
+	if len(a.Exclude) > 0 {
+		a.Notes = append(a.Notes, fmt.Sprintf("Leaving out %d of the %d frames is recommended; the scale and benefit above are for the %d kept.", len(a.Exclude), len(images), len(kept)))
+	}
+	return a
+}
+
+// patchMean is the mean luminance of a patch, 0-255
+func patchMean(p grayPatch) float64 {
+	sum := 0.0
+	for _, v := range p.pix {
+		sum += v
+	}
+	return sum / float64(max(len(p.pix), 1))
+}
+
+// print writes the analysis as a table with the recommendation under it
+func (a burstAnalysis) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FRAME\tFILE\tSIZE\tSHARPNESS\tSHIFT\tEXPOSURE\tNOISE\tEXCLUDE")
+	for _, f := range a.Frames {
+		name := "-"
+		if f.Source != "" {
+			name = filepath.Base(f.Source)
+		}
+		shift := "reference"
+		switch {
+		case f.Index == a.Reference:
+		case f.Matched:
+			shift = fmt.Sprintf("%+.2f,%+.2f", f.ShiftX, f.ShiftY)
+		default:
+			shift = "-"
+		}
+		exclude := f.Exclude
+		if f.DuplicateOf != nil {
+			exclude = strings.TrimSpace(fmt.Sprintf("%s (same as %d)", exclude, *f.DuplicateOf))
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%dx%d\t%.1f\t%s\t%+.2f EV\t%.1f\t%s\n", f.Index, name, f.Width, f.Height, f.Sharpness, shift, f.ExposureEV, f.Noise, exclude)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRecommended scale: %dx (expected benefit: %s)\n", a.RecommendedScale, a.Benefit)
+	if len(a.Exclude) > 0 {
+		excluded := make([]string, len(a.Exclude))
+		for i, index := range a.Exclude {
+			excluded[i] = fmt.Sprint(index)
+		}
+		fmt.Fprintf(w, "Frames to leave out: %s\n", strings.Join(excluded, ", "))
+	}
+	for _, note := range a.Notes {
+		fmt.Fprintln(w, "- "+note)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// apiKey is one entry of the API key store. Keys may be stored in clear text or,
+// preferably, as the hex SHA-256 of the key so the file never holds usable secrets.
+// Zero limits fall back to the server-wide rate, job and quota flags.
+type apiKey struct {
+	Name      string  `json:"name"`
+	Key       string  `json:"key,omitempty"`
+	KeySHA256 string  `json:"key_sha256,omitempty"`
+	Email     string  `json:"email,omitempty"`      // Where completion e-mails of the key's jobs go
+	RateLimit float64 `json:"rate_limit,omitempty"` // Job submissions per minute
+	RateBurst int     `json:"rate_burst,omitempty"`
+	MaxJobs   int     `json:"max_jobs,omitempty"` // Jobs queued or running at once
+
+	StorageMB      int64   `json:"storage_mb,omitempty"`      // Stored results
+	ComputeMinutes float64 `json:"compute_minutes,omitempty"` // Processing time per 24 hours
+}
+
+// apiKeyStore looks keys up by their SHA-256 digest
+type apiKeyStore struct {
+	byHash map[string]*apiKey
+}
+
+// apiKeys holds the loaded key store; nil when -api-keys is not set and the API is open.
+// It is replaced when the configuration is reloaded.
+var apiKeys atomic.Pointer[apiKeyStore]
+
+// loadAPIKeys reads a JSON array of apiKey entries from path
+func loadAPIKeys(path string) (*apiKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*apiKey
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing API key store %s: %w", path, err)
+	}
+
+	store := &apiKeyStore{byHash: make(map[string]*apiKey)}
+	for i, k := range entries {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API key store %s: entry %d has no name", path, i+1)
+		}
+		hash := strings.ToLower(k.KeySHA256)
+		if k.Key != "" {
+			hash = hashAPIKey(k.Key)
+		}
+		if len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("API key store %s: key %q needs a key or a 64-digit key_sha256", path, k.Name)
+		}
+		k.Key = "" // Only the digest is kept in memory
+		store.byHash[hash] = k
+	}
+	return store, nil
+}
+
+// hashAPIKey returns the hex SHA-256 digest under which a key is stored
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the entry for a presented key, or nil
+func (s *apiKeyStore) lookup(key string) *apiKey {
+	if key == "" {
+		return nil
+	}
+	return s.byHash[hashAPIKey(key)]
+}
+
+// presentedAPIKey extracts the key from "Authorization: Bearer <key>" or X-API-Key
+func presentedAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, _ := strings.Cut(auth, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the key the request authenticated with, or nil
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// requireAPIKey refuses requests without a valid key when a key store is configured
+func requireAPIKey(writeError errorWriter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := apiKeys.Load()
+		if store == nil {
+			next(w, r)
+			return
+		}
+		k := store.lookup(presentedAPIKey(r))
+		if k == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chicha-superresolution"`)
+			writeError(w, &requestError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "A valid API key is required in the Authorization: Bearer header"})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+// Screen recorders and some cameras save a sequence as an animated PNG: a PNG
+// whose acTL chunk announces frames, each an fcTL chunk placing it on the
+// canvas and its data in fdAT chunks, the first possibly in the IDAT ones. The
+// standard library decodes only the default image, so every frame is rebuilt
+// as a PNG of its own, decoded, and composed onto the canvas the way a player
+// shows it; the frames of the file then make up a burst, as those of a video do.
+
+// APNG frame disposal and blending, see the fcTL chunk
+const (
+	apngDisposeBackground = 1 // Clear the frame's region to transparent black before the next
+	apngDisposePrevious   = 2 // Restore the frame's region to what it was before it
+	apngBlendOver         = 1 // Alpha-blend the frame onto the canvas instead of replacing its region
+)
+
+// errTooManyFrames rejects an animated PNG of more frames than may be decoded
+var errTooManyFrames = errors.New("too many frames")
+
+// apngFrame is one frame of an animated PNG as its fcTL chunk places it
+type apngFrame struct {
+	bounds  image.Rectangle // Region of the canvas it covers
+	dispose byte
+	blend   byte
+	data    []byte // Its compressed image data, from IDAT or fdAT chunks
+}
+
+// isAPNG reports whether the PNG file data starts with, or head of it holds,
+// an acTL chunk before the image data: the mark of an animated PNG
+func isAPNG(head []byte) bool {
+	if !bytes.HasPrefix(head, pngMagic) {
+		return false
+	}
+	for at := len(pngMagic); at+8 <= len(head); {
+		length, kind := int(binary.BigEndian.Uint32(head[at:])), string(head[at+4:at+8])
+		switch kind {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		if length < 0 || length > len(head) {
+			return false
+		}
+		at += 12 + length
+	}
+	return false
+}
+
+// decodeFrames decodes the frames of a file: every frame of an animated PNG,
+// at most maxFrames of them unless it is 0, or else the one image decodeFrame
+// reads, with its format and tags
+func decodeFrames(r io.Reader, maxFrames int) ([]image.Image, string, *frameTags, error) {
+	br := bufio.NewReaderSize(r, exifSearch)
+	if head, _ := br.Peek(len(pngMagic)); !bytes.Equal(head, pngMagic) {
+		img, format, tags, err := decodeFrame(br)
+		return []image.Image{img}, format, tags, err
+	}
+	data, err := io.ReadAll(br) // The acTL chunk may follow others of any size
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if !isAPNG(data) {
+		img, format, tags, err := decodeFrame(bytes.NewReader(data))
+		return []image.Image{img}, format, tags, err
+	}
+	frames, err := apngFrames(data, maxFrames)
+	return frames, "apng", nil, err
+}
+
+// apngFrames decodes the frames of the animated PNG data, each as the canvas
+// shows it once the frame is drawn, and fails with errTooManyFrames when there
+// are more than maxFrames, unless it is 0
+func apngFrames(data []byte, maxFrames int) ([]image.Image, error) {
+	corrupt := errors.New("corrupt APNG")
+	var header []byte // IHDR data
+	var shared bytes.Buffer
+	var frames []*apngFrame
+	for at := len(pngMagic); ; {
+		if at+12 > len(data) {
+			return nil, corrupt
+		}
+		length := int64(binary.BigEndian.Uint32(data[at:]))
+		if length > int64(len(data)-at-12) {
+			return nil, corrupt
+		}
+		kind, body := string(data[at+4:at+8]), data[at+8:at+8+int(length)]
+		chunk := data[at : at+12+int(length)]
+		at += len(chunk)
+		var current *apngFrame
+		if len(frames) > 0 {
+			current = frames[len(frames)-1]
+		}
+		switch kind {
+		case "IHDR":
+			if len(body) != 13 {
+				return nil, corrupt
+			}
+			header = body
+		case "fcTL":
+			if len(body) != 26 || header == nil {
+				return nil, corrupt
+			}
+			width, height := int(binary.BigEndian.Uint32(body[4:])), int(binary.BigEndian.Uint32(body[8:]))
+			x, y := int(binary.BigEndian.Uint32(body[12:])), int(binary.BigEndian.Uint32(body[16:]))
+			bounds := image.Rect(x, y, x+width, y+height)
+			canvas := image.Rect(0, 0, int(binary.BigEndian.Uint32(header)), int(binary.BigEndian.Uint32(header[4:])))
+			if width <= 0 || height <= 0 || x < 0 || y < 0 || !bounds.In(canvas) {
+				return nil, corrupt
+			}
+			if maxFrames > 0 && len(frames) == maxFrames {
+				return nil, errTooManyFrames
+			}
+			frames = append(frames, &apngFrame{bounds: bounds, dispose: body[24], blend: body[25]})
+		case "IDAT":
+			if current != nil { // The default image is the first frame only when its fcTL comes first
+				current.data = append(current.data, body...)
+			}
+		case "fdAT":
+			if current == nil || len(body) < 4 {
+				return nil, corrupt
+			}
+			current.data = append(current.data, body[4:]...) // After the sequence number
+		case "IEND":
+			return composeAPNG(header, shared.Bytes(), frames)
+		case "acTL":
+		default:
+			if current == nil { // Palette, transparency, gamma and the like apply to every frame
+				shared.Write(chunk)
+			}
+		}
+	}
+}
+
+// composeAPNG decodes frames, each a PNG of the header and shared chunks of
+// their file, and draws them in turn onto the canvas the header describes
+func composeAPNG(header, shared []byte, frames []*apngFrame) ([]image.Image, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("APNG without frames")
+	}
+	canvasBounds := image.Rect(0, 0, int(binary.BigEndian.Uint32(header)), int(binary.BigEndian.Uint32(header[4:])))
+	var canvas draw.Image
+	images := make([]image.Image, 0, len(frames))
+	for n, f := range frames {
+		img, err := decodeAPNGFrame(header, shared, f)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d of the APNG: %w", n+1, err)
+		}
+		if canvas == nil {
+			canvas = blankFrame(img, canvasBounds) // 16-bit when the file is
+		}
+		var previous draw.Image
+		if f.dispose == apngDisposePrevious && n > 0 {
+			previous = blankFrame(img, f.bounds)
+			draw.Draw(previous, f.bounds, canvas, f.bounds.Min, draw.Src)
+		}
+		op := draw.Src
+		if f.blend == apngBlendOver {
+			op = draw.Over
+		}
+		draw.Draw(canvas, f.bounds, img, image.Point{}, op)
+		if f.bounds == canvasBounds && op == draw.Src {
+			images = append(images, img) // The frame as decoded, so 16-bit grayscale stays that
+		} else {
+			shown := blankFrame(img, canvasBounds)
+			draw.Draw(shown, canvasBounds, canvas, image.Point{}, draw.Src)
+			images = append(images, shown)
+		}
+		switch {
+		case previous != nil:
+			draw.Draw(canvas, f.bounds, previous, f.bounds.Min, draw.Src)
+		case f.dispose == apngDisposeBackground || f.dispose == apngDisposePrevious: // The first frame has nothing to restore
+			draw.Draw(canvas, f.bounds, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return images, nil
+}
+
+// decodeAPNGFrame decodes frame f as a PNG of its own: the file's header, sized
+// to the frame, its shared chunks and the frame's image data
+func decodeAPNGFrame(header, shared []byte, f *apngFrame) (image.Image, error) {
+	var file bytes.Buffer
+	file.Write(pngMagic)
+	ihdr := bytes.Clone(header)
+	binary.BigEndian.PutUint32(ihdr, uint32(f.bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(f.bounds.Dy()))
+	writePNGChunk(&file, "IHDR", ihdr)
+	file.Write(shared)
+	writePNGChunk(&file, "IDAT", f.data)
+	writePNGChunk(&file, "IEND", nil)
+	return png.Decode(&file)
+}
+
+// writePNGChunk appends a chunk of the given kind and data, with its CRC
+func writePNGChunk(w *bytes.Buffer, kind string, data []byte) {
+	chunk := append([]byte(kind), data...)
+	w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data))))
+	w.Write(chunk)
+	w.Write(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(chunk)))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// zipMagic starts every ZIP archive that holds at least one entry
+var zipMagic = []byte("PK\x03\x04")
+
+// uploadFrame is one frame of an upload: a file of the form or an entry of an
+// uploaded ZIP archive
+type uploadFrame struct {
+	name string
+	size int64 // Uncompressed size; archive/zip refuses entries larger than they declare
+	open func() (io.ReadCloser, error)
+}
+
+// uploadFrames lists the frames of the uploaded files, expanding ZIP archives in
+// place so a burst can be sent as one file. The returned function closes the
+// archives once the frames have been read.
+func uploadFrames(files []uploadFrame) (frames []uploadFrame, closeArchives func(), reqErr *requestError) {
+	var archives []io.Closer
+	closeArchives = func() {
+		for _, a := range archives {
+			a.Close()
+		}
+	}
+	for _, upload := range files {
+		file, err := upload.open()
+		if err != nil {
+			closeArchives()
+			return nil, nil, &requestError{Status: http.StatusInternalServerError, Code: "upload_read_failed", Message: "Error opening uploaded file"}
+		}
+		head := make([]byte, len(zipMagic))
+		n, _ := io.ReadFull(file, head)
+		archive, seekable := file.(io.ReaderAt)
+		if !bytes.Equal(head[:n], zipMagic) || !seekable {
+			file.Close()
+			frames = append(frames, upload)
+			continue
+		}
+
+		archives = append(archives, file)
+		entries, reqErr := archiveFrames(upload.name, archive, upload.size)
+		if reqErr != nil {
+			closeArchives()
+			return nil, nil, reqErr
+		}
+		frames = append(frames, entries...)
+	}
+	return frames, closeArchives, nil
+}
+
+// archiveFrames lists the image entries of a ZIP archive in name order, skipping
+// folders and the hidden files archivers add
+func archiveFrames(name string, file io.ReaderAt, size int64) ([]uploadFrame, *requestError) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) { // Only base names are used, so unsafe paths do no harm
+		return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_archive", Message: fmt.Sprintf("File %s is not a readable ZIP archive.", name)}
+	}
+
+	entries := make([]*zip.File, 0, len(archive.File))
+	for _, entry := range archive.File {
+		base := path.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.HasPrefix(entry.Name, "__MACOSX/") {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_archive", Message: fmt.Sprintf("Archive %s contains no files.", name)}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	frames := make([]uploadFrame, len(entries))
+	for i, entry := range entries {
+		if entry.Method != zip.Store && entry.Method != zip.Deflate {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_archive", Message: fmt.Sprintf("File %s in archive %s uses an unsupported compression method; use deflate or store.", entry.Name, name)}
+		}
+		frames[i] = uploadFrame{name: path.Base(entry.Name), size: int64(min(entry.UncompressedSize64, 1<<62)), open: entry.Open}
+	}
+	return frames, nil
+}
+
+// checkArchiveSize keeps expanded archives within the request size limit, so a
+// small archive cannot unpack into more data than could have been uploaded
+func checkArchiveSize(frames []uploadFrame) *requestError {
+	limit := liveConfig().MaxUploadMB << 20
+	if limit <= 0 {
+		return nil
+	}
+	var total int64
+	for _, frame := range frames {
+		if total += frame.size; total > limit {
+			return &requestError{
+				Status:  http.StatusRequestEntityTooLarge,
+				Code:    "upload_too_large",
+				Message: fmt.Sprintf("The uploaded frames unpack to more than the %d MB limit per request. Please send fewer or smaller frames.", limit>>20),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// Whether fusing a burst beats resizing one photo in an image editor shows
+// best side by side. The bundle of every job holds the same small square of
+// the result and of the reference frame upscaled to its size by each kernel
+// an editor would offer, over the part of the frame with the most detail.
+
+// baselineCrop is the side of the squares compared, in pixels of the result
+const baselineCrop = 256
+
+// baselineKernels are the kernels of interpolationKernels the result is
+// compared with, from the plainest
+var baselineKernels = []string{"nearest", "bilinear", "bicubic"}
+
+// baselineReport tells where the squares of the bundle were cut and which
+// file holds each, for report.json
+type baselineReport struct {
+	X      int            `json:"x"` // Of the top left corner of the squares, in pixels of the result
+	Y      int            `json:"y"`
+	Width  int            `json:"width"`
+	Height int            `json:"height"`
+	Crops  []baselineFile `json:"crops"` // The upscales by baselineKernels, then the result
+}
+
+// baselineFile names the file of one square in the bundle and how it was made
+type baselineFile struct {
+	Method string `json:"method"` // A kernel of baselineKernels, or "result"
+	File   string `json:"file"`
+}
+
+// baselineCrops cuts the square over the most detail out of the result and out
+// of the reference frame upscaled to its size by each of baselineKernels, and
+// returns where it was cut and the squares, in the order of the report
+func baselineCrops(reference, result image.Image) (baselineReport, []image.Image) {
+	rb := result.Bounds()
+	region := detailedRegion(reference, rb.Size(), image.Pt(min(baselineCrop, rb.Dx()), min(baselineCrop, rb.Dy())))
+	report := baselineReport{X: region.Min.X, Y: region.Min.Y, Width: region.Dx(), Height: region.Dy()}
+	var crops []image.Image
+	fb := reference.Bounds()
+	kx, ky := float64(rb.Dx())/float64(fb.Dx()), float64(rb.Dy())/float64(fb.Dy())
+	// From the frame to the square, as if the whole frame were upscaled and
+	// then cropped, so kernels sample beyond the edges of the square as they would
+	s2d := f64.Aff3{kx, 0, -kx*float64(fb.Min.X) - float64(region.Min.X), 0, ky, -ky*float64(fb.Min.Y) - float64(region.Min.Y)}
+	for _, name := range baselineKernels {
+		crop := image.NewRGBA(image.Rectangle{Max: region.Size()})
+		interpolationKernels[name].Transform(crop, s2d, reference, fb, draw.Src, nil)
+		crops = append(crops, crop)
+		report.Crops = append(report.Crops, baselineFile{Method: name, File: "baselines/" + name + ".png"})
+	}
+	crop := image.NewRGBA(image.Rectangle{Max: region.Size()})
+	draw.Copy(crop, image.Point{}, result, region.Add(rb.Min), draw.Src, nil)
+	crops = append(crops, crop)
+	report.Crops = append(report.Crops, baselineFile{Method: "result", File: "baselines/result.png"})
+	return report, crops
+}
+
+// detailedRegion returns the rectangle of the given size, within an image of
+// size upscaled from frame, over the part of frame where its brightness
+// changes the most from pixel to pixel
+func detailedRegion(frame image.Image, size, crop image.Point) image.Rectangle {
+	b := frame.Bounds()
+	w, h := b.Dx(), b.Dy()
+	kx, ky := float64(size.X)/float64(w), float64(size.Y)/float64(h)
+	cw, ch := min(int(math.Ceil(float64(crop.X)/kx)), w), min(int(math.Ceil(float64(crop.Y)/ky)), h) // The square in pixels of the frame
+	luma := lumaPlane(frame)
+	// Sums of the squared gradient above and left of every pixel, for the
+	// energy of any window in four lookups
+	sums := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := 0.0
+		for x := 0; x < w; x++ {
+			var gx, gy float64
+			if x+1 < w {
+				gx = luma[y*w+x+1] - luma[y*w+x]
+			}
+			if y+1 < h {
+				gy = luma[(y+1)*w+x] - luma[y*w+x]
+			}
+			row += gx*gx + gy*gy
+			sums[(y+1)*(w+1)+x+1] = sums[y*(w+1)+x+1] + row
+		}
+	}
+	step := max(min(cw, ch)/4, 1)
+	best, corner := -1.0, image.Point{}
+	for y := 0; y <= h-ch; y += step {
+		for x := 0; x <= w-cw; x += step {
+			energy := sums[(y+ch)*(w+1)+x+cw] - sums[y*(w+1)+x+cw] - sums[(y+ch)*(w+1)+x] + sums[y*(w+1)+x]
+			if energy > best {
+				best, corner = energy, image.Pt(x, y)
+			}
+		}
+	}
+	at := image.Pt(min(int(float64(corner.X)*kx), size.X-crop.X), min(int(float64(corner.Y)*ky), size.Y-crop.Y))
+	return image.Rectangle{Min: at, Max: at.Add(crop)}
+}
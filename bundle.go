@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// jobReport describes how a result was made, for the bundle and for later review
+type jobReport struct {
+	JobID         string        `json:"job_id"`
+	RequestID     string        `json:"request_id,omitempty"`
+	Created       time.Time     `json:"created"`
+	Started       time.Time     `json:"started"`
+	Finished      time.Time     `json:"finished"`
+	Preset        string        `json:"preset,omitempty"`
+	Scale         int           `json:"scale"`
+	Fit           string        `json:"fit,omitempty"` // How frames of another size than the reference were brought to a common size
+	Algorithm     string        `json:"algorithm"`
+	Kernel        string        `json:"kernel"`
+	Format        string        `json:"format"`
+	Lossless      bool          `json:"lossless,omitempty"` // JPEG was refused for the result
+	Quality       int           `json:"quality,omitempty"`
+	Progressive   bool          `json:"progressive,omitempty"` // The JPEG result is progressive
+	Chroma        string        `json:"chroma,omitempty"`      // Chroma subsampling of the JPEG result, "" for 4:2:0
+	Denoise       int           `json:"denoise"`
+	Sharpen       int           `json:"sharpen"`
+	Thermal       bool          `json:"thermal,omitempty"`        // The result shows fused radiometric counts in false colour
+	Mono16        bool          `json:"mono16,omitempty"`         // The frames were fused at 16 bits and rendered in gray
+	Film          bool          `json:"film,omitempty"`           // The frames were fused as passes of a film scan, see filmPasses
+	Negative      bool          `json:"negative,omitempty"`       // The frames were inverted from negatives
+	MatchExposure bool          `json:"match_exposure,omitempty"` // The frames were brought to the exposure of the reference
+	Deghost       bool          `json:"deghost,omitempty"`        // What moved against the reference was taken from it, see rejectGhosts
+	Subject       bool          `json:"subject,omitempty"`        // The moving subject was taken from the frame sharpest in it, see subjectMask
+	Deterministic bool          `json:"deterministic,omitempty"`  // The frames were added one after another in order, see accumulateSuperResolution
+	TileReject    int           `json:"tile_reject,omitempty"`    // Percent of the frames left out of every tile, see rejectTiles
+	Adaptive      bool          `json:"adaptive,omitempty"`       // The frames were weighed by their noise, see noise.go
+	LumaOnly      bool          `json:"luma_only,omitempty"`      // The frames were fused in their brightness alone, see luma.go
+	YCbCr         bool          `json:"ycbcr,omitempty"`          // JPEG frames were fused in their Y'CbCr planes, see ycbcr.go
+	InputSpace    string        `json:"input_space,omitempty"`    // Colour space the frames were taken to be in
+	WorkingSpace  string        `json:"working_space,omitempty"`  // "linear" when they were fused in linear light
+	OutputSpace   string        `json:"output_space,omitempty"`   // Colour space the result was converted to
+	Tonemap       string        `json:"tonemap,omitempty"`        // Operator the fused 16-bit values were rendered with
+	Width         int           `json:"width"`
+	Height        int           `json:"height"`
+	Frames        []frameReport `json:"frames"`
+	Submitted     int           `json:"frames_submitted,omitempty"` // Frames submitted, of which those above were fused
+	FrameNote     string        `json:"frame_count_note,omitempty"` // What the frame-count policy decided or warns of, see frameCountNote
+
+	Assessment *burstAssessment `json:"assessment,omitempty"` // What the pre-flight check expected of the burst
+	Warning    string           `json:"warning,omitempty"`    // Limits of the result to keep in mind, see presetWarnings
+	Baselines  *baselineReport  `json:"baselines,omitempty"`  // Squares of the result beside plain upscales of the reference, see baselineCrops
+}
+
+// frameReport describes one input frame in the order it was fused, the reference first
+type frameReport struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	ShiftX int `json:"shift_x"` // Pixels the frame was moved by to align it with the reference
+	ShiftY int `json:"shift_y"`
+
+	Manual   bool    `json:"manual,omitempty"`   // The alignment was set by hand
+	Rotation float64 `json:"rotation,omitempty"` // Degrees the frame was turned by clockwise, when set by hand
+}
+
+// newJobReport gathers the report of a finished job
+func newJobReport(j *job, frames []image.Image, shifts []image.Point, result image.Image, opts processOptions, assessment burstAssessment) jobReport {
+	report := jobReport{
+		JobID:         j.ID,
+		RequestID:     j.RequestID,
+		Created:       j.Created,
+		Started:       j.Started,
+		Finished:      j.Finished,
+		Preset:        opts.Preset,
+		Warning:       presetWarnings[opts.Preset],
+		Scale:         opts.Scale,
+		Fit:           opts.Fit,
+		Submitted:     opts.Submitted,
+		FrameNote:     opts.frameCountNote(fmt.Sprintf),
+		Algorithm:     opts.Algorithm,
+		Kernel:        opts.Kernel,
+		Format:        opts.Format,
+		Lossless:      opts.Lossless,
+		Denoise:       opts.Denoise,
+		Sharpen:       opts.Sharpen,
+		Thermal:       opts.Thermal,
+		Mono16:        opts.Mono16,
+		Film:          opts.Film,
+		Negative:      opts.Negative,
+		MatchExposure: opts.MatchExposure,
+		Deghost:       opts.Deghost,
+		Subject:       opts.Subject,
+		Deterministic: opts.Deterministic,
+		TileReject:    opts.TileReject,
+		Adaptive:      opts.Adaptive,
+		LumaOnly:      opts.LumaOnly,
+		YCbCr:         opts.YCbCr,
+		InputSpace:    opts.InputSpace,
+		WorkingSpace:  opts.WorkingSpace,
+		OutputSpace:   opts.OutputSpace,
+		Tonemap:       opts.Tonemap,
+		Width:         result.Bounds().Dx(),
+		Height:        result.Bounds().Dy(),
+	}
+	if opts.Format == formatJPEG {
+		report.Quality = opts.Quality
+		report.Progressive = opts.Progressive
+		report.Chroma = opts.Chroma
+	}
+	if assessment.Frames > 0 {
+		report.Assessment = &assessment
+	}
+	for i, frame := range frames {
+		f := frameReport{Width: frame.Bounds().Dx(), Height: frame.Bounds().Dy()}
+		if i < len(shifts) {
+			f.ShiftX, f.ShiftY = shifts[i].X, shifts[i].Y
+		}
+		if o := opts.offset(i); o != nil {
+			f.Manual, f.Rotation = true, o.Angle
+		}
+		report.Frames = append(report.Frames, f)
+	}
+	return report
+}
+
+// comparisonImage puts a bicubic upscale of the reference frame on the left half
+// and the fused result on the right, so the gain shows at a glance
+func comparisonImage(reference image.Image, result image.Image) *image.RGBA {
+	b := result.Bounds()
+	comparison := bicubicUpscale(reference, b.Size())
+	half := image.Rect(b.Dx()/2, 0, b.Dx(), b.Dy())
+	draw.Copy(comparison, half.Min, result, half.Add(b.Min), draw.Src, nil)
+	return comparison
+}
+
+// writeBundle sends everything a job produced as one ZIP archive: the result as
+// encoded, the fused counts of thermal frames unless radiometric is nil, the
+// comparison image, squares of the result and of plain upscales of the
+// reference, every frame after alignment and the report. Headers are
+// sent before the archive is built, so later errors are only logged.
+func writeBundle(w http.ResponseWriter, r *http.Request, j *job, frames []image.Image, shifts []image.Point, result image.Image, radiometric *image.Gray16, encoded []byte, opts processOptions, assessment burstAssessment) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="superres-%s.zip"`, j.ID))
+	archive := zip.NewWriter(w)
+
+	// Images are compressed already, so they are stored as they are
+	add := func(name string, method uint16, write func(zw io.Writer) error) error {
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: j.Finished})
+		if err != nil {
+			return err
+		}
+		return write(entry)
+	}
+	err := add("result"+fileExtension(opts.Format), zip.Store, func(zw io.Writer) error {
+		_, err := zw.Write(encoded)
+		return err
+	})
+	if err == nil && radiometric != nil {
+		err = add("radiometric.tiff", zip.Store, func(zw io.Writer) error {
+			return encodeTIFF(zw, radiometric, opts.resultTags(), nil)
+		})
+	}
+	if err == nil {
+		err = add("comparison.jpg", zip.Store, func(zw io.Writer) error {
+			return jpeg.Encode(zw, comparisonImage(frames[0], result), &jpeg.Options{Quality: 90})
+		})
+	}
+	var baselines baselineReport
+	if err == nil {
+		var crops []image.Image
+		baselines, crops = baselineCrops(frames[0], result)
+		for i, crop := range crops {
+			if err != nil {
+				break
+			}
+			err = add(baselines.Crops[i].File, zip.Store, func(zw io.Writer) error {
+				return png.Encode(zw, crop)
+			})
+		}
+	}
+	for i, frame := range frames {
+		if err != nil {
+			break
+		}
+		aligned := frame
+		if o := opts.offset(i); o != nil {
+			aligned = o.apply(frame)
+		} else if i > 0 && i < len(shifts) {
+			aligned = shiftImage(frame, shifts[i].X, shifts[i].Y)
+		}
+		err = add(fmt.Sprintf("aligned/frame-%03d.png", i+1), zip.Store, func(zw io.Writer) error {
+			return png.Encode(zw, aligned)
+		})
+	}
+	if err == nil {
+		err = add("report.json", zip.Deflate, func(zw io.Writer) error {
+			encoder := json.NewEncoder(zw)
+			encoder.SetIndent("", "  ")
+			report := newJobReport(j, frames, shifts, result, opts, assessment)
+			report.Baselines = &baselines
+			return encoder.Encode(report)
+		})
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error writing result bundle", "error", err)
+	}
+}
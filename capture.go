@@ -0,0 +1,74 @@
+package main
+
+import (
+	_ "embed" // Required for embedding
+	"fmt"
+	"net/http"
+)
+
+//go:embed static/capture.js
+var captureJS string
+
+//go:embed static/offline.js
+var offlineJS string
+
+// defaultBurstFrames is how many frames the capture page takes per burst unless
+// the frame limit is lower
+const defaultBurstFrames = 8
+
+// capturePageHandler renders a page that takes a burst of frames with the
+// device camera and submits them like the upload form, so a phone needs no
+// separate app. Browsers only allow camera access over HTTPS or on localhost.
+// Bursts taken without a connection are queued in the browser and submitted
+// once it returns.
+func capturePageHandler(w http.ResponseWriter, r *http.Request) {
+	const capturePageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Capture a Burst}}</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Capture a Burst}}</h1>
+	%s
+	<form id="capture" action="%s" method="post" class="bg-body p-4 rounded shadow">
+	<input type="hidden" name="csrf_token" value="%s">
+	<p class="form-text">{{Hold the phone as still as you can: the small shifts between frames are what adds the detail.}} %s</p>
+	<video id="viewfinder" class="w-100 rounded bg-dark mb-3" autoplay playsinline muted></video>
+	<div class="row g-2 mb-3">
+	<div class="col"><label for="burst" class="form-label">{{Frames}}</label><input type="number" id="burst" min="2" max="%d" value="%d" class="form-control"></div>
+	<div class="col"><label for="interval" class="form-label">{{Interval (ms)}}</label><input type="number" id="interval" min="0" max="2000" value="100" class="form-control"></div>
+	</div>
+	%s
+	%s
+	<div class="d-grid gap-2">
+	<button type="button" id="start" class="btn btn-outline-primary">{{Start camera}}</button>
+	<button type="submit" id="shoot" class="btn btn-success btn-lg" disabled>{{Capture and submit}}</button>
+	</div>
+	<div id="status" class="form-text mt-2" role="status"></div>
+	<div id="queued" class="form-text" role="status"></div>
+	<div id="result" class="mt-3"></div>
+	</form>
+	</div>
+	%s
+	<script>%s</script>
+	<script>%s</script>
+	%s
+	</body>
+	</html>
+	`
+	token := csrfToken(w, r) // Sets the cookie, so it must run before the header is written
+	cfg := liveConfig()
+	maxBurst, burst := cfg.MaxFrames, defaultBurstFrames
+	if maxBurst <= 0 {
+		maxBurst = 64
+	}
+	burst = min(burst, maxBurst)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, localize(r, capturePageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), config.url("/upload"), token, uploadLimitsText(r), maxBurst, burst, workspaceSelect(r), optionFields(r), messagesScript(r), offlineJS, captureJS, pageFooter(r))
+}
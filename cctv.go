@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// overlayBandPercent is the height of the top and bottom bands of a frame that
+// mask_overlays keeps out of alignment, in percent of the frame height: cameras
+// burn the time, date and camera name in there
+const overlayBandPercent = 10
+
+// overlayBands returns the height of the top and bottom bands of a frame of the
+// given height that mask_overlays sets apart
+func overlayBands(height int) int {
+	return height * overlayBandPercent / 100
+}
+
+// withoutOverlays returns the part of img between its overlay bands, to align
+// against: the burned-in clock changes from frame to frame while staying put,
+// which pulls the measured shift towards zero or to a wrong match
+func withoutOverlays(img image.Image) image.Image {
+	b := img.Bounds()
+	band := overlayBands(b.Dy())
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok || band == 0 {
+		return img
+	}
+	return sub.SubImage(image.Rect(b.Min.X, b.Min.Y+band, b.Max.X, b.Max.Y-band))
+}
+
+// deinterlaceFrame rebuilds img from its first field: the even rows are kept
+// and every odd row, taken half a frame interval later, is replaced by the
+// average of the rows above and below it, so moving edges lose their combing
+func deinterlaceFrame(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+	rowBytes := b.Dx() * 4
+	for y := b.Min.Y + 1; y < b.Max.Y; y += 2 {
+		row := out.Pix[out.PixOffset(b.Min.X, y):][:rowBytes]
+		above := out.Pix[out.PixOffset(b.Min.X, y-1):][:rowBytes]
+		if y+1 >= b.Max.Y {
+			copy(row, above)
+			continue
+		}
+		below := out.Pix[out.PixOffset(b.Min.X, y+1):][:rowBytes]
+		for i := range row {
+			row[i] = uint8((int(above[i]) + int(below[i]) + 1) / 2)
+		}
+	}
+	return out
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	_ "embed" // Required for embedding
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
-	"image/jpeg"
 	"io"
-	"log"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"golang.org/x/image/draw"
 )
@@ -21,251 +30,1260 @@ import (
 //go:embed static/bootstrap.min.css
 var bootstrapCSS string
 
-// Main entry point for the server
+//go:embed static/upload.js
+var uploadJS string
+
+// Main entry point: runs the subcommand named by the first argument, or the
+// server when the arguments start with a flag or there are none
 func main() {
+	if browserModule != nil {
+		browserModule() // The WebAssembly build is the upload page's alignment preview, not a server
+		return
+	}
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && (!strings.HasPrefix(args[0], "-") || args[0] == "-version" || args[0] == "--version") {
+		name, args = strings.TrimLeft(args[0], "-"), args[1:]
+	}
+	if name == "help" {
+		commandUsage(os.Stdout)
+		return
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		commandUsage(os.Stderr)
+		os.Exit(exitBadInput)
+	}
+	os.Exit(command.run(args))
+}
+
+// serveCommand runs the web server and the API until SIGINT or SIGTERM
+func serveCommand(args []string) int {
+	usage := fmt.Sprintf("Usage: %s [serve] [flags]\n\nRuns the web server. Run %s help for the commands that process files instead.\n\n", os.Args[0], os.Args[0])
+	if err := parseFlags("serve", usage, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if config.S3Bucket != "" && config.ResultsDir == "" {
+		fmt.Fprintln(os.Stderr, "-s3-bucket needs -results-dir, the local cache of the stored results")
+		return exitBadInput
+	}
+	if err := setupLogging(config.LogLevel, config.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+
 	// Register routes for the web interface
-	http.HandleFunc("/", uploadPageHandler)   // Render the upload page
-	http.HandleFunc("/upload", uploadHandler) // Handle file uploads
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", requireLogin(uploadPageHandler))                                                               // Render the upload page
+	mux.HandleFunc("/upload", requireLogin(limitClients(writePlainError, uploadHandler)))                              // Handle file uploads
+	mux.HandleFunc("POST /preflight", requireLogin(limitClients(writePlainError, preflightHandler)))                   // Check a burst before processing it
+	mux.HandleFunc("POST /workflow", requireLogin(limitClients(writePlainError, workflowStartHandler)))                // Keep a burst for the step-by-step workflow
+	mux.HandleFunc("GET /workflow/{id}", requireLogin(workflowPageHandler))                                            // A stage of the workflow
+	mux.HandleFunc("POST /workflow/{id}", requireLogin(workflowStepHandler))                                           // Save a stage and move to the next
+	mux.HandleFunc("POST /workflow/{id}/process", requireLogin(limitClients(writePlainError, workflowProcessHandler))) // Run the job of a workflow
+	mux.HandleFunc("POST /workflow/{id}/delete", requireLogin(workflowDeleteHandler))                                  // Abandon a workflow
+	mux.HandleFunc("GET /progress/{request}", requireLogin(progressHandler))                                           // Progress of a form submission
+	mux.HandleFunc("GET /capture", requireLogin(capturePageHandler))                                                   // Take a burst with the device camera
+	mux.HandleFunc("GET /language/{locale}", languageHandler)                                                          // Switch the language of the web UI
+	mux.HandleFunc("GET /theme/{theme}", themeHandler)                                                                 // Switch the colour theme of the web UI
+	if config.Logo != "" {
+		mux.HandleFunc("GET /logo", logoHandler)
+	}
+
+	if config.PreviewWasm != "" {
+		mux.HandleFunc("GET /align-preview.wasm", alignPreviewHandler)
+		mux.HandleFunc("GET /wasm_exec.js", wasmExecHandler)
+	}
+
+	// Installable app: the manifest, icons and service worker load without a login
+	mux.HandleFunc("GET /manifest.webmanifest", manifestHandler)
+	for _, size := range appIconSizes {
+		mux.HandleFunc(fmt.Sprintf("GET /icon-%d.png", size), appIconHandler(size))
+	}
+	mux.HandleFunc("GET /sw.js", serviceWorkerHandler)
+
+	// Stored results of the current user
+	mux.HandleFunc("GET /results", requireLogin(resultsPageHandler))
+	mux.HandleFunc("GET /results/{id}", requireLogin(resultFileHandler))
+	mux.HandleFunc("GET /results/{id}/view", requireLogin(viewerPageHandler))
+	mux.HandleFunc("GET /results/{id}/thumbnail", requireLogin(thumbnailHandler))
+	mux.HandleFunc("GET /results/{id}/tiles/{level}/{tile}", requireLogin(tileHandler))
+	mux.HandleFunc("POST /results/{id}/delete", requireLogin(resultDeleteHandler))
+	mux.HandleFunc("POST /results/{id}/share", requireLogin(resultShareHandler))
+	mux.HandleFunc("POST /results/{id}/unshare", requireLogin(resultUnshareHandler))
+	mux.HandleFunc("GET /s/{token}", sharedResultHandler) // Share links work without a login
+
+	registerWorkspaceRoutes(mux)
+	registerCloudRoutes(mux)
+	registerClusterRoutes(mux)
+
+	// Admin dashboard
+	mux.HandleFunc("GET /admin", requireAdmin(adminPageHandler))
+	mux.HandleFunc("POST /admin/jobs/{id}/cancel", requireAdmin(adminCancelHandler))
+	mux.HandleFunc("POST /admin/purge", requireAdmin(adminPurgeHandler))
+
+	// Single sign-on through an OpenID Connect provider, when configured
+	mux.HandleFunc("GET /login", loginHandler)
+	mux.HandleFunc("GET /auth/callback", callbackHandler)
+	mux.HandleFunc("GET /logout", logoutHandler)
+
+	// Register the versioned JSON API
+	mux.HandleFunc("GET /api", apiIndexHandler)
+	mux.HandleFunc("GET /api/v1", apiV1InfoHandler)
+	mux.HandleFunc("POST /api/v1/superresolve", requireAPIKey(writeAPIErrorV1, limitClients(writeAPIErrorV1, apiV1SuperResolveHandler)))
+	mux.HandleFunc("POST /api/v1/preflight", requireAPIKey(writeAPIErrorV1, limitClients(writeAPIErrorV1, apiV1PreflightHandler)))
+	mux.HandleFunc("GET /api/v1/jobs", requireAPIKey(writeAPIErrorV1, apiV1JobsHandler))
+	mux.HandleFunc("GET /api/v1/jobs/{id}/result", requireAPIKey(writeAPIErrorV1, apiV1JobResultHandler))
+	mux.HandleFunc("DELETE /api/v1/jobs/{id}/result", requireAPIKey(writeAPIErrorV1, apiV1DeleteResultHandler))
+	mux.HandleFunc("GET /api/v1/jobs/{id}/progress", requireAPIKey(writeAPIErrorV1, apiV1JobProgressHandler))
+	mux.HandleFunc("POST /api/v1/jobs/{id}/shares", requireAPIKey(writeAPIErrorV1, apiV1CreateShareHandler))
+	mux.HandleFunc("DELETE /api/v1/jobs/{id}/shares", requireAPIKey(writeAPIErrorV1, apiV1RevokeSharesHandler))
+	mux.HandleFunc("GET /api/v1/usage", requireAPIKey(writeAPIErrorV1, apiV1UsageHandler))
+
+	// Resumable uploads sent in chunks, referenced by jobs once complete
+	mux.HandleFunc("POST /api/v1/uploads", requireAPIKey(writeAPIErrorV1, apiV1CreateUploadHandler))
+	mux.HandleFunc("GET /api/v1/uploads/{id}", requireAPIKey(writeAPIErrorV1, apiV1UploadStatusHandler))
+	mux.HandleFunc("PATCH /api/v1/uploads/{id}", requireAPIKey(writeAPIErrorV1, apiV1UploadChunkHandler))
+	mux.HandleFunc("DELETE /api/v1/uploads/{id}", requireAPIKey(writeAPIErrorV1, apiV1DeleteUploadHandler))
+
+	// Health and readiness probes for load balancers and orchestrators
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.HandleFunc("GET /version", versionHandler)
+	mux.HandleFunc("GET /metrics", metricsHandler)
+
+	// Restore job records left by the previous run
+	if config.JobStore != "" {
+		if err := jobs.load(config.JobStore); err != nil {
+			fatal("Error loading job store", "error", err)
+		}
+	}
+
+	initCSRF(config.CSRFSecret)
+	if config.APIKeys != "" {
+		store, err := loadAPIKeys(config.APIKeys)
+		if err != nil {
+			fatal("Error loading API keys", "error", err)
+		}
+		apiKeys.Store(store)
+		slog.Info("API key authentication enabled", "keys", len(store.byHash))
+	}
+	if config.OIDCIssuer != "" {
+		if config.OIDCClientID == "" {
+			fatal("-oidc-issuer requires -oidc-client-id")
+		}
+		provider, err := discoverOIDC(config.OIDCIssuer)
+		if err != nil {
+			fatal("Error discovering OIDC provider", "error", err)
+		}
+		oidc = provider
+		slog.Info("Web UI login enabled", "issuer", provider.Issuer)
+	}
+	if config.WorkspaceStore != "" {
+		if err := workspaces.load(config.WorkspaceStore); err != nil {
+			fatal("Error loading workspace store", "error", err)
+		}
+	}
+	if config.ResultsDir != "" {
+		if err := os.MkdirAll(config.ResultsDir, 0o755); err != nil {
+			fatal("Error creating results directory", "error", err)
+		}
+	}
+	if err := startSharedStore(); err != nil {
+		fatal("Error connecting to object storage", "error", err)
+	}
+	// Clean up uploads left behind by a server that was killed mid-job
+	if removed := sweepTempDirs(); removed > 0 {
+		slog.Info("Removed orphaned temporary directories", "count", removed, "path", tempRoot())
+	}
+	if !config.InMemory {
+		if err := uploads.load(); err != nil {
+			fatal("Error loading resumable uploads", "error", err)
+		}
+		uploads.startSweeper()
+		workflows.startSweeper()
+	}
+	queue, err := newJobQueue()
+	if err != nil {
+		fatal("Error connecting to the Redis job queue", "error", err)
+	}
+	jobs.start(config.Workers, queue)
+	limiter.startSweeper()
+
+	if config.AccessLog != "" {
+		if err := setupAccessLog(config.AccessLog, config.AccessLogMaxSize, config.AccessLogBackups); err != nil {
+			fatal("Error opening access log", "error", err)
+		}
+	}
+	if config.OTLPEndpoint != "" {
+		startTracing(config.OTLPEndpoint)
+	}
 
 	// Start the HTTP server
-	log.Println("Server running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{Addr: config.addr(), Handler: config.withBasePath(traceRequests(assignRequestIDs(logRequests(allowCORS(mux)))))}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- serve(server) }()
+	slog.Info("Server running", "url", fmt.Sprintf("%s://%s%s/", config.scheme(), displayHost(config), config.BasePath))
+
+	// Run until the server fails or we are asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watchConfig(ctx)
+	select {
+	case err := <-serverErr:
+		fatal("HTTP server failed", "error", err)
+	case <-ctx.Done():
+	}
+	stop() // A second signal kills the process immediately
+
+	gracefulShutdown(server)
+	return exitOK
+}
+
+// gracefulShutdown stops accepting jobs, lets running ones finish within the
+// shutdown timeout, closes the HTTP server and flushes the job store
+func gracefulShutdown(server *http.Server) {
+	slog.Info("Shutting down: no new jobs accepted, waiting for running jobs", "timeout", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	jobs.stopIntake()
+	if err := jobs.wait(ctx); err != nil {
+		slog.Warn("Shutdown timeout reached with jobs still running; they will be recorded as interrupted")
+	}
+
+	// Let finished handlers write their responses before the listener closes
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down HTTP server", "error", err)
+	}
+	removeOwnedTempDirs()
+	if err := jobs.flush(); err != nil {
+		slog.Error("Error flushing job store", "error", err)
+	}
+	tracer.flush(ctx)
+	slog.Info("Server stopped")
+}
+
+// displayHost returns a browsable host:port for the startup log line
+func displayHost(c serverConfig) string {
+	if c.Listen == "" || c.Listen == "0.0.0.0" || c.Listen == "::" {
+		return net.JoinHostPort("localhost", strconv.Itoa(c.Port))
+	}
+	return c.addr()
 }
 
 func uploadPageHandler(w http.ResponseWriter, r *http.Request) {
 	// Serve the HTML template with embedded CSS
 	const uploadPageHTML = `
 	<!DOCTYPE html>
-	<html lang="en">
+	<html lang="%s">
 	<head>
 	<meta charset="UTF-8">
 	<meta name="viewport" content="width=device-width, initial-scale=1.0">
-	<title>Super Resolution</title>
-	<style>%s</style>
+	<title>{{Super Resolution}}</title>
+	%s
 	</head>
-	<body class="bg-light">
+	<body class="bg-body-tertiary">
 	<div class="container py-5">
-	<h1 class="mb-4 text-center text-primary">Super Resolution Tool</h1>
-	<form action="/upload" method="post" enctype="multipart/form-data" class="bg-white p-4 rounded shadow">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Super Resolution Tool}}</h1>
+	%s
+	<form action="%s" method="post" enctype="multipart/form-data" class="bg-body p-4 rounded shadow">
+	<input type="hidden" name="csrf_token" value="%s">
 	<div class="mb-3">
-	<label for="images" class="form-label">Upload Images (JPEG only)</label>
-	<input type="file" name="images" id="images" multiple required class="form-control">
+	<label for="images" class="form-label">{{Upload Images (JPEG, PNG, GIF or TIFF) or a ZIP archive of them}}</label>
+	<div class="form-text mb-2">%s</div>
+	<input type="file" name="images" id="images" accept="image/jpeg,image/png,image/apng,.apng,image/gif,image/tiff,.tif,.tiff,.zip,application/zip" multiple %s class="form-control" data-max-file-mb="%d" data-max-frames="%d"%s>
+	<div id="dropzone" class="d-none border border-2 rounded p-4 text-center text-muted" style="border-style:dashed!important;cursor:pointer" role="button" tabindex="0">{{Drop images or a ZIP archive here, or click to choose files}}</div>
+	<div id="selection" class="form-text mt-2"></div>
+	<div id="previews" class="row row-cols-3 row-cols-md-6 g-2 mt-1"></div>
+	<div class="form-text mt-2">{{On a phone?}} <a href="%s">{{Capture a burst with the camera}}</a> {{instead.}}</div>
+	</div>
+	%s
+	%s
+	%s
+	%s
+	%s
+	%s
+	<div class="form-check mb-3">
+	<input type="checkbox" name="stream" value="strips" id="stream" class="form-check-input">
+	<label for="stream" class="form-check-label">{{Stream the result in strips (for very large outputs)}}</label>
+	</div>
+	<div class="form-check mb-3">
+	<input type="checkbox" name="bundle" value="true" id="bundle" class="form-check-input">
+	<label for="bundle" class="form-check-label">{{Download everything as a ZIP: the result, the aligned frames, a comparison image and a JSON report}}</label>
 	</div>
 	<div class="d-grid gap-2">
-	<button type="submit" class="btn btn-success btn-lg">Submit Images</button>
+	<button type="submit" class="btn btn-success btn-lg">{{Submit Images}}</button>
+	<button type="submit" formaction="%s" class="btn btn-outline-primary" title="{{Measures how much detail the frames can add and recommends a scale, without processing them}}">{{Check the burst}}</button>
+	%s
+	<button type="submit" formaction="%s" class="btn btn-outline-primary" title="{{A rough result in seconds; then run the full job on the same images}}">%s</button>
+	<button type="submit" formaction="%s" class="btn btn-outline-secondary" title="{{Frames and the result are never written to the server's disk; the result is not kept}}">{{Submit without temporary files}}</button>
 	</div>
 	</form>
+	<div id="progress" class="d-none bg-body p-4 rounded shadow mt-3" data-progress-url="%s" aria-live="polite">
+	<div class="d-flex justify-content-between mb-2"><strong id="progress-stage"></strong></div>
+	<div class="progress" role="progressbar" aria-label="{{Progress}}" aria-valuemin="0" aria-valuemax="100"><div class="progress-bar progress-bar-striped progress-bar-animated" style="width:0%%"></div></div>
+	<div id="progress-detail" class="form-text mt-2"></div>
+	</div>
 	</div>
+	%s
+	<script>%s</script>
+	<script>%s</script>
+	%s
 	</body>
 	</html>
 	`
+	token := csrfToken(w, r) // Sets the cookie, so it must run before the header is written
+	cfg := liveConfig()
 	w.WriteHeader(http.StatusOK)
-	_, _ = fmt.Fprintf(w, uploadPageHTML, bootstrapCSS)
+	_, _ = fmt.Fprintf(w, localize(r, uploadPageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), config.url("/upload"), token, uploadLimitsText(r), fileInputRequired(), cfg.MaxFileMB, cfg.MaxFrames, alignPreviewAttributes(),
+		config.url("/capture"), frameURLField(r), cloudFolderField(r), darkFramesField(r)+flatFramesField(r), workspaceSelect(r), optionFields(r), notifyEmailField(r), config.url("/preflight"), workflowButton(r), config.url("/upload")+"?preview=true", trf(r, "Quick preview at 1/%d resolution", previewDownsample), config.url("/upload")+"?in_memory=true", config.url("/progress/"), messagesScript(r), uploadJS, progressJS, pageFooter(r))
 }
 
-// uploadHandler processes uploaded images, validates their formats, and performs super-resolution if valid
+// uploadHandler processes uploads from the browser form and reports errors as plain text
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse uploaded files from the form
-	err := r.ParseMultipartForm(10 << 20) // Allow up to 10 MB for the form data
-	if err != nil {
-		http.Error(w, "Unable to parse uploaded files", http.StatusBadRequest) // Send an error if parsing fails
+	// Refuse oversized requests before reading them
+	if reqErr := limitUploadSize(w, r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	// Only posts carrying the token from our own form are processed
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	serveSuperResolution(w, r, writePlainError, acceptsHTML(r))
+}
+
+// serveSuperResolution decodes the uploaded frames, resolves the request options and writes the fused result,
+// as the image itself or, with resultPage, as a page comparing it with a plain upscale
+func serveSuperResolution(w http.ResponseWriter, r *http.Request, writeError errorWriter, resultPage bool) {
+	// Refuse work from accounts that have used up their quota before reading the upload
+	if reqErr := checkQuota(w, r); reqErr != nil {
+		writeError(w, reqErr)
 		return
 	}
 
-	// Create a temporary directory to store uploaded images
-	tempDir, err := os.MkdirTemp("", "superres") // Create a unique directory for this request
+	images, tags, reqErr := decodeUploadedImages(w, r)
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+
+	// Translate the wire-level request into pipeline options
+	req, reqErr := parseSuperResolutionRequestV1(r)
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	opts, reqErr := req.options(len(images))
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	opts.Tags = tags[opts.Reference]
+	if reqErr := checkWorkspaceAccess(r, req.Workspace); reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	notice, reqErr := newJobNotice(r, opts)
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	slog.InfoContext(r.Context(), "Scaling factor determined", "scale", opts.Scale, "frames", len(images))
+
+	images = referenceFirst(images, opts.Reference)
+	if opts.Offsets != nil {
+		opts.Offsets = referenceFirst(opts.Offsets, opts.Reference)
+	}
+
+	opts.Mono16 = opts.Mono16 && sixteenBitGray(images) // Other frames are fused at 8 bits as usual
+	submitted := len(images)
+	images, reqErr = prepareFrames(r.Context(), images, opts)
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	if note := opts.countFrames(submitted, len(images)); note != "" {
+		slog.WarnContext(r.Context(), "Frame-count policy applied", "note", note)
+	}
+	if opts.Algorithm == algorithmReference {
+		images = images[:1]
+	}
+	if opts.Preview {
+		images = downsampleFrames(images, previewDownsample)
+		for i, o := range opts.Offsets {
+			if o != nil {
+				small := o.scaled(1.0 / previewDownsample)
+				opts.Offsets[i] = &small
+			}
+		}
+	}
+
+	// Make sure the result can be kept before spending time on it
+	keepResult := config.ResultsDir != "" && !opts.InMemory && !opts.Preview
+	releaseDisk := func() {}
+	if keepResult {
+		releaseDisk, reqErr = reserveDisk(w, estimatedResultBytes(images[0], opts))
+		if reqErr != nil {
+			writeError(w, reqErr)
+			return
+		}
+	}
+	detached := false // Set when the job outlives the request to report its end
+	defer func() {
+		if !detached {
+			releaseDisk()
+		}
+	}()
+
+	// Queue the processing and wait for a worker to complete it
+	var acc *fusionAccumulator
+	var assessment burstAssessment
+	record := &job{
+		RequestID: requestIDFromContext(r.Context()),
+		Owner:     requestOwner(r),
+		Workspace: req.Workspace,
+		Frames:    len(images),
+		Scale:     opts.Scale,
+		Algorithm: opts.Algorithm,
+		Kernel:    opts.Kernel,
+		Format:    opts.Format,
+		Quality:   opts.Quality,
+		Denoise:   opts.Denoise,
+		Sharpen:   opts.Sharpen,
+		Preview:   opts.Preview,
+	}
+	// A job that reports its end is not tied to the request: its submitter may
+	// hang up and wait for the report instead
+	jobCtx := r.Context()
+	if notice != nil {
+		jobCtx = context.WithoutCancel(jobCtx)
+	}
+	work := func(ctx context.Context) (err error) {
+		acc, assessment, err = fuseFrames(ctx, images, opts)
+		return err
+	}
+	if config.QueueRedis != "" {
+		// Any instance may run the job, so its frames go where every one can read them
+		task, err := stageFusionTask(r.Context(), images, opts)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error staging frames for the shared queue", "error", err)
+			writeError(w, &requestError{Status: http.StatusServiceUnavailable, Code: "queue_unavailable", Message: "The job queue is unavailable, please retry shortly"})
+			return
+		}
+		record.task = task
+		work = func(ctx context.Context) (err error) {
+			acc, assessment, err = task.result(ctx)
+			return err
+		}
+	}
+	j, err := jobs.submit(jobCtx, record, work)
+	if err != nil && record.task != nil {
+		record.task.remove(context.WithoutCancel(r.Context()))
+	}
+	switch {
+	case errors.Is(err, errDraining):
+		w.Header().Set("Retry-After", "30")
+		writeError(w, &requestError{Status: http.StatusServiceUnavailable, Code: "shutting_down", Message: "The server is shutting down, please retry shortly"})
+		return
+	case errors.Is(err, errQueueFull):
+		w.Header().Set("Retry-After", "10")
+		writeError(w, &requestError{Status: http.StatusServiceUnavailable, Code: "queue_full", Message: "The server is busy, please retry shortly"})
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Error queuing job", "error", err)
+		writeError(w, &requestError{Status: http.StatusServiceUnavailable, Code: "queue_unavailable", Message: "The job queue is unavailable, please retry shortly"})
+		return
+	}
+	w.Header().Set("X-Job-ID", j.ID)
+	select {
+	case <-j.done:
+	case <-r.Context().Done():
+		holdClientSlot(r.Context(), j.done) // Against -max-jobs-per-client until the job ends
+		if notice != nil {
+			detached = true
+			go finishDetachedJob(context.WithoutCancel(r.Context()), j, &acc, req.Uploads, opts, keepResult, notice, releaseDisk)
+			return
+		}
+		// The client went away; a queued job will be skipped by its worker and a
+		// running one stops at its next cancellation check, releasing its buffers
+		go func() {
+			<-j.done
+			if acc != nil {
+				acc.release()
+			}
+		}()
+		return
+	}
+	if j.err != nil {
+		notice.send(r.Context(), callbackFailed, j.ID)
+	}
+	if errors.Is(j.err, errCanceledByAdmin) {
+		writeError(w, &requestError{Status: http.StatusConflict, Code: "job_canceled", Message: "The job was canceled by an administrator"})
+		return
+	}
+	if j.err != nil {
+		writeError(w, &requestError{Status: http.StatusInternalServerError, Code: "processing_failed", Message: "Error processing images: " + j.err.Error()})
+		return
+	}
+
+	if assessment.Frames > 0 {
+		w.Header().Set("X-Recommended-Scale", strconv.Itoa(assessment.RecommendedScale))
+		w.Header().Set("X-Expected-Benefit", assessment.Benefit)
+	}
+	w.Header().Set("X-Frames-Submitted", strconv.Itoa(opts.Submitted))
+	w.Header().Set("X-Frames-Fused", strconv.Itoa(opts.Fused))
+
+	// Resumable uploads are kept for retries until a job has used them
+	for _, id := range req.Uploads {
+		uploads.remove(id)
+	}
+
+	// Stream the result strip by strip when the client asked for it
+	if opts.StreamStrips {
+		defer acc.release()
+		_, endEncode := startStage(r.Context(), "encode")
+		defer endEncode()
+		if err := streamResultStrips(w, acc, opts); err != nil {
+			slog.ErrorContext(r.Context(), "Error streaming result strips", "error", err) // Headers are already sent, so only log
+		}
+		notice.send(r.Context(), callbackDone, j.ID)
+		return
+	}
+
+	// Combine the accumulated data into the final image
+	slog.InfoContext(r.Context(), "Combining accumulated data into the final high-resolution image")
+	result := renderResult(acc, 0, acc.height, opts)
+	shifts := acc.shifts
+	var radiometric *image.Gray16
+	if acc.radiometric && opts.Bundle {
+		radiometric = acc.radiometricRows(0, acc.height)
+	}
+
+	acc.release()
+
+	// Return the resulting image to the client, keeping a copy in the owner's gallery
+	_, endEncode := startStage(r.Context(), "encode")
+	out := io.Writer(w)
+	var encoded bytes.Buffer
+	if resultPage || opts.Bundle {
+		out = &encoded // The page or archive embeds the image, so it is written afterwards
+	}
+	var stored *os.File
+	if keepResult {
+		stored = createResultFile(r.Context(), j.ID+fileExtension(opts.Format))
+	}
+	if stored != nil {
+		out = io.MultiWriter(out, stored)
+	}
+	var delivery bytes.Buffer
+	if opts.DeliverTo != "" {
+		out = io.MultiWriter(out, &delivery)
+	}
+	if !resultPage && !opts.Bundle {
+		w.Header().Set("Content-Type", contentType(opts.Format))
+	}
+	err = encodeResult(out, result, opts) // Encode the resulting image and write it to the response
+	endEncode()
+	if stored != nil {
+		finishResultFile(r.Context(), j.ID, stored, err)
+	}
+	if err == nil && opts.DeliverTo != "" {
+		deliverResult(r.Context(), opts.DeliverTo, j.ID, fileExtension(opts.Format), delivery.Bytes())
+	}
+	notice.send(r.Context(), callbackEvent(err), j.ID)
 	if err != nil {
-		http.Error(w, "Failed to create temporary directory", http.StatusInternalServerError) // Handle directory creation failure
+		writeError(w, &requestError{Status: http.StatusInternalServerError, Code: "encoding_failed", Message: "Error encoding high-resolution image"}) // Handle encoding errors
 		return
 	}
-	defer os.RemoveAll(tempDir) // Clean up the temporary directory after processing
+	switch {
+	case opts.Bundle:
+		writeBundle(w, r, j, images, shifts, result, radiometric, encoded.Bytes(), opts, assessment)
+	case resultPage:
+		var storedURL string
+		if finished, ok := jobs.get(j.ID); ok && finished.Result != "" {
+			storedURL = config.url("/results/" + j.ID)
+		}
+		writeResultPage(w, r, images[0], result, encoded.Bytes(), opts, storedURL, assessment)
+	}
+}
+
+// fuseFrames is the processing of a job: it assesses what the burst can give,
+// so a result that adds nothing is explained rather than silently delivered,
+// then aligns and accumulates the frames
+func fuseFrames(ctx context.Context, images []image.Image, opts processOptions) (*fusionAccumulator, burstAssessment, error) {
+	var assessment burstAssessment
+	if opts.Algorithm != algorithmReference && !opts.Preview {
+		_, endAssess := startStage(ctx, "assess")
+		assessment = assessBurst(images)
+		endAssess()
+		slog.InfoContext(ctx, "Burst assessed", "recommended_scale", assessment.RecommendedScale, "benefit", assessment.Benefit, "noise", assessment.Noise)
+	}
+	acc, err := accumulateSuperResolution(ctx, images, opts)
+	return acc, assessment, err
+}
+
+// finishDetachedJob sees a job that reports its end through after its submitter
+// hung up: it waits for the job, stores and delivers its result as asked and
+// sends the report. acc is filled in by the job's work.
+func finishDetachedJob(ctx context.Context, j *job, acc **fusionAccumulator, uploadIDs []string, opts processOptions, keepResult bool, notice *jobNotice, releaseDisk func()) {
+	defer releaseDisk()
+	<-j.done
+	if j.err != nil {
+		notice.send(ctx, callbackFailed, j.ID)
+		return
+	}
+	for _, id := range uploadIDs {
+		uploads.remove(id)
+	}
+	defer (*acc).release()
+	var stored *os.File
+	if keepResult {
+		stored = createResultFile(ctx, j.ID+fileExtension(opts.Format))
+	}
+	var delivery bytes.Buffer
+	var err error
+	switch {
+	case stored != nil && opts.DeliverTo != "":
+		err = encodeResult(io.MultiWriter(stored, &delivery), renderResult(*acc, 0, (*acc).height, opts), opts)
+	case stored != nil:
+		err = encodeResult(stored, renderResult(*acc, 0, (*acc).height, opts), opts)
+	case opts.DeliverTo != "":
+		err = encodeResult(&delivery, renderResult(*acc, 0, (*acc).height, opts), opts)
+	}
+	if stored != nil {
+		finishResultFile(ctx, j.ID, stored, err)
+	}
+	if err == nil && opts.DeliverTo != "" {
+		deliverResult(ctx, opts.DeliverTo, j.ID, fileExtension(opts.Format), delivery.Bytes())
+	}
+	notice.send(ctx, callbackEvent(err), j.ID)
+}
+
+// referenceFirst moves the reference frame, or what belongs to it, to the front:
+// the pipeline aligns every frame to the first one
+func referenceFirst[T any](frames []T, reference int) []T {
+	if reference == 0 {
+		return frames
+	}
+	first := frames[reference] // Read before slices.Delete clears the end of frames
+	return append([]T{first}, slices.Delete(frames, reference, reference+1)...)
+}
+
+// decodeUploadedImages saves the uploaded files to a temporary directory, or keeps them in
+// memory for in-memory requests, validates their formats and decodes them, with
+// the tags of each, nil unless it is a TIFF, and calibrates them and brings
+// them to a common size, see fitUploadedFrames
+func decodeUploadedImages(w http.ResponseWriter, r *http.Request) ([]image.Image, []*frameTags, *requestError) {
+	_, endStage := startStage(r.Context(), "upload")
+	defer func() { endStage() }() // Ends whichever stage is current when we return
+
+	inMemory, reqErr := inMemoryRequested(r)
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+
+	// Parse uploaded files from the form
+	err := parseUpload(r) // Larger uploads spill over to temporary files unless processed in memory
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, nil, uploadTooLarge()
+	}
+	if err != nil {
+		return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_upload", Message: "Unable to parse uploaded files"} // Send an error if parsing fails
+	}
+	defer r.MultipartForm.RemoveAll() // Drop the spill-over files as well
+
+	// Enforce the frame-count and per-file limits
+	resumed, reqErr := uploads.frames(r, frameUploadIDs(r))
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+	files, closeArchives, reqErr := uploadFrames(append(uploadedFiles(r), resumed...))
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+	defer closeArchives()
+	urls := frameURLs(r)
+	if reqErr := checkFrameURLs(urls); reqErr != nil {
+		return nil, nil, reqErr
+	}
+	cloud, reqErr := cloudFolderFiles(r)
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+	if reqErr := checkUploadedFiles(files, len(urls)+len(cloud.files)); reqErr != nil {
+		return nil, nil, reqErr
+	}
+	if reqErr := checkArchiveSize(files); reqErr != nil {
+		return nil, nil, reqErr
+	}
+
+	var uploadBytes int64
+	for _, frame := range files {
+		uploadBytes += frame.size
+	}
+
+	// Unless processing in memory, copy the frames to a private temporary directory
+	var tempDir string
+	if !inMemory {
+		// Hold disk budget for the copies until the temporary directory is removed
+		releaseDisk, reqErr := reserveDisk(w, uploadBytes)
+		if reqErr != nil {
+			return nil, nil, reqErr
+		}
+		defer releaseDisk()
+
+		tempDir, err = createTempDir(requestIDFromContext(r.Context())) // Create a unique directory for this request
+		if err != nil {
+			return nil, nil, &requestError{Status: http.StatusInternalServerError, Code: "temp_dir_failed", Message: "Failed to create temporary directory"} // Handle directory creation failure
+		}
+		defer removeTempDir(tempDir) // Clean up the temporary directory after processing
+	}
+
+	// Collect readers of the uploaded images: the saved copies, or the buffered parts in memory
+	var frames []io.Reader
+	var imageNames []string
+	for i, frame := range files { // Iterate over each uploaded file or archive entry
+		// Validate the name and the content before anything touches the disk
+		if reqErr := validateFileName(frame.name); reqErr != nil {
+			return nil, nil, reqErr
+		}
+		format, reqErr := sniffUpload(frame)
+		if reqErr != nil {
+			return nil, nil, reqErr
+		}
+		slog.DebugContext(r.Context(), "Upload passed content checks", "file", frame.name, "format", format)
 
-	// Store paths of the uploaded images
-	var imagePaths []string
-	for _, fileHeader := range r.MultipartForm.File["images"] { // Iterate over each uploaded file
 		// Open the uploaded file
-		file, err := fileHeader.Open()
+		file, err := frame.open()
 		if err != nil {
-			http.Error(w, "Error opening uploaded file", http.StatusInternalServerError) // Send error if file cannot be opened
-			return
+			return nil, nil, &requestError{Status: http.StatusInternalServerError, Code: "upload_read_failed", Message: "Error opening uploaded file"} // Send error if file cannot be opened
 		}
 		defer file.Close() // Ensure the file is closed after processing
+		imageNames = append(imageNames, frame.name)
+		if inMemory {
+			frames = append(frames, file)
+			continue
+		}
 
 		// Save the file to the temporary directory
-		destPath := filepath.Join(tempDir, fileHeader.Filename) // Construct the destination path
-		destFile, err := os.Create(destPath)                    // Create a new file in the temp directory
+		destPath := filepath.Join(tempDir, fmt.Sprintf("%03d-%s", i, frame.name)) // Prefix the index so equal names don't collide
+		destFile, err := os.Create(destPath)                                      // Create a new file in the temp directory
 		if err != nil {
-			http.Error(w, "Error saving uploaded file", http.StatusInternalServerError) // Handle file saving errors
-			return
+			return nil, nil, &requestError{Status: http.StatusInternalServerError, Code: "upload_save_failed", Message: "Error saving uploaded file"} // Handle file saving errors
 		}
 		defer destFile.Close() // Ensure the destination file is closed after writing
 
-		// Copy the contents of the uploaded file to the destination
+		// Copy the contents of the uploaded file to the destination and rewind it for decoding
 		_, err = io.Copy(destFile, file)
+		if err == nil {
+			_, err = destFile.Seek(0, io.SeekStart)
+		}
 		if err != nil {
-			http.Error(w, "Error copying file data", http.StatusInternalServerError) // Handle file copy errors
-			return
+			return nil, nil, &requestError{Status: http.StatusInternalServerError, Code: "upload_save_failed", Message: "Error copying file data"} // Handle file copy errors
 		}
+		frames = append(frames, destFile)
+	}
 
-		// Add the file path to the list of image paths
-		imagePaths = append(imagePaths, destPath)
+	// Download the frames given by URL and from the cloud folder, within what is
+	// left of the request size limit
+	budget := func() (int64, *requestError) {
+		limit := liveConfig().MaxUploadMB << 20
+		if limit <= 0 {
+			return 0, nil
+		}
+		if limit <= uploadBytes {
+			return 0, uploadTooLarge()
+		}
+		return limit - uploadBytes, nil
 	}
+	addFetched := func(name string, data []byte) *requestError {
+		format, reqErr := sniffImage(name, bytes.NewReader(data))
+		if reqErr != nil {
+			return reqErr
+		}
+		slog.DebugContext(r.Context(), "Fetched frame passed content checks", "source", name, "bytes", len(data), "format", format)
+		uploadBytes += int64(len(data))
+		frames = append(frames, bytes.NewReader(data))
+		imageNames = append(imageNames, name)
+		return nil
+	}
+	for _, rawURL := range urls {
+		left, reqErr := budget()
+		if reqErr != nil {
+			return nil, nil, reqErr
+		}
+		data, reqErr := fetchFrame(r.Context(), rawURL, left)
+		if reqErr != nil {
+			return nil, nil, reqErr
+		}
+		if reqErr := addFetched(rawURL, data); reqErr != nil {
+			return nil, nil, reqErr
+		}
+	}
+	for _, file := range cloud.files {
+		left, reqErr := budget()
+		if reqErr != nil {
+			return nil, nil, reqErr
+		}
+		data, reqErr := cloud.fetch(r.Context(), file, left)
+		if reqErr != nil {
+			return nil, nil, reqErr
+		}
+		if reqErr := addFetched(file.Name, data); reqErr != nil {
+			return nil, nil, reqErr
+		}
+	}
+
+	endStage()
+	_, endStage = startStage(r.Context(), "decode")
 
 	// Decode and validate the uploaded images
 	var images []image.Image // List to hold successfully decoded images
-	for _, path := range imagePaths {
-		// Open the saved image file
-		file, err := os.Open(path)
-		if err != nil {
-			http.Error(w, "Error opening saved file", http.StatusInternalServerError) // Handle file open errors
-			return
+	var tags []*frameTags
+	var names []string // Of every frame, those of an animated PNG numbered after its file
+	maxFrames := liveConfig().MaxFrames
+	for i, frame := range frames {
+		// Decode the image to check its format; an animated PNG may add frames
+		// up to what the limit leaves after the files still to come
+		limit := 0
+		if maxFrames > 0 {
+			limit = max(maxFrames-len(images)-(len(frames)-i-1), 1)
+		}
+		decoded, format, tiffTags, err := decodeFrames(frame, limit)
+		if errors.Is(err, errTooManyFrames) {
+			return nil, nil, &requestError{Status: http.StatusRequestEntityTooLarge, Code: "too_many_frames", Message: fmt.Sprintf("File %s holds more frames than fit in the %d accepted per job. Please select fewer frames.", imageNames[i], maxFrames)}
+		}
+		if format == "apng" && err != nil {
+			return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("File %s is an animated PNG whose frames cannot be decoded: %v", imageNames[i], err)}
+		}
+		if errors.Is(err, errMalformedGeoTIFF) {
+			return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("File %s has malformed GeoTIFF tags, so its georeferencing cannot be kept", imageNames[i])}
 		}
-		defer file.Close() // Ensure the file is closed after reading
-
-		// Decode the image to check its format
-		img, format, err := image.Decode(file)
 		if err != nil {
 			// If decoding fails, send an error with the list of supported formats
-			supportedFormats := "JPEG, PNG, GIF"
-			http.Error(w, fmt.Sprintf("Unsupported format for file %s. Supported formats are: %s", filepath.Base(path), supportedFormats), http.StatusBadRequest)
-			return
+			return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("Unsupported format for file %s. Supported formats are: %s", imageNames[i], supportedFormats)}
 		}
-		log.Printf("Decoded %s as %s format", path, format) // Log the successful decoding
+		slog.DebugContext(r.Context(), "Decoded uploaded file", "file", imageNames[i], "format", format, "frames", len(decoded), "in_memory", inMemory) // Log the successful decoding
 
-		// Add the successfully decoded image to the list
-		images = append(images, img)
+		// Add the successfully decoded images to the list
+		for n, img := range decoded {
+			name := imageNames[i]
+			if len(decoded) > 1 {
+				name = fmt.Sprintf("%s frame %d", name, n+1)
+			}
+			images = append(images, img)
+			tags = append(tags, tiffTags)
+			names = append(names, name)
+		}
 	}
 
 	// Ensure there are valid images to process
 	if len(images) == 0 {
-		http.Error(w, "No valid images to process. Please upload supported formats only.", http.StatusBadRequest) // Send error if no valid images
-		return
+		return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "no_images", Message: "No valid images to process. Please upload supported formats only."} // Send error if no valid images
 	}
 
-	// Calculate the maximum scaling factor based on the number of valid images
-	maxScale := int(math.Sqrt(float64(len(images)))) // Use the square root of the image count as the scaling factor
-	log.Printf("Maximum scaling factor determined: %dx", maxScale)
-
-	// Perform super-resolution
-	result := performSuperResolution(images, maxScale) // Call the function to generate the high-resolution image
-
-	// Return the resulting image to the client
-	w.Header().Set("Content-Type", "image/jpeg") // Set the content type to JPEG
-	err = jpeg.Encode(w, result, nil)            // Encode the resulting image to JPEG and write it to the response
-	if err != nil {
-		http.Error(w, "Error encoding high-resolution image", http.StatusInternalServerError) // Handle encoding errors
+	if images, reqErr = subtractUploadedDarks(r, images); reqErr != nil {
+		return nil, nil, reqErr
 	}
+	if images, reqErr = divideUploadedFlats(r, images); reqErr != nil {
+		return nil, nil, reqErr
+	}
+	images, reqErr = fitUploadedFrames(r, images, tags, names)
+	return images, tags, reqErr
 }
 
 // performSuperResolution реализует суперразрешение с параллелизмом
 func performSuperResolution(images []image.Image, upscaleFactor int) *image.RGBA {
-	log.Println("Starting super-resolution process...")
+	acc, _ := accumulateSuperResolution(context.Background(), images, processOptions{Scale: upscaleFactor, Kernel: "bilinear"}) // Cannot be canceled
+
+	// Генерация итогового изображения
+	slog.Info("Combining accumulated data into the final high-resolution image")
+	highResImg := acc.renderRows(0, acc.height)
+	acc.release()
+
+	slog.Info("Super-resolution process completed successfully")
+	return highResImg
+}
+
+// fusionAccumulator holds the per-pixel sums gathered from every aligned, upscaled frame
+type fusionAccumulator struct {
+	width, height    int
+	accR, accG, accB [][]float64
+	weights          [][]float64
+	shifts           []image.Point // Offset each frame was moved by to align it with the first
+
+	radiometric bool         // accR sums the 16-bit counts of thermal or mono16 frames and accG and accB are nil, see thermal.go
+	palette     []color.RGBA // Colours the fused counts are rendered in, when radiometric
+	span        [2]float64   // Fused counts at the ends of the palette, when radiometric
+	tone        toneCurve    // Mapping of the fused counts to the palette instead of the span, when radiometric and tone mapped
+
+	denoise int // Denoise strength the noise left in the result calls for, with adaptive; see adaptiveDenoise
+
+	chroma *image.RGBA // Reference upscaled with the kernel, whose colour the fused brightness in accR is rendered in, when luma-only; accG and accB are nil, see luma.go
+	ycbcr  bool        // accR, accG and accB sum the Y', Cb and Cr planes of JPEG frames, see ycbcr.go
+	linear *colorSpace // Space whose transfer curve the frames were decoded from into the linear light accR, accG and accB sum, with working_space=linear; see colorspace.go
+}
+
+// accumulateSuperResolution aligns the frames, by hand where opts.Offsets has an
+// entry for them, upscales them with the kernel of opts and sums them into an
+// accumulator, stopping with the context's error when ctx is canceled
+func accumulateSuperResolution(ctx context.Context, images []image.Image, opts processOptions) (*fusionAccumulator, error) {
+	upscaleFactor, kernel := opts.Scale, interpolationKernels[opts.Kernel]
+	slog.InfoContext(ctx, "Starting super-resolution process", "frames", len(images), "scale", upscaleFactor)
+	if opts.Deinterlace {
+		deinterlaced := make([]image.Image, len(images))
+		for i, img := range images {
+			deinterlaced[i] = deinterlaceFrame(img)
+		}
+		images = deinterlaced
+	}
 
 	srcBounds := images[0].Bounds()
 	highResWidth := srcBounds.Dx() * upscaleFactor
 	highResHeight := srcBounds.Dy() * upscaleFactor
 
+	var noise []float64 // Noise level of every frame, measured before alignment resamples it, when adaptive
+	if opts.Adaptive {
+		noise = frameNoise(ctx, images)
+	}
+
 	// Параллельное выравнивание изображений
-	log.Println("Aligning images before processing...")
-	alignedImages := findAndAlignImages(images)
+	_, endAlign := startStage(ctx, "align")
+	alignedImages, shifts := findAndAlignImages(ctx, images, opts)
+	endAlign()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts.Deghost {
+		alignedImages = rejectGhosts(ctx, alignedImages, noise)
+	}
+	var frameWeights []float64 // Weight of every frame when film passes or noise levels are weighed, nil for all alike
+	if opts.Film {
+		alignedImages, frameWeights = filmPasses(ctx, alignedImages, noise)
+	}
+	if noise != nil && frameWeights == nil {
+		frameWeights = noiseWeights(noise)
+	}
+	if opts.Algorithm == algorithmMedian {
+		alignedImages, frameWeights = []image.Image{medianFrame(ctx, alignedImages)}, nil
+	}
+	var planar []*ycbcrFrame // The aligned frames in their Y'CbCr planes, when they all are
+	if opts.YCbCr && !opts.LumaOnly {
+		planar = planarFrames(alignedImages)
+	}
+	_, endFuse := startStage(ctx, "fuse")
+	defer endFuse()
+	overlayBand := 0 // Rows at the top and bottom taken from the reference alone
+	if opts.MaskOverlays {
+		overlayBand = overlayBands(srcBounds.Dy()) * upscaleFactor
+	}
+	if workers := clusterWorkers(); len(workers) > 0 && len(alignedImages) > 1 && overlayBand == 0 && !opts.Thermal && !opts.Mono16 && !opts.LumaOnly && planar == nil && opts.WorkingSpace == "" && frameWeights == nil && opts.Algorithm != algorithmWeighted && opts.TileReject == 0 && !opts.Subject { // Workers fuse every frame alike into all their rows, at 8 bits
+		acc, err := clusterFuse(ctx, workers, alignedImages, upscaleFactor, kernel, highResWidth, highResHeight)
+		if acc != nil {
+			acc.shifts = shifts
+		}
+		return acc, err
+	}
 
 	// Инициализация матриц для накопления
-	accR := make([][]float64, highResHeight)
-	accG := make([][]float64, highResHeight)
-	accB := make([][]float64, highResHeight)
-	weights := make([][]float64, highResHeight)
-	for y := range accR {
-		accR[y] = make([]float64, highResWidth)
-		accG[y] = make([]float64, highResWidth)
-		accB[y] = make([]float64, highResWidth)
-		weights[y] = make([]float64, highResWidth)
+	acc := &fusionAccumulator{
+		width:       highResWidth,
+		height:      highResHeight,
+		accR:        make([][]float64, highResHeight),
+		weights:     make([][]float64, highResHeight),
+		shifts:      shifts,
+		radiometric: opts.Thermal || opts.Mono16,
+		palette:     opts.radiometricPalette(),
+		ycbcr:       planar != nil,
+	}
+	if opts.LumaOnly {
+		acc.chroma = image.NewRGBA(image.Rect(0, 0, highResWidth, highResHeight))
+		kernel.Scale(acc.chroma, acc.chroma.Bounds(), alignedImages[0], alignedImages[0].Bounds(), draw.Src, nil)
+	}
+	planes := !acc.radiometric && acc.chroma == nil // Whether accG and accB are summed too
+	if planes {
+		acc.accG = make([][]float64, highResHeight)
+		acc.accB = make([][]float64, highResHeight)
+	}
+	for y := range acc.accR {
+		acc.accR[y] = make([]float64, highResWidth)
+		if planes {
+			acc.accG[y] = make([]float64, highResWidth)
+			acc.accB[y] = make([]float64, highResWidth)
+		}
+		acc.weights[y] = make([]float64, highResWidth)
+	}
+	metrics.accumulatorBytes.Add(acc.bytes())
+	jobs.recordMemory(jobIDFromContext(ctx), acc.bytes())
+	var levels *[256]float64 // What every 8-bit level of the frames adds, when that is its linear light
+	if opts.WorkingSpace == spaceLinear {
+		space := opts.inputSpace()
+		acc.linear, levels = &space, space.linearLevels()
 	}
 
 	// Канал для параллельной обработки пикселей
-	taskChan := make(chan *image.RGBA, len(alignedImages))
-	var wg sync.WaitGroup
-
+	type fusionFrame struct {
+		img    image.Image
+		y0, y1 int     // Rows it adds to
+		weight float64 // What it counts for against the other frames
+
+		pixelWeights []float32     // Weight of every pixel of the frame, row by row, or nil for all alike: by how well it lines up, see residualWeights, and out of a moving subject, see subjectMask
+		tiles        *tileMask     // Tiles of the frame fused, or nil for all of them; see rejectTiles
+		planes       [][][]float32 // Upscaled planes of the frame instead of img: its brightness when luma-only, Y', Cb and Cr when planar
+	}
 	numCPUs := runtime.NumCPU()
-	log.Printf("Using %d CPU cores for pixel accumulation...", numCPUs)
+	taskChan := make(chan fusionFrame, numCPUs) // A few upscaled frames in memory at a time, however many there are
+	var wg sync.WaitGroup
 
-	// Горутины для обработки пикселей
-	for i := 0; i < numCPUs; i++ {
-		go func() {
-			for img := range taskChan {
-				for y := 0; y < highResHeight; y++ {
-					for x := 0; x < highResWidth; x++ {
-						r, g, b, _ := img.At(x, y).RGBA()
-						accR[y][x] += float64(r >> 8)
-						accG[y][x] += float64(g >> 8)
-						accB[y][x] += float64(b >> 8)
-						weights[y][x]++
+	slog.DebugContext(ctx, "Accumulating pixels", "cpus", numCPUs, "deterministic", opts.Deterministic)
+	var fused atomic.Int32
+	reportProgress(ctx, "fuse", 0, len(alignedImages))
+
+	// addRows adds the rows [y0, y1) of a frame to the sums. Several frames are
+	// added at once, so every row is locked while it is added to; the order the
+	// frames reach a row in is then up to the scheduler, except when deterministic.
+	rows := make([]sync.Mutex, highResHeight)
+	addRows := func(frame fusionFrame, y0, y1 int) {
+		img := frame.img
+		for y := y0; y < y1; y++ {
+			rows[y].Lock()
+			inBand := y >= overlayBand && y < highResHeight-overlayBand // Outside it the rows are the reference's alone, whole
+			var pixelWeights []float32                                  // Weights of the row of the frame this one is upscaled from
+			if frame.pixelWeights != nil && inBand {
+				pixelWeights = frame.pixelWeights[y/upscaleFactor*srcBounds.Dx():]
+			}
+			for x := 0; x < highResWidth; x++ {
+				weight := frame.weight
+				if pixelWeights != nil {
+					weight *= float64(pixelWeights[x/upscaleFactor])
+				}
+				if frame.tiles != nil && inBand {
+					weight *= float64(frame.tiles.weight(x/upscaleFactor, y/upscaleFactor))
+				}
+				if frame.planes != nil {
+					acc.accR[y][x] += weight * float64(frame.planes[0][y][x])
+					if acc.ycbcr {
+						acc.accG[y][x] += weight * float64(frame.planes[1][y][x])
+						acc.accB[y][x] += weight * float64(frame.planes[2][y][x])
 					}
+					acc.weights[y][x] += weight
+					continue
+				}
+				r, g, b, a := img.At(x, y).RGBA()
+				if acc.radiometric {
+					// The gray count, all 16 bits of it, premultiplied by the
+					// coverage, which uncovered pixels have none of
+					acc.accR[y][x] += weight * float64(r)
+					acc.weights[y][x] += weight * float64(a) / 0xffff
+					continue
+				}
+				if levels != nil {
+					acc.accR[y][x] += weight * levels[r>>8]
+					acc.accG[y][x] += weight * levels[g>>8]
+					acc.accB[y][x] += weight * levels[b>>8]
+					acc.weights[y][x] += weight
+					continue
 				}
-				wg.Done()
+				acc.accR[y][x] += weight * float64(r>>8)
+				acc.accG[y][x] += weight * float64(g>>8)
+				acc.accB[y][x] += weight * float64(b>>8)
+				acc.weights[y][x] += weight
 			}
-		}()
+			rows[y].Unlock()
+		}
+	}
+
+	// Горутины для обработки пикселей, по кадру на каждую; в детерминированном
+	// режиме кадры добавляются по очереди, каждый по полосам строк
+	if !opts.Deterministic {
+		for i := 0; i < numCPUs; i++ {
+			go func() {
+				for frame := range taskChan {
+					addRows(frame, frame.y0, frame.y1)
+					reportProgress(ctx, "fuse", int(fused.Add(1)), len(alignedImages))
+					wg.Done()
+				}
+			}()
+		}
+	}
+
+	var tiles []*tileMask // Tiles of every frame fused, when the worst-agreeing frames are left out of each
+	if opts.TileReject > 0 {
+		tiles = rejectTiles(ctx, alignedImages, opts.TileReject)
+	}
+	var refLuma []float64 // Brightness of the reference the other frames are weighed against, with the weighted algorithm
+	if opts.Algorithm == algorithmWeighted {
+		refLuma = lumaPlane(alignedImages[0])
+	}
+	var subject []float32 // How much of every pixel is the moving subject, fused from the frame sharpest in it alone
+	sharpest := 0
+	if opts.Subject {
+		subject, sharpest = subjectMask(ctx, alignedImages, shifts, noise)
 	}
 
 	// Масштабирование изображений и отправка в канал
-	for _, img := range alignedImages {
+	for i, img := range alignedImages {
+		if ctx.Err() != nil {
+			break // Canceled: stop feeding frames and drop what was accumulated
+		}
 		wg.Add(1)
-		highResImgTmp := image.NewRGBA(image.Rect(0, 0, highResWidth, highResHeight))
-		draw.BiLinear.Scale(highResImgTmp, highResImgTmp.Bounds(), img, img.Bounds(), draw.Over, nil)
-		taskChan <- highResImgTmp
+		var frame fusionFrame
+		switch {
+		case acc.chroma != nil:
+			frame.planes = [][][]float32{upscaleLuma(img, highResWidth, highResHeight, kernel)}
+		case acc.ycbcr:
+			frame.planes = planar[i].upscale(highResWidth, highResHeight, kernel)
+		default:
+			highResImgTmp := blankFrame(img, image.Rect(0, 0, highResWidth, highResHeight))
+			kernel.Scale(highResImgTmp, highResImgTmp.Bounds(), img, img.Bounds(), draw.Over, nil)
+			frame.img = highResImgTmp
+		}
+		frame.y0, frame.y1, frame.weight = 0, highResHeight, 1
+		if tiles != nil {
+			frame.tiles = tiles[i]
+		}
+		if frameWeights != nil {
+			frame.weight = frameWeights[i]
+		}
+		if i > 0 {
+			frame.y0, frame.y1 = overlayBand, highResHeight-overlayBand
+			if refLuma != nil {
+				frame.pixelWeights = residualWeights(ctx, refLuma, img, i)
+			}
+		}
+		if subject != nil && i != sharpest {
+			frame.pixelWeights = outsideSubject(frame.pixelWeights, subject)
+		}
+		if opts.Deterministic {
+			forRowBands(image.Rect(0, frame.y0, highResWidth, frame.y1), func(y0, y1 int) { addRows(frame, y0, y1) })
+			reportProgress(ctx, "fuse", int(fused.Add(1)), len(alignedImages))
+			wg.Done()
+			continue
+		}
+		taskChan <- frame
 	}
 
 	close(taskChan)
 	wg.Wait()
 
-	// Генерация итогового изображения
-	log.Println("Combining accumulated data into the final high-resolution image...")
-	highResImg := image.NewRGBA(image.Rect(0, 0, highResWidth, highResHeight))
-	for y := 0; y < highResHeight; y++ {
-		for x := 0; x < highResWidth; x++ {
-			if weights[y][x] > 0 {
-				r := uint8(math.Min(math.Round(accR[y][x]/weights[y][x]), 255))
-				g := uint8(math.Min(math.Round(accG[y][x]/weights[y][x]), 255))
-				b := uint8(math.Min(math.Round(accB[y][x]/weights[y][x]), 255))
-				highResImg.SetRGBA(x, y, color.RGBA{R: r, G: g, B: b, A: 255})
+	if err := ctx.Err(); err != nil {
+		acc.release()
+		return nil, err
+	}
+	if acc.radiometric {
+		acc.span = acc.radiometricSpan()
+		acc.tone = acc.radiometricTone(opts.Tonemap)
+	}
+	if noise != nil {
+		left := fusedNoise(noise, frameWeights)
+		acc.denoise = min(int(math.Round(left*adaptiveDenoise)), 100)
+		slog.InfoContext(ctx, "Noise left in the fused result", "noise", left, "denoise", acc.denoise)
+	}
+	return acc, nil
+}
+
+// forRowBands calls band for the rows of b split into a band per CPU, in
+// parallel, and returns once every band is done
+func forRowBands(b image.Rectangle, band func(y0, y1 int)) {
+	workers := min(runtime.NumCPU(), max(b.Dy(), 1))
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			band(b.Min.Y+b.Dy()*w/workers, b.Min.Y+b.Dy()*(w+1)/workers)
+		}()
+	}
+	wg.Wait()
+}
+
+// bytes returns the memory held by the accumulation buffers
+func (acc *fusionAccumulator) bytes() int64 {
+	planes := int64(4) // Four float64 planes, or two for radiometric counts and brightness alone
+	if acc.radiometric || acc.chroma != nil {
+		planes = 2
+	}
+	n := int64(acc.width) * int64(acc.height) * planes * 8
+	if acc.chroma != nil {
+		n += int64(len(acc.chroma.Pix))
+	}
+	return n
+}
+
+// release drops the accumulation buffers once the result has been rendered
+func (acc *fusionAccumulator) release() {
+	if acc.weights == nil {
+		return
+	}
+	metrics.accumulatorBytes.Add(-acc.bytes())
+	acc.accR, acc.accG, acc.accB, acc.weights, acc.chroma = nil, nil, nil, nil, nil
+}
+
+// renderRows turns the accumulated rows [y0, y1) into an RGBA strip positioned at (0, 0)
+func (acc *fusionAccumulator) renderRows(y0, y1 int) *image.RGBA {
+	if acc.radiometric {
+		return acc.paletteRows(y0, y1)
+	}
+	if acc.chroma != nil {
+		return acc.lumaRows(y0, y1)
+	}
+	if acc.ycbcr {
+		return acc.ycbcrRows(y0, y1)
+	}
+	if acc.linear != nil {
+		return acc.linearRows(y0, y1)
+	}
+	strip := image.NewRGBA(image.Rect(0, 0, acc.width, y1-y0))
+	for y := y0; y < y1; y++ {
+		for x := 0; x < acc.width; x++ {
+			if acc.weights[y][x] > 0 {
+				r := uint8(math.Min(math.Round(acc.accR[y][x]/acc.weights[y][x]), 255))
+				g := uint8(math.Min(math.Round(acc.accG[y][x]/acc.weights[y][x]), 255))
+				b := uint8(math.Min(math.Round(acc.accB[y][x]/acc.weights[y][x]), 255))
+				strip.SetRGBA(x, y-y0, color.RGBA{R: r, G: g, B: b, A: 255})
 			} else {
-				highResImg.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+				strip.SetRGBA(x, y-y0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
 			}
 		}
 	}
-
-	log.Println("Super-resolution process completed successfully.")
-	return highResImg
+	return strip
 }
 
-
 // alignImages aligns a list of images based on the first image
 func alignImages(images []image.Image) []image.Image {
-	reference := images[0] // Use the first image as the reference
-	alignedImages := []image.Image{reference}
+	reference := newColourPlane(images[0]) // Use the first image as the reference
+	alignedImages := []image.Image{images[0]}
 
 	for i := 1; i < len(images); i++ {
 		img := images[i]
-		dx, dy := estimateTranslation(reference, img)
-		alignedImg := shiftImage(img, dx, dy)
+		dx, dy := estimateTranslation(reference, newColourPlane(img))
+		alignedImg := shiftImage(img, -dx, -dy) // Move its content back onto the reference's
 		alignedImages = append(alignedImages, alignedImg)
 	}
 
 	return alignedImages
 }
 
-// estimateTranslation estimates the shift (dx, dy) between two images
-func estimateTranslation(refImg, img image.Image) (dx, dy int) {
+// estimateTranslation estimates how far (dx, dy) the content of img lies from
+// that of the reference
+func estimateTranslation(ref, img *colourPlane) (dx, dy int) {
 	// Define the maximum shift to search
 	maxShift := 10 // pixels
 
-	minSSD := math.MaxFloat64
+	minDiff := math.MaxFloat64
 	bestDx, bestDy := 0, 0
 
 	for yShift := -maxShift; yShift <= maxShift; yShift++ {
 		for xShift := -maxShift; xShift <= maxShift; xShift++ {
-			ssd := computeSSD(refImg, img, xShift, yShift)
-			if ssd < minSSD {
-				minSSD = ssd
+			diff := calculateDifference(context.Background(), ref, img, xShift, yShift)
+			if diff < minDiff {
+				minDiff = diff
 				bestDx = xShift
 				bestDy = yShift
 			}
@@ -275,38 +1293,11 @@ func estimateTranslation(refImg, img image.Image) (dx, dy int) {
 	return bestDx, bestDy
 }
 
-// computeSSD computes the Sum of Squared Differences between two images with a given shift
-func computeSSD(refImg, img image.Image, xShift, yShift int) float64 {
-	ssd := 0.0
-	bounds := refImg.Bounds()
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			refX := x
-			refY := y
-			imgX := x + xShift
-			imgY := y + yShift
-
-			if imgX < bounds.Min.X || imgX >= bounds.Max.X || imgY < bounds.Min.Y || imgY >= bounds.Max.Y {
-				continue
-			}
-
-			refR, refG, refB, _ := refImg.At(refX, refY).RGBA()
-			imgR, imgG, imgB, _ := img.At(imgX, imgY).RGBA()
-
-			dr := float64((refR >> 8) - (imgR >> 8))
-			dg := float64((refG >> 8) - (imgG >> 8))
-			db := float64((refB >> 8) - (imgB >> 8))
-
-			ssd += dr*dr + dg*dg + db*db
-		}
-	}
-	return ssd
-}
-
 // shiftImage shifts an image by dx and dy pixels
 func shiftImage(img image.Image, dx, dy int) image.Image {
 	bounds := img.Bounds()
-	shiftedImg := image.NewRGBA(bounds)
+	shiftedImg := blankFrame(img, bounds)
+	uncovered := uncoveredColour(shiftedImg)
 
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
@@ -314,23 +1305,56 @@ func shiftImage(img image.Image, dx, dy int) image.Image {
 			srcY := y - dy
 
 			if srcX < bounds.Min.X || srcX >= bounds.Max.X || srcY < bounds.Min.Y || srcY >= bounds.Max.Y {
-				shiftedImg.Set(x, y, color.Black) // Заполняем пустые области чёрным
+				shiftedImg.Set(x, y, uncovered) // Заполняем пустые области чёрным (16-битные — прозрачным)
 			} else {
 				shiftedImg.Set(x, y, img.At(srcX, srcY))
 			}
 		}
 	}
 
-	log.Printf("Image shifted by dx=%d, dy=%d", dx, dy)
+	slog.Debug("Image shifted", "dx", dx, "dy", dy)
 	return shiftedImg
 }
 
-
-func findAndAlignImages(images []image.Image) []image.Image {
-	log.Println("Starting parallel image alignment process...")
+// findAndAlignImages shifts every frame onto the first one and returns the
+// aligned frames along with the shift applied to each. Frames with an entry in
+// opts.Offsets are moved as it says instead of searching for their shift.
+func findAndAlignImages(ctx context.Context, images []image.Image, opts processOptions) ([]image.Image, []image.Point) {
+	offsets := opts.Offsets
+	slog.InfoContext(ctx, "Starting parallel image alignment process")
+	if opts.Align == alignPlanet {
+		return alignPlanetFrames(ctx, images)
+	}
 	reference := images[0] // Опорное изображение
 	alignedImages := make([]image.Image, len(images))
 	alignedImages[0] = reference // Первое изображение уже выровнено
+	if opts.MaskOverlays {
+		reference = withoutOverlays(reference)
+	}
+	shifts := make([]image.Point, len(images))
+	var aligned atomic.Int32
+	reportProgress(ctx, "align", 0, len(images)-1)
+	registered := make([]*frameOffset, len(images)) // Alignments found from the stars, along the drift or by shift and turn, or none, used where none was set by hand
+	switch opts.Align {
+	case alignStars:
+		registered = starOffsets(ctx, images)
+	case alignDrift:
+		registered = driftOffsets(ctx, images)
+	case alignHandheld:
+		registered = handheldOffsets(ctx, images)
+	case alignNone:
+		for i := range registered {
+			registered[i] = &frameOffset{} // Fused where they are
+		}
+	}
+	var tripodRef grayPatch // What frames are refined against with align=tripod
+	if opts.Align == alignTripod {
+		tripodRef = centerPatch(reference, assessPatch)
+	}
+	var measured map[int]image.Point // Shifts found by cluster workers, which align against the whole reference
+	if workers := clusterWorkers(); len(workers) > 0 && !opts.MaskOverlays && opts.Align == "" {
+		measured = clusterAlignShifts(ctx, workers, images, offsets)
+	}
 
 	var wg sync.WaitGroup
 	for i := 1; i < len(images); i++ {
@@ -338,27 +1362,57 @@ func findAndAlignImages(images []image.Image) []image.Image {
 		go func(i int) {
 			defer wg.Done()
 			img := images[i]
-			log.Printf("Aligning image %d with the reference image...", i)
+			slog.DebugContext(ctx, "Aligning image with the reference image", "frame", i)
+			o := registered[i]
+			if i < len(offsets) && offsets[i] != nil {
+				o = offsets[i]
+				slog.InfoContext(ctx, "Using the alignment set by hand", "frame", i, "dx", o.DX, "dy", o.DY, "angle", o.Angle)
+			}
+			if o != nil {
+				shifts[i] = image.Point{X: o.DX, Y: o.DY}
+				alignedImages[i] = planarShift(img, *o, opts.YCbCr)
+				reportProgress(ctx, "align", int(aligned.Add(1)), len(images)-1)
+				return
+			}
+			if opts.Align == alignTripod {
+				alignedImages[i], shifts[i] = alignTripodFrame(ctx, tripodRef, img, i)
+				reportProgress(ctx, "align", int(aligned.Add(1)), len(images)-1)
+				return
+			}
 
 			// Найти оптимальное совмещение
-			dx, dy := findOverlap(reference, img)
-			log.Printf("Optimal shift for image %d: dx=%d, dy=%d", i, dx, dy)
+			shift, ok := measured[i]
+			if !ok {
+				shift.X, shift.Y = findOverlap(ctx, reference, img)
+			}
+			dx, dy := shift.X, shift.Y
+			slog.InfoContext(ctx, "Optimal shift found", "frame", i, "dx", dx, "dy", dy)
+			shifts[i] = image.Point{X: dx, Y: dy}
+			reportProgress(ctx, "align", int(aligned.Add(1)), len(images)-1)
 
 			// Сдвинуть текущее изображение
-			alignedImages[i] = shiftImage(img, dx, dy)
+			alignedImages[i] = planarShift(img, frameOffset{DX: dx, DY: dy}, opts.YCbCr)
 		}(i)
 	}
 
 	// Ожидание завершения всех горутин
 	wg.Wait()
-	log.Println("Image alignment process completed.")
-	return alignedImages
+	slog.InfoContext(ctx, "Image alignment process completed")
+	return alignedImages, shifts
 }
 
+// alignMethods are the accepted values of the align parameter besides "",
+// which searches for the shift of every frame
+var alignMethods = []string{alignStars, alignPlanet, alignDrift, alignTripod, alignNone, alignHandheld}
 
-func findOverlap(refImg, img image.Image) (dx, dy int) {
-	log.Println("Starting parallel overlap calculation...")
-	maxShift := 50 // Максимальное смещение (в пикселях)
+// maxAlignShift is how far findOverlap searches for a frame's shift, in pixels
+const maxAlignShift = 50
+
+// findOverlap searches the shifts within maxAlignShift pixels for the one that
+// best lines img up with refImg and returns how far img must move to it
+func findOverlap(ctx context.Context, refImg, img image.Image) (dx, dy int) {
+	slog.DebugContext(ctx, "Starting parallel overlap calculation")
+	maxShift := maxAlignShift
 	type result struct {
 		xShift, yShift int
 		diff           float64
@@ -366,17 +1420,19 @@ func findOverlap(refImg, img image.Image) (dx, dy int) {
 	resultsChan := make(chan result, (2*maxShift+1)*(2*maxShift+1))
 	var wg sync.WaitGroup
 
-	// Сосредоточьтесь на центральной области изображения
-	refBounds := refImg.Bounds()
-	centerX := refBounds.Min.X + (refBounds.Dx() / 2)
-	centerY := refBounds.Min.Y + (refBounds.Dy() / 2)
+	// Сосредоточьтесь на центральной области изображения: без полосы по краям,
+	// которую сдвиг выводит за кадр, каждый сдвиг сравнивает одни и те же пиксели
+	ref, frame := newColourPlane(refImg), newColourPlane(img)
+	if centre := ref.rect.Inset(maxShift); centre.Dx() > 2*maxShift && centre.Dy() > 2*maxShift {
+		ref = ref.crop(centre)
+	}
 
 	for yShift := -maxShift; yShift <= maxShift; yShift++ {
 		for xShift := -maxShift; xShift <= maxShift; xShift++ {
 			wg.Add(1)
 			go func(x, y int) {
 				defer wg.Done()
-				diff := calculateDifference(refImg, img, centerX+x, centerY+y)
+				diff := calculateDifference(ctx, ref, frame, x, y)
 				resultsChan <- result{xShift: x, yShift: y, diff: diff}
 			}(xShift, yShift)
 		}
@@ -388,53 +1444,23 @@ func findOverlap(refImg, img image.Image) (dx, dy int) {
 		close(resultsChan)
 	}()
 
-	// Поиск минимального значения
+	// Поиск минимального значения; при равенстве — наименьший сдвиг, затем
+	// верхний и левый, чтобы результат не зависел от порядка горутин
 	minDiff := math.MaxFloat64
+	closer := func(x, y int) bool {
+		n, best := x*x+y*y, dx*dx+dy*dy
+		return n < best || n == best && (y < dy || y == dy && x < dx)
+	}
 	for res := range resultsChan {
-		if res.diff < minDiff {
+		if res.diff < minDiff || res.diff == minDiff && closer(res.xShift, res.yShift) {
 			minDiff = res.diff
 			dx = res.xShift
 			dy = res.yShift
 		}
 	}
 
-	log.Printf("Found optimal overlap: dx=%d, dy=%d, minDiff=%f", dx, dy, minDiff)
+	// The content of img lies (dx, dy) from the reference's, so it moves back by as much
+	dx, dy = -dx, -dy
+	slog.DebugContext(ctx, "Found optimal overlap", "dx", dx, "dy", dy, "min_diff", minDiff)
 	return dx, dy
 }
-
-
-
-func calculateDifference(refImg, img image.Image, dx, dy int) float64 {
-	// Логирование только для отладки; основной вывод будет в других функциях
-	totalDiff := 0.0
-	count := 0
-
-	refBounds := refImg.Bounds()
-	imgBounds := img.Bounds()
-
-	for y := refBounds.Min.Y; y < refBounds.Max.Y; y++ {
-		for x := refBounds.Min.X; x < refBounds.Max.X; x++ {
-			imgX := x + dx
-			imgY := y + dy
-
-			if imgX < imgBounds.Min.X || imgX >= imgBounds.Max.X || imgY < imgBounds.Min.Y || imgY >= imgBounds.Max.Y {
-				continue
-			}
-
-			refR, refG, refB, _ := refImg.At(x, y).RGBA()
-			imgR, imgG, imgB, _ := img.At(imgX, imgY).RGBA()
-
-			dr := float64((refR >> 8) - (imgR >> 8))
-			dg := float64((refG >> 8) - (imgG >> 8))
-			db := float64((refB >> 8) - (imgB >> 8))
-
-			totalDiff += dr*dr + dg*dg + db*db
-			count++
-		}
-	}
-
-	if count == 0 {
-		return math.MaxFloat64
-	}
-	return totalDiff / float64(count)
-}
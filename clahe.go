@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// Fused results often look flat: averaging frames takes out noise, not haze,
+// and the upscaled detail is faint next to the range of the whole picture.
+// Contrast-limited adaptive histogram equalization stretches the brightness of
+// every tile of the result over the range its own histogram spans, blending
+// the stretches of neighbouring tiles so no seams show, and caps how far any
+// level is stretched so flat areas do not turn to grain.
+
+// Contrast-limited adaptive histogram equalization
+const (
+	defaultCLAHETile = 128 // Side of the tiles, in pixels of the result, when clahe_tile is left out
+	minCLAHETile     = 16  // Least side of the tiles: smaller ones hold too few pixels for a histogram
+)
+
+// claheClipLimit is the height a histogram bin is cut at, in multiples of the
+// mean height of the bins, for a clahe strength of 0-100
+func claheClipLimit(strength int) float64 {
+	return 1 + float64(strength)/10
+}
+
+// clahe equalizes the brightness of img, in place, tile by tile: the histogram
+// of each tile, cut at the clip limit of strength with what is cut spread over
+// every bin, maps the brightness of its pixels, and every pixel takes the
+// mappings of the four tiles around it blended by how near their centres are.
+// The colour of a pixel keeps its distance from its brightness.
+func clahe(img *image.RGBA, strength, tile int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	nx, ny := max(1, int(math.Round(float64(w)/float64(tile)))), max(1, int(math.Round(float64(h)/float64(tile))))
+	luma := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			luma[y*w+x] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2]) + 500) / 1000)
+		}
+	}
+
+	// The mapping of every tile
+	maps := make([][256]float64, nx*ny)
+	for ty := 0; ty < ny; ty++ {
+		for tx := 0; tx < nx; tx++ {
+			var histogram [256]float64
+			x0, x1, y0, y1 := tx*w/nx, (tx+1)*w/nx, ty*h/ny, (ty+1)*h/ny
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					histogram[luma[y*w+x]]++
+				}
+			}
+			n := float64((x1 - x0) * (y1 - y0))
+			limit := claheClipLimit(strength) * n / 256
+			excess := 0.0
+			for v, count := range histogram {
+				if count > limit {
+					excess += count - limit
+					histogram[v] = limit
+				}
+			}
+			sum := 0.0
+			for v, count := range histogram {
+				sum += count + excess/256
+				maps[ty*nx+tx][v] = 255 * sum / n
+			}
+		}
+	}
+
+	// Every pixel blended between the mappings of the tiles around it
+	tw, th := float64(w)/float64(nx), float64(h)/float64(ny)
+	for y := 0; y < h; y++ {
+		fy := math.Min(math.Max((float64(y)+0.5)/th-0.5, 0), float64(ny-1))
+		ty0 := int(fy)
+		ty1, wy := min(ty0+1, ny-1), fy-float64(ty0)
+		for x := 0; x < w; x++ {
+			fx := math.Min(math.Max((float64(x)+0.5)/tw-0.5, 0), float64(nx-1))
+			tx0 := int(fx)
+			tx1, wx := min(tx0+1, nx-1), fx-float64(tx0)
+			v := luma[y*w+x]
+			top := maps[ty0*nx+tx0][v]*(1-wx) + maps[ty0*nx+tx1][v]*wx
+			bottom := maps[ty1*nx+tx0][v]*(1-wx) + maps[ty1*nx+tx1][v]*wx
+			shift := top*(1-wy) + bottom*wy - float64(v)
+			p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			for c := 0; c < 3; c++ {
+				p[c] = uint8(math.Min(math.Max(math.Round(float64(p[c])+shift), 0), 255))
+			}
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stdioPath in place of a frame or result file stands for standard input or output
+const stdioPath = "-"
+
+// Exit codes of the commands
+const (
+	exitOK          = 0
+	exitInternal    = 1   // Files that cannot be written and other unexpected errors
+	exitBadInput    = 2   // Invalid flags or arguments, or frames that cannot be read
+	exitAlignment   = 3   // Frames that cannot be aligned with the reference frame
+	exitFewFrames   = 4   // Too few frames to fuse
+	exitMismatch    = 5   // The result verify made again differs from its manifest
+	exitInterrupted = 130 // Stopped by SIGINT or SIGTERM, as shells report it
+)
+
+// commandError is an error that ends a command with a given exit code
+type commandError struct {
+	code int
+	err  error
+}
+
+func (e *commandError) Error() string { return e.err.Error() }
+func (e *commandError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code a command ends with because of err
+func exitCode(err error) int {
+	var cmdErr *commandError
+	var reqErr *requestError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &cmdErr):
+		return cmdErr.code
+	case errors.As(err, &reqErr):
+		return exitBadInput
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	}
+	return exitInternal
+}
+
+// command is a subcommand, run with the arguments after its name and ending
+// the program with the exit code it returns
+type command struct {
+	run     func(args []string) int
+	summary string // One line for the help listing
+}
+
+// commands are the subcommands by the name given as the first argument; serve
+// also runs when the arguments start with a flag, as before there were others
+var commands = map[string]command{
+	"serve":     {serveCommand, "run the web server and API (the default)"},
+	"process":   {processCommand, "process one burst, or a directory of bursts, from the command line"},
+	"watch":     {watchCommand, "process every burst dropped into a folder"},
+	"align":     {alignCommand, "write the frames of a burst aligned with the reference, and their shifts"},
+	"analyze":   {analyzeCommand, "report on the frames of a burst without processing it"},
+	"stabilize": {stabilizeCommand, "write a clip as a video, steadied and every frame fused with its neighbours"},
+	"verify":    {verifyCommand, "process the frames of a manifest written by process -manifest again and check the result is the same"},
+	"version":   {versionCommand, "print the version, commit and build date"},
+	"capture":   {captureCommand, "shoot a burst with a camera connected by USB, through gphoto2, and process it"},
+	"worker":    {workerCommand, "run jobs from the shared -queue-redis queue without serving HTTP"},
+}
+
+// commandUsage lists the commands
+func commandUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", os.Args[0])
+	names := slices.Sorted(maps.Keys(commands))
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-9s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(w, "\nRun %s <command> -h for the flags of a command. Without a command the server runs with the flags given.\n", os.Args[0])
+}
+
+// pipelineFlags defines the processing options of the commands on fs, with the
+// names and meaning of the API parameters
+func pipelineFlags(fs *flag.FlagSet) *superResolutionRequestV1 {
+	req := &superResolutionRequestV1{}
+	fs.IntVar(&req.Scale, "scale", 0, fmt.Sprintf("upscale factor 1-%d (0 picks the square root of the frame count, at most %d)", maxUpscaleFactor, maxUpscaleFactor))
+	fs.StringVar(&req.Algorithm, "algorithm", "", "fusion algorithm: "+strings.Join(fusionAlgorithms, ", "))
+	fs.StringVar(&req.Kernel, "kernel", "", "interpolation kernel: "+strings.Join(kernelNames(), ", "))
+	fs.StringVar(&req.Format, "format", "", "output format: jpeg, png, pdf or tiff")
+	fs.BoolVar(&req.Lossless, "lossless", false, "refuse lossy output: PNG unless -format or the output name picks PDF or TIFF, an error for JPEG")
+	fs.IntVar(&req.Quality, "quality", 0, fmt.Sprintf("JPEG quality 1-100 (default %d)", defaultJPEGQuality))
+	fs.BoolVar(&req.Progressive, "progressive", false, "write progressive JPEG")
+	fs.StringVar(&req.Chroma, "chroma", "", "JPEG chroma subsampling: "+strings.Join(chromaModes, ", ")+" (default "+chroma420+")")
+	fs.IntVar(&req.Denoise, "denoise", 0, "denoise strength 0-100")
+	fs.IntVar(&req.Sharpen, "sharpen", 0, "sharpen strength 0-100")
+	fs.IntVar(&req.Reference, "reference", 0, "index of the frame the others are aligned to, from 0 in name order")
+	fs.StringVar(&req.Preset, "preset", "", "defaults tuned for a kind of footage, for the flags not given: "+strings.Join(presetNames(), ", "))
+	fs.BoolVar(&req.Deinterlace, "deinterlace", false, "rebuild every frame from its first field, for interlaced video")
+	fs.BoolVar(&req.MaskOverlays, "mask-overlays", false, fmt.Sprintf("align without the top and bottom %d%% of the frames, where cameras burn in the time, and take them from the reference alone", overlayBandPercent))
+	fs.StringVar(&req.ROI, "roi", "", "x,y,width,height of the region of the reference frame to process alone, in pixels")
+	fs.StringVar(&req.Fit, "fit", "", fitFlagUsage)
+	fs.StringVar(&req.ManyFrames, "many-frames", "", fmt.Sprintf("how a burst of more than %d frames is fused: %s fuses the sharpest %d, %s every frame (default %s)", maxFusedFrames, manyFramesSelect, maxFusedFrames, manyFramesAll, manyFramesSelect))
+	fs.IntVar(&req.Deconvolve, "deconvolve", 0, "deconvolution strength 0-100, restoring edges blurred by upscaling")
+	fs.BoolVar(&req.Rectify, "rectify", false, "find the page in every frame and straighten it, for photographs of a document")
+	fs.BoolVar(&req.Flatten, "flatten", false, "even out shadows and uneven light on a page")
+	fs.BoolVar(&req.Binarize, "binarize", false, "render the result as black ink on white paper")
+	fs.StringVar(&req.Align, "align", "", fmt.Sprintf("how frames are aligned: empty to search for their shift, %s to match their stars, %s to track the disk of the Moon or a planet and match points on it, %s to follow the drift of a microscope stage, %s to refine frames from a tripod within a pixel, %s to fuse them where they are, %s to search for them turned as well as moved, for bursts shot in the hand", alignStars, alignPlanet, alignDrift, alignTripod, alignNone, alignHandheld))
+	fs.IntVar(&req.Keep, "keep", 0, "percent of the frames, the sharpest, that are fused (0 keeps all)")
+	fs.IntVar(&req.TileReject, "tile-reject", 0, fmt.Sprintf("percent of the frames, 0-%d, left out of every %d-pixel tile: those that agree least with the others there, such as one a bird flew through (0 leaves none out)", maxTileReject, rejectTile))
+	fs.IntVar(&req.Wavelet, "wavelet", 0, "wavelet sharpening strength 0-100, for planetary stacks")
+	fs.IntVar(&req.CLAHE, "clahe", 0, "local contrast enhancement (CLAHE) strength 0-100")
+	fs.IntVar(&req.CLAHETile, "clahe-tile", 0, fmt.Sprintf("side of the tiles of the local contrast enhancement, in pixels of the result; %d by default", defaultCLAHETile))
+	fs.BoolVar(&req.Mono16, "mono16", false, "fuse 16-bit grayscale frames at full depth, rendering them in gray and writing the fused values to <result>-radiometric.tiff; other frames are fused at 8 bits")
+	fs.StringVar(&req.Tonemap, "tonemap", "", fmt.Sprintf("how the fused 16-bit values of thermal and mono16 jobs are rendered: empty to stretch them linearly, clipping the brightest, or %s to compress the highlights", strings.Join(tonemapOperators, ", ")))
+	fs.BoolVar(&req.Film, "film", false, "fuse the frames as passes of a film scanner, replacing dust with the median of the passes and weighing each pass by its noise")
+	fs.BoolVar(&req.Negative, "negative", false, "invert scans of negatives, removing the orange cast of the film base")
+	fs.BoolVar(&req.MatchExposure, "match-exposure", false, "bring every frame to the brightness and colour of the reference")
+	fs.BoolVar(&req.Deghost, "deghost", false, "fuse what moved against the reference, such as people and cars, as the reference shows it")
+	fs.BoolVar(&req.Subject, "subject", false, "fuse a moving subject, such as the person of a portrait, from the frame sharpest in it alone and the background from every frame")
+	fs.BoolVar(&req.Deterministic, "deterministic", false, "add the frames to the result one after another in their order, so the same frames and flags always give a byte-identical result, at some cost in speed")
+	fs.BoolVar(&req.LumaOnly, "luma-only", false, "fuse the brightness of the frames alone and upscale the colour of the reference, about three times faster")
+	fs.BoolVar(&req.YCbCr, "ycbcr", false, "shift and fuse JPEG frames in their Y'CbCr planes, converting to RGB once")
+	fs.StringVar(&req.InputSpace, "input-space", "", "colour space of the frames: "+strings.Join(inputSpaces, ", ")+" (default "+spaceSRGB+")")
+	fs.StringVar(&req.WorkingSpace, "working-space", "", spaceLinear+" fuses the frames in linear light")
+	fs.StringVar(&req.OutputSpace, "output-space", "", "colour space the result is converted to and tagged with: "+strings.Join(outputSpaces, ", ")+" (default the input space)")
+	fs.BoolVar(&req.Adaptive, "adaptive", false, "measure the noise of every frame and weigh the frames, reject dust and ghosts and denoise by it")
+	fs.BoolVar(&req.Thermal, "thermal", false, "fuse 16-bit radiometric frames of a thermal camera, rendering them in false colour and writing the fused counts to <result>-radiometric.tiff")
+	return req
+}
+
+// extensionFormat returns the output format the extension of path names, or ""
+func extensionFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return formatPNG
+	case ".jpg", ".jpeg":
+		return formatJPEG
+	case ".pdf":
+		return formatPDF
+	case ".tif", ".tiff":
+		return formatTIFF
+	}
+	return ""
+}
+
+// parseExit is the exit code of a command whose flags did not parse: asking for
+// them with -h is no failure
+func parseExit(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	return exitBadInput
+}
+
+// logFlags defines the logging flags, which every command shares, on fs
+func logFlags(fs *flag.FlagSet, level, format *string) {
+	fs.StringVar(level, "log-level", *level, "minimum log level: debug, info, warn or error")
+	fs.StringVar(format, "log-format", *format, "log output format: text or json")
+}
+
+// commandLogging adds the logging flags to fs; the returned function applies them
+// once fs is parsed
+func commandLogging(fs *flag.FlagSet) func() error {
+	level, format := defaultConfig.LogLevel, defaultConfig.LogFormat
+	logFlags(fs, &level, &format)
+	return func() error { return setupLogging(level, format) }
+}
+
+// burstFrames returns the image files directly in dir, in name order
+func burstFrames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") && imageFileName(e.Name()) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// decodeFrameFiles decodes the frames at paths; the path "-" stands for all the
+// frames of the stream on standard input, and a video file for the frames clip
+// selects from it, decoded by ffmpeg
+func decodeFrameFiles(ctx context.Context, paths []string, clip videoClip) ([]image.Image, []*frameTags, error) {
+	images := make([]image.Image, 0, len(paths))
+	var tags []*frameTags
+	for _, path := range paths {
+		if path == stdioPath {
+			frames, err := readFrameStream(os.Stdin)
+			if err != nil {
+				return nil, nil, &commandError{exitBadInput, err}
+			}
+			images = append(images, frames...)
+			tags = append(tags, make([]*frameTags, len(frames))...)
+			continue
+		}
+		if isVideoFile(path) {
+			frames, err := readVideoFrames(ctx, path, clip)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, nil, ctx.Err()
+				}
+				return nil, nil, &commandError{exitBadInput, fmt.Errorf("%s: %w", path, err)}
+			}
+			images = append(images, frames...)
+			tags = append(tags, make([]*frameTags, len(frames))...)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, &commandError{exitBadInput, err}
+		}
+		frames, format, tiffTags, err := decodeFrames(f, 0)
+		f.Close()
+		if errors.Is(err, errMalformedGeoTIFF) || format == "apng" && err != nil {
+			return nil, nil, &commandError{exitBadInput, fmt.Errorf("%s: %w", path, err)}
+		}
+		if err != nil {
+			return nil, nil, &commandError{exitBadInput, fmt.Errorf("%s: unsupported format, supported formats are %s", path, supportedFormats)}
+		}
+		images = append(images, frames...)
+		tags = append(tags, tiffTags)
+		tags = append(tags, make([]*frameTags, len(frames)-1)...) // Those of an animated PNG's other frames
+	}
+	return images, tags, nil
+}
+
+// frameSizes reads the sizes of the frames at paths from their headers, for
+// -dry-run; frames from standard input, video files and animated PNGs are
+// decoded in full
+func frameSizes(ctx context.Context, paths []string, clip videoClip) ([]image.Point, error) {
+	var sizes []image.Point
+	decoded := func(path string) error {
+		frames, _, err := decodeFrameFiles(ctx, []string{path}, clip)
+		for _, frame := range frames {
+			sizes = append(sizes, frame.Bounds().Size())
+		}
+		return err
+	}
+	for _, path := range paths {
+		if path == stdioPath || isVideoFile(path) {
+			if err := decoded(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, &commandError{exitBadInput, err}
+		}
+		br := bufio.NewReaderSize(f, exifSearch)
+		head, _ := br.Peek(exifSearch)
+		if isAPNG(head) {
+			f.Close()
+			if err := decoded(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(br)
+		f.Close()
+		if err != nil {
+			return nil, &commandError{exitBadInput, fmt.Errorf("%s: unsupported format, supported formats are %s", path, supportedFormats)}
+		}
+		if !tiffHeader(head) && jpegOrientation(head) >= 5 { // Turned a quarter, as decodeFrame will
+			cfg.Width, cfg.Height = cfg.Height, cfg.Width
+		}
+		sizes = append(sizes, image.Pt(cfg.Width, cfg.Height))
+	}
+	return sizes, nil
+}
+
+// checkBurst resolves the options of req for frames of the given sizes, called
+// names in messages, and rejects bursts the pipeline cannot fuse: fewer than
+// two frames, unless only the reference is upscaled, or frames of another size
+// than the reference, which cannot be aligned with it unless -fit brings them
+// to a common size
+func checkBurst(sizes []image.Point, names []string, req superResolutionRequestV1) (processOptions, error) {
+	if len(sizes) == 0 {
+		return processOptions{}, &commandError{exitFewFrames, errors.New("no frames: expected JPEG, PNG, GIF or TIFF files")}
+	}
+	opts, reqErr := req.options(len(sizes))
+	if reqErr != nil {
+		return opts, reqErr
+	}
+	if len(sizes) < 2 && opts.Algorithm != algorithmReference {
+		return opts, &commandError{exitFewFrames, fmt.Errorf("one frame cannot be fused: give two or more, or use -algorithm %s", algorithmReference)}
+	}
+	if mismatch := sizeMismatch(sizes, names, opts.Reference); mismatch != "" && opts.Fit == "" {
+		return opts, &commandError{exitAlignment, fmt.Errorf("%s; use -fit %s or -fit %s to bring the frames to a common size", mismatch, fitCrop, fitResize)}
+	}
+	return opts, nil
+}
+
+// processBurst checks the burst and runs the pipeline on decoded frames with the
+// options of req, as a job of the server would, and returns the rendered result, the fused counts
+// of thermal frames or nil, and the shift of every frame, the reference first. tags holds the
+// TIFF tags of each frame, which the options keep those of the reference of, and names what messages call it.
+func processBurst(ctx context.Context, images []image.Image, tags []*frameTags, names []string, req superResolutionRequestV1) (*image.RGBA, *image.Gray16, processOptions, []image.Point, error) {
+	sizes := make([]image.Point, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds().Size()
+	}
+	opts, err := checkBurst(sizes, names, req)
+	if err != nil {
+		return nil, nil, opts, nil, err
+	}
+	opts.Tags = tags[opts.Reference]
+	if opts.Fit != "" {
+		var corner image.Point
+		images, corner = fitFrames(images, opts.Reference, opts.Fit)
+		opts.Tags = fitTags(opts.Tags, corner)
+	}
+	images = referenceFirst(images, opts.Reference)
+	opts.Mono16 = opts.Mono16 && sixteenBitGray(images) // Other frames are fused at 8 bits as usual
+	var reqErr *requestError
+	submitted := len(images)
+	if images, reqErr = prepareFrames(ctx, images, opts); reqErr != nil {
+		return nil, nil, opts, nil, reqErr
+	}
+	if note := opts.countFrames(submitted, len(images)); note != "" {
+		slog.WarnContext(ctx, "Frame-count policy applied", "note", note)
+	}
+	if opts.Algorithm == algorithmReference {
+		images = images[:1]
+	}
+	acc, err := accumulateSuperResolution(ctx, images, opts)
+	if err != nil {
+		return nil, nil, opts, nil, err
+	}
+	defer acc.release()
+	var radiometric *image.Gray16
+	if acc.radiometric {
+		radiometric = acc.radiometricRows(0, acc.height)
+	}
+	return renderResult(acc, 0, acc.height, opts), radiometric, opts, acc.shifts, nil
+}
+
+// burstRun is what runBurst made of one burst
+type burstRun struct {
+	path   string // Where the result was written
+	frames int
+	opts   processOptions // As the parameters resolved
+	result map[string]any // The result event of -json
+}
+
+// runBurst decodes the frames at paths, those of videos as clip selects, takes
+// the master dark off them and divides them by the master flat of cal, processes them with the options of req and writes the result where resultPath
+// says for the resolved options and the frame count. Progress and the result are reported to events, which may be nil.
+func runBurst(ctx context.Context, paths []string, clip videoClip, cal calibration, req superResolutionRequestV1, events *commandEvents, burst string, resultPath func(opts processOptions, frames int) string) (burstRun, error) {
+	start := time.Now()
+	images, tags, err := decodeFrameFiles(ctx, paths, clip)
+	if err != nil {
+		return burstRun{}, err
+	}
+	var reqErr *requestError
+	if images, reqErr = cal.apply(images); reqErr != nil {
+		return burstRun{}, reqErr
+	}
+	run := burstRun{frames: len(images)}
+	if events != nil {
+		events.emit("start", burst, map[string]any{"frames": len(images)})
+		ctx = withProgressFunc(ctx, func(stage string, done, total int) {
+			events.emit("progress", burst, map[string]any{"stage": stage, "done": done, "total": total})
+		})
+	}
+	result, radiometric, opts, shifts, err := processBurst(ctx, slices.Clone(images), tags, frameNames(paths, len(images)), req) // Reordered in place
+	if err != nil {
+		return run, err
+	}
+	run.path, run.opts = resultPath(opts, len(images)), opts
+	if err := writeResultFile(run.path, result, opts); err != nil {
+		return run, &commandError{exitInternal, err}
+	}
+	var radiometricPath string
+	switch {
+	case radiometric != nil && run.path == stdioPath:
+		slog.WarnContext(ctx, "The fused radiometric counts are not written when the result goes to standard output")
+	case radiometric != nil:
+		radiometricPath = strings.TrimSuffix(run.path, filepath.Ext(run.path)) + "-radiometric.tiff"
+		if err := writeOutputFile(radiometricPath, func(w io.Writer) error { return encodeTIFF(w, radiometric, opts.resultTags(), nil) }); err != nil {
+			return run, &commandError{exitInternal, err}
+		}
+	}
+	if events != nil {
+		ordered := referenceFirst(images, opts.Reference)
+		frames := make([]frameReport, len(ordered))
+		for i, frame := range ordered {
+			frames[i] = frameReport{Width: frame.Bounds().Dx(), Height: frame.Bounds().Dy()}
+			if i < len(shifts) {
+				frames[i].ShiftX, frames[i].ShiftY = shifts[i].X, shifts[i].Y
+			}
+		}
+		run.result = map[string]any{
+			"path":             run.path,
+			"width":            result.Bounds().Dx(),
+			"height":           result.Bounds().Dy(),
+			"scale":            opts.Scale,
+			"algorithm":        opts.Algorithm,
+			"kernel":           opts.Kernel,
+			"format":           opts.Format,
+			"frames":           frames,
+			"assessment":       assessBurst(ordered),
+			"duration_seconds": time.Since(start).Seconds(),
+		}
+		if warning, ok := presetWarnings[opts.Preset]; ok {
+			run.result["warning"] = warning
+		}
+		if note := opts.frameCountNote(fmt.Sprintf); note != "" {
+			run.result["frames_fused"] = opts.Fused
+			run.result["frame_count_note"] = note
+		}
+		if radiometricPath != "" {
+			run.result["radiometric_path"] = radiometricPath
+		}
+	}
+	return run, nil
+}
+
+// commandEvents writes the -json output of the commands: one JSON object per
+// line and event, named by its "event" field
+type commandEvents struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// jsonFlag adds -json to fs; the returned function gives the event writer once
+// fs is parsed, or nil without -json
+func jsonFlag(fs *flag.FlagSet) func(resultToStdout bool) *commandEvents {
+	enabled := fs.Bool("json", false, "print progress, frame shifts, quality metrics and result paths as JSON lines on standard output (standard error when the result goes there)")
+	return func(resultToStdout bool) *commandEvents {
+		if !*enabled {
+			return nil
+		}
+		out := os.Stdout
+		if resultToStdout {
+			out = os.Stderr
+		}
+		return &commandEvents{enc: json.NewEncoder(out)}
+	}
+}
+
+// emit writes one event about burst, which may be empty, with fields; it does
+// nothing on a nil writer
+func (e *commandEvents) emit(event, burst string, fields map[string]any) {
+	if e == nil {
+		return
+	}
+	line := map[string]any{"event": event, "time": time.Now().UTC().Format(time.RFC3339Nano)}
+	if burst != "" {
+		line["burst"] = burst
+	}
+	for k, v := range fields {
+		line[k] = v
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(line)
+}
+
+// writeResultFile encodes img to path with the format of opts, see writeOutputFile
+func writeResultFile(path string, img image.Image, opts processOptions) error {
+	return writeOutputFile(path, func(w io.Writer) error { return encodeResult(w, img, opts) })
+}
+
+// writeOutputFile writes what encode produces to path through a temporary file
+// in the same directory, so programs watching the directory never pick up a
+// partial result. The path "-" writes to standard output.
+func writeOutputFile(path string, encode func(w io.Writer) error) error {
+	if path == stdioPath {
+		out := bufio.NewWriter(os.Stdout)
+		return errors.Join(encode(out), out.Flush())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { // Templates may name subfolders
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = encode(tmp)
+	if err := errors.Join(err, tmp.Close()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// defaultNameTemplate names each result after its burst
+const defaultNameTemplate = "{stem}.{ext}"
+
+// namePlaceholder matches the placeholders of a -name template
+var namePlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// namePlaceholders describes the placeholders of -name templates, for the flag help
+const namePlaceholders = "{stem} burst name, {scale}, {algo}, {kernel}, {frames} frame count, {ext} jpg or png, {date} YYYY-MM-DD and {time} HHMMSS when the result was written, {seq} the lowest free number from 001"
+
+// nameTemplateFlag adds -name to fs
+func nameTemplateFlag(fs *flag.FlagSet) *string {
+	return fs.String("name", defaultNameTemplate, "template of result file names, relative to the output directory: "+namePlaceholders)
+}
+
+// checkNameTemplate rejects templates with unknown placeholders or without any
+// that tells bursts apart
+func checkNameTemplate(tmpl string) error {
+	distinct := false
+	for _, m := range namePlaceholder.FindAllStringSubmatch(tmpl, -1) {
+		switch m[1] {
+		case "stem", "seq":
+			distinct = true
+		case "scale", "algo", "kernel", "frames", "ext", "date", "time":
+		default:
+			return fmt.Errorf("unknown placeholder %s in -name; use %s", m[0], namePlaceholders)
+		}
+	}
+	if !distinct {
+		return errors.New("-name must contain {stem} or {seq}, or bursts would overwrite each other's results")
+	}
+	return nil
+}
+
+// resultFileName fills in a -name template for the burst stem processed with
+// opts, and joins it to dir. {seq} takes the lowest number whose file does not
+// exist yet, so repeated runs into the same directory keep earlier results.
+func resultFileName(dir, tmpl, stem string, frames int, opts processOptions) string {
+	now := time.Now()
+	name := func(seq int) string {
+		return namePlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+			switch m[1 : len(m)-1] {
+			case "stem":
+				return stem
+			case "scale":
+				return strconv.Itoa(opts.Scale)
+			case "algo":
+				return opts.Algorithm
+			case "kernel":
+				return opts.Kernel
+			case "frames":
+				return strconv.Itoa(frames)
+			case "ext":
+				return strings.TrimPrefix(fileExtension(opts.Format), ".")
+			case "date":
+				return now.Format("2006-01-02")
+			case "time":
+				return now.Format("150405")
+			case "seq":
+				return fmt.Sprintf("%03d", seq)
+			}
+			return m
+		})
+	}
+	if !strings.Contains(tmpl, "{seq}") {
+		return filepath.Join(dir, name(0))
+	}
+	for seq := 1; ; seq++ {
+		path := filepath.Join(dir, name(seq))
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			return path
+		}
+	}
+}
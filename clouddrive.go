@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxCloudEntries bounds how much of one folder is listed
+const maxCloudEntries = 5000
+
+// cloudStateCookie carries the OAuth state between the redirect to a cloud drive
+// and its callback
+const cloudStateCookie = "chicha_sr_cloud_state"
+
+// errCloudExpired is returned when the drive no longer accepts the access token
+var errCloudExpired = errors.New("access token expired or revoked")
+
+// cloudEntry is a file or folder in a cloud drive
+type cloudEntry struct {
+	ID     string // What the drive's API addresses the entry by
+	Name   string
+	Folder bool
+}
+
+// cloudProvider is a cloud drive users pick folders of frames from, signed in
+// to with OAuth 2.0 and PKCE
+type cloudProvider struct {
+	Name         string // Path segment and form value, e.g. gdrive
+	Label        string // Shown to users
+	AuthURL      string
+	TokenURL     string
+	Scope        string
+	AuthParams   url.Values // Extra parameters of the authorization request
+	Root         string     // ID of the top folder
+	clientID     func(c serverConfig) string
+	clientSecret func(c serverConfig) string // Empty for public clients
+	list         func(ctx context.Context, token, folder string) ([]cloudEntry, error)
+	download     func(ctx context.Context, token string, file cloudEntry) (*http.Request, error)
+}
+
+// cloudProviders are the drives frames can be imported from, by name
+var cloudProviders = map[string]*cloudProvider{
+	"gdrive": {
+		Name:         "gdrive",
+		Label:        "Google Drive",
+		AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:     "https://oauth2.googleapis.com/token",
+		Scope:        "https://www.googleapis.com/auth/drive.readonly",
+		Root:         "root",
+		clientID:     func(c serverConfig) string { return c.GDriveClientID },
+		clientSecret: func(c serverConfig) string { return c.GDriveClientSecret },
+		list:         listGoogleDrive,
+		download:     downloadGoogleDrive,
+	},
+	"dropbox": {
+		Name:         "dropbox",
+		Label:        "Dropbox",
+		AuthURL:      "https://www.dropbox.com/oauth2/authorize",
+		TokenURL:     "https://api.dropboxapi.com/oauth2/token",
+		Scope:        "files.metadata.read files.content.read",
+		AuthParams:   url.Values{"token_access_type": {"online"}},
+		Root:         "",
+		clientID:     func(c serverConfig) string { return c.DropboxAppKey },
+		clientSecret: func(c serverConfig) string { return c.DropboxAppSecret },
+		list:         listDropbox,
+		download:     downloadDropbox,
+	},
+}
+
+// cloudProviderOrder lists the providers in the order the upload form offers them
+var cloudProviderOrder = []string{"gdrive", "dropbox"}
+
+// enabledCloudProvider returns the configured provider called name, or nil
+func enabledCloudProvider(name string) *cloudProvider {
+	p := cloudProviders[name]
+	if p == nil || p.clientID(config) == "" {
+		return nil
+	}
+	return p
+}
+
+// cloudImportEnabled reports whether any cloud drive is configured
+func cloudImportEnabled() bool {
+	for _, name := range cloudProviderOrder {
+		if enabledCloudProvider(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudToken is the access token kept in a signed cookie per provider. It is
+// bound to the account that connected the drive, so a shared browser does not
+// hand it to the next user.
+type cloudToken struct {
+	AccessToken string `json:"access_token"`
+	Owner       string `json:"owner,omitempty"` // See requestOwner
+	Expires     int64  `json:"exp"`
+}
+
+func cloudTokenCookie(p *cloudProvider) string { return "chicha_sr_cloud_" + p.Name }
+
+// cloudTokenFromRequest returns the access token the user granted for p, or ""
+func cloudTokenFromRequest(r *http.Request, p *cloudProvider) string {
+	cookie, err := r.Cookie(cloudTokenCookie(p))
+	if err != nil {
+		return ""
+	}
+	data, ok := verifyCookie("cloud-"+p.Name, cookie.Value)
+	if !ok {
+		return ""
+	}
+	var t cloudToken
+	if json.Unmarshal(data, &t) != nil || time.Now().Unix() > t.Expires || t.Owner != requestOwner(r) {
+		return ""
+	}
+	return t.AccessToken
+}
+
+// cloudSelection is the folder of frames chosen on the upload form
+func cloudSelection(r *http.Request) (provider, folder string) {
+	return r.FormValue("cloud"), r.FormValue("cloud_folder")
+}
+
+// cloudFolderField renders the upload form part for cloud drives: the folder
+// chosen in the picker, passed back in the query string, or links to the picker
+// of each configured drive
+func cloudFolderField(r *http.Request) string {
+	q := r.URL.Query()
+	if p := enabledCloudProvider(q.Get("cloud")); p != nil && q.Has("cloud_folder") {
+		name := q.Get("cloud_name")
+		if name == "" {
+			name = p.Label
+		}
+		return fmt.Sprintf(`<div class="alert alert-info mb-3">%s
+	<input type="hidden" name="cloud" value="%s"><input type="hidden" name="cloud_folder" value="%s">
+	<a href="%s" class="ms-2">%s</a> &middot; <a href="%s">%s</a>
+	</div>`, trf(r, "The images in the %s folder %s are used as frames, with any files chosen above.", p.Label, "<strong>"+html.EscapeString(name)+"</strong>"),
+			p.Name, html.EscapeString(q.Get("cloud_folder")), config.url("/cloud/"+p.Name), tr(r, "Choose another folder"), config.url("/"), tr(r, "Remove"))
+	}
+	var links []string
+	for _, name := range cloudProviderOrder {
+		if p := enabledCloudProvider(name); p != nil {
+			links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, config.url("/cloud/"+p.Name), p.Label))
+		}
+	}
+	if len(links) == 0 {
+		return ""
+	}
+	return `<div class="form-text mb-3">` + tr(r, "Or use a folder of images from") + " " + strings.Join(links, " &middot; ") + `</div>`
+}
+
+// registerCloudRoutes adds the cloud drive folder pickers when any is configured
+func registerCloudRoutes(mux *http.ServeMux) {
+	if !cloudImportEnabled() {
+		return
+	}
+	mux.HandleFunc("GET /cloud/{provider}", requireLogin(cloudFolderPageHandler))
+	mux.HandleFunc("GET /cloud/{provider}/connect", requireLogin(cloudConnectHandler))
+	mux.HandleFunc("GET /cloud/{provider}/callback", requireLogin(cloudCallbackHandler))
+}
+
+// cloudRedirectURL returns the redirect URI to register with the provider
+func cloudRedirectURL(r *http.Request, p *cloudProvider) string {
+	return absoluteURL(r, "/cloud/"+p.Name+"/callback")
+}
+
+// cloudConnectHandler sends the user to the drive to grant read access
+func cloudConnectHandler(w http.ResponseWriter, r *http.Request) {
+	p := enabledCloudProvider(r.PathValue("provider"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	// oidcState fits the same authorization code flow
+	st := oidcState{State: randomToken(), Verifier: randomToken(), RedirectURI: cloudRedirectURL(r, p), Next: config.url("/cloud/" + p.Name)}
+	data, _ := json.Marshal(st)
+	setAppCookie(w, cloudStateCookie, signCookie("cloud-state-"+p.Name, data), 10*time.Minute)
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID(config)},
+		"redirect_uri":          {st.RedirectURI},
+		"scope":                 {p.Scope},
+		"state":                 {st.State},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	for k, v := range p.AuthParams {
+		q[k] = v
+	}
+	http.Redirect(w, r, p.AuthURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// cloudCallbackHandler trades the code for an access token and keeps it in a
+// cookie for as long as the drive says it is valid
+func cloudCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p := enabledCloudProvider(r.PathValue("provider"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	fail := func(status int, message string, err error) {
+		slog.WarnContext(r.Context(), "Cloud drive connection failed", "provider", p.Name, "reason", message, "error", err)
+		writePlainError(w, &requestError{Status: status, Code: "cloud_connect_failed", Message: message})
+	}
+
+	var st oidcState
+	cookie, err := r.Cookie(cloudStateCookie)
+	if err != nil {
+		fail(http.StatusBadRequest, "The connection has expired, please try again.", err)
+		return
+	}
+	data, ok := verifyCookie("cloud-state-"+p.Name, cookie.Value)
+	if !ok || json.Unmarshal(data, &st) != nil || st.State == "" || r.URL.Query().Get("state") != st.State {
+		fail(http.StatusBadRequest, "The connection state does not match, please try again.", nil)
+		return
+	}
+	setAppCookie(w, cloudStateCookie, "", -time.Second)
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail(http.StatusForbidden, p.Label+" refused access: "+e, nil)
+		return
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {st.RedirectURI},
+		"code_verifier": {st.Verifier},
+		"client_id":     {p.clientID(config)},
+	}
+	if secret := p.clientSecret(config); secret != "" {
+		form.Set("client_secret", secret)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		fail(http.StatusInternalServerError, "Could not connect to "+p.Label+".", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := doJSON(req, &token); err != nil || token.AccessToken == "" {
+		fail(http.StatusBadGateway, "Could not complete the connection to "+p.Label+".", err)
+		return
+	}
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if lifetime <= 0 || lifetime > sessionLifetime {
+		lifetime = time.Hour
+	}
+	value, _ := json.Marshal(cloudToken{AccessToken: token.AccessToken, Owner: requestOwner(r), Expires: time.Now().Add(lifetime).Unix()})
+	setAppCookie(w, cloudTokenCookie(p), signCookie("cloud-"+p.Name, value), lifetime)
+	slog.InfoContext(r.Context(), "Cloud drive connected", "provider", p.Name, "owner", requestOwner(r))
+	http.Redirect(w, r, st.Next, http.StatusFound)
+}
+
+// cloudFolderPageHandler lists a folder of the drive: its subfolders to open and
+// a button using its images as frames on the upload form
+func cloudFolderPageHandler(w http.ResponseWriter, r *http.Request) {
+	p := enabledCloudProvider(r.PathValue("provider"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	token := cloudTokenFromRequest(r, p)
+	if token == "" {
+		http.Redirect(w, r, config.url("/cloud/"+p.Name+"/connect"), http.StatusFound)
+		return
+	}
+	folder, name := p.Root, p.Label
+	if r.URL.Query().Has("folder") {
+		folder, name = r.URL.Query().Get("folder"), r.URL.Query().Get("name")
+	}
+	entries, err := p.list(r.Context(), token, folder)
+	if errors.Is(err, errCloudExpired) {
+		http.Redirect(w, r, config.url("/cloud/"+p.Name+"/connect"), http.StatusFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing cloud folder", "provider", p.Name, "error", err)
+		writePlainError(w, &requestError{Status: http.StatusBadGateway, Code: "cloud_failed", Message: "Could not list the folder in " + p.Label + "."})
+		return
+	}
+
+	var list strings.Builder
+	images := 0
+	for _, e := range entries {
+		if !e.Folder {
+			images++
+			continue
+		}
+		q := url.Values{"folder": {e.ID}, "name": {e.Name}}
+		fmt.Fprintf(&list, `<li class="list-group-item"><a href="%s">&#128193; %s</a></li>`, html.EscapeString(config.url("/cloud/"+p.Name)+"?"+q.Encode()), html.EscapeString(e.Name))
+	}
+	if list.Len() == 0 {
+		list.WriteString(`<li class="list-group-item text-muted">` + tr(r, "No subfolders") + `</li>`)
+	}
+	use := `<p class="text-muted">` + tr(r, "No JPEG, PNG, GIF or TIFF images in this folder.") + `</p>`
+	if images > 0 {
+		q := url.Values{"cloud": {p.Name}, "cloud_folder": {folder}, "cloud_name": {name}}
+		use = fmt.Sprintf(`<a href="%s" class="btn btn-success">%s</a>`, html.EscapeString(config.url("/")+"?"+q.Encode()), trf(r, "Use the %d images in this folder", images))
+	}
+
+	const cloudFolderPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>%s</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">%s</h1>
+	%s
+	<div class="bg-body p-4 rounded shadow">
+	<h2 class="h5 mb-3">%s</h2>
+	<p><a href="%s">{{Back to the top folder}}</a></p>
+	<ul class="list-group mb-3">%s</ul>
+	%s
+	</div>
+	</div>
+	%s
+	</body>
+	</html>
+	`
+	title := trf(r, "Frames from %s", p.Label)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, localize(r, cloudFolderPageHTML), requestLocale(r), html.EscapeString(title), pageHead(r), brandLogo(), html.EscapeString(title), navBar(r),
+		html.EscapeString(name), config.url("/cloud/"+p.Name), list.String(), use, pageFooter(r))
+}
+
+// cloudFolder is the folder of frames a request chose, listed with the token of
+// the user who chose it
+type cloudFolder struct {
+	provider *cloudProvider
+	token    string
+	files    []cloudEntry // Images in the folder, by name
+}
+
+// cloudFolderFiles lists the images of the folder chosen on the upload form, or
+// returns an empty cloudFolder when none was
+func cloudFolderFiles(r *http.Request) (cloudFolder, *requestError) {
+	name, folder := cloudSelection(r)
+	if name == "" {
+		return cloudFolder{}, nil
+	}
+	p := enabledCloudProvider(name)
+	if p == nil {
+		return cloudFolder{}, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter cloud names no cloud drive this server can import from: %q", name)}
+	}
+	token := cloudTokenFromRequest(r, p)
+	if token == "" {
+		return cloudFolder{}, &requestError{Status: http.StatusUnauthorized, Code: "cloud_not_connected", Message: fmt.Sprintf("The connection to %s has expired. Please choose the folder again.", p.Label)}
+	}
+	entries, err := p.list(r.Context(), token, folder)
+	if errors.Is(err, errCloudExpired) {
+		return cloudFolder{}, &requestError{Status: http.StatusUnauthorized, Code: "cloud_not_connected", Message: fmt.Sprintf("The connection to %s has expired. Please choose the folder again.", p.Label)}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing cloud folder", "provider", p.Name, "error", err)
+		return cloudFolder{}, &requestError{Status: http.StatusBadGateway, Code: "cloud_failed", Message: "Could not list the folder in " + p.Label + "."}
+	}
+	cf := cloudFolder{provider: p, token: token}
+	for _, e := range entries {
+		if !e.Folder {
+			cf.files = append(cf.files, e)
+		}
+	}
+	return cf, nil
+}
+
+// fetch downloads one image of the folder within budget, see downloadFrame
+func (cf cloudFolder) fetch(ctx context.Context, file cloudEntry, budget int64) ([]byte, *requestError) {
+	req, err := cf.provider.download(ctx, cf.token, file)
+	if err != nil {
+		return nil, &requestError{Status: http.StatusInternalServerError, Code: "fetch_failed", Message: fmt.Sprintf("Error fetching %s from %s", file.Name, cf.provider.Label)}
+	}
+	return downloadFrame(req, cf.provider.Label+": "+file.Name, budget)
+}
+
+// cloudJSON performs an API request of a drive and decodes its JSON answer
+func cloudJSON(req *http.Request, v any) error {
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errCloudExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// listGoogleDrive lists the subfolders and images of a Google Drive folder
+func listGoogleDrive(ctx context.Context, token, folder string) ([]cloudEntry, error) {
+	var entries []cloudEntry
+	pageToken := ""
+	for len(entries) < maxCloudEntries {
+		q := url.Values{
+			"q":        {fmt.Sprintf("'%s' in parents and trashed = false", strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(folder))},
+			"fields":   {"nextPageToken,files(id,name,mimeType)"},
+			"orderBy":  {"folder,name"},
+			"pageSize": {"1000"},
+		}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.googleapis.com/drive/v3/files?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var page struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				ID       string `json:"id"`
+				Name     string `json:"name"`
+				MimeType string `json:"mimeType"`
+			} `json:"files"`
+		}
+		if err := cloudJSON(req, &page); err != nil {
+			return nil, err
+		}
+		for _, f := range page.Files {
+			folder := f.MimeType == "application/vnd.google-apps.folder"
+			if folder || imageFileName(f.Name) {
+				entries = append(entries, cloudEntry{ID: f.ID, Name: f.Name, Folder: folder})
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	return entries, nil
+}
+
+func downloadGoogleDrive(ctx context.Context, token string, file cloudEntry) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.googleapis.com/drive/v3/files/"+url.PathEscape(file.ID)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+// listDropbox lists the subfolders and images of a Dropbox folder, folders first
+// and by name as the Google Drive listing comes
+func listDropbox(ctx context.Context, token, folder string) ([]cloudEntry, error) {
+	var entries []cloudEntry
+	endpoint := "https://api.dropboxapi.com/2/files/list_folder"
+	body, _ := json.Marshal(map[string]any{"path": folder, "limit": 2000})
+	for len(entries) < maxCloudEntries {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		var page struct {
+			Entries []struct {
+				Tag  string `json:".tag"`
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"entries"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		if err := cloudJSON(req, &page); err != nil {
+			return nil, err
+		}
+		for _, e := range page.Entries {
+			folder := e.Tag == "folder"
+			if folder || (e.Tag == "file" && imageFileName(e.Name)) {
+				entries = append(entries, cloudEntry{ID: e.ID, Name: e.Name, Folder: folder})
+			}
+		}
+		if !page.HasMore {
+			break
+		}
+		endpoint = "https://api.dropboxapi.com/2/files/list_folder/continue"
+		body, _ = json.Marshal(map[string]string{"cursor": page.Cursor})
+	}
+	slices.SortFunc(entries, func(a, b cloudEntry) int {
+		if a.Folder != b.Folder {
+			if a.Folder {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	return entries, nil
+}
+
+func downloadDropbox(ctx context.Context, token string, file cloudEntry) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://content.dropboxapi.com/2/files/download", nil)
+	if err != nil {
+		return nil, err
+	}
+	arg, _ := json.Marshal(map[string]string{"path": file.ID}) // IDs are ASCII, as the header must be
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+	return req, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/image/draw"
+)
+
+// A coordinator started with -cluster-workers hands the alignment of a job's
+// frames and the fusion of bands of its rows to other instances of the server
+// started with the same -cluster-secret, and merges their partial accumulations.
+// Work a worker fails to do is done locally, so a job never fails because of one.
+// The work travels as multipart HTTP requests rather than gRPC, through the same
+// listener, proxies and TLS as the rest of the server, without generated code.
+
+// clusterClient sends work to the cluster workers. Requests carry every frame
+// of a job, so there is no overall timeout; they end with the job's context.
+var clusterClient = &http.Client{}
+
+// clusterWorkers returns the base URLs of the configured workers, nil when the
+// job is processed on this machine alone
+func clusterWorkers() []string {
+	var workers []string
+	for _, w := range strings.Split(config.ClusterWorkers, ",") {
+		if w = strings.TrimRight(strings.TrimSpace(w), "/"); w != "" {
+			workers = append(workers, w)
+		}
+	}
+	return workers
+}
+
+// registerClusterRoutes serves the work of a coordinator when -cluster-secret is set
+func registerClusterRoutes(mux *http.ServeMux) {
+	if config.ClusterSecret == "" {
+		return
+	}
+	mux.HandleFunc("POST /cluster/align", requireClusterSecret(clusterAlignHandler))
+	mux.HandleFunc("POST /cluster/fuse", requireClusterSecret(clusterFuseHandler))
+}
+
+// requireClusterSecret admits requests presenting -cluster-secret as a bearer token
+func requireClusterSecret(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(config.ClusterSecret)) != 1 {
+			writeAPIErrorV1(w, &requestError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "The cluster secret is required in the Authorization: Bearer header"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clusterAlignShifts finds the shift of every frame but the reference, images[0],
+// on the workers, each measuring its share of the frames against the reference.
+// Frames with an entry in offsets are skipped. The result has an entry for every
+// frame a worker measured; the others are left to the caller.
+func clusterAlignShifts(ctx context.Context, workers []string, images []image.Image, offsets []*frameOffset) map[int]image.Point {
+	batches := make([][]int, len(workers))
+	next := 0
+	for i := 1; i < len(images); i++ {
+		if i < len(offsets) && offsets[i] != nil {
+			continue
+		}
+		batches[next%len(workers)] = append(batches[next%len(workers)], i)
+		next++
+	}
+
+	var mu sync.Mutex
+	shifts := make(map[int]image.Point)
+	var wg sync.WaitGroup
+	for w, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frames := []image.Image{images[0]}
+			for _, i := range batch {
+				frames = append(frames, images[i])
+			}
+			var result struct {
+				Shifts []image.Point `json:"shifts"`
+			}
+			err := postClusterWork(ctx, workers[w], "/cluster/align", nil, frames, func(body io.Reader) error {
+				return json.NewDecoder(body).Decode(&result)
+			})
+			if err == nil && len(result.Shifts) != len(batch) {
+				err = fmt.Errorf("%d shifts returned for %d frames", len(result.Shifts), len(batch))
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "Cluster worker failed to align frames, aligning them locally", "worker", workers[w], "frames", len(batch), "error", err)
+				return
+			}
+			mu.Lock()
+			for k, i := range batch {
+				shifts[i] = result.Shifts[k]
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return shifts
+}
+
+// clusterFuse accumulates the aligned frames upscaled to width x height on the
+// workers, each summing one band of rows, and merges the bands into one accumulator
+func clusterFuse(ctx context.Context, workers []string, aligned []image.Image, upscaleFactor int, kernel draw.Interpolator, width, height int) (*fusionAccumulator, error) {
+	acc := &fusionAccumulator{
+		width:   width,
+		height:  height,
+		accR:    make([][]float64, height),
+		accG:    make([][]float64, height),
+		accB:    make([][]float64, height),
+		weights: make([][]float64, height),
+	}
+	metrics.accumulatorBytes.Add(acc.bytes())
+	jobs.recordMemory(jobIDFromContext(ctx), acc.bytes())
+
+	bandHeight := (height + len(workers) - 1) / len(workers)
+	bands := (height + bandHeight - 1) / bandHeight
+	var fused atomic.Int32
+	reportProgress(ctx, "fuse", 0, bands)
+	params := map[string]string{"scale": strconv.Itoa(upscaleFactor), "kernel": kernelName(kernel), "width": strconv.Itoa(width)}
+	var wg sync.WaitGroup
+	for b := range bands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			y0, y1 := b*bandHeight, min((b+1)*bandHeight, height)
+			band := &fusionAccumulator{width: width, height: y1 - y0}
+			bandParams := map[string]string{"y0": strconv.Itoa(y0), "y1": strconv.Itoa(y1)}
+			for k, v := range params {
+				bandParams[k] = v
+			}
+			err := postClusterWork(ctx, workers[b], "/cluster/fuse", bandParams, aligned, band.readPlanes)
+			if err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "Cluster worker failed to fuse rows, fusing them locally", "worker", workers[b], "from_row", y0, "to_row", y1, "error", err)
+				band = accumulateRows(ctx, aligned, upscaleFactor, kernel, width, height, y0, y1)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// The bands do not overlap, so their rows are taken over as they are
+			copy(acc.accR[y0:y1], band.accR)
+			copy(acc.accG[y0:y1], band.accG)
+			copy(acc.accB[y0:y1], band.accB)
+			copy(acc.weights[y0:y1], band.weights)
+			reportProgress(ctx, "fuse", int(fused.Add(1)), bands)
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		acc.release()
+		return nil, err
+	}
+	return acc, nil
+}
+
+// accumulateRows sums the rows [y0, y1) of the frames upscaled with kernel to
+// width x height; the rows of the returned accumulator start at y0
+func accumulateRows(ctx context.Context, frames []image.Image, upscaleFactor int, kernel draw.Interpolator, width, height, y0, y1 int) *fusionAccumulator {
+	band := &fusionAccumulator{
+		width:   width,
+		height:  y1 - y0,
+		accR:    make([][]float64, y1-y0),
+		accG:    make([][]float64, y1-y0),
+		accB:    make([][]float64, y1-y0),
+		weights: make([][]float64, y1-y0),
+	}
+	for y := range band.accR {
+		band.accR[y] = make([]float64, width)
+		band.accG[y] = make([]float64, width)
+		band.accB[y] = make([]float64, width)
+		band.weights[y] = make([]float64, width)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for _, img := range frames {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			// Scaling onto the full output rectangle clipped to the band gives the
+			// same pixels as scaling the whole frame and cutting the band out
+			strip := image.NewRGBA(image.Rect(0, y0, width, y1))
+			kernel.Scale(strip, image.Rect(0, 0, width, height), img, img.Bounds(), draw.Over, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			for y := y0; y < y1; y++ {
+				for x := 0; x < width; x++ {
+					c := strip.RGBAAt(x, y)
+					band.accR[y-y0][x] += float64(c.R)
+					band.accG[y-y0][x] += float64(c.G)
+					band.accB[y-y0][x] += float64(c.B)
+					band.weights[y-y0][x]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return band
+}
+
+// kernelName returns the name of an interpolation kernel, the default for unknown ones
+func kernelName(kernel draw.Interpolator) string {
+	for name, k := range interpolationKernels {
+		if k == kernel {
+			return name
+		}
+	}
+	return defaultKernel
+}
+
+// postClusterWork sends params and frames, as lossless PNG parts in order, to a
+// worker and hands a successful response body to decode
+func postClusterWork(ctx context.Context, worker, path string, params map[string]string, frames []image.Image, decode func(io.Reader) error) error {
+	body, mw := io.Pipe()
+	form := multipart.NewWriter(mw)
+	go func() {
+		for k, v := range params {
+			if err := form.WriteField(k, v); err != nil {
+				mw.CloseWithError(err)
+				return
+			}
+		}
+		encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+		for i, frame := range frames {
+			part, err := form.CreateFormFile("frame", fmt.Sprintf("frame-%03d.png", i))
+			if err == nil {
+				err = encoder.Encode(part, frame)
+			}
+			if err != nil {
+				mw.CloseWithError(err)
+				return
+			}
+		}
+		mw.CloseWithError(form.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, worker+path, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+config.ClusterSecret)
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return decode(resp.Body)
+}
+
+// readClusterWork reads the fields and frames sent by postClusterWork. The
+// secret admits only the coordinator, but a worker still holds it to the
+// limits of -max-upload-mb, -max-frames and -max-megapixels, as any upload.
+func readClusterWork(w http.ResponseWriter, r *http.Request) (map[string]string, []image.Image, *requestError) {
+	if reqErr := limitUploadSize(w, r); reqErr != nil {
+		return nil, nil, reqErr
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	mr, err := r.MultipartReader()
+	if mediaType != "multipart/form-data" || err != nil {
+		return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_request", Message: "Expected a multipart/form-data body"}
+	}
+	readErr := func(err error) *requestError {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return uploadTooLarge()
+		}
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_request", Message: "Reading the request: " + err.Error()}
+	}
+	maxFrames := liveConfig().MaxFrames
+	params := make(map[string]string)
+	var frames []image.Image
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, readErr(err)
+		}
+		if part.FileName() == "" {
+			value, _ := io.ReadAll(io.LimitReader(part, 64))
+			params[part.FormName()] = string(value)
+			continue
+		}
+		if maxFrames > 0 && len(frames) >= maxFrames {
+			return nil, nil, &requestError{Status: http.StatusRequestEntityTooLarge, Code: "too_many_frames", Message: fmt.Sprintf("More than %d frames were sent", maxFrames)}
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, readErr(err)
+		}
+		name := fmt.Sprintf("frame %d", len(frames))
+		if _, reqErr := sniffImage(name, bytes.NewReader(data)); reqErr != nil {
+			return nil, nil, reqErr
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_image", Message: fmt.Sprintf("Decoding %s: %v", name, err)}
+		}
+		frames = append(frames, img)
+	}
+	if len(frames) == 0 {
+		return nil, nil, &requestError{Status: http.StatusBadRequest, Code: "no_images", Message: "No frames were sent"}
+	}
+	return params, frames, nil
+}
+
+// clusterAlignHandler measures the shift of every frame sent against the first
+func clusterAlignHandler(w http.ResponseWriter, r *http.Request) {
+	_, frames, reqErr := readClusterWork(w, r)
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	slog.InfoContext(r.Context(), "Aligning frames for the coordinator", "frames", len(frames)-1)
+	shifts := make([]image.Point, len(frames)-1)
+	var wg sync.WaitGroup
+	for i := range shifts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shifts[i].X, shifts[i].Y = findOverlap(r.Context(), frames[0], frames[i+1])
+		}()
+	}
+	wg.Wait()
+	if r.Context().Err() != nil {
+		return // The coordinator gave up
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"shifts": shifts})
+}
+
+// clusterFuseHandler sums one band of rows of the aligned frames sent, upscaled,
+// and returns the partial accumulation
+func clusterFuseHandler(w http.ResponseWriter, r *http.Request) {
+	params, frames, reqErr := readClusterWork(w, r)
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	scale, _ := strconv.Atoi(params["scale"])
+	width, _ := strconv.Atoi(params["width"])
+	y0, _ := strconv.Atoi(params["y0"])
+	y1, _ := strconv.Atoi(params["y1"])
+	kernel, ok := interpolationKernels[params["kernel"]]
+	src := frames[0].Bounds()
+	height := src.Dy() * scale
+	if !ok || scale < 1 || scale > maxUpscaleFactor || width != src.Dx()*scale || y0 < 0 || y0 >= y1 || y1 > height {
+		writeAPIErrorV1(w, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "Invalid scale, kernel, width or rows"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Fusing rows for the coordinator", "frames", len(frames), "from_row", y0, "to_row", y1)
+	band := accumulateRows(r.Context(), frames, scale, kernel, width, height, y0, y1)
+	if r.Context().Err() != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := band.writePlanes(w); err != nil {
+		slog.WarnContext(r.Context(), "Error sending fused rows", "error", err)
+	}
+}
+
+// writePlanes sends the accumulation as the R, G, B and weight sums of every
+// row in turn, little-endian float64s
+func (acc *fusionAccumulator) writePlanes(w io.Writer) error {
+	row := make([]byte, 8*acc.width)
+	for y := range acc.height {
+		for _, plane := range [][][]float64{acc.accR, acc.accG, acc.accB, acc.weights} {
+			for x, v := range plane[y] {
+				binary.LittleEndian.PutUint64(row[8*x:], math.Float64bits(v))
+			}
+			if _, err := w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readPlanes fills the accumulation, whose size is set, from what writePlanes sent
+func (acc *fusionAccumulator) readPlanes(r io.Reader) error {
+	acc.accR = make([][]float64, acc.height)
+	acc.accG = make([][]float64, acc.height)
+	acc.accB = make([][]float64, acc.height)
+	acc.weights = make([][]float64, acc.height)
+	row := make([]byte, 8*acc.width)
+	for y := range acc.height {
+		for _, plane := range [][][]float64{acc.accR, acc.accG, acc.accB, acc.weights} {
+			if _, err := io.ReadFull(r, row); err != nil {
+				return fmt.Errorf("reading row %d: %w", y, err)
+			}
+			plane[y] = make([]float64, acc.width)
+			for x := range plane[y] {
+				plane[y][x] = math.Float64frombits(binary.LittleEndian.Uint64(row[8*x:]))
+			}
+		}
+	}
+	return nil
+}
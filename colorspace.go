@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+)
+
+// Frames carry no colour space the pipeline looks at: their values are fused
+// and written out as they are, which a viewer takes for sRGB. Frames from
+// cameras and phones set to Display P3 or Adobe RGB come out dull that way.
+// The input_space option says what the frames are in, the output_space option
+// converts the result to another space, and either tags it with an ICC
+// profile, so viewers show its colours as meant. The working_space option
+// fuses the frames in linear light, where averaging mixes light as it mixes,
+// instead of on their encoded levels, which darkens edges between bright and
+// dark; the primaries need no conversion for fusing, since a linear average
+// does not depend on them.
+
+// Colour spaces of the input_space, output_space and working_space parameters
+const (
+	spaceSRGB      = "srgb"
+	spaceDisplayP3 = "display-p3"
+	spaceAdobeRGB  = "adobe-rgb"
+	spaceLinear    = "linear" // sRGB primaries with no transfer curve
+)
+
+// colorSpace is an RGB colour space with a D65 white point
+type colorSpace struct {
+	name      string        // Name in the profile
+	primaries [3][2]float64 // CIE xy chromaticities of red, green and blue
+	gamma     float64       // Exponent of the transfer curve, 0 for the sRGB curve
+}
+
+// colorSpaces are the spaces of the parameters by name
+var colorSpaces = map[string]colorSpace{
+	spaceSRGB:      {"sRGB", [3][2]float64{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}}, 0},
+	spaceDisplayP3: {"Display P3", [3][2]float64{{0.680, 0.320}, {0.265, 0.690}, {0.150, 0.060}}, 0},
+	spaceAdobeRGB:  {"Adobe RGB (1998)", [3][2]float64{{0.64, 0.33}, {0.21, 0.71}, {0.15, 0.06}}, 563.0 / 256},
+	spaceLinear:    {"Linear sRGB", [3][2]float64{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}}, 1},
+}
+
+// inputSpaces are the accepted values of input_space besides "", sRGB;
+// outputSpaces those of output_space besides "", the input space
+var (
+	inputSpaces  = []string{spaceSRGB, spaceDisplayP3, spaceAdobeRGB}
+	outputSpaces = []string{spaceSRGB, spaceDisplayP3, spaceAdobeRGB, spaceLinear}
+)
+
+// White points: D65, which the spaces share, and D50, the ICC connection space's
+var (
+	whiteD65 = [3]float64{0.95047, 1, 1.08883}
+	whiteD50 = [3]float64{0.96422, 1, 0.82521}
+)
+
+// decode turns an encoded level, 0-1, into linear light
+func (s colorSpace) decode(v float64) float64 {
+	if s.gamma != 0 {
+		return math.Pow(v, s.gamma)
+	}
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// encode turns linear light, 0-1, into an encoded level
+func (s colorSpace) encode(v float64) float64 {
+	v = math.Min(math.Max(v, 0), 1)
+	if s.gamma != 0 {
+		return math.Pow(v, 1/s.gamma)
+	}
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// linearLevels returns the linear light of every 8-bit level of s, 0-255
+func (s colorSpace) linearLevels() *[256]float64 {
+	var levels [256]float64
+	for v := range levels {
+		levels[v] = 255 * s.decode(float64(v)/255)
+	}
+	return &levels
+}
+
+// toXYZ returns the matrix taking linear RGB of s to CIE XYZ relative to white
+func (s colorSpace) toXYZ(white [3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for c, p := range s.primaries {
+		x, y := p[0], p[1]
+		m[0][c], m[1][c], m[2][c] = x/y, 1, (1-x-y)/y
+	}
+	scale := applyMatrix(invertMatrix(m), white)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] *= scale[c]
+		}
+	}
+	return m
+}
+
+// bradford returns the matrix adapting XYZ under white point from to white point to
+func bradford(from, to [3]float64) [3][3]float64 {
+	cone := [3][3]float64{{0.8951, 0.2664, -0.1614}, {-0.7502, 1.7135, 0.0367}, {0.0389, -0.0685, 1.0296}}
+	f, t := applyMatrix(cone, from), applyMatrix(cone, to)
+	var gain [3][3]float64
+	for i := range gain {
+		gain[i][i] = t[i] / f[i]
+	}
+	return multiplyMatrices(invertMatrix(cone), multiplyMatrices(gain, cone))
+}
+
+func applyMatrix(m [3][3]float64, v [3]float64) [3]float64 {
+	return [3]float64{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func multiplyMatrices(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = a[r][0]*b[0][c] + a[r][1]*b[1][c] + a[r][2]*b[2][c]
+		}
+	}
+	return m
+}
+
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) - m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) + m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	for r := range inv {
+		for c := range inv[r] {
+			// The cofactor of m[c][r]
+			r0, r1, c0, c1 := (c+1)%3, (c+2)%3, (r+1)%3, (r+2)%3
+			inv[r][c] = (m[r0][c0]*m[r1][c1] - m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inv
+}
+
+// convertSpace converts img, in place, from colour space from to colour space
+// to: through linear light and XYZ, the colours outside to clipped
+func convertSpace(img *image.RGBA, from, to colorSpace) {
+	m := multiplyMatrices(invertMatrix(to.toXYZ(whiteD65)), from.toXYZ(whiteD65))
+	linear := from.linearLevels()
+	const steps = 4096 // Levels of linear light the encoding is looked up at
+	var encoded [steps + 1]uint8
+	for i := range encoded {
+		encoded[i] = uint8(math.Round(255 * to.encode(float64(i)/steps)))
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			out := applyMatrix(m, [3]float64{linear[p[0]] / 255, linear[p[1]] / 255, linear[p[2]] / 255})
+			for c, v := range out {
+				p[c] = encoded[int(math.Round(math.Min(math.Max(v, 0), 1)*steps))]
+			}
+		}
+	}
+}
+
+// iccProfile returns an ICC version 2 display profile of s: its primaries
+// adapted to D50 and its transfer curve, as a table for the sRGB curve
+func (s colorSpace) iccProfile() []byte {
+	be := binary.BigEndian
+	s15 := func(b []byte, v float64) []byte { return be.AppendUint32(b, uint32(int32(math.Round(v*65536)))) }
+	xyz := func(v [3]float64) []byte {
+		b := []byte("XYZ \x00\x00\x00\x00")
+		for _, c := range v {
+			b = s15(b, c)
+		}
+		return b
+	}
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = be.AppendUint32(desc, uint32(len(s.name)+1))
+	desc = append(append(desc, s.name...), 0)
+	desc = append(desc, make([]byte, 4+4+2+1+67)...) // No Unicode or ScriptCode description
+	curve := []byte("curv\x00\x00\x00\x00")
+	switch s.gamma {
+	case 0:
+		const points = 1024
+		curve = be.AppendUint32(curve, points)
+		for i := range points {
+			curve = be.AppendUint16(curve, uint16(math.Round(65535*s.decode(float64(i)/(points-1)))))
+		}
+	case 1:
+		curve = be.AppendUint32(curve, 0) // Identity
+	default:
+		curve = be.AppendUint32(curve, 1)
+		curve = be.AppendUint16(curve, uint16(math.Round(s.gamma*256)))
+	}
+	m := multiplyMatrices(bradford(whiteD65, whiteD50), s.toXYZ(whiteD65))
+	tags := []struct {
+		signature string
+		data      []byte
+	}{
+		{"desc", desc},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", xyz(whiteD50)},
+		{"rXYZ", xyz([3]float64{m[0][0], m[1][0], m[2][0]})},
+		{"gXYZ", xyz([3]float64{m[0][1], m[1][1], m[2][1]})},
+		{"bXYZ", xyz([3]float64{m[0][2], m[1][2], m[2][2]})},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	// The tag table, then the data of the tags on 4-byte boundaries, the three
+	// curves sharing theirs
+	table := be.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := func() int { return 128 + 4 + 12*len(tags) + len(data) }
+	var curveOffset int
+	for _, t := range tags {
+		at := offset()
+		if t.signature[1:] == "TRC" && curveOffset != 0 {
+			at = curveOffset
+		} else {
+			if t.signature[1:] == "TRC" {
+				curveOffset = at
+			}
+			data = append(data, t.data...)
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		table = append(table, t.signature...)
+		table = be.AppendUint32(table, uint32(at))
+		table = be.AppendUint32(table, uint32(len(t.data)))
+	}
+
+	header := make([]byte, 128)
+	be.PutUint32(header[0:], uint32(128+len(table)+len(data)))
+	be.PutUint32(header[8:], 0x02100000) // Version 2.1
+	copy(header[12:], "mntrRGB XYZ ")
+	for i, v := range []uint16{2024, 1, 1} { // Creation date, fixed so the profile is the same every time
+		be.PutUint16(header[24+2*i:], v)
+	}
+	copy(header[36:], "acsp")
+	for i, c := range whiteD50 { // Illuminant of the connection space
+		be.PutUint32(header[68+4*i:], uint32(int32(math.Round(c*65536))))
+	}
+	return append(append(header, table...), data...)
+}
+
+// writeProfiled writes what encode writes in format png or jpeg with the ICC
+// profile embedded: in an iCCP chunk after the header of a PNG file, in an APP2
+// segment after the start of a JPEG one. A nil profile writes it as it is.
+func writeProfiled(w io.Writer, format string, profile []byte, encode func(io.Writer) error) error {
+	if profile == nil {
+		return encode(w)
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return err
+	}
+	encoded := buf.Bytes()
+	var inserted []byte
+	at := 2 // After the SOI marker of JPEG
+	if format == formatPNG {
+		at = 8 + 8 + 13 + 4 // After the signature and the IHDR chunk
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(profile)
+		zw.Close()
+		chunk := append([]byte("iCCPICC profile\x00\x00"), compressed.Bytes()...)
+		inserted = binary.BigEndian.AppendUint32(nil, uint32(len(chunk)-4))
+		inserted = append(inserted, chunk...)
+		inserted = binary.BigEndian.AppendUint32(inserted, crc32.ChecksumIEEE(chunk))
+	} else {
+		inserted = []byte{0xff, 0xe2}
+		inserted = binary.BigEndian.AppendUint16(inserted, uint16(2+14+len(profile)))
+		inserted = append(inserted, "ICC_PROFILE\x00\x01\x01"...) // The first of one segment
+		inserted = append(inserted, profile...)
+	}
+	for _, part := range [][]byte{encoded[:at], inserted, encoded[at:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inputSpace returns the colour space of the frames, sRGB unless input_space
+// says otherwise
+func (opts processOptions) inputSpace() colorSpace {
+	if opts.InputSpace == "" {
+		return colorSpaces[spaceSRGB]
+	}
+	return colorSpaces[opts.InputSpace]
+}
+
+// linearRows renders the rows [y0, y1) of an accumulation of linear light into
+// an RGBA strip positioned at (0, 0), encoded again with the curve of acc.linear
+func (acc *fusionAccumulator) linearRows(y0, y1 int) *image.RGBA {
+	strip := image.NewRGBA(image.Rect(0, 0, acc.width, y1-y0))
+	for y := y0; y < y1; y++ {
+		for x := 0; x < acc.width; x++ {
+			p := strip.Pix[strip.PixOffset(x, y-y0):]
+			p[3] = 255
+			w := acc.weights[y][x]
+			if w <= 0 {
+				p[0], p[1], p[2] = 255, 255, 255
+				continue
+			}
+			for c, sum := range [3]float64{acc.accR[y][x], acc.accG[y][x], acc.accB[y][x]} {
+				p[c] = uint8(math.Round(255 * acc.linear.encode(sum/w/255)))
+			}
+		}
+	}
+	return strip
+}
+
+// outputSpace returns the colour space the result is written in: output_space,
+// or input_space when it is left out, and whether either was given
+func (opts processOptions) outputSpace() (colorSpace, bool) {
+	name := opts.OutputSpace
+	if name == "" {
+		name = opts.InputSpace
+	}
+	if name == "" {
+		return colorSpaces[spaceSRGB], false
+	}
+	return colorSpaces[name], true
+}
+
+// outputProfile returns the ICC profile the result is tagged with, or nil when
+// no colour space was asked for
+func (opts processOptions) outputProfile() []byte {
+	if space, ok := opts.outputSpace(); ok {
+		return space.iccProfile()
+	}
+	return nil
+}
+
+// convertResult converts a rendered result from input_space to output_space,
+// when they differ
+func convertResult(img *image.RGBA, opts processOptions) {
+	if opts.OutputSpace == "" || opts.OutputSpace == opts.InputSpace || (opts.InputSpace == "" && opts.OutputSpace == spaceSRGB) {
+		return
+	}
+	convertSpace(img, opts.inputSpace(), colorSpaces[opts.OutputSpace])
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverConfig holds the settings that control how the HTTP server is exposed
+type serverConfig struct {
+	ConfigFile string // File the settings below are loaded from before flags are applied
+
+	Listen   string // Interface address to bind, empty for all interfaces
+	Port     int    // TCP port to listen on
+	BasePath string // URL prefix when served behind a reverse proxy under a subpath, e.g. "/sr"
+
+	TLSCert       string // PEM certificate file for native TLS
+	TLSKey        string // PEM private key file for native TLS
+	AutocertHosts string // Comma-separated hostnames to obtain Let's Encrypt certificates for
+	AutocertCache string // Directory where ACME certificates and account keys are cached
+	AutocertEmail string // Contact address registered with the ACME account
+	AutocertHTTP  string // Address answering HTTP-01 challenges and redirecting to HTTPS, empty to disable
+
+	ShutdownTimeout time.Duration // How long a graceful shutdown waits for running jobs
+	JobStore        string        // JSON file job records are persisted to, empty for memory only
+
+	Workers     int    // Jobs processed concurrently
+	QueueSize   int    // Jobs allowed to wait for a worker before new ones are refused
+	QueueRedis  string // Redis URL of a job queue shared by every instance, empty for a queue of this instance alone
+	TempDir     string // Directory for per-request upload files, empty for the system default
+	InMemory    bool   // Process every upload in memory without writing frames or results to disk
+	MinFreeDisk int64  // Free megabytes required in the working directories for /readyz to pass
+
+	DiskBudgetMB int64 // Megabytes of upload copies and stored results allowed in total, 0 for unlimited
+
+	UploadDir    string        // Directory keeping resumable uploads, empty for a folder in the temp directory
+	UploadExpiry time.Duration // How long an idle resumable upload is kept
+
+	FetchSchemes  string        // Comma-separated URL schemes frames may be fetched from, empty to disable fetching
+	FetchTimeout  time.Duration // How long fetching one frame may take
+	FetchPrivate  bool          // Allow fetching from loopback and private network addresses, and callbacks and deliveries to them
+	WebhookSecret string        // Key completion callbacks are signed with, empty to refuse callback_url
+
+	DeliverSchemes string // Comma-separated schemes of deliver_to URLs results may be uploaded to, empty to disable delivery
+	SFTPKey        string // Private key file SFTP deliveries authenticate with, besides passwords in the URL
+	SFTPKnownHosts string // known_hosts file SFTP servers are checked against, empty for ~/.ssh/known_hosts
+
+	SMTPAddr     string // Mail server host:port completion e-mails are sent through, empty to send none
+	SMTPUser     string // Login for the mail server, empty to send without authentication
+	SMTPPassword string
+	SMTPFrom     string        // Sender address of completion e-mails
+	NotifyAfter  time.Duration // Jobs finishing sooner are not e-mailed about, the submitter is still watching
+
+	OTLPEndpoint string // OpenTelemetry collector base URL for trace export, empty to disable
+
+	LogLevel  string // Minimum level logged: debug, info, warn or error
+	LogFormat string // Log output format: text or json
+
+	AccessLog        string // File receiving HTTP access records, empty to use the main log
+	AccessLogMaxSize int    // Megabytes after which the access log is rotated
+	AccessLogBackups int    // Rotated access log files to keep
+
+	RateLimit         float64 // Job submissions allowed per client per minute, 0 for unlimited
+	RateBurst         int     // Submissions a client may make back to back before the rate applies
+	MaxJobsPerClient  int     // Jobs one client may have queued or running at once, 0 for unlimited
+	TrustForwardedFor bool    // Identify clients by X-Forwarded-For when behind a reverse proxy
+
+	MaxUploadMB int64 // Total size of one upload request in megabytes, 0 for unlimited
+	MaxFileMB   int64 // Size of a single frame file in megabytes, 0 for unlimited
+	MaxFrames   int   // Frames accepted per job, 0 for unlimited
+
+	MaxMegapixels float64 // Pixel dimensions allowed per frame in megapixels, 0 for unlimited
+
+	CSRFSecret  string // Key signing upload form tokens; random per process when empty
+	CORSOrigins string // Comma-separated origins allowed to call the JSON API from a browser, "*" for any
+	APIKeys     string // JSON key store; when set the API requires a key
+
+	OIDCIssuer         string // OpenID Connect issuer URL; when set the web UI requires login
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCRedirectURL    string // Callback URL registered with the provider, derived from the request when empty
+	OIDCAllowedDomains string // Comma-separated e-mail domains allowed to log in, empty for any
+
+	GDriveClientID     string // OAuth client of the Google Drive folder picker, empty to hide it
+	GDriveClientSecret string
+	DropboxAppKey      string // OAuth client of the Dropbox folder picker, empty to hide it
+	DropboxAppSecret   string
+
+	ResultsDir     string // Directory keeping results for the owners' galleries, empty to keep none
+	WorkspaceStore string // JSON file workspaces are saved to, empty for memory only
+	Admins         string // Comma-separated e-mails or key:<name> allowed on /admin, empty for local clients only unless behind a proxy
+
+	S3Endpoint  string // URL of an S3-compatible service keeping results and uploads for every instance
+	S3Bucket    string // Bucket of the object store, empty to keep everything on the local disk
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Prefix    string // Key prefix, so several deployments can share a bucket
+
+	QuotaStorageMB      int64   // Stored results allowed per account in megabytes, 0 for unlimited
+	QuotaComputeMinutes float64 // Processing minutes allowed per account per 24 hours, 0 for unlimited
+
+	DefaultScale int // Upscale factor used when a request gives none, 0 for the square root of the frame count
+	StripHeight  int // Rows per streamed strip when a request gives none
+
+	AccentColor string // CSS colour replacing the primary colour of the web UI, empty for the default
+	Logo        string // Image file shown above the page titles, empty for none
+
+	PreviewWasm string // js/wasm build of this program the upload page runs for an alignment preview, empty for none
+
+	ClusterWorkers string // Comma-separated base URLs of instances jobs are split across, empty to process them here
+	ClusterSecret  string // Key coordinators and workers authenticate each other with; a worker serves /cluster/ only when set
+}
+
+// defaultConfig holds the built-in defaults
+var defaultConfig = serverConfig{
+	Port:          8080,
+	AutocertCache: "autocert-cache",
+	AutocertHTTP:  ":80",
+
+	ShutdownTimeout: 2 * time.Minute,
+	FetchTimeout:    30 * time.Second,
+	UploadExpiry:    24 * time.Hour,
+	NotifyAfter:     5 * time.Minute,
+
+	Workers:     2,
+	QueueSize:   64,
+	MinFreeDisk: 512,
+
+	LogLevel:  "info",
+	LogFormat: "text",
+
+	AccessLogMaxSize: 100,
+	AccessLogBackups: 5,
+
+	RateLimit:        30,
+	RateBurst:        10,
+	MaxJobsPerClient: 2,
+
+	MaxUploadMB: 1024,
+	MaxFileMB:   100,
+	MaxFrames:   200,
+
+	MaxMegapixels: 100,
+
+	StripHeight: defaultStripHeight,
+
+	S3Endpoint: "https://s3.amazonaws.com",
+	S3Region:   "us-east-1",
+}
+
+// config is the active server configuration, filled by parseFlags at startup.
+// Settings that can be reloaded at runtime are read through liveConfig instead.
+var config = defaultConfig
+
+// serverArgs are the arguments of the serve command, read again on reload
+var serverArgs []string
+
+// parseFlags registers the server's flags for command, whose usage starts with
+// usage, and loads args into config
+func parseFlags(command, usage string, args []string) error {
+	serverArgs = args
+	fs := flag.NewFlagSet(command, flag.ExitOnError) // Like the flags of any Go program, exiting on -h or a bad flag
+	registerFlags(fs, &config)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set through an environment variable, e.g. %s for -max-frames.\n", envName("max-frames"))
+	}
+	startupFlags, appliedFlags = fs, fs
+	return loadSettings(fs, &config, args)
+}
+
+// registerFlags defines every setting as a flag of fs bound to c
+func registerFlags(fs *flag.FlagSet, c *serverConfig) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "configuration file with flag names as keys (key = value or key: value); command-line flags override it")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "interface address to listen on (empty for all interfaces)")
+	fs.IntVar(&c.Port, "port", c.Port, "TCP port to listen on")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "URL path prefix when running behind a reverse proxy, e.g. /superres")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate file; enables HTTPS together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM private key file for -tls-cert")
+	fs.StringVar(&c.AutocertHosts, "autocert", c.AutocertHosts, "comma-separated hostnames to obtain Let's Encrypt certificates for (serve on -port 443)")
+	fs.StringVar(&c.AutocertCache, "autocert-cache", c.AutocertCache, "directory for cached ACME certificates")
+	fs.StringVar(&c.AutocertEmail, "autocert-email", c.AutocertEmail, "contact e-mail for the ACME account (optional)")
+	fs.StringVar(&c.AutocertHTTP, "autocert-http", c.AutocertHTTP, "address for ACME HTTP-01 challenges and HTTP to HTTPS redirects (empty to disable)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for running jobs on SIGINT/SIGTERM")
+	fs.StringVar(&c.JobStore, "job-store", c.JobStore, "JSON file to persist job records across restarts (empty keeps them in memory)")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "number of jobs processed concurrently (0 with -queue-redis runs none here, leaving them to other instances)")
+	fs.IntVar(&c.QueueSize, "queue-size", c.QueueSize, "number of jobs that may wait for a worker")
+	fs.StringVar(&c.QueueRedis, "queue-redis", c.QueueRedis, "Redis URL, e.g. redis://:password@redis:6379/0 (rediss:// for TLS), of a job queue shared by every instance started with it; needs -s3-bucket (empty queues jobs in this instance)")
+	fs.StringVar(&c.TempDir, "temp-dir", c.TempDir, "directory for temporary upload files (empty for the system default)")
+	fs.BoolVar(&c.InMemory, "in-memory", c.InMemory, "never write uploads or results to disk: frames are decoded from memory and results are not kept (bound memory with -max-upload-mb)")
+	fs.Int64Var(&c.MinFreeDisk, "min-free-disk", c.MinFreeDisk, "free space in MB required in the temp and job store directories for /readyz to pass")
+	fs.Int64Var(&c.DiskBudgetMB, "disk-budget-mb", c.DiskBudgetMB, "disk space in MB that upload copies in -temp-dir and stored results may use together (0 for unlimited)")
+	fs.StringVar(&c.UploadDir, "upload-dir", c.UploadDir, "directory for resumable uploads sent in chunks through /api/v1/uploads (default chicha-sr-uploads in the temp directory)")
+	fs.DurationVar(&c.UploadExpiry, "upload-expiry", c.UploadExpiry, "how long an unfinished or unused resumable upload is kept after its last chunk")
+	fs.StringVar(&c.FetchSchemes, "fetch-schemes", c.FetchSchemes, "comma-separated URL schemes frames may be fetched from by the server, e.g. https or http,https (empty disables fetching)")
+	fs.DurationVar(&c.FetchTimeout, "fetch-timeout", c.FetchTimeout, "time allowed to download one frame from a URL")
+	fs.BoolVar(&c.FetchPrivate, "fetch-private", c.FetchPrivate, "allow fetching frames from, and sending job callbacks and results to, localhost and private network addresses (only for trusted users)")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "key job completion callbacks are signed with in X-Signature-256 (empty refuses callback_url)")
+	fs.StringVar(&c.DeliverSchemes, "deliver-schemes", c.DeliverSchemes, "comma-separated schemes of deliver_to URLs finished results may be uploaded to: sftp, ftp or sftp,ftp (empty disables delivery)")
+	fs.StringVar(&c.SFTPKey, "sftp-key", c.SFTPKey, "private key file for logging in to SFTP delivery servers")
+	fs.StringVar(&c.SFTPKnownHosts, "sftp-known-hosts", c.SFTPKnownHosts, "known_hosts file SFTP delivery servers must be listed in (default ~/.ssh/known_hosts)")
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", c.SMTPAddr, "mail server host:port for job completion e-mails, using STARTTLS when offered (empty disables e-mail)")
+	fs.StringVar(&c.SMTPUser, "smtp-user", c.SMTPUser, "login for the mail server (empty to send without authentication)")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", c.SMTPPassword, "password for the mail server")
+	fs.StringVar(&c.SMTPFrom, "smtp-from", c.SMTPFrom, "sender address of job completion e-mails")
+	fs.DurationVar(&c.NotifyAfter, "notify-after", c.NotifyAfter, "only e-mail about jobs that ran at least this long")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "OpenTelemetry collector URL for OTLP/HTTP trace export, e.g. http://localhost:4318")
+	logFlags(fs, &c.LogLevel, &c.LogFormat)
+	fs.StringVar(&c.AccessLog, "access-log", c.AccessLog, "file for HTTP access records, rotated by size (empty logs requests to the main log)")
+	fs.IntVar(&c.AccessLogMaxSize, "access-log-max-size", c.AccessLogMaxSize, "access log size in MB that triggers rotation")
+	fs.IntVar(&c.AccessLogBackups, "access-log-backups", c.AccessLogBackups, "number of rotated access log files to keep")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "job submissions allowed per client per minute (0 for unlimited)")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "submissions a client may send back to back before -rate-limit applies")
+	fs.IntVar(&c.MaxJobsPerClient, "max-jobs-per-client", c.MaxJobsPerClient, "jobs one client may have queued or running at once (0 for unlimited)")
+	fs.BoolVar(&c.TrustForwardedFor, "trust-forwarded-for", c.TrustForwardedFor, "identify clients by X-Forwarded-For (only behind a trusted reverse proxy)")
+	fs.Int64Var(&c.MaxUploadMB, "max-upload-mb", c.MaxUploadMB, "maximum size of one upload request in MB (0 for unlimited)")
+	fs.Int64Var(&c.MaxFileMB, "max-file-mb", c.MaxFileMB, "maximum size of a single frame file in MB (0 for unlimited)")
+	fs.IntVar(&c.MaxFrames, "max-frames", c.MaxFrames, "maximum number of frames per job (0 for unlimited)")
+	fs.Float64Var(&c.MaxMegapixels, "max-megapixels", c.MaxMegapixels, "maximum pixel dimensions of one frame in megapixels (0 for unlimited)")
+	fs.StringVar(&c.CSRFSecret, "csrf-secret", c.CSRFSecret, "key for signing upload form tokens and login sessions, shared by all replicas behind a load balancer (random when empty)")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "comma-separated origins allowed to call the JSON API from browsers, e.g. https://app.example.com, or * for any (disabled when empty)")
+	fs.StringVar(&c.APIKeys, "api-keys", c.APIKeys, "JSON file of API keys; when set, /api/v1/superresolve requires Authorization: Bearer <key>")
+	fs.StringVar(&c.OIDCIssuer, "oidc-issuer", c.OIDCIssuer, "OpenID Connect issuer URL; when set the web UI requires logging in (e.g. https://accounts.google.com)")
+	fs.StringVar(&c.OIDCClientID, "oidc-client-id", c.OIDCClientID, "OAuth2 client ID registered with the OIDC provider")
+	fs.StringVar(&c.OIDCClientSecret, "oidc-client-secret", c.OIDCClientSecret, "OAuth2 client secret (empty for public clients)")
+	fs.StringVar(&c.OIDCRedirectURL, "oidc-redirect-url", c.OIDCRedirectURL, "callback URL registered with the provider (default <scheme>://<host><base-path>/auth/callback)")
+	fs.StringVar(&c.OIDCAllowedDomains, "oidc-allowed-domains", c.OIDCAllowedDomains, "comma-separated e-mail domains allowed to log in (empty allows any account)")
+	fs.StringVar(&c.GDriveClientID, "gdrive-client-id", c.GDriveClientID, "Google OAuth client ID that lets users pick a Google Drive folder of frames (redirect URI <scheme>://<host><base-path>/cloud/gdrive/callback)")
+	fs.StringVar(&c.GDriveClientSecret, "gdrive-client-secret", c.GDriveClientSecret, "Google OAuth client secret")
+	fs.StringVar(&c.DropboxAppKey, "dropbox-app-key", c.DropboxAppKey, "Dropbox app key that lets users pick a Dropbox folder of frames (redirect URI <scheme>://<host><base-path>/cloud/dropbox/callback)")
+	fs.StringVar(&c.DropboxAppSecret, "dropbox-app-secret", c.DropboxAppSecret, "Dropbox app secret")
+	fs.StringVar(&c.ResultsDir, "results-dir", c.ResultsDir, "directory to keep results in for the \"My results\" gallery and GET /api/v1/jobs (empty keeps none)")
+	fs.StringVar(&c.S3Bucket, "s3-bucket", c.S3Bucket, "S3 or MinIO bucket keeping results and completed uploads for every instance, with -results-dir as a local cache (empty keeps them on this disk only)")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", c.S3Endpoint, "URL of the S3 service, e.g. http://minio:9000; buckets are addressed path-style")
+	fs.StringVar(&c.S3Region, "s3-region", c.S3Region, "region the S3 requests are signed for")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", c.S3AccessKey, "S3 access key ID")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", c.S3SecretKey, "S3 secret access key")
+	fs.StringVar(&c.S3Prefix, "s3-prefix", c.S3Prefix, "prefix of the object keys, to share a bucket between deployments")
+	fs.Int64Var(&c.QuotaStorageMB, "quota-storage-mb", c.QuotaStorageMB, "stored results allowed per user or API key in MB (0 for unlimited)")
+	fs.Float64Var(&c.QuotaComputeMinutes, "quota-compute-minutes", c.QuotaComputeMinutes, "processing minutes allowed per user or API key in any 24 hours (0 for unlimited)")
+	fs.StringVar(&c.WorkspaceStore, "workspace-store", c.WorkspaceStore, "JSON file to keep team workspaces in across restarts (empty keeps them in memory)")
+	fs.StringVar(&c.Admins, "admins", c.Admins, "comma-separated e-mails of logged-in users allowed to use /admin (empty allows only clients on localhost, and nobody with -base-path or -trust-forwarded-for, behind a proxy)")
+	fs.IntVar(&c.DefaultScale, "default-scale", c.DefaultScale, fmt.Sprintf("upscale factor 1-%d used when a request gives none (0 picks the square root of the frame count)", maxUpscaleFactor))
+	fs.IntVar(&c.StripHeight, "strip-height", c.StripHeight, "rows per streamed strip when a request gives none")
+	fs.StringVar(&c.AccentColor, "accent-color", c.AccentColor, "colour of links, headings and primary buttons in the web UI as #rgb or #rrggbb (empty for the default blue)")
+	fs.StringVar(&c.Logo, "logo", c.Logo, "image file shown above the page titles of the web UI, e.g. the organization's logo (empty for none)")
+	fs.StringVar(&c.PreviewWasm, "preview-wasm", c.PreviewWasm, "js/wasm build of this program (GOOS=js GOARCH=wasm) the upload page runs to preview frame alignment before uploading (empty for none)")
+	fs.StringVar(&c.ClusterWorkers, "cluster-workers", c.ClusterWorkers, "comma-separated base URLs of worker instances, e.g. http://node1:8080,http://node2:8080, the alignment and fusion of every job are split across (empty processes jobs here)")
+	fs.StringVar(&c.ClusterSecret, "cluster-secret", c.ClusterSecret, "key shared by a coordinator and its workers; instances started with it accept work on /cluster/ from coordinators")
+}
+
+// loadSettings fills c, whose flags are registered on fs. Values are taken from,
+// in order of precedence: args, CHICHA_SR_* environment variables, the -config
+// file and the built-in defaults.
+func loadSettings(fs *flag.FlagSet, c *serverConfig, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if err := loadEnvironment(fs, explicit); err != nil {
+		return err
+	}
+	if c.ConfigFile != "" {
+		if err := loadConfigFile(fs, c.ConfigFile, explicit); err != nil {
+			return fmt.Errorf("loading -config: %w", err)
+		}
+	}
+
+	c.BasePath = normalizeBasePath(c.BasePath)
+	if c.Workers < 0 || (c.Workers == 0 && c.QueueRedis == "") {
+		c.Workers = 1 // With a shared queue 0 leaves the jobs to other instances and the worker command
+	}
+	c.QueueSize = max(c.QueueSize, 0)
+	c.RateBurst = max(c.RateBurst, 1)
+	if c.DefaultScale < 0 || c.DefaultScale > maxUpscaleFactor {
+		return fmt.Errorf("-default-scale must be between 0 and %d", maxUpscaleFactor)
+	}
+	if c.QueueRedis != "" && c.S3Bucket == "" {
+		return fmt.Errorf("-queue-redis needs -s3-bucket, where the frames of queued jobs wait for the instance that runs them")
+	}
+	if c.SMTPAddr != "" && c.SMTPFrom == "" {
+		return fmt.Errorf("-smtp-addr needs -smtp-from, the sender address of the e-mails")
+	}
+	if c.ClusterWorkers != "" && c.ClusterSecret == "" {
+		return fmt.Errorf("-cluster-workers needs -cluster-secret, the key the workers were started with")
+	}
+	if c.AccentColor != "" && !accentColorPattern.MatchString(c.AccentColor) {
+		return fmt.Errorf("-accent-color must be a colour like #0d6efd, got %q", c.AccentColor)
+	}
+	return nil
+}
+
+// envPrefix starts the environment variable mirroring each flag, e.g. CHICHA_SR_MAX_FRAMES for -max-frames
+const envPrefix = "CHICHA_SR_"
+
+// envName returns the environment variable for a flag name
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadEnvironment sets every flag not given on the command line from its
+// environment variable, adding it to explicit so the config file cannot override it
+func loadEnvironment(fs *flag.FlagSet, explicit map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", envName(f.Name), setErr)
+			return
+		}
+		explicit[f.Name] = true
+	})
+	return err
+}
+
+// normalizeBasePath turns user input like "sr/" into "/sr"; the root path becomes ""
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// addr returns the host:port the server binds to
+func (c serverConfig) addr() string {
+	return net.JoinHostPort(c.Listen, strconv.Itoa(c.Port))
+}
+
+// tlsEnabled reports whether the server terminates TLS itself
+func (c serverConfig) tlsEnabled() bool {
+	return c.AutocertHosts != "" || c.TLSCert != "" || c.TLSKey != ""
+}
+
+// scheme returns the URL scheme clients use to reach the server
+func (c serverConfig) scheme() string {
+	if c.tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// url prefixes an absolute application path with the base path, for use in generated links
+func (c serverConfig) url(path string) string {
+	return c.BasePath + path
+}
+
+// absoluteURL returns the full URL of an application path as the client of r reaches it
+func absoluteURL(r *http.Request, path string) string {
+	scheme := config.scheme()
+	if proto := r.Header.Get("X-Forwarded-Proto"); config.TrustForwardedFor && proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + config.url(path)
+}
+
+// withBasePath mounts handler under the configured base path
+func (c serverConfig) withBasePath(handler http.Handler) http.Handler {
+	if c.BasePath == "" {
+		return handler
+	}
+	prefixed := http.StripPrefix(c.BasePath, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == c.BasePath:
+			http.Redirect(w, r, c.BasePath+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, c.BasePath+"/"):
+			prefixed.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r) // Outside of the mount point
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadConfigFile applies the settings of a configuration file to the flags in fs,
+// skipping those named in explicit so command-line values take precedence.
+//
+// The file is the flat subset shared by TOML and YAML: one "key = value" or
+// "key: value" per line, where keys are flag names (dashes or underscores),
+// strings may be quoted, lists may be written as [a, b] and # starts a comment.
+// [section] headers are accepted for grouping and otherwise ignored.
+func loadConfigFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" || text == "---" || strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") && !strings.ContainsAny(text, "=:") {
+			continue
+		}
+
+		sep := strings.IndexAny(text, "=:")
+		if sep < 0 {
+			return fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+		key := strings.ReplaceAll(strings.TrimSpace(text[:sep]), "_", "-")
+		value, err := parseConfigValue(strings.TrimSpace(text[sep+1:]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, line, key, err)
+		}
+
+		if fs.Lookup(key) == nil || key == "config" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, line, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, line, key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// stripComment removes a # comment that is not inside a quoted string
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigValue unquotes strings and joins [a, b] lists with commas, the form
+// list-valued flags take
+func parseConfigValue(value string) (string, error) {
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		var items []string
+		for _, item := range strings.Split(value[1:len(value)-1], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			unquoted, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, unquoted)
+		}
+		return strings.Join(items, ","), nil
+	}
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		return strconv.Unquote(value)
+	case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browser clients of the API may read
+var corsExposedHeaders = strings.Join([]string{
+	requestIDHeader, "X-Job-ID", "X-API-Version", "Retry-After",
+	"X-Image-Width", "X-Image-Height", "X-Strip-Count", "traceparent",
+	"Location", uploadOffsetHeader, uploadLengthHeader, uploadExpiresHeader,
+}, ", ")
+
+// parseOrigins splits a comma-separated -cors-origins value into a set
+func parseOrigins(list string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// allowCORS lets pages served from the allowed origins call the JSON API directly,
+// answering preflight requests itself; requests from other origins get no CORS
+// headers, so browsers keep blocking them. The web form is never exposed.
+func allowCORS(next http.Handler) http.Handler {
+	origins := parseOrigins(config.CORSOrigins)
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || (r.URL.Path != "/api" && !strings.HasPrefix(r.URL.Path, "/api/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !origins["*"] && !origins[origin] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if origins["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+
+		// Answer the preflight here since the API routes do not accept OPTIONS
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, "+requestIDHeader+", traceparent, "+
+				uploadLengthHeader+", "+uploadOffsetHeader+", "+uploadNameHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
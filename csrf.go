@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// csrfCookieName holds the token the upload form must echo back
+const csrfCookieName = "chicha_sr_csrf"
+
+// csrfSecret signs CSRF tokens and session cookies; it is random per process unless -csrf-secret is set
+var csrfSecret []byte
+
+// initCSRF sets up the signing secret, generating one when none is configured
+func initCSRF(secret string) {
+	if secret != "" {
+		csrfSecret = []byte(secret)
+		return
+	}
+	csrfSecret = make([]byte, 32)
+	_, _ = rand.Read(csrfSecret)
+}
+
+// signCSRFNonce returns the token for nonce: the nonce plus its HMAC
+func signCSRFNonce(nonce string) string {
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(nonce))
+	return nonce + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken checks that a token was issued by this server
+func validCSRFToken(token string) bool {
+	nonce, _, ok := strings.Cut(token, ".")
+	return ok && hmac.Equal([]byte(signCSRFNonce(nonce)), []byte(token))
+}
+
+// csrfToken returns the visitor's current token, issuing a new cookie when they have none
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(cookie.Value) {
+		return cookie.Value
+	}
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	token := signCSRFNonce(hex.EncodeToString(nonce))
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     config.url("/"),
+		HttpOnly: true,
+		Secure:   config.tlsEnabled(),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// verifyCSRF accepts a form post only when its csrf_token field matches the signed
+// cookie set by the upload page, so drive-by posts from other sites are refused
+func verifyCSRF(r *http.Request) *requestError {
+	forbidden := &requestError{Status: http.StatusForbidden, Code: "csrf_failed", Message: "The upload form has expired or was not submitted from this site. Please reload the page and try again."}
+
+	// Check the cookie first so forged posts are refused before their body is read
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || !validCSRFToken(cookie.Value) {
+		return forbidden
+	}
+	// Plain url-encoded forms are parsed too, by ParseMultipartForm before it fails
+	err = parseUpload(r)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return uploadTooLarge()
+	case err != nil && !errors.Is(err, http.ErrNotMultipart):
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_upload", Message: "Unable to parse the submitted form"}
+	}
+	field := r.FormValue("csrf_token")
+	if subtle.ConstantTimeCompare([]byte(field), []byte(cookie.Value)) != 1 {
+		return forbidden
+	}
+	return nil
+}
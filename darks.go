@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+)
+
+// averageDarks returns the master dark of dark frames: their per-pixel mean,
+// in which the random noise of each averages out and what the sensor adds to
+// every exposure, its glow and hot pixels, remains
+func averageDarks(darks []image.Image) (*image.RGBA, *requestError) {
+	b := darks[0].Bounds()
+	sums := make([]float64, b.Dx()*b.Dy()*3)
+	for n, dark := range darks {
+		if dark.Bounds().Size() != b.Size() {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Dark frame %d is %dx%d but the first is %dx%d", n, dark.Bounds().Dx(), dark.Bounds().Dy(), b.Dx(), b.Dy())}
+		}
+		db := dark.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r, g, bl, _ := dark.At(db.Min.X+x, db.Min.Y+y).RGBA()
+				i := (y*b.Dx() + x) * 3
+				sums[i] += float64(r >> 8)
+				sums[i+1] += float64(g >> 8)
+				sums[i+2] += float64(bl >> 8)
+			}
+		}
+	}
+	master := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for i := 0; i < len(sums)/3; i++ {
+		for c := 0; c < 3; c++ {
+			master.Pix[i*4+c] = uint8(math.Round(sums[i*3+c] / float64(len(darks))))
+		}
+		master.Pix[i*4+3] = 0xff
+	}
+	return master, nil
+}
+
+// subtractDark takes the master dark off every frame, which must be its size.
+// 16-bit grayscale frames stay 16-bit, so thermal and mono16 keep their depth.
+func subtractDark(images []image.Image, dark *image.RGBA) ([]image.Image, *requestError) {
+	out := make([]image.Image, len(images))
+	for n, img := range images {
+		b := img.Bounds()
+		if b.Size() != dark.Bounds().Size() {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Frame %d is %dx%d but the dark frames are %dx%d: they must come from the same camera at the same settings", n, b.Dx(), b.Dy(), dark.Bounds().Dx(), dark.Bounds().Dy())}
+		}
+		if gray, ok := img.(*image.Gray16); ok {
+			light := image.NewGray16(b)
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					v := int(gray.Gray16At(b.Min.X+x, b.Min.Y+y).Y) - int(dark.Pix[dark.PixOffset(x, y)])*0x101
+					light.SetGray16(b.Min.X+x, b.Min.Y+y, color.Gray16{Y: uint16(max(v, 0))})
+				}
+			}
+			out[n] = light
+			continue
+		}
+		light := image.NewRGBA(b)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				d := dark.Pix[dark.PixOffset(x, y):]
+				p := light.Pix[light.PixOffset(b.Min.X+x, b.Min.Y+y):]
+				p[0] = uint8(max(int(r>>8)-int(d[0]), 0))
+				p[1] = uint8(max(int(g>>8)-int(d[1]), 0))
+				p[2] = uint8(max(int(bl>>8)-int(d[2]), 0))
+				p[3] = 0xff
+			}
+		}
+		out[n] = light
+	}
+	return out, nil
+}
+
+// uploadedCalibrationFrames decodes the frames uploaded with the request in
+// field, such as the dark frames, or returns nil when there are none
+func uploadedCalibrationFrames(r *http.Request, field string) ([]image.Image, *requestError) {
+	var files []uploadFrame
+	for _, fileHeader := range r.MultipartForm.File[field] {
+		if fileHeader.Filename == "" && fileHeader.Size == 0 {
+			continue
+		}
+		files = append(files, uploadFrame{name: fileHeader.Filename, size: fileHeader.Size, open: func() (io.ReadCloser, error) { return fileHeader.Open() }})
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if reqErr := checkUploadedFiles(files, 0); reqErr != nil {
+		return nil, reqErr
+	}
+	frames := make([]image.Image, 0, len(files))
+	for _, frame := range files {
+		if reqErr := validateFileName(frame.name); reqErr != nil {
+			return nil, reqErr
+		}
+		if _, reqErr := sniffUpload(frame); reqErr != nil {
+			return nil, reqErr
+		}
+		file, err := frame.open()
+		if err != nil {
+			return nil, &requestError{Status: http.StatusInternalServerError, Code: "upload_read_failed", Message: "Error opening uploaded file"}
+		}
+		img, _, _, err := decodeFrame(file)
+		file.Close()
+		if err != nil {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("Unsupported format for file %s. Supported formats are: %s", frame.name, supportedFormats)}
+		}
+		frames = append(frames, img)
+	}
+	return frames, nil
+}
+
+// subtractUploadedDarks takes the dark frames uploaded with the request, if
+// any, off the frames
+func subtractUploadedDarks(r *http.Request, images []image.Image) ([]image.Image, *requestError) {
+	darks, reqErr := uploadedCalibrationFrames(r, "darks")
+	if reqErr != nil || darks == nil {
+		return images, reqErr
+	}
+	dark, reqErr := averageDarks(darks)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	slog.InfoContext(r.Context(), "Subtracting dark frames", "darks", len(darks))
+	return subtractDark(images, dark)
+}
+
+// darkFramesField renders the dark-frame input of the upload form
+func darkFramesField(r *http.Request) string {
+	return `<div class="mb-3">
+	<label for="darks" class="form-label">` + tr(r, "Dark frames (optional)") + `</label>
+	<input type="file" name="darks" id="darks" accept="image/jpeg,image/png,image/gif,image/tiff,.tif,.tiff" multiple class="form-control">
+	<div class="form-text">` + tr(r, "For long exposures of the night sky: frames shot with the lens capped, at the same exposure, ISO and temperature. Their sensor glow and hot pixels are subtracted from every frame.") + `</div>
+	</div>`
+}
+
+// calibration holds the master frames the frames of the commands are
+// corrected with, each nil when not given
+type calibration struct {
+	dark *image.RGBA
+	flat *flatField
+
+	darkFiles, flatFiles []string // The frames the masters were averaged from, for the manifest
+}
+
+// apply takes the master dark off the frames, then divides them by the master flat
+func (c calibration) apply(images []image.Image) ([]image.Image, *requestError) {
+	var reqErr *requestError
+	if c.dark != nil {
+		if images, reqErr = subtractDark(images, c.dark); reqErr != nil {
+			return nil, reqErr
+		}
+	}
+	if c.flat != nil {
+		return divideFlat(images, c.flat)
+	}
+	return images, nil
+}
+
+// calibrationFlags registers the -darks and -flats flags of the commands that
+// process frames; the returned function loads the frames they name once fs is
+// parsed
+func calibrationFlags(fs *flag.FlagSet) func(ctx context.Context) (calibration, error) {
+	darks := fs.String("darks", "", "glob of dark frames, shot with the lens capped at the exposure of the frames, to subtract from them, e.g. 'darks/*.png'")
+	flats := fs.String("flats", "", "glob of flat frames, shot of an empty, evenly lit field, to divide the frames by, evening out vignetting and dust, e.g. 'flats/*.tif'")
+	return func(ctx context.Context) (calibration, error) {
+		darkFiles, err := globCalibrationFiles("-darks", *darks)
+		if err != nil {
+			return calibration{}, err
+		}
+		flatFiles, err := globCalibrationFiles("-flats", *flats)
+		if err != nil {
+			return calibration{}, err
+		}
+		return loadCalibration(ctx, darkFiles, flatFiles)
+	}
+}
+
+// loadCalibration averages the dark frames and the flat frames at the paths
+// given into their masters, leaving out those with no paths
+func loadCalibration(ctx context.Context, darkFiles, flatFiles []string) (calibration, error) {
+	c := calibration{darkFiles: darkFiles, flatFiles: flatFiles}
+	var reqErr *requestError
+	if len(darkFiles) > 0 {
+		frames, _, err := decodeFrameFiles(ctx, darkFiles, videoClip{})
+		if err != nil {
+			return c, err
+		}
+		if c.dark, reqErr = averageDarks(frames); reqErr != nil {
+			return c, reqErr
+		}
+	}
+	if len(flatFiles) > 0 {
+		frames, _, err := decodeFrameFiles(ctx, flatFiles, videoClip{})
+		if err != nil {
+			return c, err
+		}
+		if c.flat, reqErr = averageFlats(frames); reqErr != nil {
+			return c, reqErr
+		}
+	}
+	return c, nil
+}
+
+// globCalibrationFiles returns the files matching the pattern given to flag,
+// or nil when pattern is empty
+func globCalibrationFiles(flag, pattern string) ([]string, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, &commandError{exitBadInput, fmt.Errorf("%s: %w", flag, err)}
+	}
+	if len(paths) == 0 {
+		return nil, &commandError{exitBadInput, fmt.Errorf("%s: no files match %s", flag, pattern)}
+	}
+	return paths, nil
+}
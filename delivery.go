@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Delivery states recorded on a job, see job.Delivery
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// deliveryTimeout bounds one attempt to upload a result
+const deliveryTimeout = 5 * time.Minute
+
+// deliveryDialer connects to delivery servers, keeping to public addresses
+// unless -fetch-private is set
+var deliveryDialer = &net.Dialer{Timeout: 15 * time.Second, Control: publicAddressesOnly}
+
+// deliverySchemeAllowed reports whether results may be uploaded to URLs with scheme
+func deliverySchemeAllowed(scheme string) bool {
+	for _, allowed := range strings.Split(config.DeliverSchemes, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), scheme) && scheme != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeliveryURL validates the deliver_to parameter: an sftp:// or ftp:// URL
+// of a directory, ending in a slash, or of the file to write
+func checkDeliveryURL(raw string) *requestError {
+	if raw == "" {
+		return nil
+	}
+	if config.DeliverSchemes == "" {
+		return &requestError{Status: http.StatusBadRequest, Code: "delivery_disabled", Message: "This server does not upload results elsewhere. Please download them instead."}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "sftp" && u.Scheme != "ftp") {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "Parameter deliver_to must be an sftp:// or ftp:// URL, e.g. sftp://user@archive.example.com/incoming/"}
+	}
+	if !deliverySchemeAllowed(u.Scheme) {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter deliver_to uses a scheme that is not allowed; allowed schemes: %s", config.DeliverSchemes)}
+	}
+	return nil
+}
+
+// deliveryPath returns the remote path a result of job id with extension ext is
+// written to: the URL's path, or a file named after the job in its directory
+func deliveryPath(u *url.URL, id, ext string) string {
+	p := u.Path
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "superres-" + id + ext
+	}
+	return p
+}
+
+// deliverResult uploads an encoded result to the deliver_to URL in the
+// background, retrying a few times, and records the outcome on the job
+func deliverResult(ctx context.Context, rawURL, id, ext string, data []byte) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return // Validated by checkDeliveryURL
+	}
+	jobs.setDelivery(id, deliveryPending)
+	ctx = context.WithoutCancel(ctx)
+	remote := deliveryPath(u, id, ext)
+	go func() {
+		for attempt := 0; ; attempt++ {
+			attemptCtx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+			var err error
+			switch u.Scheme {
+			case "sftp":
+				err = uploadSFTP(attemptCtx, u, remote, data)
+			case "ftp":
+				err = uploadFTP(attemptCtx, u, remote, data)
+			}
+			cancel()
+			if err == nil {
+				jobs.setDelivery(id, deliveryDelivered)
+				slog.InfoContext(ctx, "Result delivered", "job_id", id, "to", u.Redacted(), "path", remote, "bytes", len(data), "attempts", attempt+1)
+				return
+			}
+			if attempt == len(callbackRetryDelays) || errors.Is(err, errPrivateAddress) {
+				jobs.setDelivery(id, deliveryFailed)
+				slog.ErrorContext(ctx, "Giving up on result delivery", "job_id", id, "to", u.Redacted(), "attempts", attempt+1, "error", err)
+				return
+			}
+			slog.WarnContext(ctx, "Result delivery failed, will retry", "job_id", id, "to", u.Redacted(), "retry_in", callbackRetryDelays[attempt], "error", err)
+			time.Sleep(callbackRetryDelays[attempt])
+		}
+	}()
+}
+
+// dialDelivery connects to the host of u, on the scheme's port when it names none
+func dialDelivery(ctx context.Context, u *url.URL, defaultPort string) (net.Conn, error) {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return deliveryDialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+}
+
+// sftpClientConfig authenticates with the URL's password or the -sftp-key and
+// checks the server against -sftp-known-hosts
+func sftpClientConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	knownHostsFile := config.SFTPKnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if config.SFTPKey != "" {
+		pem, err := os.ReadFile(config.SFTPKey)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("reading -sftp-key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+	return &ssh.ClientConfig{User: u.User.Username(), Auth: auth, HostKeyCallback: hostKeys, Timeout: 15 * time.Second}, nil
+}
+
+// uploadSFTP writes data to remote on the SFTP server of u, under a temporary
+// name first so watchers of the directory never pick up a partial file
+func uploadSFTP(ctx context.Context, u *url.URL, remote string, data []byte) error {
+	cfg, err := sftpClientConfig(u)
+	if err != nil {
+		return err
+	}
+	conn, err := dialDelivery(ctx, u, "22")
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), cfg)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
+	s := &sftpSession{w: w, r: r}
+	if err := s.init(); err != nil {
+		return err
+	}
+	partial := path.Join(path.Dir(remote), "."+path.Base(remote)+".part")
+	if err := s.writeFile(partial, data); err != nil {
+		return err
+	}
+	if err := s.rename(partial, remote); err != nil {
+		// SFTP version 3 servers refuse to rename over an existing file
+		if s.remove(remote) != nil || s.rename(partial, remote) != nil {
+			_ = s.remove(partial)
+			return err
+		}
+	}
+	return nil
+}
+
+// SFTP version 3 packet types and flags used by sftpSession
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpWrite   = 6
+	sftpRemove  = 13
+	sftpRename  = 18
+	sftpStatus  = 101
+	sftpHandle  = 102
+
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+
+	sftpChunk = 32 << 10 // Largest write every server accepts
+)
+
+// sftpSession speaks the few requests of the SFTP protocol a delivery needs,
+// one at a time
+type sftpSession struct {
+	w  io.Writer
+	r  io.Reader
+	id uint32
+}
+
+// sftpPacket builds the payload of a request
+type sftpPacket struct{ bytes.Buffer }
+
+func (p *sftpPacket) uint32(v uint32) { _ = binary.Write(p, binary.BigEndian, v) }
+func (p *sftpPacket) uint64(v uint64) { _ = binary.Write(p, binary.BigEndian, v) }
+func (p *sftpPacket) string(s []byte) { p.uint32(uint32(len(s))); p.Write(s) }
+
+// send writes a packet of type kind; requests other than init start with an ID
+func (s *sftpSession) send(kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = kind
+	_, err := s.w.Write(append(header, payload...))
+	return err
+}
+
+// receive reads one packet and returns its type and payload
+func (s *sftpSession) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", length)
+	}
+	payload := make([]byte, length-1)
+	_, err := io.ReadFull(s.r, payload)
+	return header[4], payload, err
+}
+
+// request sends a request built by fill and returns the reply after its ID
+func (s *sftpSession) request(kind byte, fill func(p *sftpPacket)) (byte, []byte, error) {
+	s.id++
+	var p sftpPacket
+	p.uint32(s.id)
+	fill(&p)
+	if err := s.send(kind, p.Bytes()); err != nil {
+		return 0, nil, err
+	}
+	reply, payload, err := s.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload) != s.id {
+		return 0, nil, errors.New("sftp: reply to another request")
+	}
+	return reply, payload[4:], nil
+}
+
+// status turns an SSH_FXP_STATUS reply into an error unless it reports success
+func sftpStatusError(reply byte, payload []byte) error {
+	if reply != sftpStatus || len(payload) < 4 {
+		return fmt.Errorf("sftp: unexpected reply %d", reply)
+	}
+	code := binary.BigEndian.Uint32(payload)
+	if code == 0 {
+		return nil
+	}
+	message := ""
+	if len(payload) >= 8 {
+		if n := binary.BigEndian.Uint32(payload[4:]); int(n) <= len(payload)-8 {
+			message = string(payload[8 : 8+n])
+		}
+	}
+	return fmt.Errorf("sftp: status %d: %s", code, message)
+}
+
+func (s *sftpSession) init() error {
+	var p sftpPacket
+	p.uint32(3)
+	if err := s.send(sftpInit, p.Bytes()); err != nil {
+		return err
+	}
+	reply, _, err := s.receive()
+	if err == nil && reply != sftpVersion {
+		err = fmt.Errorf("sftp: unexpected reply %d to init", reply)
+	}
+	return err
+}
+
+// writeFile creates or truncates name and writes data to it
+func (s *sftpSession) writeFile(name string, data []byte) error {
+	reply, payload, err := s.request(sftpOpen, func(p *sftpPacket) {
+		p.string([]byte(name))
+		p.uint32(sftpFlagWrite | sftpFlagCreate | sftpFlagTruncate)
+		p.uint32(0) // No attributes
+	})
+	if err != nil {
+		return err
+	}
+	if reply != sftpHandle {
+		return sftpStatusError(reply, payload)
+	}
+	if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) > len(payload)-4 {
+		return errors.New("sftp: malformed handle")
+	}
+	handle := payload[4 : 4+binary.BigEndian.Uint32(payload)]
+	for offset := 0; offset < len(data); offset += sftpChunk {
+		chunk := data[offset:min(offset+sftpChunk, len(data))]
+		reply, payload, err := s.request(sftpWrite, func(p *sftpPacket) {
+			p.string(handle)
+			p.uint64(uint64(offset))
+			p.string(chunk)
+		})
+		if err == nil {
+			err = sftpStatusError(reply, payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	reply, payload, err = s.request(sftpClose, func(p *sftpPacket) { p.string(handle) })
+	if err != nil {
+		return err
+	}
+	return sftpStatusError(reply, payload)
+}
+
+func (s *sftpSession) rename(from, to string) error {
+	reply, payload, err := s.request(sftpRename, func(p *sftpPacket) {
+		p.string([]byte(from))
+		p.string([]byte(to))
+	})
+	if err != nil {
+		return err
+	}
+	return sftpStatusError(reply, payload)
+}
+
+func (s *sftpSession) remove(name string) error {
+	reply, payload, err := s.request(sftpRemove, func(p *sftpPacket) { p.string([]byte(name)) })
+	if err != nil {
+		return err
+	}
+	return sftpStatusError(reply, payload)
+}
+
+// uploadFTP stores data as remote on the FTP server of u in passive mode,
+// anonymously unless the URL has a user
+func uploadFTP(ctx context.Context, u *url.URL, remote string, data []byte) error {
+	conn, err := dialDelivery(ctx, u, "21")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+	command := func(expect int, format string, args ...any) (string, error) {
+		if err := c.PrintfLine(format, args...); err != nil {
+			return "", err
+		}
+		_, message, err := c.ReadResponse(expect)
+		return message, err
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	code, _, err := func() (int, string, error) {
+		if err := c.PrintfLine("USER %s", user); err != nil {
+			return 0, "", err
+		}
+		return c.ReadResponse(2)
+	}()
+	if code == 331 {
+		_, err = command(230, "PASS %s", password)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := command(200, "TYPE I"); err != nil {
+		return err
+	}
+	message, err := command(227, "PASV")
+	if err != nil {
+		return err
+	}
+	// Connect to the control connection's host whatever address the reply names,
+	// so a server cannot point the data connection elsewhere
+	open, closing := strings.Index(message, "("), strings.Index(message, ")")
+	if open < 0 || closing < open {
+		return fmt.Errorf("ftp: unexpected PASV reply %q", message)
+	}
+	fields := strings.Split(message[open+1:closing], ",")
+	if len(fields) != 6 {
+		return fmt.Errorf("ftp: unexpected PASV reply %q", message)
+	}
+	high, errHigh := strconv.Atoi(strings.TrimSpace(fields[4]))
+	low, errLow := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if errHigh != nil || errLow != nil {
+		return fmt.Errorf("ftp: unexpected PASV reply %q", message)
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	dataConn, err := deliveryDialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(high<<8|low)))
+	if err != nil {
+		return err
+	}
+	if err := c.PrintfLine("STOR %s", remote); err != nil {
+		dataConn.Close()
+		return err
+	}
+	if _, _, err := c.ReadResponse(1); err != nil {
+		dataConn.Close()
+		return err
+	}
+	_, err = dataConn.Write(data)
+	if err := errors.Join(err, dataConn.Close()); err != nil {
+		return err
+	}
+	if _, _, err := c.ReadResponse(226); err != nil {
+		return err
+	}
+	_, _ = command(221, "QUIT")
+	return nil
+}
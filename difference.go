@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+)
+
+// Alignment compares a frame with the reference at every shift it searches, so
+// both are read once into planes of their 8-bit colours held as signed
+// integers. Every difference is then taken between two ints: subtracting the
+// uint32 values RGBA returns would wrap to some four billion wherever the frame
+// is the brighter one, and the shift found would be the one that happens to
+// make the frame darker rather than the one that lines it up.
+
+// colourPlane holds the red, green and blue of every pixel of an image, 0-255
+type colourPlane struct {
+	rect image.Rectangle
+	pix  []int32 // Red, green and blue of each pixel in turn, row by row
+}
+
+// newColourPlane reads the colours of img
+func newColourPlane(img image.Image) *colourPlane {
+	b := img.Bounds()
+	p := &colourPlane{rect: b, pix: make([]int32, 0, 3*b.Dx()*b.Dy())}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			p.pix = append(p.pix, int32(r>>8), int32(g>>8), int32(bl>>8))
+		}
+	}
+	return p
+}
+
+// offset returns where the colours of pixel (x, y) start in p.pix
+func (p *colourPlane) offset(x, y int) int {
+	return 3 * ((y-p.rect.Min.Y)*p.rect.Dx() + x - p.rect.Min.X)
+}
+
+// crop returns the part of p within r, at the same coordinates
+func (p *colourPlane) crop(r image.Rectangle) *colourPlane {
+	r = r.Intersect(p.rect)
+	c := &colourPlane{rect: r, pix: make([]int32, 0, 3*r.Dx()*r.Dy())}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		c.pix = append(c.pix, p.pix[p.offset(r.Min.X, y):p.offset(r.Max.X, y)]...)
+	}
+	return c
+}
+
+// computeSSD returns the sum of squared differences between the colours of the
+// pixels of ref and those of img (xShift, yShift) away from them, over the
+// pixels where img has some, and how many those are; it stops short when ctx
+// is canceled
+func computeSSD(ctx context.Context, ref, img *colourPlane, xShift, yShift int) (ssd float64, pixels int) {
+	// The pixels of ref whose counterparts lie within img
+	shared := ref.rect.Intersect(img.rect.Sub(image.Pt(xShift, yShift)))
+	if shared.Empty() {
+		return 0, 0
+	}
+	var sum int64 // Exact: a pixel adds at most 3*255*255
+	for y := shared.Min.Y; y < shared.Max.Y; y++ {
+		if ctx.Err() != nil {
+			break
+		}
+		a := ref.pix[ref.offset(shared.Min.X, y):ref.offset(shared.Max.X, y)]
+		b := img.pix[img.offset(shared.Min.X+xShift, y+yShift):]
+		for i, v := range a {
+			d := int64(v - b[i])
+			sum += d * d
+		}
+		pixels += shared.Dx()
+	}
+	return float64(sum), pixels
+}
+
+// calculateDifference returns the mean squared difference of computeSSD, summed
+// over the three colours; it gives up with +Inf when ctx is canceled and
+// returns math.MaxFloat64 when img has no pixels (dx, dy) away from ref's
+func calculateDifference(ctx context.Context, ref, img *colourPlane, dx, dy int) float64 {
+	ssd, pixels := computeSSD(ctx, ref, img, dx, dy)
+	switch {
+	case ctx.Err() != nil:
+		return math.Inf(1)
+	case pixels == 0:
+		return math.MaxFloat64
+	}
+	return ssd / float64(pixels)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// noiseImage returns a width x height image of random colours, the same for a seed
+func noiseImage(width, height int, seed uint64) *image.RGBA {
+	rng := rand.New(rand.NewPCG(seed, 1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.IntN(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+// displaced returns img with its content moved by (dx, dy), the pixels it
+// leaves uncovered filled from other noise so they match nothing
+func displaced(img *image.RGBA, dx, dy int) *image.RGBA {
+	b := img.Bounds()
+	out := noiseImage(b.Dx(), b.Dy(), 99)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if p := image.Pt(x-dx, y-dy); p.In(b) {
+				out.SetRGBA(x, y, img.RGBAAt(p.X, p.Y))
+			}
+		}
+	}
+	return out
+}
+
+func uniformImage(width, height int, v uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestComputeSSDSigned(t *testing.T) {
+	dark, bright := newColourPlane(uniformImage(8, 6, 10)), newColourPlane(uniformImage(8, 6, 200))
+	want := float64(8 * 6 * 3 * 190 * 190)
+	for _, tc := range []struct {
+		name     string
+		ref, img *colourPlane
+	}{
+		{"frame brighter", dark, bright},
+		{"frame darker", bright, dark},
+	} {
+		ssd, pixels := computeSSD(context.Background(), tc.ref, tc.img, 0, 0)
+		if ssd != want || pixels != 8*6 {
+			t.Errorf("%s: computeSSD = %v over %d pixels, want %v over %d", tc.name, ssd, pixels, want, 8*6)
+		}
+	}
+}
+
+func TestComputeSSDOverlap(t *testing.T) {
+	ref, img := newColourPlane(uniformImage(10, 8, 0)), newColourPlane(uniformImage(10, 8, 1))
+	for _, tc := range []struct {
+		dx, dy, pixels int
+	}{
+		{0, 0, 80},
+		{3, 0, 56},
+		{-3, 2, 42},
+		{0, -7, 10},
+		{10, 0, 0},
+		{0, -8, 0},
+	} {
+		ssd, pixels := computeSSD(context.Background(), ref, img, tc.dx, tc.dy)
+		if pixels != tc.pixels || ssd != float64(3*tc.pixels) {
+			t.Errorf("computeSSD at (%d, %d) = %v over %d pixels, want %v over %d", tc.dx, tc.dy, ssd, pixels, float64(3*tc.pixels), tc.pixels)
+		}
+	}
+	if diff := calculateDifference(context.Background(), ref, img, 10, 0); diff != math.MaxFloat64 {
+		t.Errorf("calculateDifference without shared pixels = %v, want math.MaxFloat64", diff)
+	}
+}
+
+func TestCalculateDifferenceAtShift(t *testing.T) {
+	src := noiseImage(64, 48, 1)
+	for _, shift := range []image.Point{{0, 0}, {5, 0}, {0, -4}, {-7, 3}, {6, 6}} {
+		ref, img := newColourPlane(src), newColourPlane(displaced(src, shift.X, shift.Y))
+		if diff := calculateDifference(context.Background(), ref, img, shift.X, shift.Y); diff != 0 {
+			t.Errorf("shift %v: difference where the frames line up = %v, want 0", shift, diff)
+		}
+		if shift == (image.Point{}) {
+			continue
+		}
+		if diff := calculateDifference(context.Background(), ref, img, 0, 0); diff == 0 {
+			t.Errorf("shift %v: difference without shifting = 0, want more", shift)
+		}
+	}
+}
+
+func TestCalculateDifferenceCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := newColourPlane(uniformImage(4, 4, 0))
+	if diff := calculateDifference(ctx, p, p, 0, 0); !math.IsInf(diff, 1) {
+		t.Errorf("calculateDifference once canceled = %v, want +Inf", diff)
+	}
+}
+
+func TestColourPlaneCrop(t *testing.T) {
+	src := noiseImage(20, 10, 2)
+	p := newColourPlane(src)
+	c := p.crop(image.Rect(5, 2, 12, 30))
+	if want := image.Rect(5, 2, 12, 10); c.rect != want {
+		t.Fatalf("crop = %v, want %v", c.rect, want)
+	}
+	if ssd, pixels := computeSSD(context.Background(), c, p, 0, 0); ssd != 0 || pixels != 7*8 {
+		t.Errorf("crop against its image = %v over %d pixels, want 0 over %d", ssd, pixels, 7*8)
+	}
+}
+
+func TestEstimateTranslation(t *testing.T) {
+	src := noiseImage(48, 40, 3)
+	for _, shift := range []image.Point{{0, 0}, {4, -2}, {-9, 10}, {-1, -6}} {
+		dx, dy := estimateTranslation(newColourPlane(src), newColourPlane(displaced(src, shift.X, shift.Y)))
+		if image.Pt(dx, dy) != shift {
+			t.Errorf("estimateTranslation of content moved by %v = (%d, %d)", shift, dx, dy)
+		}
+	}
+}
+
+func TestFindOverlapRecoversShift(t *testing.T) {
+	src := noiseImage(240, 200, 4)
+	for _, shift := range []image.Point{{0, 0}, {3, 1}, {-12, 7}, {25, -40}, {-maxAlignShift, maxAlignShift}} {
+		img := displaced(src, shift.X, shift.Y)
+		dx, dy := findOverlap(context.Background(), src, img)
+		if want := shift.Mul(-1); image.Pt(dx, dy) != want {
+			t.Fatalf("findOverlap of content moved by %v = (%d, %d), want %v", shift, dx, dy, want)
+		}
+		// Moving the frame as found puts its content back on the reference's
+		aligned := shiftImage(img, dx, dy)
+		inner := src.Bounds().Inset(maxAlignShift)
+		for y := inner.Min.Y; y < inner.Max.Y; y++ {
+			for x := inner.Min.X; x < inner.Max.X; x++ {
+				if aligned.At(x, y) != src.At(x, y) {
+					t.Fatalf("shift %v: aligned frame differs from the reference at (%d, %d)", shift, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestPreviewAlignmentSigned(t *testing.T) {
+	src := noiseImage(80, 60, 5)
+	frame := displaced(src, -3, 2)
+	p := previewAlignment(src, frame, image.Pt(320, 240), image.Pt(320, 240))
+	if p.DX != -12 || p.DY != 8 || p.Difference != 0 || p.Warning != "" {
+		t.Errorf("previewAlignment = %+v, want content moved by (-12, 8) at no difference", p)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"sync"
+)
+
+// diskBudget accounts for the space jobs take under -temp-dir and -results-dir so
+// that a job short of space is refused up front instead of failing mid-write
+var diskBudget struct {
+	mu       sync.Mutex
+	reserved int64 // Bytes set aside for jobs in progress
+}
+
+// storedResultBytes is the size of all results kept for the galleries
+func storedResultBytes() int64 {
+	var total int64
+	for _, j := range jobs.list(func(j *job) bool { return j.Result != "" }) {
+		total += j.ResultSize
+	}
+	return total
+}
+
+// diskBudgetUsage returns the bytes in use or reserved and the budget, 0 for unlimited
+func diskBudgetUsage() (used, budget int64) {
+	diskBudget.mu.Lock()
+	reserved := diskBudget.reserved
+	diskBudget.mu.Unlock()
+	return storedResultBytes() + reserved, liveConfig().DiskBudgetMB << 20
+}
+
+// reserveDisk sets aside n bytes of the disk budget, returning a function that
+// gives them back once the job no longer needs them. When space is short but held
+// by jobs in progress, the client is told to retry once they finish.
+func reserveDisk(w http.ResponseWriter, n int64) (release func(), reqErr *requestError) {
+	budget := liveConfig().DiskBudgetMB << 20
+	stored := int64(0)
+	if budget > 0 {
+		stored = storedResultBytes() // Outside the lock, as it walks the job list
+	}
+
+	diskBudget.mu.Lock()
+	defer diskBudget.mu.Unlock()
+	if budget > 0 && stored+diskBudget.reserved+n > budget {
+		if diskBudget.reserved > 0 {
+			w.Header().Set("Retry-After", "30")
+		}
+		return nil, &requestError{
+			Status:  http.StatusInsufficientStorage,
+			Code:    "disk_budget_exceeded",
+			Message: fmt.Sprintf("The job needs %s of disk space but only %s of the server's %d MB budget is free; please retry later", formatMB(n), formatMB(max(budget-stored-diskBudget.reserved, 0)), budget>>20),
+		}
+	}
+	diskBudget.reserved += n
+	return releaseDisk(n), nil
+}
+
+// forceReserveDisk accounts for n bytes already on disk, even beyond the budget
+func forceReserveDisk(n int64) (release func()) {
+	diskBudget.mu.Lock()
+	diskBudget.reserved += n
+	diskBudget.mu.Unlock()
+	return releaseDisk(n)
+}
+
+// releaseDisk returns a function giving n reserved bytes back, at most once
+func releaseDisk(n int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			diskBudget.mu.Lock()
+			diskBudget.reserved -= n
+			diskBudget.mu.Unlock()
+		})
+	}
+}
+
+// estimatedResultBytes bounds the size of the stored result of a job: a JPEG at
+// the default quality rarely exceeds one byte per output pixel, one at a high
+// quality two, and a PNG, PDF or TIFF stays within its three bytes of raw RGB
+func estimatedResultBytes(frame image.Image, opts processOptions) int64 {
+	b := frame.Bounds()
+	perPixel := int64(1)
+	switch {
+	case opts.Format == formatPNG, opts.Format == formatPDF, opts.Format == formatTIFF:
+		perPixel = 3
+	case opts.Quality > 90:
+		perPixel = 2
+	}
+	return int64(b.Dx()) * int64(b.Dy()) * int64(opts.Scale) * int64(opts.Scale) * perPixel
+}
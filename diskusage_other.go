@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// diskUsage is not implemented on this platform; disk checks are reported as unknown
+func diskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
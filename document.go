@@ -0,0 +1,317 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+)
+
+// pageAnalysisWidth is the width frames are reduced to for finding the page,
+// which needs its outline rather than its detail
+const pageAnalysisWidth = 400
+
+// minPageArea is the smallest share of the frame a page must cover to be taken
+// for one; anything smaller is more likely a bright patch of the background
+const minPageArea = 0.2
+
+// pageQuad holds the corners of a page in a frame, in pixels
+type pageQuad struct {
+	topLeft, topRight, bottomRight, bottomLeft [2]float64
+}
+
+// findPage finds the outline of a sheet of paper in img: the largest bright
+// region apart from its surroundings, its corners taken where it reaches
+// furthest towards the corners of the frame. It reports false when nothing
+// covers enough of the frame to be a page.
+func findPage(img image.Image) (pageQuad, bool) {
+	b := img.Bounds()
+	step := max(1, b.Dx()/pageAnalysisWidth)
+	w, h := b.Dx()/step, b.Dy()/step
+	if w < 2 || h < 2 {
+		return pageQuad{}, false
+	}
+	luma := make([]uint8, w*h)
+	var histogram [256]int
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := color.GrayModel.Convert(img.At(b.Min.X+x*step, b.Min.Y+y*step)).(color.Gray).Y
+			luma[y*w+x] = l
+			histogram[l]++
+		}
+	}
+	threshold := otsuThreshold(histogram[:], w*h)
+
+	// Keep the largest 4-connected region brighter than the threshold
+	label := make([]int32, w*h)
+	var best []int
+	queue := make([]int, 0, w*h)
+	next := int32(0)
+	for start := range luma {
+		if label[start] != 0 || luma[start] <= threshold {
+			continue
+		}
+		next++
+		label[start] = next
+		queue = append(queue[:0], start)
+		for i := 0; i < len(queue); i++ {
+			p := queue[i]
+			x, y := p%w, p/w
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= w || n[1] < 0 || n[1] >= h {
+					continue
+				}
+				q := n[1]*w + n[0]
+				if label[q] == 0 && luma[q] > threshold {
+					label[q] = next
+					queue = append(queue, q)
+				}
+			}
+		}
+		if len(queue) > len(best) {
+			best = append(best[:0], queue...)
+		}
+	}
+	if float64(len(best)) < minPageArea*float64(w*h) {
+		return pageQuad{}, false
+	}
+
+	// The corners reach furthest along the diagonals
+	minSum, maxSum, minDiff, maxDiff := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	var quad pageQuad
+	for _, p := range best {
+		x, y := float64(p%w), float64(p/w)
+		if s := x + y; s < minSum {
+			minSum, quad.topLeft = s, [2]float64{x, y}
+		}
+		if s := x + y; s > maxSum {
+			maxSum, quad.bottomRight = s, [2]float64{x, y}
+		}
+		if d := x - y; d > maxDiff {
+			maxDiff, quad.topRight = d, [2]float64{x, y}
+		}
+		if d := x - y; d < minDiff {
+			minDiff, quad.bottomLeft = d, [2]float64{x, y}
+		}
+	}
+	for _, corner := range []*[2]float64{&quad.topLeft, &quad.topRight, &quad.bottomRight, &quad.bottomLeft} {
+		corner[0] = float64(b.Min.X) + (corner[0]+0.5)*float64(step)
+		corner[1] = float64(b.Min.Y) + (corner[1]+0.5)*float64(step)
+	}
+	return quad, true
+}
+
+// otsuThreshold returns the level that best splits a histogram of n values in two
+func otsuThreshold(histogram []int, n int) uint8 {
+	total := 0.0
+	for level, count := range histogram {
+		total += float64(level * count)
+	}
+	var below, belowSum, bestVariance float64
+	var threshold uint8
+	for level, count := range histogram {
+		below += float64(count)
+		if below == 0 || below == float64(n) {
+			continue
+		}
+		belowSum += float64(level * count)
+		meanBelow := belowSum / below
+		meanAbove := (total - belowSum) / (float64(n) - below)
+		if variance := below * (float64(n) - below) * (meanBelow - meanAbove) * (meanBelow - meanAbove); variance > bestVariance {
+			bestVariance, threshold = variance, uint8(level)
+		}
+	}
+	return threshold
+}
+
+// size returns the width and height the page is straightened to: its longer
+// opposite edges, so no detail is squeezed
+func (q pageQuad) size() image.Point {
+	dist := func(a, b [2]float64) float64 { return math.Hypot(a[0]-b[0], a[1]-b[1]) }
+	return image.Pt(
+		int(math.Round(max(dist(q.topLeft, q.topRight), dist(q.bottomLeft, q.bottomRight)))),
+		int(math.Round(max(dist(q.topLeft, q.bottomLeft), dist(q.topRight, q.bottomRight)))))
+}
+
+// rectifyFrames straightens the page in every frame to the rectangle of the
+// page in the reference, the first frame, by undoing the perspective each was
+// shot with, so the frames line up like flat scans. Frames in which no page is
+// found are straightened with the outline of the reference; when the reference
+// shows no page, the frames are kept as they are.
+func rectifyFrames(images []image.Image) []image.Image {
+	reference, ok := findPage(images[0])
+	if !ok {
+		slog.Warn("No page found in the reference frame, so the frames are not straightened")
+		return images
+	}
+	size := reference.size()
+	rectified := make([]image.Image, len(images))
+	for i, img := range images {
+		quad, ok := findPage(img)
+		if !ok {
+			slog.Warn("No page found in a frame, so it is straightened like the reference", "frame", i)
+			quad = reference
+		}
+		rectified[i] = warpPage(img, quad, size)
+	}
+	return rectified
+}
+
+// warpPage maps the quadrilateral quad of img onto an image of the given size
+// with the perspective transform between them, sampling bilinearly
+func warpPage(img image.Image, quad pageQuad, size image.Point) *image.RGBA {
+	w, h := float64(size.X), float64(size.Y)
+	m := homography([4][2]float64{{0, 0}, {w, 0}, {w, h}, {0, h}}, [4][2]float64{quad.topLeft, quad.topRight, quad.bottomRight, quad.bottomLeft})
+	src := image.NewRGBA(img.Bounds())
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	out := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			u, v := float64(x)+0.5, float64(y)+0.5
+			d := m[6]*u + m[7]*v + 1
+			sx, sy := (m[0]*u+m[1]*v+m[2])/d-0.5, (m[3]*u+m[4]*v+m[5])/d-0.5
+			out.SetRGBA(x, y, bilinearAt(src, sx, sy))
+		}
+	}
+	return out
+}
+
+// bilinearAt samples img at a fractional position, clamped to its edges
+func bilinearAt(img *image.RGBA, x, y float64) color.RGBA {
+	b := img.Bounds()
+	x = min(max(x, float64(b.Min.X)), float64(b.Max.X-1))
+	y = min(max(y, float64(b.Min.Y)), float64(b.Max.Y-1))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, b.Max.X-1), min(y0+1, b.Max.Y-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+	var out [4]uint8
+	for c := range out {
+		at := func(px, py int) float64 { return float64(img.Pix[img.PixOffset(px, py)+c]) }
+		top := at(x0, y0)*(1-fx) + at(x1, y0)*fx
+		bottom := at(x0, y1)*(1-fx) + at(x1, y1)*fx
+		out[c] = uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+	return color.RGBA{out[0], out[1], out[2], out[3]}
+}
+
+// homography returns the perspective transform taking the points from onto
+// the points to, as the first eight entries of its 3x3 matrix, the ninth being 1
+func homography(from, to [4][2]float64) [8]float64 {
+	// Each pair of points gives two rows of the linear system in the eight entries
+	var a [8][9]float64
+	for i := range 4 {
+		u, v, x, y := from[i][0], from[i][1], to[i][0], to[i][1]
+		a[2*i] = [9]float64{u, v, 1, 0, 0, 0, -u * x, -v * x, x}
+		a[2*i+1] = [9]float64{0, 0, 0, u, v, 1, -u * y, -v * y, y}
+	}
+	// Gaussian elimination with partial pivoting
+	for col := range 8 {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		if a[col][col] == 0 {
+			continue // Degenerate corners; the entry stays zero
+		}
+		for row := range 8 {
+			if row == col {
+				continue
+			}
+			f := a[row][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+	var m [8]float64
+	for i := range m {
+		if a[i][i] != 0 {
+			m[i] = a[i][8] / a[i][i]
+		}
+	}
+	return m
+}
+
+// flattenBlock is the size of the blocks, in pixels, whose brightest value
+// stands for the paper under them when flattening the background
+const flattenBlock = 32
+
+// flattenBackground evens out the light falling on a page: it estimates the
+// paper's brightness everywhere from the brightest pixel of each block, smoothed
+// across neighbouring blocks, and divides every pixel by it, so shadows and
+// gradients turn white while ink keeps its contrast
+func flattenBackground(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	bw, bh := (w+flattenBlock-1)/flattenBlock, (h+flattenBlock-1)/flattenBlock
+	paper := make([]float64, bw*bh)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := out.PixOffset(x, y)
+			l := 0.299*float64(out.Pix[i]) + 0.587*float64(out.Pix[i+1]) + 0.114*float64(out.Pix[i+2])
+			block := (y/flattenBlock)*bw + x/flattenBlock
+			paper[block] = max(paper[block], l)
+		}
+	}
+	// Smooth over the neighbouring blocks, so a block that is all ink takes the paper around it
+	smoothed := make([]float64, len(paper))
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			sum, n := 0.0, 0.0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if nx, ny := bx+dx, by+dy; nx >= 0 && nx < bw && ny >= 0 && ny < bh {
+						sum += paper[ny*bw+nx]
+						n++
+					}
+				}
+			}
+			smoothed[by*bw+bx] = max(sum/n, paper[by*bw+bx]*0.5)
+		}
+	}
+	for y := 0; y < h; y++ {
+		// Interpolate between block centres, so block edges do not show
+		fy := min(max((float64(y)+0.5)/flattenBlock-0.5, 0), float64(bh-1))
+		y0 := int(fy)
+		y1 := min(y0+1, bh-1)
+		ty := fy - float64(y0)
+		for x := 0; x < w; x++ {
+			fx := min(max((float64(x)+0.5)/flattenBlock-0.5, 0), float64(bw-1))
+			x0 := int(fx)
+			x1 := min(x0+1, bw-1)
+			tx := fx - float64(x0)
+			level := (smoothed[y0*bw+x0]*(1-tx)+smoothed[y0*bw+x1]*tx)*(1-ty) + (smoothed[y1*bw+x0]*(1-tx)+smoothed[y1*bw+x1]*tx)*ty
+			gain := 255 / max(level, 1)
+			i := out.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				out.Pix[i+c] = uint8(math.Min(math.Round(float64(out.Pix[i+c])*gain), 255))
+			}
+		}
+	}
+	return out
+}
+
+// binarizeThreshold is the brightness below which a pixel of a flattened page
+// is taken for ink when binarizing
+const binarizeThreshold = 160
+
+// binarize turns img to black ink on white paper, in place
+func binarize(img *image.RGBA) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			value := uint8(255)
+			if 0.299*float64(img.Pix[i])+0.587*float64(img.Pix[i+1])+0.114*float64(img.Pix[i+2]) < binarizeThreshold {
+				value = 0
+			}
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = value, value, value
+		}
+	}
+}
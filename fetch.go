@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxFetchRedirects bounds the redirects followed when fetching a frame
+const maxFetchRedirects = 5
+
+// errPrivateAddress refuses connections to the server's own network
+var errPrivateAddress = errors.New("address is not publicly routable")
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice but not
+// covered by netip.Addr.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// refusePrivateAddresses is a dialer control that keeps fetches from reaching
+// loopback, private or link-local hosts, checked on the address actually dialed
+// so DNS tricks and redirects cannot get around it
+func refusePrivateAddresses(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, ip)
+	}
+	return nil
+}
+
+// publicAddressesOnly applies refusePrivateAddresses unless -fetch-private lifts it
+func publicAddressesOnly(network, address string, c syscall.RawConn) error {
+	if config.FetchPrivate {
+		return nil
+	}
+	return refusePrivateAddresses(network, address, c)
+}
+
+// fetchClient downloads frames; proxies are not used so every connection passes
+// the address check
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicAddressesOnly,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxFetchRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+		}
+		if !fetchSchemeAllowed(req.URL.Scheme) {
+			return fmt.Errorf("redirect to a %s URL is not allowed", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// fetchSchemeAllowed reports whether frames may be fetched from URLs with scheme
+func fetchSchemeAllowed(scheme string) bool {
+	for _, allowed := range strings.Split(config.FetchSchemes, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), scheme) && scheme != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// frameURLs returns the image URLs of the submitted form: repeated urls fields,
+// each of which may also hold several URLs separated by whitespace
+func frameURLs(r *http.Request) []string {
+	var urls []string
+	for _, field := range r.MultipartForm.Value["urls"] {
+		urls = append(urls, strings.Fields(field)...)
+	}
+	return urls
+}
+
+// fileInputRequired makes the upload form insist on files unless frames can be
+// given by URL or from a cloud drive
+func fileInputRequired() string {
+	if config.FetchSchemes != "" || cloudImportEnabled() {
+		return ""
+	}
+	return "required"
+}
+
+// frameURLField renders the upload form field for frame URLs when fetching is enabled
+func frameURLField(r *http.Request) string {
+	if config.FetchSchemes == "" {
+		return ""
+	}
+	return `<div class="mb-3">
+	<label for="urls" class="form-label">` + tr(r, "Or image URLs, one per line") + `</label>
+	<textarea name="urls" id="urls" rows="3" class="form-control" placeholder="https://example.com/frame1.jpg"></textarea>
+	</div>`
+}
+
+// checkFrameURLs validates the URLs of a request before any is fetched
+func checkFrameURLs(urls []string) *requestError {
+	if len(urls) == 0 {
+		return nil
+	}
+	if config.FetchSchemes == "" {
+		return &requestError{Status: http.StatusBadRequest, Code: "fetch_disabled", Message: "This server does not fetch frames from URLs. Please upload the files instead."}
+	}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return &requestError{Status: http.StatusBadRequest, Code: "invalid_url", Message: fmt.Sprintf("%q is not a valid absolute URL.", raw)}
+		}
+		if !fetchSchemeAllowed(u.Scheme) {
+			return &requestError{Status: http.StatusBadRequest, Code: "invalid_url", Message: fmt.Sprintf("URL %s uses a scheme that is not allowed; allowed schemes: %s", raw, config.FetchSchemes)}
+		}
+	}
+	return nil
+}
+
+// fetchFrame downloads one frame into memory within the per-file limit and the
+// remaining total budget, and returns its content
+func fetchFrame(ctx context.Context, rawURL string, budget int64) ([]byte, *requestError) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, &requestError{Status: http.StatusBadGateway, Code: "fetch_failed", Message: fmt.Sprintf("Error fetching %s: %s", rawURL, err)}
+	}
+	req.Header.Set("Accept", "image/*")
+	return downloadFrame(req, rawURL, budget)
+}
+
+// downloadFrame sends req for the frame called name in errors and reads it like
+// fetchFrame, within -fetch-timeout
+func downloadFrame(req *http.Request, name string, budget int64) ([]byte, *requestError) {
+	ctx, cancel := context.WithTimeout(req.Context(), config.FetchTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	failed := func(reason string) *requestError {
+		return &requestError{Status: http.StatusBadGateway, Code: "fetch_failed", Message: fmt.Sprintf("Error fetching %s: %s", name, reason)}
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_url", Message: fmt.Sprintf("URL %s points to a private network address, which is not allowed.", name)}
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, failed(fmt.Sprintf("no complete response within %s", config.FetchTimeout))
+		}
+		return nil, failed(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, failed(resp.Status)
+	}
+
+	// Read one byte past the limit to tell a file at the limit from a larger one
+	limit, tooLarge := budget, uploadTooLarge()
+	if fileLimit := liveConfig().MaxFileMB << 20; fileLimit > 0 && (limit <= 0 || fileLimit < limit) {
+		limit = fileLimit
+		tooLarge = &requestError{Status: http.StatusRequestEntityTooLarge, Code: "file_too_large", Message: fmt.Sprintf("File at %s is above the %d MB limit per frame.", name, fileLimit>>20)}
+	}
+	var body io.Reader = resp.Body
+	if limit > 0 {
+		if resp.ContentLength > limit {
+			return nil, tooLarge
+		}
+		body = io.LimitReader(resp.Body, limit+1)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(body); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, failed(fmt.Sprintf("no complete response within %s", config.FetchTimeout))
+		}
+		return nil, failed(err.Error())
+	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		return nil, tooLarge
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Video files are demuxed and muxed by ffmpeg, run as a separate program with
+// frames passed through pipes as PNG images, so no codec is built in and the
+// same build reads and writes whatever the installed ffmpeg supports.
+
+// ffmpegEnv names the ffmpeg binary when it is not on PATH as "ffmpeg"
+const ffmpegEnv = "CHICHA_SR_FFMPEG"
+
+// errNoFFmpeg explains how to get ffmpeg when a video needs it
+var errNoFFmpeg = fmt.Errorf("video files need ffmpeg, which was not found on PATH: install it (https://ffmpeg.org/download.html, or the ffmpeg package of your system) or set %s to its path", ffmpegEnv)
+
+// videoExtensions are the extensions of files read as videos
+var videoExtensions = []string{".3gp", ".avi", ".flv", ".m2ts", ".m4v", ".mkv", ".mov", ".mp4", ".mpeg", ".mpg", ".mts", ".webm", ".wmv"}
+
+// isVideoFile reports whether the file at path is read as a video, by its extension
+func isVideoFile(path string) bool {
+	return slices.Contains(videoExtensions, strings.ToLower(filepath.Ext(path)))
+}
+
+// findFFmpeg returns the ffmpeg binary to run: the one named by CHICHA_SR_FFMPEG,
+// or ffmpeg on PATH
+func findFFmpeg() (string, error) {
+	if name := os.Getenv(ffmpegEnv); name != "" {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", fmt.Errorf("%s=%s: %w", ffmpegEnv, name, err)
+		}
+		return path, nil
+	}
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", errNoFFmpeg
+	}
+	return path, nil
+}
+
+// videoClip selects the frames taken from a video
+type videoClip struct {
+	Start  time.Duration // Position of the first frame
+	Frames int           // Frames taken from there on, 0 for all to the end
+}
+
+// defaultVideoFrames is how many frames are taken from a video unless -video-frames says otherwise
+const defaultVideoFrames = 30
+
+// videoFlags adds the flags selecting the frames of video files to fs
+func videoFlags(fs *flag.FlagSet) *videoClip {
+	clip := &videoClip{}
+	fs.DurationVar(&clip.Start, "video-start", 0, "position in video files the frames are taken from, e.g. 1m30s (needs ffmpeg)")
+	fs.IntVar(&clip.Frames, "video-frames", defaultVideoFrames, "frames taken from each video file (0 for all to the end, which may take a lot of memory)")
+	return clip
+}
+
+// ffmpegError is the failure of an ffmpeg run, with what it printed about it
+type ffmpegError struct {
+	err    error
+	stderr string
+}
+
+func (e *ffmpegError) Error() string {
+	if e.stderr == "" {
+		return "ffmpeg: " + e.err.Error()
+	}
+	return "ffmpeg: " + e.err.Error() + ": " + e.stderr
+}
+
+func (e *ffmpegError) Unwrap() error { return e.err }
+
+// runFFmpeg runs ffmpeg with args, its standard input and output connected to
+// stdin and stdout, which may be nil. Failures carry the last lines ffmpeg printed.
+func runFFmpeg(ctx context.Context, args []string, stdin io.Reader, stdout func(io.Reader) error) error {
+	bin, err := findFFmpeg()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, bin, append([]string{"-hide_banner", "-loglevel", "error"}, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return &ffmpegError{err: err}
+	}
+	var readErr error
+	if stdout != nil {
+		readErr = stdout(out)
+	}
+	io.Copy(io.Discard, out) // Let ffmpeg finish writing what was not read
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &ffmpegError{err: err, stderr: lastLines(stderr.String(), 3)}
+	}
+	return readErr
+}
+
+// lastLines returns the last n lines of s, joined by "; "
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.Join(lines[max(len(lines)-n, 0):], "; ")
+}
+
+// readVideoFrames decodes the frames clip selects from the video at path
+func readVideoFrames(ctx context.Context, path string, clip videoClip) ([]image.Image, error) {
+	args := []string{"-nostdin"}
+	if clip.Start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(clip.Start.Seconds(), 'f', -1, 64))
+	}
+	args = append(args, "-i", path, "-map", "0:v:0")
+	if clip.Frames > 0 {
+		args = append(args, "-frames:v", strconv.Itoa(clip.Frames))
+	}
+	args = append(args, "-f", "image2pipe", "-c:v", "png", "-")
+	var frames []image.Image
+	err := runFFmpeg(ctx, args, nil, func(r io.Reader) (err error) {
+		frames, err = readFrameStream(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("no frames were read: the video is empty or -video-start is past its end")
+	}
+	return frames, nil
+}
+
+// writeVideo encodes the frames that frames puts, one by one, as a video at
+// path, its format chosen by ffmpeg from the extension, playing at fps frames
+// per second. Frames are encoded as they come, so a long clip is never held in
+// memory; an error of frames stops the encoding and is returned.
+func writeVideo(ctx context.Context, path string, fps float64, frames func(put func(image.Image) error) error) error {
+	pr, pw := io.Pipe()
+	produced := make(chan error, 1)
+	go func() {
+		encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+		err := frames(func(frame image.Image) error { return encoder.Encode(pw, frame) })
+		pw.CloseWithError(err)
+		produced <- err
+	}()
+	args := []string{"-y", "-f", "image2pipe", "-framerate", strconv.FormatFloat(fps, 'f', -1, 64), "-c:v", "png", "-i", "-",
+		// Most players need 4:2:0 chroma, which needs even dimensions
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2", "-pix_fmt", "yuv420p", path}
+	err := runFFmpeg(ctx, args, pr, nil)
+	pr.CloseWithError(io.ErrClosedPipe) // Stops the encoder when ffmpeg quit early
+	if framesErr := <-produced; framesErr != nil && !errors.Is(framesErr, io.ErrClosedPipe) {
+		return framesErr
+	}
+	return err
+}
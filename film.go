@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+)
+
+// A film scanner that takes several passes over a frame reads the same grain
+// and dyes every time, with noise of its own on top, while dust that settles or
+// shifts between passes, and the specks of a single pass, turn up in one of them
+// only. With the film option, a pixel of a pass that strays far from the median
+// of the passes is taken for dust and replaced with that median, and each pass
+// is weighted by how closely it follows the median: the grain, which every pass
+// shares, is part of the picture and does not count against a pass as noise
+// would. The negative option turns the scans of negatives into positives first.
+
+// Negative inversion
+const (
+	filmBaseShare  = 0.995 // Share of the pixels of the reference, channel by channel, below the film base
+	filmDenseShare = 0.005 // Share below the densest part of the negative, which turns white
+)
+
+// Rejection and weighting of passes
+const (
+	filmRejectSigma = 4 // Deviations from the median of the passes, in noise levels of the noisiest pass, that make a pixel dust
+	filmNoiseFloor  = 2 // Least noise level of a pass, in 8-bit levels, so identical passes keep their fine detail
+)
+
+// invertNegatives turns the scans of negatives into positives. The film base,
+// the brightest the unexposed film lets through, turns black and the densest
+// part of the negative white, channel by channel, which takes the orange cast
+// of the base of colour negatives away with it. Both are measured on the
+// reference, so every frame is inverted alike.
+func invertNegatives(ctx context.Context, images []image.Image) []image.Image {
+	var histograms [3][]int
+	for c := range histograms {
+		histograms[c] = make([]int, 1<<16)
+	}
+	b := images[0].Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := images[0].At(x, y).RGBA()
+			histograms[0][r]++
+			histograms[1][g]++
+			histograms[2][bl]++
+		}
+	}
+	var base, dense [3]float64
+	for c, histogram := range histograms {
+		base[c] = histogramShare(histogram, filmBaseShare)
+		dense[c] = histogramShare(histogram, filmDenseShare)
+		if base[c] <= dense[c] { // A channel of one level
+			dense[c] = base[c] - 1
+		}
+	}
+	slog.InfoContext(ctx, "Inverting negatives", "base_r", int(base[0])>>8, "base_g", int(base[1])>>8, "base_b", int(base[2])>>8)
+	positives := make([]image.Image, len(images))
+	for i, img := range images {
+		b := img.Bounds()
+		positive := image.NewRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				p := positive.Pix[positive.PixOffset(x, y):]
+				for c, v := range [3]uint32{r, g, bl} {
+					t := (base[c] - float64(v)) / (base[c] - dense[c])
+					p[c] = uint8(math.Round(math.Min(math.Max(t, 0), 1) * 255))
+				}
+				p[3] = 0xff
+			}
+		}
+		positives[i] = positive
+	}
+	return positives
+}
+
+// histogramShare returns the level of histogram that share of its counts are below
+func histogramShare(histogram []int, share float64) float64 {
+	total := 0
+	for _, n := range histogram {
+		total += n
+	}
+	below := int(float64(total) * share)
+	seen := 0
+	for v, n := range histogram {
+		if seen += n; seen > below {
+			return float64(v)
+		}
+	}
+	return float64(len(histogram) - 1)
+}
+
+// filmPasses takes the aligned passes of a film scan and returns them with the
+// pixels that stray from the median of the passes replaced by it, and the
+// weight each pass is fused with. The noise level of a pass in a channel is
+// the robust spread of its differences from the median there. A pixel is dust
+// when a channel of it is further from the median than filmRejectSigma noise
+// levels of the noisiest pass, whose noise the median carries too; inverting a
+// negative amplifies the noise of some channels several times over the others.
+// A pass weighs the inverse of the mean of its noise levels squared over the
+// channels, scaled so the weights average 1. No noise level is taken below
+// that measured for the pass, in noise, or below filmNoiseFloor when noise is
+// nil. Fewer than three passes have no median to go by and are returned as
+// they are.
+func filmPasses(ctx context.Context, aligned []image.Image, noise []float64) ([]image.Image, []float64) {
+	if len(aligned) < 3 {
+		slog.WarnContext(ctx, "Film passes need three or more frames to tell dust from the picture, fusing them as they are", "frames", len(aligned))
+		return aligned, nil
+	}
+	b := aligned[0].Bounds()
+	passes := make([]*image.RGBA, len(aligned))
+	for i, img := range aligned {
+		passes[i] = image.NewRGBA(b)
+		draw.Draw(passes[i], b, img, b.Min, draw.Src)
+	}
+
+	// The median of the passes, and how far each pass is from it
+	median := image.NewRGBA(b)
+	deviations := make([][3][256]int, len(passes))
+	var mu sync.Mutex
+	forRowBands(b, func(y0, y1 int) {
+		values := make([]uint8, len(passes))
+		local := make([][3][256]int, len(passes))
+		for y := y0; y < y1; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				o := median.PixOffset(x, y)
+				for c := 0; c < 3; c++ {
+					for i, pass := range passes {
+						values[i] = pass.Pix[o+c]
+					}
+					slices.Sort(values)
+					m := values[len(values)/2]
+					if len(values)%2 == 0 {
+						m = uint8((int(values[len(values)/2-1]) + int(m) + 1) / 2)
+					}
+					median.Pix[o+c] = m
+					for i, pass := range passes {
+						local[i][c][absDiff(pass.Pix[o+c], m)]++
+					}
+				}
+				median.Pix[o+3] = 0xff
+			}
+		}
+		mu.Lock()
+		for i := range local {
+			for c := range local[i] {
+				for d, n := range local[i][c] {
+					deviations[i][c][d] += n
+				}
+			}
+		}
+		mu.Unlock()
+	})
+	if ctx.Err() != nil {
+		return aligned, nil
+	}
+	spread := make([][3]float64, len(passes))
+	var limit [3]uint8
+	for i := range passes {
+		floor := float64(filmNoiseFloor)
+		if noise != nil {
+			floor = noise[i]
+		}
+		for c := range spread[i] {
+			spread[i][c] = max(1.4826*histogramShare(deviations[i][c][:], 0.5), floor) // The median absolute deviation, as the standard deviation of Gaussian noise
+			limit[c] = max(limit[c], uint8(math.Min(filmRejectSigma*spread[i][c], 255)))
+		}
+	}
+
+	// Dust is replaced with the median, in every channel of the pixel
+	rejected := make([]int, len(passes))
+	for i, pass := range passes {
+		forRowBands(b, func(y0, y1 int) {
+			n := 0
+			for y := y0; y < y1; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					o := pass.PixOffset(x, y)
+					if absDiff(pass.Pix[o], median.Pix[o]) > limit[0] || absDiff(pass.Pix[o+1], median.Pix[o+1]) > limit[1] || absDiff(pass.Pix[o+2], median.Pix[o+2]) > limit[2] {
+						copy(pass.Pix[o:o+3], median.Pix[o:o+3])
+						n++
+					}
+				}
+			}
+			mu.Lock()
+			rejected[i] += n
+			mu.Unlock()
+		})
+	}
+
+	weights := make([]float64, len(passes))
+	sum := 0.0
+	for i, n := range spread {
+		weights[i] = 3 / (n[0]*n[0] + n[1]*n[1] + n[2]*n[2])
+		sum += weights[i]
+	}
+	out := make([]image.Image, len(passes))
+	for i := range weights {
+		weights[i] *= float64(len(weights)) / sum
+		out[i] = passes[i]
+		slog.InfoContext(ctx, "Film pass weighed", "frame", i, "noise_r", spread[i][0], "noise_g", spread[i][1], "noise_b", spread[i][2], "weight", weights[i], "dust_pixels", rejected[i])
+	}
+	return out, weights
+}
+
+// absDiff returns the distance between two 8-bit levels
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
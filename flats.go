@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"math"
+	"net/http"
+)
+
+// minFlatGain is the least a pixel of the master flat is taken to pass of the
+// light, so a dead pixel or a speck of dust on the flat frames cannot blow the
+// frames up where it lies
+const minFlatGain = 0.05
+
+// flatField is the master flat of flat frames: for every pixel and channel,
+// the share of the light the optics pass there against the field's average
+type flatField struct {
+	width, height int
+	gain          []float64 // Three per pixel, row by row
+}
+
+// averageFlats returns the master flat of flat frames, shot of an empty,
+// evenly lit field: their per-pixel mean, in which the noise of each averages
+// out, divided by its own mean in every channel, so that what remains is the
+// vignetting of the optics and the shadows of dust on the sensor
+func averageFlats(flats []image.Image) (*flatField, *requestError) {
+	b := flats[0].Bounds()
+	flat := &flatField{width: b.Dx(), height: b.Dy(), gain: make([]float64, b.Dx()*b.Dy()*3)}
+	for n, frame := range flats {
+		if frame.Bounds().Size() != b.Size() {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Flat frame %d is %dx%d but the first is %dx%d", n, frame.Bounds().Dx(), frame.Bounds().Dy(), b.Dx(), b.Dy())}
+		}
+		fb := frame.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r, g, bl, _ := frame.At(fb.Min.X+x, fb.Min.Y+y).RGBA()
+				i := (y*b.Dx() + x) * 3
+				flat.gain[i] += float64(r)
+				flat.gain[i+1] += float64(g)
+				flat.gain[i+2] += float64(bl)
+			}
+		}
+	}
+	for c := 0; c < 3; c++ {
+		mean := 0.0
+		for i := c; i < len(flat.gain); i += 3 {
+			mean += flat.gain[i]
+		}
+		mean /= float64(b.Dx() * b.Dy())
+		if mean == 0 {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "The flat frames are black: they must be shot of an evenly lit field"}
+		}
+		for i := c; i < len(flat.gain); i += 3 {
+			flat.gain[i] = max(flat.gain[i]/mean, minFlatGain)
+		}
+	}
+	return flat, nil
+}
+
+// divideFlat divides every frame, which must be the size of the master flat,
+// by it. 16-bit grayscale frames stay 16-bit, divided by the mean gain of the
+// channels.
+func divideFlat(images []image.Image, flat *flatField) ([]image.Image, *requestError) {
+	out := make([]image.Image, len(images))
+	for n, img := range images {
+		b := img.Bounds()
+		if b.Dx() != flat.width || b.Dy() != flat.height {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Frame %d is %dx%d but the flat frames are %dx%d: they must come from the same camera and optics", n, b.Dx(), b.Dy(), flat.width, flat.height)}
+		}
+		if gray, ok := img.(*image.Gray16); ok {
+			even := image.NewGray16(b)
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					i := (y*b.Dx() + x) * 3
+					gain := (flat.gain[i] + flat.gain[i+1] + flat.gain[i+2]) / 3
+					v := float64(gray.Gray16At(b.Min.X+x, b.Min.Y+y).Y) / gain
+					even.SetGray16(b.Min.X+x, b.Min.Y+y, color.Gray16{Y: uint16(math.Min(math.Round(v), 0xffff))})
+				}
+			}
+			out[n] = even
+			continue
+		}
+		even := image.NewRGBA(b)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				i := (y*b.Dx() + x) * 3
+				p := even.Pix[even.PixOffset(b.Min.X+x, b.Min.Y+y):]
+				for c, v := range [3]uint32{r, g, bl} {
+					p[c] = uint8(math.Min(math.Round(float64(v>>8)/flat.gain[i+c]), 255))
+				}
+				p[3] = 0xff
+			}
+		}
+		out[n] = even
+	}
+	return out, nil
+}
+
+// divideUploadedFlats divides the frames by the flat frames uploaded with the
+// request, if any
+func divideUploadedFlats(r *http.Request, images []image.Image) ([]image.Image, *requestError) {
+	flats, reqErr := uploadedCalibrationFrames(r, "flats")
+	if reqErr != nil || flats == nil {
+		return images, reqErr
+	}
+	flat, reqErr := averageFlats(flats)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	slog.InfoContext(r.Context(), "Dividing by flat frames", "flats", len(flats))
+	return divideFlat(images, flat)
+}
+
+// flatFramesField renders the flat-frame input of the upload form
+func flatFramesField(r *http.Request) string {
+	return `<div class="mb-3">
+	<label for="flats" class="form-label">` + tr(r, "Flat frames (optional)") + `</label>
+	<input type="file" name="flats" id="flats" accept="image/jpeg,image/png,image/gif,image/tiff,.tif,.tiff" multiple class="form-control">
+	<div class="form-text">` + tr(r, "For microscopes and telescopes: frames of an empty, evenly lit field through the same optics. The frames are divided by them, evening out vignetting and the shadows of dust.") + `</div>
+	</div>`
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// How many frames a burst holds decides what fusing it can do. Fewer than
+// minGainFrames cannot fill the four sub-pixel positions of even a 2x scale,
+// so the result is little more than an upscale of the reference. Past
+// maxFusedFrames, every further frame lowers the noise by under a percent
+// while aligning and fusing it costs as much as the first, so by default the
+// sharpest maxFusedFrames of a larger burst are fused; with many_frames=all,
+// all of them are, streamed through the accumulator a few at a time. What was
+// decided is reported with the result.
+
+const (
+	minGainFrames  = 4   // Fewest frames that can fill the sub-pixel positions of a 2x scale
+	maxFusedFrames = 100 // Most frames fused unless many_frames asks for all
+)
+
+// Ways of the many_frames parameter to fuse bursts of more than maxFusedFrames
+const (
+	manyFramesSelect = "select" // Fuse the sharpest maxFusedFrames, the reference among them; the default
+	manyFramesAll    = "all"    // Fuse every frame
+)
+
+// manyFramesModes are the accepted values of the many_frames parameter besides "",
+// which stands for manyFramesSelect
+var manyFramesModes = []string{manyFramesSelect, manyFramesAll}
+
+// limitsFrames reports whether the frame-count policy picks the frames fused
+// out of submitted: the burst is larger than maxFusedFrames, and neither keep,
+// align=planet, offsets given by frame nor many_frames=all pick them instead
+func (opts processOptions) limitsFrames(submitted int) bool {
+	return submitted > maxFusedFrames && opts.ManyFrames != manyFramesAll && opts.Keep == 0 && opts.Align != alignPlanet && opts.Offsets == nil
+}
+
+// frameCountNote puts what the frame-count policy decided or warns of for the
+// opts.Submitted frames, opts.Fused of which were fused, into words with
+// format, which translates it for a page; "" when there is nothing to say
+func (opts processOptions) frameCountNote(format func(string, ...any) string) string {
+	switch {
+	case opts.Fused < opts.Submitted && opts.limitsFrames(opts.Submitted):
+		return format("%d frames were submitted and the sharpest %d of them were fused: more would barely lower the noise further. Set many_frames to %s (-many-frames %s) to fuse every frame.", opts.Submitted, opts.Fused, manyFramesAll, manyFramesAll)
+	case opts.Fused > 0 && opts.Fused < minGainFrames && opts.Scale > 1 && opts.Algorithm != algorithmReference:
+		return format("Only %d frame(s) were fused: fewer than %d cannot add real detail, so the result is little more than an upscale of the reference. Fuse a burst of %d or more frames taken from slightly different positions.", opts.Fused, minGainFrames, minGainFrames)
+	}
+	return ""
+}
+
+// frameCountNotice renders the frame-count note of opts for the result page, if there is one
+func frameCountNotice(r *http.Request, opts processOptions) string {
+	note := opts.frameCountNote(func(format string, args ...any) string { return trf(r, format, args...) })
+	if note == "" {
+		return ""
+	}
+	return `<div class="alert alert-warning" role="alert">` + html.EscapeString(note) + `</div>`
+}
+
+// countFrames records in opts how many frames were submitted and how many of
+// them prepareFrames left to fuse, and returns the note on them, in English
+func (opts *processOptions) countFrames(submitted, fused int) string {
+	opts.Submitted, opts.Fused = submitted, fused
+	return opts.frameCountNote(fmt.Sprintf)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Frames of a burst are aligned with the reference pixel for pixel, so all of
+// them must be its size. One saved turned a quarter, or taken with another
+// camera or at another resolution, is rejected with the names and sizes of the
+// odd frames, unless the fit option brings them to a common size first.
+
+// Ways of the fit parameter to bring the frames to a common size
+const (
+	fitCrop   = "crop"   // Cut every frame about its centre to the width and height all of them have
+	fitResize = "resize" // Scale every frame to cover the reference, keeping its shape, and cut it about its centre to that size
+)
+
+// fitModes are the accepted values of the fit parameter besides "", which
+// rejects frames of another size than the reference
+var fitModes = []string{fitCrop, fitResize}
+
+// fitFlagUsage describes the -fit flag of the commands
+const fitFlagUsage = "bring frames of another size than the reference to a common size: " + fitCrop + " cuts them about their centre to the size all of them have, " + fitResize + " scales them to cover the reference, keeping their shape (default rejects them)"
+
+// frameNames returns what messages call the frames decoded from paths, given
+// how many there are: their paths when every path held one frame, their
+// numbers from 0 when videos or a stream on standard input held more
+func frameNames(paths []string, frames int) []string {
+	if len(paths) == frames {
+		return paths
+	}
+	names := make([]string, frames)
+	for i := range names {
+		names[i] = fmt.Sprintf("frame %d", i)
+	}
+	return names
+}
+
+// sizeMismatch describes the frames of another size than the one at index
+// reference, by their names, or returns "" when all of them are its size
+func sizeMismatch(sizes []image.Point, names []string, reference int) string {
+	want := sizes[reference]
+	var odd []string
+	for i, size := range sizes {
+		if size == want {
+			continue
+		}
+		s := fmt.Sprintf("%s (%dx%d", names[i], size.X, size.Y)
+		if size == image.Pt(want.Y, want.X) {
+			s += ", turned a quarter"
+		}
+		odd = append(odd, s+")")
+	}
+	switch len(odd) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("%s differs in size from the reference frame %s (%dx%d), so it cannot be aligned with it", odd[0], names[reference], want.X, want.Y)
+	}
+	return fmt.Sprintf("%d frames differ in size from the reference frame %s (%dx%d), so they cannot be aligned with it: %s", len(odd), names[reference], want.X, want.Y, strings.Join(odd, ", "))
+}
+
+// fitUploadedFrames rejects uploaded frames of another size than the
+// reference, naming them by names, or brings them to a common size as the fit
+// parameter says, moving the georeferencing in tags along. A reference or fit
+// the request options reject is left to them.
+func fitUploadedFrames(r *http.Request, images []image.Image, tags []*frameTags, names []string) ([]image.Image, *requestError) {
+	reference, reqErr := formInt(r, "reference")
+	if reqErr != nil || reference < 0 || reference >= len(images) {
+		return images, nil
+	}
+	sizes := make([]image.Point, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds().Size()
+	}
+	mismatch := sizeMismatch(sizes, names, reference)
+	if mismatch == "" {
+		return images, nil
+	}
+	fit := r.FormValue("fit")
+	switch fit {
+	case "":
+		return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("%s; set fit to %s or %s to bring the frames to a common size", mismatch, fitCrop, fitResize)}
+	case fitCrop, fitResize:
+		size := fittedSize(sizes, reference, fit)
+		slog.InfoContext(r.Context(), "Fitting frames to a common size", "fit", fit, "width", size.X, "height", size.Y)
+		images, corner := fitFrames(images, reference, fit)
+		tags[reference] = fitTags(tags[reference], corner)
+		return images, nil
+	}
+	return images, nil
+}
+
+// fittedSize returns the size fit brings frames of the given sizes to
+func fittedSize(sizes []image.Point, reference int, fit string) image.Point {
+	size := sizes[reference]
+	if fit == fitCrop {
+		for _, s := range sizes {
+			size = image.Pt(min(size.X, s.X), min(size.Y, s.Y))
+		}
+	}
+	return size
+}
+
+// fitFrames brings the frames to the size fittedSize gives for fit, as fitModes
+// describe, and returns them with where the region kept of the reference
+// starts in it; frames already that size are kept as they are
+func fitFrames(images []image.Image, reference int, fit string) ([]image.Image, image.Point) {
+	sizes := make([]image.Point, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds().Size()
+	}
+	size := fittedSize(sizes, reference, fit)
+	fitted := make([]image.Image, len(images))
+	var kept image.Point
+	for i, img := range images {
+		b := img.Bounds()
+		if b.Size() == size {
+			fitted[i] = img
+			continue
+		}
+		var frame draw.Image = image.NewGray16(image.Rectangle{Max: size}) // Radiometric frames keep their counts
+		if _, ok := img.(*image.Gray16); !ok {
+			frame = blankFrame(img, frame.Bounds())
+		}
+		// The largest region of the frame with the shape of the result, about its centre
+		source := size
+		if fit == fitResize {
+			scale := max(float64(size.X)/float64(b.Dx()), float64(size.Y)/float64(b.Dy()))
+			source = image.Pt(min(int(float64(size.X)/scale+0.5), b.Dx()), min(int(float64(size.Y)/scale+0.5), b.Dy()))
+		}
+		corner := b.Min.Add(b.Size().Sub(source).Div(2))
+		if i == reference {
+			kept = corner.Sub(b.Min)
+		}
+		if source == size {
+			draw.Draw(frame, frame.Bounds(), img, corner, draw.Src)
+		} else {
+			draw.CatmullRom.Scale(frame, frame.Bounds(), img, image.Rectangle{Min: corner, Max: corner.Add(source)}, draw.Src, nil)
+		}
+		fitted[i] = frame
+	}
+	return fitted, kept
+}
+
+// fitTags returns the tags t of the reference for the region of it fitFrames
+// kept from corner on
+func fitTags(t *frameTags, corner image.Point) *frameTags {
+	if t == nil || corner == (image.Point{}) {
+		return t
+	}
+	return &frameTags{Geo: t.Geo.resampled(corner, 1), Resolution: t.Resolution}
+}
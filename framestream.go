@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// pngMagic starts every PNG file
+var pngMagic = []byte("\x89PNG\r\n\x1a\n")
+
+// readFrameStream decodes the frames of r: a tar archive of image files, taken
+// in name order, or JPEG, PNG and GIF images written one after another, as
+// ffmpeg -f image2pipe produces; an animated PNG adds all its frames
+func readFrameStream(r io.Reader) ([]image.Image, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, _ := br.Peek(262)
+	if len(head) == 262 && bytes.HasPrefix(head[257:], []byte("ustar")) {
+		return readFrameTar(br)
+	}
+
+	var images []image.Image
+	for n := 1; ; n++ {
+		head, err := br.Peek(len(pngMagic))
+		if len(head) == 0 && errors.Is(err, io.EOF) {
+			break
+		}
+		var data []byte
+		switch {
+		case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+			data, err = splitJPEG(br)
+		case bytes.Equal(head, pngMagic):
+			data, err = splitPNG(br)
+		case bytes.HasPrefix(head, []byte("GIF8")):
+			// The GIF decoder reads no further than the trailer of the image
+			var img image.Image
+			if img, _, err = image.Decode(br); err != nil {
+				return nil, fmt.Errorf("frame %d of the input stream: %w", n, err)
+			}
+			images = append(images, img)
+			continue
+		default:
+			return nil, fmt.Errorf("frame %d of the input stream: unsupported format, expected a tar archive or %s images", n, supportedFormats)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("frame %d of the input stream: %w", n, err)
+		}
+		frames, _, _, err := decodeFrames(bytes.NewReader(data), 0)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d of the input stream: %w", n, err)
+		}
+		images = append(images, frames...)
+	}
+	return images, nil
+}
+
+// readFrameTar decodes the image entries of a tar archive in name order,
+// skipping folders and hidden files like archiveFrames does for ZIP uploads
+func readFrameTar(r io.Reader) ([]image.Image, error) {
+	type entry struct {
+		name   string
+		frames []image.Image // More than one for an animated PNG
+	}
+	var entries []entry
+	archive := tar.NewReader(r)
+	for {
+		hdr, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading the input tar archive: %w", err)
+		}
+		base := path.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(base, ".") || !imageFileName(base) {
+			continue
+		}
+		frames, _, _, err := decodeFrames(archive, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s in the input tar archive: unsupported format, supported formats are %s", hdr.Name, supportedFormats)
+		}
+		entries = append(entries, entry{hdr.Name, frames})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	var images []image.Image
+	for _, e := range entries {
+		images = append(images, e.frames...)
+	}
+	return images, nil
+}
+
+// splitJPEG reads one JPEG file from r, walking its segments and the
+// entropy-coded data after each scan header up to the end-of-image marker
+func splitJPEG(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return nil, err
+	}
+	buf.Write(soi)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, truncated(err)
+		}
+		if b != 0xFF {
+			return nil, errors.New("corrupt JPEG: expected a marker")
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF { // Markers may be padded with fill bytes
+			if marker, err = r.ReadByte(); err != nil {
+				return nil, truncated(err)
+			}
+		}
+		buf.Write([]byte{0xFF, marker})
+		switch {
+		case marker == 0xD9: // End of image
+			return buf.Bytes(), nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // No length or payload
+			continue
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, truncated(err)
+		}
+		length := int(binary.BigEndian.Uint16(size[:]))
+		if length < 2 {
+			return nil, errors.New("corrupt JPEG: invalid segment length")
+		}
+		buf.Write(size[:])
+		if _, err := io.CopyN(&buf, r, int64(length-2)); err != nil {
+			return nil, truncated(err)
+		}
+		if marker == 0xDA { // Start of scan: copy the coded data up to the next marker
+			if err := copyScan(&buf, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// copyScan copies entropy-coded JPEG data, in which 0xFF is followed by a
+// stuffed zero or a restart marker, and stops before the first other marker
+func copyScan(buf *bytes.Buffer, r *bufio.Reader) error {
+	for {
+		b, err := r.Peek(2)
+		if err != nil {
+			return truncated(err)
+		}
+		switch {
+		case b[0] != 0xFF:
+			buf.WriteByte(b[0])
+			r.Discard(1)
+		case b[1] == 0x00 || b[1] >= 0xD0 && b[1] <= 0xD7:
+			buf.Write(b)
+			r.Discard(2)
+		default:
+			return nil
+		}
+	}
+}
+
+// splitPNG reads one PNG file from r, chunk by chunk up to IEND
+func splitPNG(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(len(pngMagic))); err != nil {
+		return nil, err
+	}
+	for {
+		var hdr [8]byte // Length and type
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, truncated(err)
+		}
+		buf.Write(hdr[:])
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if length > 1<<31-1 {
+			return nil, errors.New("corrupt PNG: invalid chunk length")
+		}
+		if _, err := io.CopyN(&buf, r, length+4); err != nil { // Data and CRC
+			return nil, truncated(err)
+		}
+		if string(hdr[4:]) == "IEND" {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// truncated reports a stream that ends inside an image as such
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
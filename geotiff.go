@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"slices"
+)
+
+// GeoTIFF frames from drones and satellites tie their pixels to the ground with
+// tags that the TIFF decoder skips. They are read from the reference frame,
+// moved to the pixel grid of the result, cut to the roi and made finer by the
+// scale, and written with it when the result is a TIFF, so GIS programs lay
+// the result over the same place as its frames.
+
+// Tags of the GeoTIFF specification
+const (
+	tagModelPixelScale     = 33550
+	tagModelTiepoint       = 33922
+	tagModelTransformation = 34264
+	tagGeoKeyDirectory     = 34735
+	tagGeoDoubleParams     = 34736
+	tagGeoASCIIParams      = 34737
+)
+
+// Baseline TIFF tags read from frames besides their pixels
+const (
+	tagImageDescription = 270
+	tagXResolution      = 282
+	tagYResolution      = 283
+	tagResolutionUnit   = 296
+)
+
+// tagICCProfile holds the colour profile of a TIFF, see outputProfile
+const tagICCProfile = 34675
+
+// GeoTIFF raster types: whether a raster coordinate names the corner of a pixel
+// or its centre
+const (
+	geoKeyRasterType   = 1025
+	rasterPixelIsPoint = 2
+)
+
+// geoReference is the georeferencing of a frame, as its GeoTIFF tags hold it
+type geoReference struct {
+	PixelScale     []float64 // Ground size of a pixel along x, y and z, with Tiepoints
+	Tiepoints      []float64 // Raster i, j, k and model x, y, z of each tiepoint
+	Transformation []float64 // 4x4 matrix from raster to model coordinates, row by row, instead of the two above
+	KeyDirectory   []uint16  // Coordinate system keys, copied as they are
+	DoubleParams   []float64
+	ASCIIParams    string
+}
+
+// frameTags is what the tags of a TIFF frame say about where its pixels lie,
+// beyond the pixels themselves; frames of other formats have none
+type frameTags struct {
+	Geo        *geoReference    // Where the pixels lie on the ground, nil unless the frame is a GeoTIFF
+	Resolution *pixelResolution // How large the pixels are, nil unless the frame records it; see microscope.go
+}
+
+// tiffHeader reports whether head starts a TIFF file, in either byte order
+func tiffHeader(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*"))
+}
+
+// decodeFrame decodes an image in any of the supportedFormats, with the tags of
+// a TIFF, or nil for the other frames. JPEG frames are turned upright as their
+// EXIF orientation says.
+func decodeFrame(r io.Reader) (image.Image, string, *frameTags, error) {
+	br := bufio.NewReaderSize(r, exifSearch)
+	if head, _ := br.Peek(exifSearch); !tiffHeader(head) {
+		orientation := jpegOrientation(head) // Read before decoding moves past head
+		img, format, err := image.Decode(br)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return uprightFrame(img, orientation), format, nil, nil
+	}
+	data, err := io.ReadAll(br) // The tags may lie anywhere in the file
+	if err != nil {
+		return nil, "", nil, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	tags, err := readFrameTags(data)
+	return img, format, tags, err
+}
+
+// errMalformedGeoTIFF rejects frames whose GeoTIFF tags cannot be made sense of
+var errMalformedGeoTIFF = errors.New("malformed GeoTIFF tags")
+
+// readFrameTags reads the tags of the first image of the TIFF file data, which
+// has been decoded already, or returns nil when it has none of interest. Other
+// tags the reader cannot make sense of are skipped, GeoTIFF ones rejected: a
+// map laid in the wrong place is worse than none.
+func readFrameTags(data []byte) (*frameTags, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	ifd := int64(order.Uint32(data[4:8]))
+	if ifd+2 > int64(len(data)) {
+		return nil, errMalformedGeoTIFF
+	}
+	entries := int64(order.Uint16(data[ifd:]))
+	if ifd+2+entries*12 > int64(len(data)) {
+		return nil, errMalformedGeoTIFF
+	}
+	var geo geoReference
+	var resolution pixelResolution
+	found := false
+	for n := range entries {
+		entry := data[ifd+2+n*12:][:12]
+		tag, kind, count := order.Uint16(entry), order.Uint16(entry[2:]), int64(order.Uint32(entry[4:]))
+		geoTag := slices.Contains([]uint16{tagModelPixelScale, tagModelTiepoint, tagModelTransformation, tagGeoKeyDirectory, tagGeoDoubleParams, tagGeoASCIIParams}, tag) // Not others in their range, such as tagICCProfile
+		var size int64
+		switch kind {
+		case 2: // ASCII
+			size = 1
+		case 3: // SHORT
+			size = 2
+		case 5, 12: // RATIONAL, DOUBLE
+			size = 8
+		}
+		value := entry[8:12]
+		if count*size > 4 {
+			offset := int64(order.Uint32(value))
+			if count > int64(len(data)) || offset+count*size > int64(len(data)) {
+				size = 0
+			} else {
+				value = data[offset : offset+count*size]
+			}
+		} else {
+			value = value[:count*size]
+		}
+		if size == 0 && geoTag {
+			return nil, errMalformedGeoTIFF
+		}
+		doubles := func() []float64 {
+			if kind != 12 {
+				return nil
+			}
+			out := make([]float64, count)
+			for i := range out {
+				out[i] = math.Float64frombits(order.Uint64(value[i*8:]))
+			}
+			return out
+		}
+		rational := func() float64 {
+			if kind != 5 || count != 1 || order.Uint32(value[4:]) == 0 {
+				return 0
+			}
+			return float64(order.Uint32(value)) / float64(order.Uint32(value[4:]))
+		}
+		switch tag {
+		case tagImageDescription:
+			if kind == 2 {
+				resolution.ImageJUnit = imageJUnit(string(value))
+			}
+		case tagXResolution:
+			resolution.X = rational()
+		case tagYResolution:
+			resolution.Y = rational()
+		case tagResolutionUnit:
+			if kind == 3 && count == 1 {
+				resolution.Unit = order.Uint16(value)
+			}
+		case tagModelPixelScale:
+			geo.PixelScale = doubles()
+		case tagModelTiepoint:
+			geo.Tiepoints = doubles()
+		case tagModelTransformation:
+			geo.Transformation = doubles()
+		case tagGeoDoubleParams:
+			geo.DoubleParams = doubles()
+		case tagGeoKeyDirectory:
+			if kind == 3 {
+				geo.KeyDirectory = make([]uint16, count)
+				for i := range geo.KeyDirectory {
+					geo.KeyDirectory[i] = order.Uint16(value[i*2:])
+				}
+			}
+		case tagGeoASCIIParams:
+			if kind == 2 {
+				geo.ASCIIParams = string(value)
+			}
+		}
+		found = found || geoTag
+	}
+	var tags frameTags
+	switch {
+	case !found:
+	case len(geo.KeyDirectory) < 4, len(geo.Tiepoints)%6 != 0:
+		return nil, errMalformedGeoTIFF
+	case geo.Transformation != nil && len(geo.Transformation) != 16:
+		return nil, errMalformedGeoTIFF
+	case geo.Transformation == nil && (len(geo.Tiepoints) == 0 || geo.PixelScale != nil && len(geo.PixelScale) != 3):
+		return nil, errMalformedGeoTIFF
+	default:
+		tags.Geo = &geo
+	}
+	if resolution.X > 0 && resolution.Y > 0 {
+		if resolution.Unit == 0 {
+			resolution.Unit = resolutionInch // The default of the specification
+		}
+		tags.Resolution = &resolution
+	}
+	if tags == (frameTags{}) {
+		return nil, nil
+	}
+	return &tags, nil
+}
+
+// pixelIsPoint reports whether the raster coordinates of g name pixel centres
+func (g *geoReference) pixelIsPoint() bool {
+	keys := g.KeyDirectory
+	for i := 4; i+3 < len(keys); i += 4 {
+		if keys[i] == geoKeyRasterType && keys[i+1] == 0 {
+			return keys[i+3] == rasterPixelIsPoint
+		}
+	}
+	return false
+}
+
+// resampled returns the georeferencing of an image whose raster is that of g
+// moved to origin and made factor times finer: pixel i of the new raster is
+// pixel origin + i/factor of the old. It is nil when g is.
+func (g *geoReference) resampled(origin image.Point, factor float64) *geoReference {
+	if g == nil {
+		return nil
+	}
+	c := 0.0 // Raster coordinates of pixel corners are those of centres plus c
+	if g.pixelIsPoint() {
+		c = 0.5
+	}
+	out := *g
+	if g.PixelScale != nil {
+		out.PixelScale = []float64{g.PixelScale[0] / factor, g.PixelScale[1] / factor, g.PixelScale[2]}
+	}
+	out.Tiepoints = slices.Clone(g.Tiepoints)
+	for i := 0; i < len(out.Tiepoints); i += 6 {
+		out.Tiepoints[i] = factor*(g.Tiepoints[i]-float64(origin.X)+c) - c
+		out.Tiepoints[i+1] = factor*(g.Tiepoints[i+1]-float64(origin.Y)+c) - c
+	}
+	if m := g.Transformation; m != nil {
+		// Old raster coordinates are new ones over factor plus a move, which the
+		// last column of the matrix takes up
+		moveX, moveY := float64(origin.X)+c/factor-c, float64(origin.Y)+c/factor-c
+		out.Transformation = slices.Clone(m)
+		for row := 0; row < 4; row++ {
+			out.Transformation[row*4] = m[row*4] / factor
+			out.Transformation[row*4+1] = m[row*4+1] / factor
+			out.Transformation[row*4+3] = m[row*4+3] + m[row*4]*moveX + m[row*4+1]*moveY
+		}
+	}
+	return &out
+}
+
+// resultTags returns the tags of the result of a job, or nil when its reference
+// frame had none: the georeferencing unless the job redraws the frame, and the
+// size of its pixels unless it straightens it
+func (opts processOptions) resultTags() *frameTags {
+	if opts.Tags == nil {
+		return nil
+	}
+	factor := float64(opts.Scale)
+	if opts.Preview {
+		factor /= previewDownsample
+	}
+	var tags frameTags
+	if !opts.Rectify && opts.Align != alignPlanet { // Straightened to the page, or replaced by the sharpest frame, the reference no longer lines up with its map
+		tags.Geo = opts.Tags.Geo.resampled(opts.ROI.Min, factor)
+	}
+	if !opts.Rectify {
+		tags.Resolution = opts.Tags.Resolution.resampled(factor)
+	}
+	return &tags
+}
+
+// geo returns the georeferencing of t, nil when t is
+func (t *frameTags) geo() *geoReference {
+	if t == nil {
+		return nil
+	}
+	return t.Geo
+}
+
+// resolution returns the size of the pixels of t, nil when t is
+func (t *frameTags) resolution() *pixelResolution {
+	if t == nil {
+		return nil
+	}
+	return t.Resolution
+}
+
+// tiffEntry is a field of a TIFF image file directory being written
+type tiffEntry struct {
+	tag, kind uint16
+	count     uint32
+	value     []byte // Little-endian; stored in the entry when it fits, after the directory otherwise
+}
+
+// encodeTIFF writes img as a Deflate-compressed TIFF, 16-bit grayscale for a
+// Gray16 image and 8-bit RGB otherwise, with tags unless they are nil and the
+// RGB tagged with the ICC profile unless it is nil
+func encodeTIFF(w io.Writer, img image.Image, tags *frameTags, profile []byte) error {
+	b := img.Bounds()
+	gray16, _ := img.(*image.Gray16)
+	var raw bytes.Buffer
+	zw := zlib.NewWriter(&raw)
+	row := make([]byte, 0, b.Dx()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if gray16 != nil {
+				row = binary.LittleEndian.AppendUint16(row, gray16.Gray16At(x, y).Y)
+				continue
+			}
+			r, g, bl, _ := img.At(x, y).RGBA()
+			row = append(row, byte(r>>8), byte(g>>8), byte(bl>>8))
+		}
+		if _, err := zw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	le := binary.LittleEndian
+	shorts := func(tag uint16, values ...uint16) tiffEntry {
+		var v []byte
+		for _, s := range values {
+			v = le.AppendUint16(v, s)
+		}
+		return tiffEntry{tag, 3, uint32(len(values)), v}
+	}
+	long := func(tag uint16, value uint32) tiffEntry { return tiffEntry{tag, 4, 1, le.AppendUint32(nil, value)} }
+	doubles := func(tag uint16, values []float64) tiffEntry {
+		var v []byte
+		for _, d := range values {
+			v = le.AppendUint64(v, math.Float64bits(d))
+		}
+		return tiffEntry{tag, 12, uint32(len(values)), v}
+	}
+	rational := func(tag uint16, value float64) tiffEntry {
+		denominator := uint32(1)
+		for denominator < 1e6 && value*float64(denominator)*10 < math.MaxUint32 {
+			denominator *= 10
+		}
+		v := le.AppendUint32(nil, uint32(math.Round(value*float64(denominator))))
+		return tiffEntry{tag, 5, 1, le.AppendUint32(v, denominator)}
+	}
+	const dataOffset = 8 // The pixels follow the header
+	entries := []tiffEntry{
+		long(256, uint32(b.Dx())),
+		long(257, uint32(b.Dy())),
+		shorts(258, 8, 8, 8),
+		shorts(259, 8), // Deflate
+		shorts(262, 2), // RGB
+		long(273, dataOffset),
+		shorts(277, 3),
+		long(278, uint32(b.Dy())), // One strip
+		long(279, uint32(raw.Len())),
+		shorts(284, 1),
+	}
+	if gray16 != nil {
+		entries[2], entries[4], entries[6] = shorts(258, 16), shorts(262, 1), shorts(277, 1) // Black is zero
+	}
+	if profile != nil && gray16 == nil {
+		entries = append(entries, tiffEntry{tagICCProfile, 7, uint32(len(profile)), profile})
+	}
+	if res := tags.resolution(); res != nil {
+		if res.ImageJUnit != "" {
+			description := "ImageJ=1.11a\nunit=" + res.ImageJUnit + "\n\x00"
+			entries = append(entries, tiffEntry{tagImageDescription, 2, uint32(len(description)), []byte(description)})
+		}
+		entries = append(entries, rational(tagXResolution, res.X), rational(tagYResolution, res.Y), shorts(tagResolutionUnit, res.Unit))
+	}
+	if geo := tags.geo(); geo != nil {
+		if geo.PixelScale != nil {
+			entries = append(entries, doubles(tagModelPixelScale, geo.PixelScale))
+		}
+		if geo.Tiepoints != nil {
+			entries = append(entries, doubles(tagModelTiepoint, geo.Tiepoints))
+		}
+		if geo.Transformation != nil {
+			entries = append(entries, doubles(tagModelTransformation, geo.Transformation))
+		}
+		entries = append(entries, shorts(tagGeoKeyDirectory, geo.KeyDirectory...))
+		if geo.DoubleParams != nil {
+			entries = append(entries, doubles(tagGeoDoubleParams, geo.DoubleParams))
+		}
+		if geo.ASCIIParams != "" {
+			entries = append(entries, tiffEntry{tagGeoASCIIParams, 2, uint32(len(geo.ASCIIParams)), []byte(geo.ASCIIParams)})
+		}
+	}
+	slices.SortFunc(entries, func(a, b tiffEntry) int { return cmp.Compare(a.tag, b.tag) }) // As the specification orders them
+
+	// Header, pixels, the directory on a word boundary, then the values too long for it
+	var out bytes.Buffer
+	out.WriteString("II*\x00")
+	ifd := dataOffset + raw.Len() + raw.Len()%2
+	out.Write(le.AppendUint32(nil, uint32(ifd)))
+	out.Write(raw.Bytes())
+	if raw.Len()%2 == 1 {
+		out.WriteByte(0)
+	}
+	extra := ifd + 2 + len(entries)*12 + 4
+	var values bytes.Buffer
+	out.Write(le.AppendUint16(nil, uint16(len(entries))))
+	for _, e := range entries {
+		out.Write(le.AppendUint16(nil, e.tag))
+		out.Write(le.AppendUint16(nil, e.kind))
+		out.Write(le.AppendUint32(nil, e.count))
+		if len(e.value) <= 4 {
+			out.Write(append(slices.Clone(e.value), make([]byte, 4-len(e.value))...))
+			continue
+		}
+		out.Write(le.AppendUint32(nil, uint32(extra+values.Len())))
+		values.Write(e.value)
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	out.Write([]byte{0, 0, 0, 0}) // No further images
+	out.Write(values.Bytes())
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -2,4 +2,10 @@ module chicha-superresolution
 
 go 1.23
 
-require golang.org/x/image v0.22.0 // indirect
+require golang.org/x/image v0.22.0
+
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
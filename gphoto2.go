@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Bursts are shot with gphoto2, run as a separate program like ffmpeg, which
+// drives most DSLRs and mirrorless cameras connected by USB.
+
+// gphoto2Env names the gphoto2 binary when it is not on PATH as "gphoto2"
+const gphoto2Env = "CHICHA_SR_GPHOTO2"
+
+// errNoGphoto2 explains how to get gphoto2 when capture needs it
+var errNoGphoto2 = fmt.Errorf("capture needs gphoto2, which was not found on PATH: install it (http://www.gphoto.org, or the gphoto2 package of your system) or set %s to its path", gphoto2Env)
+
+// findGphoto2 returns the gphoto2 binary to run: the one named by
+// CHICHA_SR_GPHOTO2, or gphoto2 on PATH
+func findGphoto2() (string, error) {
+	if name := os.Getenv(gphoto2Env); name != "" {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", fmt.Errorf("%s=%s: %w", gphoto2Env, name, err)
+		}
+		return path, nil
+	}
+	path, err := exec.LookPath("gphoto2")
+	if err != nil {
+		return "", errNoGphoto2
+	}
+	return path, nil
+}
+
+// captureCommand shoots a burst with the connected camera and processes it as
+// process would, from shutter to result in one run
+func captureCommand(args []string) int {
+	fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s capture -output <file> [flags]\n\nShoots a burst with the camera connected by USB, through gphoto2, and processes it.\nSet the camera to JPEG, or RAW+JPEG, and hold it still or on a tripod.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "", "result file, or - for standard output; its extension picks the format unless -format is set (required)")
+	frames := fs.Int("frames", defaultBurstFrames, "frames to shoot")
+	interval := fs.Duration("interval", 0, "pause between two frames, in whole seconds (0 shoots as fast as the camera allows)")
+	keep := fs.String("keep-frames", "", "new or empty directory the shot frames are kept in (default they are deleted once processed)")
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	req := pipelineFlags(fs)
+	loadCalibration := calibrationFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if *output == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return exitBadInput
+	}
+	if *frames < 1 || *interval < 0 {
+		fmt.Fprintln(os.Stderr, "-frames must be at least 1 and -interval not negative")
+		return exitBadInput
+	}
+	if req.Format == "" {
+		req.Format = extensionFormat(*output) // Ahead of a preset, which could pick another
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cal, err := loadCalibration(ctx) // Before the shutter, so a mistake costs no burst
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	events := jsonEvents(*output == stdioPath)
+	name := strings.TrimSuffix(filepath.Base(*output), filepath.Ext(*output))
+	start := time.Now()
+	dir := *keep
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "chicha-sr-capture-"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitInternal
+		}
+		defer os.RemoveAll(dir)
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitInternal
+	} else if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		fmt.Fprintf(os.Stderr, "-keep-frames %s is not empty, and its files would be taken for frames of the burst\n", dir)
+		return exitBadInput
+	}
+
+	paths, err := captureBurst(ctx, dir, *frames, *interval)
+	if err == nil {
+		slog.Info("Burst captured", "frames", len(paths), "dir", dir, "duration", time.Since(start).Round(time.Millisecond))
+		var run burstRun
+		run, err = runBurst(ctx, paths, videoClip{}, cal, *req, events, name, func(opts processOptions, n int) string { return *output })
+		if err == nil {
+			slog.Info("Burst processed", "burst", name, "frames", run.frames, "result", run.path, "duration", time.Since(start).Round(time.Millisecond))
+			events.emit("result", name, run.result)
+			return exitOK
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		events.emit("canceled", name, nil)
+		return exitInterrupted
+	}
+	slog.Error("Error capturing burst", "burst", name, "error", err)
+	events.emit("error", name, map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+	return exitCode(err)
+}
+
+// captureBurst shoots frames with the camera and downloads them to dir, and
+// returns the paths of the images among them in shooting order; RAW files the
+// camera also wrote are left in dir
+func captureBurst(ctx context.Context, dir string, frames int, interval time.Duration) ([]string, error) {
+	bin, err := findGphoto2()
+	if err != nil {
+		return nil, &commandError{exitBadInput, err}
+	}
+	cmd := exec.CommandContext(ctx, bin, "--capture-image-and-download", "--force-overwrite",
+		"--frames", strconv.Itoa(frames), "--interval", strconv.Itoa(int(interval.Seconds())),
+		"--filename", filepath.Join(dir, "frame-%03n.%C"))
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	slog.Info("Capturing burst", "frames", frames, "interval", interval)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &commandError{exitInternal, fmt.Errorf("gphoto2: %w: %s", err, lastLines(out.String(), 3))}
+	}
+	slog.Debug("gphoto2 finished", "output", out.String())
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, &commandError{exitInternal, err}
+	}
+	var paths []string
+	for _, entry := range entries { // Sorted by name, which is shooting order
+		if !entry.IsDir() && imageFileName(entry.Name()) {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, &commandError{exitFewFrames, errors.New("the camera saved no JPEG frames: set its image quality to JPEG or RAW+JPEG")}
+	}
+	return paths, nil
+}
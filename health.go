@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// diskReport is the free space of one working directory
+type diskReport struct {
+	Path       string `json:"path"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+// healthReport is the body served by /healthz and /readyz
+type healthReport struct {
+	Status string       `json:"status"` // "ok" or "fail"
+	Checks []string     `json:"failed_checks,omitempty"`
+	Jobs   jobStats     `json:"jobs"`
+	Disks  []diskReport `json:"disks"`
+}
+
+// workingDirs lists the directories the server writes into
+func workingDirs() []string {
+	dirs := []string{config.TempDir}
+	if dirs[0] == "" {
+		dirs[0] = os.TempDir()
+	}
+	if config.JobStore != "" {
+		dirs = append(dirs, filepath.Dir(config.JobStore))
+	}
+	if config.ResultsDir != "" {
+		dirs = append(dirs, config.ResultsDir)
+	}
+	return dirs
+}
+
+// collectHealth gathers queue, worker and disk state; ready adds the checks that
+// decide whether the instance should receive new traffic
+func collectHealth(ready bool) (healthReport, bool) {
+	report := healthReport{Jobs: jobs.stats()}
+
+	// Liveness: every worker goroutine must still be running its loop
+	if report.Jobs.WorkersAlive < len(report.Jobs.Workers) {
+		report.Checks = append(report.Checks, "workers")
+	}
+
+	for _, dir := range workingDirs() {
+		d := diskReport{Path: dir}
+		free, total, err := diskUsage(dir)
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			d.FreeBytes, d.TotalBytes = free, total
+			if ready && free < uint64(liveConfig().MinFreeDisk)<<20 {
+				report.Checks = append(report.Checks, "disk:"+dir)
+			}
+		}
+		report.Disks = append(report.Disks, d)
+	}
+
+	if ready {
+		if report.Jobs.Draining {
+			report.Checks = append(report.Checks, "draining")
+		}
+		if report.Jobs.Queued >= report.Jobs.QueueSize && report.Jobs.Running >= len(report.Jobs.Workers) {
+			report.Checks = append(report.Checks, "queue_full")
+		}
+	}
+
+	report.Status = "ok"
+	if len(report.Checks) > 0 {
+		report.Status = "fail"
+	}
+	return report, len(report.Checks) == 0
+}
+
+// healthzHandler reports whether the process is alive and its workers are running
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, false)
+}
+
+// readyzHandler reports whether the instance can take new jobs right now
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, true)
+}
+
+func writeHealth(w http.ResponseWriter, ready bool) {
+	report, ok := collectHealth(ready)
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
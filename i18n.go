@@ -0,0 +1,160 @@
+package main
+
+import (
+	_ "embed" // Required for embedding
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed static/i18n.js
+var i18nJS string
+
+// defaultLocale is the language the web UI is written in, used when the browser
+// asks for none of the translated ones
+const defaultLocale = "en"
+
+// localeCookie remembers the language picked with the switch under the page title
+const localeCookie = "lang"
+
+// locales are the languages of the web UI with their names in themselves, in the
+// order the switch lists them
+var locales = []struct {
+	Code string
+	Name string
+}{
+	{"en", "English"},
+	{"ru", "Русский"},
+}
+
+// messages translates the web UI, keyed by locale and then by the English text.
+// Text missing from a locale is shown in English.
+var messages = map[string]map[string]string{
+	"ru": messagesRU,
+}
+
+// knownLocale reports whether the web UI is available in a language
+func knownLocale(code string) bool {
+	for _, l := range locales {
+		if l.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredLocale picks the language of the web UI the Accept-Language header
+// ranks highest, ignoring regions
+func preferredLocale(header string) string {
+	best, bestQ := defaultLocale, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(value, 64) // A malformed weight counts as 0
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if q > bestQ && knownLocale(primary) {
+			best, bestQ = primary, q
+		}
+	}
+	return best
+}
+
+// requestLocale returns the language to render a page in: the one picked with the
+// switch, or else the browser's preference
+func requestLocale(r *http.Request) string {
+	if c, err := r.Cookie(localeCookie); err == nil && knownLocale(c.Value) {
+		return c.Value
+	}
+	return preferredLocale(r.Header.Get("Accept-Language"))
+}
+
+// tr translates English text of the web UI into the language of the request
+func tr(r *http.Request, text string) string {
+	if translated, ok := messages[requestLocale(r)][text]; ok {
+		return translated
+	}
+	return text
+}
+
+// trf translates an English format string and fills it in like fmt.Sprintf
+func trf(r *http.Request, format string, args ...any) string {
+	return fmt.Sprintf(tr(r, format), args...)
+}
+
+// messageMarker matches the {{English text}} markers of page templates
+var messageMarker = regexp.MustCompile(`\{\{([^{}]+)\}\}`)
+
+// localize replaces the {{English text}} markers of a page template with their
+// translations. The template is a format string, so percent signs are escaped.
+func localize(r *http.Request, page string) string {
+	return messageMarker.ReplaceAllStringFunc(page, func(marker string) string {
+		return strings.ReplaceAll(tr(r, marker[2:len(marker)-2]), "%", "%%")
+	})
+}
+
+// messagesScript hands the translations of the request's language to the page
+// scripts, followed by the t() helper that looks them up
+func messagesScript(r *http.Request) string {
+	catalog := messages[requestLocale(r)]
+	if catalog == nil {
+		catalog = map[string]string{}
+	}
+	encoded, _ := json.Marshal(catalog) // Escapes <, > and &, so it cannot end the script
+	return `<script id="messages" type="application/json">` + string(encoded) + `</script><script>` + i18nJS + `</script>`
+}
+
+// languageSwitch renders links to the page in the other languages of the UI
+func languageSwitch(r *http.Request) string {
+	current := requestLocale(r)
+	next := returnPath(r)
+	var links []string
+	for _, l := range locales {
+		if l.Code == current {
+			continue
+		}
+		links = append(links, fmt.Sprintf(`<a href="%s?next=%s" hreflang="%s" lang="%s">%s</a>`, config.url("/language/"+l.Code), next, l.Code, l.Code, l.Name))
+	}
+	return strings.Join(links, " &middot; ")
+}
+
+// languageHandler switches the web UI to the language in the path and returns to
+// the page the switch was used on
+func languageHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("locale")
+	if !knownLocale(code) {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "The web interface is not available in this language"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     localeCookie,
+		Value:    code,
+		Path:     config.url("/"),
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		Secure:   config.tlsEnabled(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	redirectBack(w, r)
+}
+
+// returnPath is the next parameter of a switch link on the page of r, which
+// brings the user back to the page after switching
+func returnPath(r *http.Request) string {
+	return url.QueryEscape(r.URL.RequestURI())
+}
+
+// redirectBack returns from a switch link to the page in its next parameter.
+// Only paths of this application are followed, never another site.
+func redirectBack(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, `/\`) {
+		next = "/"
+	}
+	http.Redirect(w, r, config.url(next), http.StatusSeeOther)
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobStatus is the lifecycle state of a job
+type jobStatus string
+
+const (
+	jobQueued      jobStatus = "queued"
+	jobRunning     jobStatus = "running"
+	jobDone        jobStatus = "done"
+	jobFailed      jobStatus = "failed"
+	jobCanceled    jobStatus = "canceled"    // The client went away before a worker picked the job up
+	jobInterrupted jobStatus = "interrupted" // The server stopped before the job could finish
+)
+
+var (
+	// errDraining is returned when a job is submitted while the server is shutting down
+	errDraining = errors.New("server is shutting down and not accepting new jobs")
+	// errQueueFull is returned when every queue slot is taken
+	errQueueFull = errors.New("job queue is full")
+	// errCanceledByAdmin is the cause of jobs canceled from the admin dashboard
+	errCanceledByAdmin = errors.New("canceled by an administrator")
+)
+
+// job is the record of one super-resolution run
+type job struct {
+	ID         string        `json:"id"`
+	RequestID  string        `json:"request_id,omitempty"` // ID of the HTTP request that submitted the job
+	Owner      string        `json:"owner,omitempty"`      // Who submitted the job, see requestOwner
+	Workspace  string        `json:"workspace,omitempty"`  // ID of the workspace the job was shared with
+	Status     jobStatus     `json:"status"`
+	Frames     int           `json:"frames"`
+	Scale      int           `json:"scale"`
+	Algorithm  string        `json:"algorithm,omitempty"` // Processing options the job ran with, see processOptions
+	Kernel     string        `json:"kernel,omitempty"`
+	Format     string        `json:"format,omitempty"`
+	Quality    int           `json:"quality,omitempty"`
+	Denoise    int           `json:"denoise,omitempty"`
+	Sharpen    int           `json:"sharpen,omitempty"`
+	Preview    bool          `json:"preview,omitempty"` // Ran on downsampled frames, see processOptions.Preview
+	Created    time.Time     `json:"created"`
+	Started    time.Time     `json:"started"`
+	Finished   time.Time     `json:"finished"`
+	Error      string        `json:"error,omitempty"`
+	Result     string        `json:"result,omitempty"`      // File name of the stored result in -results-dir
+	ResultSize int64         `json:"result_size,omitempty"` // Bytes the stored result takes on disk
+	Memory     int64         `json:"memory,omitempty"`      // Bytes of accumulation buffers the job allocated
+	Shares     []resultShare `json:"shares,omitempty"`      // Links that give the result to anyone holding them
+	Delivery   string        `json:"delivery,omitempty"`    // State of the upload to deliver_to: pending, delivered or failed
+	Progress   *jobProgress  `json:"progress,omitempty"`    // Stage and frame counts while the job runs
+
+	ctx    context.Context             // Canceled when the submitting client goes away or the job is canceled
+	cancel context.CancelCauseFunc     // Cancels ctx
+	work   func(context.Context) error // The processing to run on a worker
+	task   *fusionTask                 // The processing in a form a shared queue can hand to another instance
+	err    error                       // Outcome of work, valid once done is closed
+	done   chan struct{}               // Closed when the job leaves the worker
+}
+
+// workerState describes what one worker goroutine is doing, for liveness reporting
+type workerState struct {
+	ID    int       `json:"id"`
+	State string    `json:"state"` // "idle" or "busy"
+	JobID string    `json:"job_id,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+// jobManager queues jobs onto a fixed pool of workers, refuses new ones while
+// draining and persists job records
+type jobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	order     []string // Job IDs in submission order
+	draining  bool
+	inflight  sync.WaitGroup
+	storePath string // JSON file the records are flushed to, empty for memory only
+
+	queue   jobQueue
+	workers []*workerState
+	alive   atomic.Int32 // Worker goroutines currently running their loop
+}
+
+// jobQueue holds jobs between their submission and a worker taking them up.
+// Workers of this instance pop jobs in a loop; a shared queue may hand them
+// jobs submitted to other instances.
+type jobQueue interface {
+	push(j *job) error                     // errQueueFull when every slot is taken
+	pop(ctx context.Context) (*job, error) // Waits for the next job; errDraining once the instance stops taking work
+	capacity() int
+	stop() // Called when the instance starts draining
+}
+
+// memoryQueue is the queue of a single instance, a buffered channel
+type memoryQueue chan *job
+
+func (q memoryQueue) push(j *job) error {
+	select {
+	case q <- j:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// pop keeps handing out the queued jobs while draining, as they were accepted
+func (q memoryQueue) pop(ctx context.Context) (*job, error) {
+	select {
+	case j := <-q:
+		return j, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q memoryQueue) capacity() int { return cap(q) }
+func (q memoryQueue) stop()         {}
+
+// jobs is the process-wide job manager
+var jobs = &jobManager{jobs: make(map[string]*job)}
+
+// newJobID returns a random identifier that is safe to use in URLs and file names
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// start launches the worker goroutines taking jobs from queue
+func (m *jobManager) start(workers int, queue jobQueue) {
+	m.queue = queue
+	for i := 0; i < workers; i++ {
+		w := &workerState{ID: i + 1, State: "idle", Since: time.Now()}
+		m.workers = append(m.workers, w)
+		go m.worker(w)
+	}
+	slog.Info("Started job workers", "workers", workers, "queue_size", queue.capacity())
+}
+
+// submit queues work as a new job unless the manager is draining or the queue is full.
+// The caller describes the job in j; its ID, status and bookkeeping are filled in here.
+func (m *jobManager) submit(ctx context.Context, j *job, work func(context.Context) error) (*job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.draining {
+		return nil, errDraining
+	}
+	j.ID = newJobID()
+	j.Status = jobQueued
+	j.Created = time.Now()
+	j.ctx, j.cancel = context.WithCancelCause(ctx)
+	j.work = work
+	j.done = make(chan struct{})
+	if err := m.queue.push(j); err != nil {
+		return nil, err
+	}
+	m.jobs[j.ID] = j
+	m.order = append(m.order, j.ID)
+	m.inflight.Add(1)
+	metrics.jobsSubmitted.Add(1)
+	return j, nil
+}
+
+// worker runs queued jobs one at a time for as long as the process lives, or
+// until a shared queue stops handing out jobs while draining
+func (m *jobManager) worker(w *workerState) {
+	m.alive.Add(1)
+	defer m.alive.Add(-1)
+
+	for {
+		j, err := m.queue.pop(context.Background())
+		switch {
+		case errors.Is(err, errDraining):
+			return
+		case err != nil:
+			slog.Error("Error taking a job from the queue", "worker", w.ID, "error", err)
+			time.Sleep(queueRetryDelay)
+			continue
+		}
+		m.run(w, j)
+	}
+}
+
+// queueRetryDelay is how long a worker waits before asking a queue that failed again
+const queueRetryDelay = 5 * time.Second
+
+// run executes a single job on worker w and records its outcome
+func (m *jobManager) run(w *workerState, j *job) {
+	m.mu.Lock()
+	if j.ctx.Err() != nil {
+		// Nobody is waiting for the result any more, or the job was canceled
+		j.Status = jobCanceled
+		j.Finished = time.Now()
+		j.err = context.Cause(j.ctx)
+		m.finish(j)
+		m.mu.Unlock()
+		close(j.done)
+		m.inflight.Done()
+		return
+	}
+	j.Status = jobRunning
+	j.Started = time.Now()
+	w.State, w.JobID, w.Since = "busy", j.ID, j.Started
+	m.mu.Unlock()
+
+	err := runRecovered(j)
+
+	m.mu.Lock()
+	j.err = err
+	j.Finished = time.Now()
+	if err != nil && j.ctx.Err() != nil {
+		j.Status = jobCanceled
+		j.err = context.Cause(j.ctx)
+		j.Error = j.err.Error()
+	} else if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+		metrics.jobsFailed.Add(1)
+	} else {
+		j.Status = jobDone
+		metrics.jobsCompleted.Add(1)
+		metrics.framesProcessed.Add(int64(j.Frames))
+	}
+	metrics.jobSeconds.observe(string(j.Status), j.Finished.Sub(j.Started).Seconds())
+	slog.Info("Job finished", "job_id", j.ID, "request_id", j.RequestID, "status", j.Status, "frames", j.Frames, "duration", j.Finished.Sub(j.Started), "worker", w.ID)
+	w.State, w.JobID, w.Since = "idle", "", j.Finished
+	m.finish(j)
+	m.mu.Unlock()
+	close(j.done)
+	m.inflight.Done()
+}
+
+// mirror records the state of a job another instance is running for this one
+func (m *jobManager) mirror(id string, started time.Time, progress *jobProgress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.Status, j.Started = jobRunning, started
+		if progress != nil {
+			j.Progress = progress
+		}
+	}
+}
+
+// complete records the outcome of a job submitted here and run through a
+// shared queue, as run does for the jobs it runs itself
+func (m *jobManager) complete(j *job, err error) {
+	m.mu.Lock()
+	j.err = err
+	j.Finished = time.Now()
+	switch {
+	case err != nil && j.ctx.Err() != nil:
+		j.Status = jobCanceled
+		j.err = context.Cause(j.ctx)
+		j.Error = j.err.Error()
+	case err != nil:
+		j.Status = jobFailed
+		j.Error = err.Error()
+	default:
+		j.Status = jobDone
+	}
+	var duration time.Duration // Since another instance took it up, if one did
+	if !j.Started.IsZero() {
+		duration = j.Finished.Sub(j.Started)
+	}
+	slog.Info("Job finished", "job_id", j.ID, "request_id", j.RequestID, "status", j.Status, "frames", j.Frames, "duration", duration, "queue", "shared")
+	m.finish(j)
+	m.mu.Unlock()
+	close(j.done)
+	m.inflight.Done()
+}
+
+// finishedRecordAge is how long the record of a job that finished without a
+// stored result is kept, long enough for the compute quota and the throughput
+// chart. Records of stored results stay until the result is deleted.
+const finishedRecordAge = quotaWindow
+
+// finish releases what a job that just ended held for its run: its work
+// closure keeps the decoded frames and the fusion accumulator alive. It also
+// forgets the jobs that finished without a stored result more than
+// finishedRecordAge ago. Called with m.mu held.
+func (m *jobManager) finish(j *job) {
+	j.cancel(nil)
+	j.ctx, j.cancel, j.work, j.task = nil, nil, nil, nil
+
+	cutoff := time.Now().Add(-finishedRecordAge)
+	m.order = slices.DeleteFunc(m.order, func(id string) bool {
+		old := m.jobs[id]
+		if old.Result != "" || old.Finished.IsZero() || !old.Finished.Before(cutoff) {
+			return false
+		}
+		delete(m.jobs, id)
+		return true
+	})
+}
+
+// runRecovered calls the job's work, turning a panic into an error so the worker survives
+func runRecovered(j *job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("Job panicked", "job_id", j.ID, "request_id", j.RequestID, "panic", p)
+			err = fmt.Errorf("internal error: %v", p)
+		}
+	}()
+	return j.work(withJobID(j.ctx, j.ID))
+}
+
+// jobStats is a point-in-time summary of the queue and workers
+type jobStats struct {
+	Queued       int           `json:"queued"`
+	Running      int           `json:"running"`
+	QueueSize    int           `json:"queue_size"`
+	WorkersAlive int           `json:"workers_alive"`
+	Workers      []workerState `json:"workers"`
+	Draining     bool          `json:"draining"`
+}
+
+// stats returns the current queue depth and worker states
+func (m *jobManager) stats() jobStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := jobStats{
+		QueueSize:    m.queue.capacity(),
+		WorkersAlive: int(m.alive.Load()),
+		Draining:     m.draining,
+	}
+	for _, id := range m.order {
+		switch m.jobs[id].Status {
+		case jobQueued:
+			st.Queued++
+		case jobRunning:
+			st.Running++
+		}
+	}
+	for _, w := range m.workers {
+		st.Workers = append(st.Workers, *w)
+	}
+	return st
+}
+
+// get returns a copy of the job with the given ID
+func (m *jobManager) get(id string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// adopt adds the record of a job another instance ran, unless it is known
+// already; it reports whether the record was added
+func (m *jobManager) adopt(j *job) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[j.ID]; ok {
+		return false
+	}
+	m.jobs[j.ID] = j
+	m.order = append(m.order, j.ID)
+	return true
+}
+
+// list returns copies of the jobs keep accepts, newest first
+func (m *jobManager) list(keep func(j *job) bool) []job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []job
+	for i := len(m.order) - 1; i >= 0; i-- {
+		if j := m.jobs[m.order[i]]; keep(j) {
+			list = append(list, *j)
+		}
+	}
+	return list
+}
+
+// cancelJob stops a queued or running job; it reports false when no such job is active
+func (m *jobManager) cancelJob(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || j.cancel == nil || (j.Status != jobQueued && j.Status != jobRunning) {
+		return false
+	}
+	j.cancel(errCanceledByAdmin)
+	return true
+}
+
+// recordMemory notes the accumulation memory a job allocated
+func (m *jobManager) recordMemory(id string, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.Memory = bytes
+	}
+}
+
+// setResult records the stored result file of a job; an empty name marks it deleted
+func (m *jobManager) setResult(id, name string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.Result, j.ResultSize = name, size
+	}
+}
+
+// setDelivery records the state of the upload of a job's result to its deliver_to URL
+func (m *jobManager) setDelivery(id, state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.Delivery = state
+	}
+}
+
+// usage sums the stored result bytes of owner and the processing time of their
+// jobs finished since the given time; oldest is the earliest such finish
+func (m *jobManager) usage(owner string, since time.Time) (storage int64, compute time.Duration, oldest time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range m.order {
+		j := m.jobs[id]
+		if j.Owner != owner {
+			continue
+		}
+		storage += j.ResultSize
+		if !j.Started.IsZero() && j.Finished.After(since) {
+			compute += j.Finished.Sub(j.Started)
+			if oldest.IsZero() || j.Finished.Before(oldest) {
+				oldest = j.Finished
+			}
+		}
+	}
+	return storage, compute, oldest
+}
+
+// stopIntake makes every following submit fail with errDraining
+func (m *jobManager) stopIntake() {
+	m.mu.Lock()
+	m.draining = true
+	m.mu.Unlock()
+	if m.queue != nil {
+		m.queue.stop()
+	}
+}
+
+// wait blocks until all queued and running jobs have finished or ctx expires
+func (m *jobManager) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// load reads previously flushed job records; jobs that were queued or running
+// when the process stopped are marked as interrupted
+func (m *jobManager) load(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.storePath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // First start with this store
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []*job
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parsing job store %s: %w", path, err)
+	}
+	for _, j := range records {
+		if j.Status == jobQueued || j.Status == jobRunning {
+			j.Status = jobInterrupted
+		}
+		m.jobs[j.ID] = j
+		m.order = append(m.order, j.ID)
+	}
+	slog.Info("Loaded job records", "count", len(records), "path", path)
+	return nil
+}
+
+// flush writes all job records to the store file, marking unfinished jobs as
+// interrupted so the store reflects what a restart will find
+func (m *jobManager) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.storePath == "" {
+		return nil
+	}
+	records := make([]job, 0, len(m.order))
+	for _, id := range m.order {
+		j := *m.jobs[id]
+		if j.Status == jobQueued || j.Status == jobRunning {
+			j.Status = jobInterrupted
+		}
+		records = append(records, j)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.storePath, data)
+}
+
+// writeFileAtomic replaces path with data through a temporary file and a rename,
+// so a crash never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// The JPEG encoder of the standard library writes baseline files with the
+// chroma halved both ways, which is what encodeResult uses by default. Fine
+// coloured detail, such as the red text of a number plate or the edges of a
+// thermal palette, smears at half resolution, and large results load top to
+// bottom instead of coarse to fine. encodeJPEG writes the other layouts: the
+// chroma at full or half width, and progressive files, whose first scan holds
+// the average colour of every block and later ones the detail of a component
+// each.
+
+// Chroma subsampling of the chroma parameter
+const (
+	chroma420 = "420" // Chroma halved both ways, as the standard library writes it
+	chroma422 = "422" // Chroma halved across only
+	chroma444 = "444" // Chroma at full resolution
+)
+
+// chromaModes are the accepted values of the chroma parameter besides "", which
+// is chroma420
+var chromaModes = []string{chroma420, chroma422, chroma444}
+
+// jpegZigzag is the natural index, row by row, of the coefficients of a block
+// in the order a JPEG file stores them
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegQuant are the quantization tables of section K.1 of the JPEG
+// specification for luminance and chrominance, in zigzag order, which quality
+// scales as libjpeg and the standard library do
+var jpegQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffman is a Huffman table as a JPEG file defines it: how many codes
+// there are of every length from 1 to 16 bits, and the values they stand for
+type jpegHuffman struct {
+	counts [16]byte
+	values []byte
+}
+
+// jpegTables are the Huffman tables of section K.3 of the JPEG specification:
+// luminance DC and AC, then chrominance DC and AC
+var jpegTables = [4]jpegHuffman{
+	{[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	{[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125}, []byte{
+		0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+		0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+		0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+		0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+		0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+		0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+		0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+		0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+		0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+		0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}},
+	{[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	{[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119}, []byte{
+		0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+		0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+		0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+		0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+		0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+		0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+		0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+		0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+		0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+		0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	}},
+}
+
+// jpegCode is a Huffman code: its bits, right-aligned, and how many there are
+type jpegCode struct {
+	bits uint32
+	n    uint
+}
+
+// codes returns the code of every value of h, as section C of the JPEG
+// specification assigns them
+func (h jpegHuffman) codes() [256]jpegCode {
+	var codes [256]jpegCode
+	code, k := uint32(0), 0
+	for length, count := range h.counts {
+		for range count {
+			codes[h.values[k]] = jpegCode{code, uint(length + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// jpegCosines[u][x] is the weight of pixel x in coefficient u of the 8-point DCT
+var jpegCosines = func() (c [8][8]float64) {
+	for u := range c {
+		scale := 0.5
+		if u == 0 {
+			scale = 0.5 / math.Sqrt2
+		}
+		for x := range c[u] {
+			c[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return c
+}()
+
+// jpegPlane is a component of the image at its own resolution, padded to
+// whole MCUs by repeating the last column and row
+type jpegPlane struct {
+	w, h  int // Padded size
+	pix   []uint8
+	quant *[64]float64 // Quantization table, in zigzag order
+	table int          // Index of its DC table in jpegTables, its AC table the next
+	hs    int          // Blocks across and down an MCU holds of it
+	vs    int
+	bw    int // Blocks across and down a scan of it alone holds: the padding beyond the image is left out
+	bh    int
+}
+
+// block returns the quantized DCT coefficients of the 8x8 block (bx, by) of p,
+// in zigzag order
+func (p *jpegPlane) block(bx, by int) [64]int {
+	var rows [8][8]float64
+	for y := range 8 {
+		line := p.pix[(by*8+y)*p.w+bx*8:]
+		for u := range 8 {
+			s := 0.0
+			for x := range 8 {
+				s += jpegCosines[u][x] * (float64(line[x]) - 128)
+			}
+			rows[y][u] = s
+		}
+	}
+	var coefficients [64]int
+	for k, n := range jpegZigzag {
+		u, v := n%8, n/8
+		s := 0.0
+		for y := range 8 {
+			s += jpegCosines[v][y] * rows[y][u]
+		}
+		coefficients[k] = int(math.Round(s / p.quant[k]))
+	}
+	return coefficients
+}
+
+// jpegBits writes the entropy-coded data of a scan, stuffing a zero byte after
+// every 0xff
+type jpegBits struct {
+	w   *bufio.Writer
+	acc uint32
+	n   uint
+}
+
+func (b *jpegBits) emit(bits uint32, n uint) {
+	b.acc = b.acc<<n | bits&(1<<n-1)
+	b.n += n
+	for b.n >= 8 {
+		c := byte(b.acc >> (b.n - 8))
+		b.w.WriteByte(c)
+		if c == 0xff {
+			b.w.WriteByte(0)
+		}
+		b.n -= 8
+	}
+}
+
+// flush pads the last byte of the scan with ones, as the specification asks
+func (b *jpegBits) flush() {
+	if b.n > 0 {
+		b.emit(1<<(8-b.n)-1, 8-b.n)
+	}
+	b.acc, b.n = 0, 0
+}
+
+// value emits the code of symbol, whose low 4 bits are the size of v in bits,
+// then v in that many bits, negative values less one
+func (b *jpegBits) value(codes *[256]jpegCode, symbol int, v int) {
+	b.emit(codes[symbol].bits, codes[symbol].n)
+	if v < 0 {
+		v--
+	}
+	b.emit(uint32(v), uint(symbol&15))
+}
+
+// jpegCoder is what coding the blocks of a component in a scan goes by
+type jpegCoder struct {
+	dcs, acs [256]jpegCode
+	last     int // DC coefficient of the previous block, which the next is coded against
+}
+
+func newJPEGCoder(p *jpegPlane) *jpegCoder {
+	return &jpegCoder{dcs: jpegTables[p.table].codes(), acs: jpegTables[p.table+1].codes()}
+}
+
+// dc emits the DC coefficient of block c
+func (b *jpegBits) dc(coder *jpegCoder, c [64]int) {
+	diff := c[0] - coder.last
+	coder.last = c[0]
+	b.value(&coder.dcs, bitSize(diff), diff)
+}
+
+// ac emits the AC coefficients of block c
+func (b *jpegBits) ac(coder *jpegCoder, c [64]int) {
+	run := 0
+	for k := 1; k < 64; k++ {
+		if c[k] == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			b.emit(coder.acs[0xf0].bits, coder.acs[0xf0].n) // Sixteen zeros
+		}
+		b.value(&coder.acs, run<<4|bitSize(c[k]), c[k])
+		run = 0
+	}
+	if run > 0 {
+		b.emit(coder.acs[0].bits, coder.acs[0].n) // The rest of the block is zero
+	}
+}
+
+// bitSize returns how many bits the magnitude of v takes
+func bitSize(v int) int {
+	if v < 0 {
+		v = -v
+	}
+	n := 0
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// encodeJPEG writes img as a JPEG file of quality 1-100 with the chroma
+// subsampled as one of chromaModes says, baseline or progressive. A
+// progressive file holds a scan of the DC coefficients of every component,
+// then one of the AC coefficients of each.
+func encodeJPEG(w io.Writer, img image.Image, quality int, chroma string, progressive bool) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 || width >= 1<<16 || height >= 1<<16 {
+		return fmt.Errorf("jpeg: image of %dx%d pixels cannot be encoded", width, height)
+	}
+	hs, vs := 2, 2 // Luma blocks across and down an MCU
+	switch chroma {
+	case chroma422:
+		vs = 1
+	case chroma444:
+		hs, vs = 1, 1
+	}
+	mcusX, mcusY := (width+8*hs-1)/(8*hs), (height+8*vs-1)/(8*vs)
+
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var quant [2][64]float64
+	var quantBytes [2][64]byte
+	for t := range quant {
+		for k, q := range jpegQuant[t] {
+			q = min(max((q*scale+50)/100, 1), 255)
+			quant[t][k], quantBytes[t][k] = float64(q), byte(q)
+		}
+	}
+
+	// The components, in full at the luma's padded size, then the chroma averaged down
+	pw, ph := mcusX*8*hs, mcusY*8*vs
+	planes := [3]*jpegPlane{
+		{w: pw, h: ph, quant: &quant[0], table: 0, hs: hs, vs: vs, bw: (width + 7) / 8, bh: (height + 7) / 8},
+		{w: pw, h: ph, quant: &quant[1], table: 2, hs: 1, vs: 1},
+		{w: pw, h: ph, quant: &quant[1], table: 2, hs: 1, vs: 1},
+	}
+	for _, p := range planes {
+		p.pix = make([]uint8, pw*ph)
+	}
+	for y := range ph {
+		for x := range pw {
+			r, g, bl, _ := img.At(b.Min.X+min(x, width-1), b.Min.Y+min(y, height-1)).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			o := y*pw + x
+			planes[0].pix[o], planes[1].pix[o], planes[2].pix[o] = yy, cb, cr
+		}
+	}
+	for _, p := range planes[1:] {
+		if hs > 1 || vs > 1 {
+			small := make([]uint8, (pw/hs)*(ph/vs))
+			for y := range ph / vs {
+				for x := range pw / hs {
+					sum := 0
+					for dy := range vs {
+						for dx := range hs {
+							sum += int(p.pix[(y*vs+dy)*pw+x*hs+dx])
+						}
+					}
+					small[y*(pw/hs)+x] = uint8((sum + hs*vs/2) / (hs * vs))
+				}
+			}
+			p.pix, p.w, p.h = small, pw/hs, ph/vs
+		}
+		p.bw, p.bh = ((width+hs-1)/hs+7)/8, ((height+vs-1)/vs+7)/8
+	}
+
+	bw := bufio.NewWriter(w)
+	segment := func(marker byte, data ...byte) {
+		bw.Write([]byte{0xff, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)})
+		bw.Write(data)
+	}
+	bw.Write([]byte{0xff, 0xd8}) // Start of image
+	for t := range quantBytes {
+		segment(0xdb, append([]byte{byte(t)}, quantBytes[t][:]...)...)
+	}
+	frame := byte(0xc0) // Baseline
+	if progressive {
+		frame = 0xc2
+	}
+	segment(frame, 8, byte(height>>8), byte(height), byte(width>>8), byte(width), 3,
+		1, byte(hs<<4|vs), 0,
+		2, 0x11, 1,
+		3, 0x11, 1)
+	for i, t := range jpegTables {
+		class := byte(i/2) | byte(i%2)<<4 // AC tables are class 1, chroma tables number 1
+		segment(0xc4, append(append([]byte{class}, t.counts[:]...), t.values...)...)
+	}
+
+	bits := &jpegBits{w: bw}
+	interleaved := func(ac bool) { // Every MCU in turn, the blocks of each component in it
+		coders := [3]*jpegCoder{newJPEGCoder(planes[0]), newJPEGCoder(planes[1]), newJPEGCoder(planes[2])}
+		for my := range mcusY {
+			for mx := range mcusX {
+				for i, p := range planes {
+					for by := range p.vs {
+						for bx := range p.hs {
+							c := p.block(mx*p.hs+bx, my*p.vs+by)
+							bits.dc(coders[i], c)
+							if ac {
+								bits.ac(coders[i], c)
+							}
+						}
+					}
+				}
+			}
+		}
+		bits.flush()
+	}
+	if !progressive {
+		segment(0xda, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0)
+		interleaved(true)
+	} else {
+		segment(0xda, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 0, 0)
+		interleaved(false)
+		// The AC coefficients of each component in a scan of its own, over the blocks the image covers
+		for i, p := range planes {
+			segment(0xda, 1, byte(i+1), byte(min(i, 1)), 1, 63, 0)
+			coder := newJPEGCoder(p)
+			for by := range p.bh {
+				for bx := range p.bw {
+					bits.ac(coder, p.block(bx, by))
+				}
+			}
+			bits.flush()
+		}
+	}
+	bw.Write([]byte{0xff, 0xd9}) // End of image
+	return bw.Flush()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// multipartMemory is how much of a multipart upload is buffered in memory before spilling to temp files
+const multipartMemory = 32 << 20
+
+// inMemoryRequested reports whether the upload must never touch the disk, either
+// because of -in-memory or the in_memory query parameter. The choice is read from
+// the URL as it has to be known before the body is parsed.
+func inMemoryRequested(r *http.Request) (bool, *requestError) {
+	value := r.URL.Query().Get("in_memory")
+	if value == "" {
+		return config.InMemory, nil
+	}
+	inMemory, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter in_memory must be true or false, got %q", value)}
+	}
+	return inMemory || config.InMemory, nil
+}
+
+// inMemoryUploadMB caps the body of in-memory requests when -max-upload-mb
+// sets no limit, as all of it is held in memory
+const inMemoryUploadMB = 1024
+
+// parseUpload parses the multipart form, keeping every part in memory for
+// in-memory requests and spilling large ones to temp files otherwise
+func parseUpload(r *http.Request) error {
+	maxMemory := int64(multipartMemory)
+	if inMemory, reqErr := inMemoryRequested(r); inMemory || reqErr != nil {
+		// limitUploadSize caps the body at -max-upload-mb; without it a request
+		// is held to inMemoryUploadMB. A bad value errs on the safe side.
+		maxMemory = math.MaxInt64
+		if liveConfig().MaxUploadMB <= 0 {
+			r.Body = http.MaxBytesReader(nil, r.Body, inMemoryUploadMB<<20)
+		}
+	}
+	return r.ParseMultipartForm(maxMemory)
+}
+
+// limitUploadSize rejects requests that declare a body above the total upload limit
+// and caps the body of the rest so oversized chunked uploads fail while reading
+func limitUploadSize(w http.ResponseWriter, r *http.Request) *requestError {
+	cfg := liveConfig()
+	if cfg.MaxUploadMB <= 0 {
+		return nil
+	}
+	limit := cfg.MaxUploadMB << 20
+	if r.ContentLength > limit {
+		return uploadTooLarge()
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return nil
+}
+
+// uploadTooLarge is the error reported when the whole request exceeds
+// -max-upload-mb, or inMemoryUploadMB for an in-memory request without it
+func uploadTooLarge() *requestError {
+	limit := liveConfig().MaxUploadMB
+	if limit <= 0 {
+		limit = inMemoryUploadMB
+	}
+	return &requestError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    "upload_too_large",
+		Message: fmt.Sprintf("The upload exceeds the %d MB limit per request. Please send fewer or smaller frames.", limit),
+	}
+}
+
+// uploadLimitsText describes the active limits for the upload form
+func uploadLimitsText(r *http.Request) string {
+	cfg := liveConfig()
+	text := tr(r, "No size limits.")
+	if cfg.MaxFrames > 0 || cfg.MaxFileMB > 0 || cfg.MaxUploadMB > 0 {
+		text = trf(r, "Up to %s, %s each, %s in total.",
+			limitOrUnlimited(r, int64(cfg.MaxFrames), "%d frames", "any number of frames"),
+			limitOrUnlimited(r, cfg.MaxFileMB, "%d MB", "any size"),
+			limitOrUnlimited(r, cfg.MaxUploadMB, "%d MB", "any size"))
+	}
+	return text
+}
+
+func limitOrUnlimited(r *http.Request, limit int64, format, unlimited string) string {
+	if limit <= 0 {
+		return tr(r, unlimited)
+	}
+	return trf(r, format, limit)
+}
+
+// uploadedFiles returns the frame files of a parsed form, skipping the empty part
+// browsers send for a file input left blank
+func uploadedFiles(r *http.Request) []uploadFrame {
+	var files []uploadFrame
+	for _, fileHeader := range r.MultipartForm.File["images"] {
+		if fileHeader.Filename == "" && fileHeader.Size == 0 {
+			continue
+		}
+		files = append(files, uploadFrame{name: fileHeader.Filename, size: fileHeader.Size, open: func() (io.ReadCloser, error) { return fileHeader.Open() }})
+	}
+	return files
+}
+
+// checkUploadedFiles enforces the frame-count and per-file size limits on the
+// uploaded frames; frames fetched from urls count towards the number of frames
+func checkUploadedFiles(files []uploadFrame, remote int) *requestError {
+	cfg := liveConfig()
+	if frames := len(files) + remote; cfg.MaxFrames > 0 && frames > cfg.MaxFrames {
+		return &requestError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    "too_many_frames",
+			Message: fmt.Sprintf("%d frames were submitted but at most %d are accepted per job. Please select fewer frames.", frames, cfg.MaxFrames),
+		}
+	}
+	if cfg.MaxFileMB > 0 {
+		for _, frame := range files {
+			if frame.size > cfg.MaxFileMB<<20 {
+				return &requestError{
+					Status:  http.StatusRequestEntityTooLarge,
+					Code:    "file_too_large",
+					Message: fmt.Sprintf("File %s is %.1f MB, above the %d MB limit per frame.", frame.name, float64(frame.size)/(1<<20), cfg.MaxFileMB),
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type jobIDContextKey struct{}
+
+// withJobID returns a context whose log records carry the job ID
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDContextKey{}, id)
+}
+
+// jobIDFromContext returns the job ID stored by withJobID, or ""
+func jobIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDContextKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request, job and trace IDs found in the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id := jobIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("job_id", id))
+	}
+	if s := spanFromContext(ctx); s != nil {
+		r.AddAttrs(slog.String("trace_id", hex.EncodeToString(s.traceID[:])))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// logLevel is the minimum level logged, adjustable when the configuration is reloaded
+var logLevel slog.LevelVar
+
+// setupLogging installs the default slog logger; the standard log package is routed through it too
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid -log-level %q: use debug, info, warn or error", level)
+	}
+	logLevel.Set(lvl)
+	opts := &slog.HandlerOptions{Level: &logLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q: use text or json", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// fatal logs an error and exits, replacing log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// The eye takes detail from brightness far more than from colour, which JPEG
+// already stores at half resolution. With the luma_only option, the frames are
+// fused in their brightness alone, one plane instead of three, and the colour
+// is the reference's, upscaled with the kernel: every pixel of it is moved by
+// the change the fusion made to its brightness. The result looks as sharp for
+// about a third of the work and half the memory.
+
+// lumaTap is the source pixels an upscaled column or row is weighed from
+type lumaTap struct {
+	first   int       // Source column or row the weights start at
+	weights []float64 // Weights of it and of those after it, summing to 1
+}
+
+// lumaTaps returns the taps kernel resamples src columns or rows to dst with,
+// placed as x/image/draw places them when it enlarges; any kernel but a
+// *draw.Kernel is taken for nearest neighbour
+func lumaTaps(kernel draw.Interpolator, dst, src int) []lumaTap {
+	taps := make([]lumaTap, dst)
+	k, ok := kernel.(*draw.Kernel)
+	ratio := float64(src) / float64(dst)
+	for x := range taps {
+		if !ok {
+			taps[x] = lumaTap{first: min(int((float64(x)+0.5)*ratio), src-1), weights: []float64{1}}
+			continue
+		}
+		center := (float64(x)+0.5)*ratio - 0.5
+		first, last := max(int(math.Floor(center-k.Support)), 0), min(int(math.Ceil(center+k.Support)), src)
+		taps[x].first = first
+		total := 0.0
+		for c := first; c < last; c++ {
+			w := 0.0
+			if t := math.Abs(center - float64(c)); t < k.Support {
+				w = k.At(t)
+			}
+			taps[x].weights = append(taps[x].weights, w)
+			total += w
+		}
+		for i := range taps[x].weights {
+			taps[x].weights[i] /= total
+		}
+	}
+	return taps
+}
+
+// upscaleLuma returns the brightness of img resampled to width x height with
+// kernel, row by row
+func upscaleLuma(img image.Image, width, height int, kernel draw.Interpolator) [][]float32 {
+	gray := lumaFrame(img)
+	return upscalePlane(gray.Rect.Dx(), gray.Rect.Dy(), width, height, kernel, func(y int, samples []uint8) {
+		copy(samples, gray.Pix[y*gray.Stride:])
+	})
+}
+
+// upscalePlane resamples a plane of w x h 8-bit samples, which row fills in one
+// row at a time, to width x height with kernel. It works on the one plane,
+// columns then rows, where x/image/draw would resample all four channels of
+// every pixel.
+func upscalePlane(w, h, width, height int, kernel draw.Interpolator, row func(y int, samples []uint8)) [][]float32 {
+	columns, rows := lumaTaps(kernel, width, w), lumaTaps(kernel, height, h)
+	samples := make([]uint8, w)
+	across := make([][]float32, h)
+	for y := range across {
+		row(y, samples)
+		across[y] = make([]float32, width)
+		for x, tap := range columns {
+			v := 0.0
+			for i, weight := range tap.weights {
+				v += weight * float64(samples[tap.first+i])
+			}
+			across[y][x] = float32(v)
+		}
+	}
+	upscaled := make([][]float32, height)
+	for y, tap := range rows {
+		upscaled[y] = make([]float32, width)
+		for i, weight := range tap.weights {
+			for x, v := range across[tap.first+i] {
+				upscaled[y][x] += float32(weight) * v
+			}
+		}
+	}
+	return upscaled
+}
+
+// lumaFrame returns the brightness of img, as color.GrayModel weighs it
+func lumaFrame(img image.Image) *image.Gray {
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, gray.Bounds().Min, draw.Src)
+	return gray
+}
+
+// lumaRows renders the rows [y0, y1) of a luma-only accumulation into an RGBA
+// strip positioned at (0, 0): the colour of acc.chroma, shifted by how much
+// brighter or darker the fused brightness is than its own
+func (acc *fusionAccumulator) lumaRows(y0, y1 int) *image.RGBA {
+	strip := image.NewRGBA(image.Rect(0, 0, acc.width, y1-y0))
+	for y := y0; y < y1; y++ {
+		for x := 0; x < acc.width; x++ {
+			if acc.weights[y][x] <= 0 {
+				strip.SetRGBA(x, y-y0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+				continue
+			}
+			c := acc.chroma.Pix[acc.chroma.PixOffset(x, y):]
+			shift := acc.accR[y][x]/acc.weights[y][x] - (0.299*float64(c[0]) + 0.587*float64(c[1]) + 0.114*float64(c[2]))
+			p := strip.Pix[strip.PixOffset(x, y-y0):]
+			for i := 0; i < 3; i++ {
+				p[i] = uint8(math.Min(math.Max(math.Round(float64(c[i])+shift), 0), 255))
+			}
+			p[3] = 255
+		}
+	}
+	return strip
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A result offered as evidence, or compared across releases, has to be made
+// again from the same frames, to the same bytes. With -manifest, process
+// writes beside every result what it was made of: the SHA-256 of every frame,
+// dark and flat frame and of the result, the parameters as given, and the
+// versions of the program, of the libraries it was built with and of its
+// fusion algorithms. The verify command checks the frames against a manifest,
+// makes the result again and compares the hashes. A manifest turns on
+// -deterministic, without which the rounding of the sums depends on the order
+// the frames are added in.
+
+// manifestVersion is the version of the manifest format, raised when fields
+// change meaning so verify refuses what it cannot read
+const manifestVersion = 1
+
+// algorithmVersions number the revisions of the fusion algorithms. Raise the
+// number of one whenever a change makes it give other bytes from the same
+// frames, so verify can tell a changed algorithm from changed frames.
+var algorithmVersions = map[string]int{
+	algorithmAverage:   1,
+	algorithmReference: 1,
+	algorithmWeighted:  1,
+	algorithmMedian:    1,
+}
+
+// jobManifest is what a result was made of, written by process -manifest and
+// checked by verify
+type jobManifest struct {
+	Version    int                      `json:"manifest_version"`
+	Created    time.Time                `json:"created"`
+	Build      buildInfo                `json:"build"`              // Of the program that made the result
+	Modules    map[string]string        `json:"modules,omitempty"`  // Versions of the libraries it was built with, by module path
+	Algorithms map[string]int           `json:"algorithm_versions"` // algorithmVersions of that program
+	Parameters superResolutionRequestV1 `json:"parameters"`         // As given, before the preset and the defaults
+	Video      *manifestVideo           `json:"video,omitempty"`    // How frames were taken from the videos among the inputs
+	Resolved   manifestOptions          `json:"resolved"`
+
+	Inputs []manifestFile `json:"inputs"` // In the order given
+	Darks  []manifestFile `json:"darks,omitempty"`
+	Flats  []manifestFile `json:"flats,omitempty"`
+	Output manifestFile   `json:"output"`
+}
+
+// manifestVideo holds the -video-start and -video-frames the frames of videos
+// were taken with
+type manifestVideo struct {
+	Start  string `json:"start"`
+	Frames int    `json:"frames"` // 0 for all to the end
+}
+
+// manifestOptions are the main options the parameters resolved to, for the
+// reader of a manifest
+type manifestOptions struct {
+	Frames    int    `json:"frames"`
+	Reference int    `json:"reference"`
+	Scale     int    `json:"scale"`
+	Algorithm string `json:"algorithm"`
+	Kernel    string `json:"kernel"`
+	Format    string `json:"format"`
+	Quality   int    `json:"quality,omitempty"`
+}
+
+// manifestFile identifies one file by its contents
+type manifestFile struct {
+	Path   string `json:"path"` // Relative to the manifest unless absolute, with forward slashes
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestPath is where the manifest of the result at path is written
+func manifestPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-manifest.json"
+}
+
+// writeManifest writes the manifest of run, made from the frames at paths, to
+// the file at path
+func writeManifest(path string, paths []string, clip videoClip, cal calibration, req superResolutionRequestV1, run burstRun) error {
+	dir := filepath.Dir(path)
+	m := jobManifest{
+		Version:    manifestVersion,
+		Created:    time.Now().UTC(),
+		Build:      currentBuild(),
+		Modules:    linkedModules(),
+		Algorithms: algorithmVersions,
+		Parameters: req,
+		Resolved: manifestOptions{
+			Frames:    run.frames,
+			Reference: run.opts.Reference,
+			Scale:     run.opts.Scale,
+			Algorithm: run.opts.Algorithm,
+			Kernel:    run.opts.Kernel,
+			Format:    run.opts.Format,
+		},
+	}
+	if run.opts.Format == formatJPEG {
+		m.Resolved.Quality = run.opts.Quality
+	}
+	if slices.ContainsFunc(paths, isVideoFile) {
+		m.Video = &manifestVideo{Start: clip.Start.String(), Frames: clip.Frames}
+	}
+	var err error
+	if m.Inputs, err = manifestFiles(dir, paths); err != nil {
+		return err
+	}
+	if m.Darks, err = manifestFiles(dir, cal.darkFiles); err != nil {
+		return err
+	}
+	if m.Flats, err = manifestFiles(dir, cal.flatFiles); err != nil {
+		return err
+	}
+	if m.Output, err = manifestFileOf(dir, run.path); err != nil {
+		return err
+	}
+	return writeOutputFile(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+}
+
+// manifestFiles hashes the files at paths, see manifestFileOf
+func manifestFiles(dir string, paths []string) ([]manifestFile, error) {
+	var files []manifestFile
+	for _, path := range paths {
+		f, err := manifestFileOf(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// manifestFileOf hashes the file at path and names it relative to dir, where
+// the manifest is, so the two can be moved together
+func manifestFileOf(dir, path string) (manifestFile, error) {
+	sum, size, err := hashFile(path)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	name := path
+	if abs, err := filepath.Abs(path); err == nil {
+		name = abs
+		if absDir, err := filepath.Abs(dir); err == nil {
+			if rel, err := filepath.Rel(absDir, abs); err == nil {
+				name = rel
+			}
+		}
+	}
+	return manifestFile{Path: filepath.ToSlash(name), Size: size, SHA256: sum}, nil
+}
+
+// resolve returns where the file is, for a manifest in dir
+func (f manifestFile) resolve(dir string) string {
+	path := filepath.FromSlash(f.Path)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// hashFile returns the SHA-256 of the file at path, in hex, and its size
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// linkedModules returns the versions of the modules the program was built
+// with, by path, or nil when the toolchain recorded none
+func linkedModules() map[string]string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || len(info.Deps) == 0 {
+		return nil
+	}
+	modules := make(map[string]string, len(info.Deps))
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		modules[dep.Path] = dep.Version
+	}
+	return modules
+}
+
+// verifyCommand makes the results of manifests again and checks they come out
+// the same
+func verifyCommand(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags] <manifest>...\n\nChecks the frames named in manifests written by process -manifest, processes them again with the parameters recorded and compares the SHA-256 of the result with the manifest's.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitBadInput
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	events := jsonEvents(false)
+	failed, code := 0, exitOK
+	for _, path := range fs.Args() {
+		start := time.Now()
+		sum, err := verifyManifest(ctx, path)
+		if errors.Is(err, context.Canceled) {
+			events.emit("canceled", path, nil)
+			return exitInterrupted
+		}
+		if err != nil {
+			failed++
+			if code == exitOK {
+				code = exitCode(err)
+			}
+			slog.Error("Result not verified", "manifest", path, "error", err)
+			events.emit("error", path, map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+			continue
+		}
+		slog.Info("Result verified", "manifest", path, "sha256", sum, "duration", time.Since(start).Round(time.Millisecond))
+		events.emit("result", path, map[string]any{"sha256": sum, "duration_seconds": time.Since(start).Seconds()})
+	}
+	if fs.NArg() > 1 {
+		events.emit("summary", "", map[string]any{"manifests": fs.NArg(), "failed": failed, "exit_code": code})
+	}
+	return code // That of the first manifest that failed
+}
+
+// verifyManifest checks the files the manifest at path names, processes the
+// frames again with its parameters and returns the SHA-256 of the result when
+// it matches the manifest's
+func verifyManifest(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", &commandError{exitBadInput, err}
+	}
+	var m jobManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", &commandError{exitBadInput, fmt.Errorf("%s: %w", path, err)}
+	}
+	switch {
+	case m.Version > manifestVersion:
+		return "", &commandError{exitBadInput, fmt.Errorf("%s: manifest version %d is newer than this program reads, %d", path, m.Version, manifestVersion)}
+	case len(m.Inputs) == 0 || m.Output.SHA256 == "":
+		return "", &commandError{exitBadInput, fmt.Errorf("%s: not a manifest of process -manifest", path)}
+	}
+
+	dir := filepath.Dir(path)
+	check := func(files []manifestFile) ([]string, error) {
+		var paths []string
+		for _, f := range files {
+			p := f.resolve(dir)
+			sum, _, err := hashFile(p)
+			if err != nil {
+				return nil, &commandError{exitBadInput, err}
+			}
+			if sum != f.SHA256 {
+				return nil, &commandError{exitBadInput, fmt.Errorf("%s has changed since the manifest was written: SHA-256 %s, the manifest says %s", p, sum, f.SHA256)}
+			}
+			paths = append(paths, p)
+		}
+		return paths, nil
+	}
+	inputs, err := check(m.Inputs)
+	if err != nil {
+		return "", err
+	}
+	darks, err := check(m.Darks)
+	if err != nil {
+		return "", err
+	}
+	flats, err := check(m.Flats)
+	if err != nil {
+		return "", err
+	}
+	changes := manifestChanges(m)
+	for _, change := range changes {
+		slog.WarnContext(ctx, "Made by another version, the result may differ", "manifest", path, "change", change)
+	}
+
+	var clip videoClip
+	if m.Video != nil {
+		if clip.Start, err = time.ParseDuration(m.Video.Start); err != nil {
+			return "", &commandError{exitBadInput, fmt.Errorf("%s: video start: %w", path, err)}
+		}
+		clip.Frames = m.Video.Frames
+	}
+	cal, err := loadCalibration(ctx, darks, flats)
+	if err != nil {
+		return "", err
+	}
+	images, tags, err := decodeFrameFiles(ctx, inputs, clip)
+	if err != nil {
+		return "", err
+	}
+	var reqErr *requestError
+	if images, reqErr = cal.apply(images); reqErr != nil {
+		return "", reqErr
+	}
+	result, _, opts, _, err := processBurst(ctx, images, tags, frameNames(inputs, len(images)), m.Parameters)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if err := encodeResult(h, result, opts); err != nil {
+		return "", &commandError{exitInternal, err}
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != m.Output.SHA256 {
+		err := fmt.Errorf("the result made again has SHA-256 %s, the manifest says %s", sum, m.Output.SHA256)
+		if len(changes) > 0 {
+			err = fmt.Errorf("%w; %s", err, strings.Join(changes, "; "))
+		}
+		return "", &commandError{exitMismatch, err}
+	}
+	return sum, nil
+}
+
+// manifestChanges lists what differs between the program that wrote m and
+// this one in ways that may change the result
+func manifestChanges(m jobManifest) []string {
+	var changes []string
+	if was, is := m.Algorithms[m.Resolved.Algorithm], algorithmVersions[m.Resolved.Algorithm]; was != is {
+		changes = append(changes, fmt.Sprintf("the %s algorithm was at version %d, now %d", m.Resolved.Algorithm, was, is))
+	}
+	if was, is := m.Build.String(), currentBuild().String(); was != is {
+		changes = append(changes, fmt.Sprintf("made by %s, now %s", was, is))
+	}
+	modules := linkedModules()
+	for _, path := range slices.Sorted(maps.Keys(m.Modules)) {
+		if was, is := m.Modules[path], modules[path]; is != "" && was != is {
+			changes = append(changes, fmt.Sprintf("%s was %s, now %s", path, was, is))
+		}
+	}
+	return changes
+}
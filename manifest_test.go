@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// manifestBurst processes a burst of noise frames written to dir with a
+// manifest and returns the path of the manifest
+func manifestBurst(t *testing.T, dir string) string {
+	t.Helper()
+	base := noiseImage(64, 48, 7)
+	var paths []string
+	for i, shift := range []struct{ dx, dy int }{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		path := filepath.Join(dir, "frame"+string(rune('0'+i))+".png")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, displaced(base, shift.dx, shift.dy)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	out := filepath.Join(dir, "result.png")
+	req := superResolutionRequestV1{Scale: 2, Format: formatPNG, Deterministic: true}
+	run, err := runBurst(context.Background(), paths, videoClip{}, calibration{}, req, nil, "", func(processOptions, int) string { return out })
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := manifestPath(out)
+	if err := writeManifest(manifest, paths, videoClip{}, calibration{}, req, run); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// readManifest decodes the manifest at path
+func readManifest(t *testing.T, path string) jobManifest {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m jobManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// editManifest rewrites the manifest at path after edit changes it
+func editManifest(t *testing.T, path string, edit func(m *jobManifest)) {
+	t.Helper()
+	m := readManifest(t, path)
+	edit(&m)
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	manifest := manifestBurst(t, dir)
+	if manifest != filepath.Join(dir, "result-manifest.json") {
+		t.Errorf("manifest written to %s", manifest)
+	}
+	m := readManifest(t, manifest)
+	if len(m.Inputs) != 4 || m.Inputs[0].Path != "frame0.png" || m.Output.Path != "result.png" {
+		t.Errorf("manifest names the inputs %+v and the output %+v, want paths relative to it", m.Inputs, m.Output)
+	}
+	if want, _, _ := hashFile(filepath.Join(dir, "result.png")); m.Output.SHA256 != want {
+		t.Errorf("manifest gives the result SHA-256 %s, want %s", m.Output.SHA256, want)
+	}
+
+	sum, err := verifyManifest(context.Background(), manifest)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if sum != m.Output.SHA256 {
+		t.Errorf("verify made SHA-256 %s, want %s", sum, m.Output.SHA256)
+	}
+
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyManifest(context.Background(), filepath.Join(moved, "result-manifest.json")); err != nil {
+		t.Errorf("verify after moving the folder: %v", err)
+	}
+}
+
+func TestManifestVerifyFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(t *testing.T, manifest string)
+		code int
+		want string
+	}{
+		{"changed frame", func(t *testing.T, manifest string) {
+			path := filepath.Join(filepath.Dir(manifest), "frame2.png")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := png.Encode(f, noiseImage(64, 48, 8)); err != nil {
+				t.Fatal(err)
+			}
+		}, exitBadInput, "has changed"},
+		{"missing frame", func(t *testing.T, manifest string) {
+			if err := os.Remove(filepath.Join(filepath.Dir(manifest), "frame1.png")); err != nil {
+				t.Fatal(err)
+			}
+		}, exitBadInput, "frame1.png"},
+		{"other result", func(t *testing.T, manifest string) {
+			editManifest(t, manifest, func(m *jobManifest) { m.Output.SHA256 = strings.Repeat("0", 64) })
+		}, exitMismatch, "the manifest says " + strings.Repeat("0", 64)},
+		{"changed algorithm", func(t *testing.T, manifest string) {
+			editManifest(t, manifest, func(m *jobManifest) {
+				m.Output.SHA256 = strings.Repeat("0", 64)
+				m.Algorithms = map[string]int{m.Resolved.Algorithm: 0}
+			})
+		}, exitMismatch, "algorithm was at version 0"},
+		{"newer manifest", func(t *testing.T, manifest string) {
+			editManifest(t, manifest, func(m *jobManifest) { m.Version = manifestVersion + 1 })
+		}, exitBadInput, "newer"},
+		{"not a manifest", func(t *testing.T, manifest string) {
+			if err := os.WriteFile(manifest, []byte(`{"manifest_version": 1}`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, exitBadInput, "not a manifest"},
+	} {
+		manifest := manifestBurst(t, t.TempDir())
+		tc.edit(t, manifest)
+		_, err := verifyManifest(context.Background(), manifest)
+		if code := exitCode(err); code != tc.code || err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: verify gave %v with exit code %d, want exit code %d and %q", tc.name, err, code, tc.code, tc.want)
+		}
+	}
+}
+
+func TestManifestChanges(t *testing.T) {
+	current := jobManifest{
+		Build:      currentBuild(),
+		Modules:    linkedModules(),
+		Algorithms: algorithmVersions,
+		Resolved:   manifestOptions{Algorithm: algorithmAverage},
+	}
+	if changes := manifestChanges(current); len(changes) != 0 {
+		t.Errorf("changes from the running program: %q", changes)
+	}
+
+	older := current
+	older.Algorithms = map[string]int{algorithmAverage: algorithmVersions[algorithmAverage] - 1}
+	older.Build.Version = "v0.0.1-old"
+	older.Modules = map[string]string{"example.com/not/linked": "v1.0.0"} // Not linked any more, so not a change
+	var module string
+	for path := range linkedModules() {
+		module = path
+		older.Modules[path] = "v0.0.0-old"
+		break
+	}
+	changes := manifestChanges(older)
+	want := []string{"average algorithm was at version", "v0.0.1-old"}
+	if module != "" {
+		want = append(want, module+" was v0.0.0-old")
+	}
+	if len(changes) != len(want) {
+		t.Errorf("changes %q, want %d", changes, len(want))
+	}
+	for _, w := range want {
+		if !strings.Contains(strings.Join(changes, "\n"), w) {
+			t.Errorf("changes %q do not mention %q", changes, w)
+		}
+	}
+}
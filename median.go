@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"log/slog"
+	"slices"
+)
+
+// Tourists crossing a square, cars passing a facade: whatever moves through a
+// burst stands in any one place in a few of its frames only. The median
+// algorithm takes the median of the aligned frames at every pixel, channel by
+// channel, so anything that covers a place in fewer than half of them is
+// erased, and upscales that one image. It is meant for emptying a scene rather
+// than for detail, which the clean preset sets up: shoot a dozen frames from a
+// tripod or a steady hand while people walk by.
+
+// minMedianFrames is the fewest frames the median algorithm takes: of two, the
+// median is their average and erases nothing
+const minMedianFrames = 3
+
+// medianFrame returns the median of the aligned frames at every pixel, in
+// every channel, the average of the middle two for an even number of them.
+// Pixels the shift of a 16-bit frame left uncovered, transparent, do not
+// count; those of 8-bit frames are black and outvoted like anything else.
+func medianFrame(ctx context.Context, aligned []image.Image) image.Image {
+	b := aligned[0].Bounds()
+	median := blankFrame(aligned[0], b)
+	_, deep := median.(*image.RGBA64)
+	forRowBands(b, func(y0, y1 int) {
+		var values [3][]uint32
+		for y := y0; y < y1; y++ {
+			if ctx.Err() != nil {
+				return
+			}
+			for x := b.Min.X; x < b.Max.X; x++ {
+				for c := range values {
+					values[c] = values[c][:0]
+				}
+				for _, img := range aligned {
+					r, g, bl, a := img.At(x, y).RGBA()
+					if a == 0 {
+						continue
+					}
+					values[0] = append(values[0], r)
+					values[1] = append(values[1], g)
+					values[2] = append(values[2], bl)
+				}
+				if len(values[0]) == 0 {
+					continue // Uncovered in every frame
+				}
+				var m [3]uint32
+				for c, v := range values {
+					slices.Sort(v)
+					m[c] = v[len(v)/2]
+					if len(v)%2 == 0 {
+						m[c] = (v[len(v)/2-1] + m[c] + 1) / 2
+					}
+				}
+				if deep {
+					median.Set(x, y, color.RGBA64{R: uint16(m[0]), G: uint16(m[1]), B: uint16(m[2]), A: 0xffff})
+				} else {
+					median.Set(x, y, color.RGBA{R: uint8(m[0] >> 8), G: uint8(m[1] >> 8), B: uint8(m[2] >> 8), A: 0xff})
+				}
+			}
+		}
+	})
+	slog.InfoContext(ctx, "Median of the frames taken", "frames", len(aligned))
+	return median
+}
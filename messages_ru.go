@@ -0,0 +1,339 @@
+package main
+
+// messagesRU is the Russian catalog of the web UI. Counts are put after a colon
+// or abbreviated, so the translations need no plural forms.
+var messagesRU = map[string]string{
+	// Navigation
+	"Upload":          "Загрузка",
+	"My results":      "Мои результаты",
+	"Admin":           "Администрирование",
+	"Workspaces":      "Рабочие пространства",
+	"Logged in as %s": "Вы вошли как %s",
+	"Log out":         "Выйти",
+	"Automatic theme": "Тема как в системе",
+	"Light theme":     "Светлая тема",
+	"Dark theme":      "Тёмная тема",
+
+	// Upload page
+	"Super Resolution":      "Суперразрешение",
+	"Super Resolution Tool": "Суперразрешение",
+	"Upload Images (JPEG, PNG, GIF or TIFF) or a ZIP archive of them": "Загрузите снимки (JPEG, PNG, GIF или TIFF) или ZIP-архив с ними",
+	"Drop images or a ZIP archive here, or click to choose files":     "Перетащите сюда снимки или ZIP-архив либо нажмите, чтобы выбрать файлы",
+	"On a phone?":                     "С телефона?",
+	"Capture a burst with the camera": "Снимите серию камерой",
+	"instead.":                        "прямо в браузере.",
+	"Or image URLs, one per line":     "Или адреса снимков, по одному в строке",
+	"Dark frames (optional)":          "Темновые кадры (необязательно)",
+	"For long exposures of the night sky: frames shot with the lens capped, at the same exposure, ISO and temperature. Their sensor glow and hot pixels are subtracted from every frame.": "Для длинных выдержек ночного неба: кадры, снятые с закрытым объективом при той же выдержке, ISO и температуре. Их свечение матрицы и горячие пиксели вычитаются из каждого кадра.",
+	"Flat frames (optional)": "Кадры плоского поля (необязательно)",
+	"For microscopes and telescopes: frames of an empty, evenly lit field through the same optics. The frames are divided by them, evening out vignetting and the shadows of dust.": "Для микроскопов и телескопов: снимки пустого, равномерно освещённого поля через ту же оптику. Кадры делятся на них, что выравнивает виньетирование и убирает тени пылинок.",
+	"Stream the result in strips (for very large outputs)":                                               "Передавать результат полосами (для очень больших изображений)",
+	"Download everything as a ZIP: the result, the aligned frames, a comparison image and a JSON report": "Скачать всё одним ZIP-архивом: результат, выровненные кадры, сравнение и отчёт в JSON",
+	"Submit Images": "Обработать",
+	"Frames and the result are never written to the server's disk; the result is not kept": "Кадры и результат не записываются на диск сервера; результат не сохраняется",
+	"Submit without temporary files":                                      "Обработать без временных файлов",
+	"Quick preview at 1/%d resolution":                                    "Быстрый предпросмотр в разрешении 1/%d",
+	"A rough result in seconds; then run the full job on the same images": "Примерный результат за секунды; затем запустите полную обработку тех же снимков",
+	"Share with workspace":                                                "Открыть рабочему пространству",
+	"Only me":                                                             "Только мне",
+	"No size limits.":                                                     "Без ограничений размера.",
+	"Up to %s, %s each, %s in total.":                                     "Лимиты: %s; %s на файл; %s всего.",
+	"%d frames":                                                           "%d кадр.",
+	"%d MB":                                                               "%d МБ",
+	"%d min":                                                              "%d мин",
+	"any number of frames":                                                "любое число кадров",
+	"any size":                                                            "без ограничений",
+	"unlimited":                                                           "без ограничений",
+
+	// Processing options
+	"Processing options":               "Параметры обработки",
+	"Preset":                           "Набор настроек",
+	"None":                             "Нет",
+	"Security camera footage":          "Запись камеры наблюдения",
+	"Number plate or small text":       "Номерной знак или мелкий текст",
+	"Document page":                    "Страница документа",
+	"Night sky":                        "Ночное небо",
+	"Moon or planet":                   "Луна или планета",
+	"Microscope captures":              "Снимки с микроскопа",
+	"Phone burst":                      "Серия снимков с телефона",
+	"Film scan passes":                 "Проходы сканера плёнки",
+	"Region of interest":               "Область интереса",
+	"width":                            "ширина",
+	"height":                           "высота",
+	"Deconvolve":                       "Деконволюция",
+	"Scale factor":                     "Увеличение",
+	"Auto":                             "Авто",
+	"Algorithm":                        "Алгоритм",
+	"Frames left out of every tile, %": "Кадров, отбрасываемых в каждом фрагменте, %",
+	"Median, removing people and cars that pass":    "Медиана: убирает прохожих и машины",
+	"Remove passers-by":                             "Убрать прохожих",
+	"Keep a moving subject sharp (portraits)":       "Сохранить движущийся объект резким (портреты)",
+	"Reproducible result (same frames, same bytes)": "Воспроизводимый результат (те же кадры — те же байты)",
+	"Average of all frames":                         "Усреднение всех кадров",
+	"Average, leaving out what lines up badly":      "Усреднение без плохо совпавших участков",
+	"Reference frame only (for comparison)":         "Только опорный кадр (для сравнения)",
+	"Interpolation":                                 "Интерполяция",
+	"Output format":                                 "Формат результата",
+	"PNG (lossless)":                                "PNG (без потерь)",
+	"PDF (A4 page)":                                 "PDF (страница A4)",
+	"TIFF (GeoTIFF for maps)":                       "TIFF (GeoTIFF для карт)",
+	"Black and white text (for documents)":          "Чёрно-белый текст (для документов)",
+	"Lossless only (for archiving, JPEG refused)":   "Только без потерь (для архива, JPEG запрещён)",
+	"JPEG quality":                                  "Качество JPEG",
+	"JPEG chroma subsampling":                       "Прореживание цвета JPEG",
+	"Frames of another size":                        "Кадры другого размера",
+	"Reject them":                                   "Отклонить",
+	"Crop all to the common size":                   "Обрезать все до общего размера",
+	"Resize to the reference":                       "Масштабировать под опорный",
+	"Bursts of many frames":                         "Длинные серии",
+	"Fuse the sharpest %d":                          "Совместить %d самых резких",
+	"Fuse every frame":                              "Совместить все кадры",
+	"%d frames were submitted and the sharpest %d of them were fused: more would barely lower the noise further. Set many_frames to %s (-many-frames %s) to fuse every frame.":                                     "Передано кадров: %d, совмещены %d самых резких: остальные почти не снизили бы шум. Чтобы совместить все кадры, задайте many_frames=%s (-many-frames %s).",
+	"Only %d frame(s) were fused: fewer than %d cannot add real detail, so the result is little more than an upscale of the reference. Fuse a burst of %d or more frames taken from slightly different positions.": "Совмещено кадров: %d. Меньше %d кадров не добавляют настоящих деталей, и результат — почти то же, что увеличенный опорный кадр. Совмещайте серию из %d и более кадров, снятых из немного разных положений.",
+	"4:4:4 (full colour resolution)": "4:4:4 (цвет в полном разрешении)",
+	"Progressive JPEG":               "Прогрессивный JPEG",
+	"Denoise":                        "Шумоподавление",
+	"Sharpen":                        "Резкость",
+	"Local contrast":                 "Локальный контраст",
+	"Tone mapping of 16-bit results": "Тональная компрессия 16-битных результатов",
+	"Linear, brightest clipped":      "Линейно, с обрезкой самого яркого",
+	"Wavelet sharpening":             "Вейвлет-резкость",
+	"Sharpest frames kept, %":        "Оставить самых резких кадров, %",
+	"Thermal camera frames (16-bit radiometric TIFF or PNG)":     "Кадры тепловизора (16-битные радиометрические TIFF или PNG)",
+	"16-bit grayscale frames at full depth (microscope cameras)": "16-битные полутоновые кадры без потери глубины (камеры микроскопов)",
+	"Passes of a film scanner (removes dust)":                    "Проходы сканера плёнки (убирает пыль)",
+	"Match the exposure of the frames":                           "Выровнять экспозицию кадров",
+	"Fuse brightness only (about 3x faster)":                     "Совмещать только яркость (примерно втрое быстрее)",
+	"Fuse JPEG frames in Y'CbCr (faster)":                        "Совмещать кадры JPEG в Y'CbCr (быстрее)",
+	"Colour space of the frames":                                 "Цветовое пространство кадров",
+	"Fuse in":                                                    "Совмещать",
+	"Encoded levels":                                             "По закодированным уровням",
+	"Linear light":                                               "В линейном свете",
+	"Colour space of the result":                                 "Цветовое пространство результата",
+	"As the frames":                                              "Как у кадров",
+	"Linear sRGB":                                                "Линейный sRGB",
+	"Adapt to the noise of every frame":                          "Учитывать шум каждого кадра",
+	"Remove ghosts of moving people and cars":                    "Убрать призраки движущихся людей и машин",
+	"Scans of a negative":                                        "Сканы негатива",
+
+	// Preset warnings
+	"Characters in this result are reconstructed from the frames and can look legible while being wrong: it is an investigative aid, not evidence. Confirm any reading against the original frames, and have forensic work done with validated tools.": "Символы на этом результате восстановлены по кадрам и могут выглядеть читаемыми, оставаясь неверными: это вспомогательный материал, а не доказательство. Сверяйте любое прочтение с исходными кадрами, а экспертизу проводите проверенными средствами.",
+
+	// Frame previews
+	"sharpness {0}": "резкость {0}",
+	"Variance of the Laplacian; higher is sharper": "Дисперсия лапласиана; чем больше, тем резче",
+	"Use":                                "Использовать",
+	"Reference":                          "Опорный",
+	"Make reference":                     "Сделать опорным",
+	"Align the other frames to this one": "Выровнять остальные кадры по этому",
+	"Remove":                             "Убрать",
+	"{0} of {1} file selected, {2}":      "Выбрано {0} из {1}, {2}",
+	"{0} of {1} files selected, {2}":     "Выбрано {0} из {1}, {2}",
+	"No files selected":                  "Файлы не выбраны",
+	"(at most {0} frames are accepted)":  "(принимается не больше {0} кадров)",
+	"Please add at least one image or ZIP archive.":                          "Добавьте хотя бы один снимок или ZIP-архив.",
+	"shift ≈ {0}, {1} px":                                                    "сдвиг ≈ {0}, {1} пкс",
+	"Estimated in the browser against the reference frame, before uploading": "Оценено в браузере относительно опорного кадра, до загрузки",
+	"Different size than the reference frame":                                "Размер отличается от опорного кадра",
+	"Moved further than the server can align":                                "Сдвиг больше, чем сервер может выровнять",
+	"Looks like a different scene than the reference frame":                  "Похоже, снята другая сцена, чем на опорном кадре",
+	"{0} frame(s) may not fuse well; consider leaving them out.":             "Кадров, которые могут плохо совместиться: {0}; их лучше исключить.",
+
+	// Progress
+	"Progress":             "Ход обработки",
+	"Uploading":            "Загрузка",
+	"{0} MB":               "{0} МБ",
+	"{0} of {1} MB":        "{0} из {1} МБ",
+	"Reading frames…":      "Чтение кадров…",
+	"Waiting in the queue": "Ожидание в очереди",
+	"Position {0} in the queue. Keep this page open: leaving it cancels the job.": "Место в очереди: {0}. Не закрывайте страницу: уход с неё отменяет задание.",
+	"Aligning frames":                        "Выравнивание кадров",
+	"Fusing frames":                          "Слияние кадров",
+	"{0} of {1} frames, {2} elapsed":         "Кадров: {0} из {1}, прошло {2}",
+	", about {0} left":                       ", осталось около {0}",
+	"{0} s":                                  "{0} с",
+	"{0} min {1} s":                          "{0} мин {1} с",
+	"{0} h {1} min":                          "{0} ч {1} мин",
+	"Starting…":                              "Запуск…",
+	"Done":                                   "Готово",
+	"Download {0}":                           "Скачать {0}",
+	"Failed":                                 "Ошибка",
+	"Error {0}":                              "Ошибка {0}",
+	"The connection to the server was lost.": "Соединение с сервером потеряно.",
+	"Preview of the result":                  "Предпросмотр результата",
+	"Run at full resolution":                 "Обработать в полном разрешении",
+	"Preview ready":                          "Предпросмотр готов",
+	"A rough look at the result: the full job gives more detail.": "Примерный вид результата: полная обработка даст больше деталей.",
+	"Checking the burst": "Проверка серии",
+	"Burst checked":      "Серия проверена",
+
+	// Burst check
+	"Check the burst": "Проверить серию",
+	"Measures how much detail the frames can add and recommends a scale, without processing them": "Оценивает, сколько деталей могут добавить кадры, и рекомендует масштаб, не обрабатывая их",
+	"Burst check": "Проверка серии",
+	"none":        "нет",
+	"small":       "небольшая",
+	"moderate":    "умеренная",
+	"strong":      "значительная",
+	"Expected benefit: %s. Recommended scale: %dx.": "Ожидаемая польза: %s. Рекомендуемый масштаб: %dx.",
+	"Only one frame was uploaded: the result can only be a plain upscale without added detail. Upload a burst of several frames taken from slightly different positions.": "Загружен только один кадр: результат будет простым увеличением без новых деталей. Загрузите серию из нескольких кадров, снятых с немного разных позиций.",
+	"No other frame lines up with the reference, so the frames cannot be fused.":                                                                                          "Ни один кадр не совмещается с опорным, поэтому объединить кадры нельзя.",
+	"The frames sit on nearly the same pixel positions, so fusing them adds little detail. Moving the camera slightly between shots helps.":                               "Кадры почти совпадают по положению пикселей, поэтому объединение добавит мало деталей. Поможет лёгкое смещение камеры между снимками.",
+	"The frames cover %.0f%% of the half-pixel positions; up to %dx upscaling can add real detail.":                                                                       "Кадры покрывают %.0f%% полупиксельных позиций; увеличение до %dx может добавить реальные детали.",
+	"The frames are noisy (noise level %.1f); fusing %d frames reduces the noise about %.1f times.":                                                                       "Кадры шумные (уровень шума %.1f); объединение %d кадров снизит шум примерно в %.1f раза.",
+	"%d of the measured frames are much softer than the sharpest one; leaving them out may give a crisper result.":                                                        "%d из измеренных кадров заметно мягче самого резкого; без них результат может быть чётче.",
+	"%d frame(s) differ in size or could not be matched to the reference.":                                                                                                "Кадров другого размера или не совмещённых с опорным: %d.",
+	"The requested %dx is more than this burst supports: the extra pixels are interpolated, not resolved.":                                                                "Запрошенный масштаб %dx больше, чем позволяет эта серия: лишние пиксели интерполированы, а не восстановлены.",
+
+	// Step-by-step workflow
+	"Step by step": "По шагам",
+	"Review the alignment and choose the options before processing": "Проверить совмещение и выбрать параметры перед обработкой",
+	"Review alignment":     "Проверка совмещения",
+	"Options":              "Параметры",
+	"Confirm":              "Подтверждение",
+	"Process":              "Обработать",
+	"Continue":             "Далее",
+	"Reference frame":      "Опорный кадр",
+	"Shifted by %d, %d px": "Сдвиг %d, %d пкс",
+	"Discard these frames": "Удалить эти кадры",
+	"Each frame is drawn in cyan over the reference in red, after moving it by the shift found: where they line up the overlay is grey, and coloured fringes show what does not. Frames with warnings will fuse poorly; move them by hand, start over without them or pick another reference.": "Каждый кадр показан голубым поверх опорного красным после сдвига на найденную величину: где они совпадают, наложение серое, а цветные каймы показывают несовпадения. Кадры с предупреждениями плохо совместятся; сдвиньте их вручную, начните заново без них или выберите другой опорный кадр.",
+	"Redraw against the chosen reference": "Перерисовать относительно выбранного опорного кадра",
+	"Adjust by hand":                      "Совместить вручную",
+	"Left":                                "Влево",
+	"Up":                                  "Вверх",
+	"Down":                                "Вниз",
+	"Right":                               "Вправо",
+	"Turn anticlockwise":                  "Повернуть против часовой стрелки",
+	"Turn clockwise":                      "Повернуть по часовой стрелке",
+	"dx, px":                              "dx, пкс",
+	"dy, px":                              "dy, пкс",
+	"Rotation, °":                         "Поворот, °",
+	"Back to automatic alignment":         "Вернуть автоматическое совмещение",
+	"Aligned by hand":                     "Совмещены вручную",
+
+	// Capture page
+	"Capture a Burst": "Съёмка серии",
+	"Hold the phone as still as you can: the small shifts between frames are what adds the detail.": "Держите телефон как можно неподвижнее: детали добавляются именно за счёт небольших сдвигов между кадрами.",
+	"Frames":             "Кадры",
+	"Interval (ms)":      "Интервал (мс)",
+	"Start camera":       "Включить камеру",
+	"Capture and submit": "Снять и обработать",
+	"This browser cannot use the camera here. Camera access needs HTTPS (or localhost).": "Этот браузер не может использовать камеру здесь. Для доступа к камере нужен HTTPS (или localhost).",
+	"Could not start the camera: {0}": "Не удалось включить камеру: {0}",
+	"Capturing frame {0} of {1}…":     "Съёмка кадра {0} из {1}…",
+	"Processing {0} frames…":          "Обработка кадров: {0}…",
+	"Done.":                           "Готово.",
+	"Error: {0}":                      "Ошибка: {0}",
+	"Saved offline: the burst is submitted when the connection returns. Keep this page open or come back to it.": "Сохранено без сети: серия будет отправлена, когда появится соединение. Не закрывайте страницу или вернитесь на неё позже.",
+	"{0} burst(s) waiting to be submitted when the connection returns.":                                          "Серий ждут отправки до появления соединения: {0}.",
+	"Download the burst captured at {0}":                                                                         "Скачать серию, снятую в {0}",
+	"A queued burst was refused: {0}":                                                                            "Сервер отклонил отложенную серию: {0}",
+
+	// Result page and viewer
+	"Super Resolution Result":                "Результат суперразрешения",
+	"Bicubic upscale of the reference frame": "Бикубическое увеличение опорного кадра",
+	"Fused result":                           "Результат слияния",
+	"Super-resolution result":                "Результат суперразрешения",
+	"Comparison position":                    "Положение шторки",
+	"Download":                               "Скачать",
+	"Inspect at 1:1":                         "Рассмотреть в масштабе 1:1",
+	"Process more images":                    "Обработать другие снимки",
+	"Result":                                 "Результат",
+	"Back":                                   "Назад",
+	"This is a quick preview at 1/%d of the resolution and is not kept. Go back to the upload page and submit the same images to run the full job.": "Это быстрый предпросмотр в разрешении 1/%d, он не сохраняется. Вернитесь на страницу загрузки и отправьте те же снимки, чтобы запустить полную обработку.",
+	"Fit": "Вписать",
+
+	// Results gallery
+	"My Results":                     "Мои результаты",
+	"No jobs yet.":                   "Заданий пока нет.",
+	"View":                           "Открыть",
+	"Delete":                         "Удалить",
+	"In progress":                    "Выполняется",
+	"Result not kept on this server": "Результаты на этом сервере не хранятся",
+	"Result deleted":                 "Результат удалён",
+	"No result":                      "Нет результата",
+	"denoise %d":                     "шумоподавление %d",
+	"sharpen %d":                     "резкость %d",
+	"Submitted %s":                   "Отправлено %s",
+	", ran %s":                       ", обработка %s",
+	"Storage used: %s of %s. Processing time in the last 24 hours: %s of %s.": "Занято места: %s из %s. Время обработки за последние 24 часа: %s из %s.",
+	"queued":      "в очереди",
+	"running":     "выполняется",
+	"done":        "готово",
+	"failed":      "ошибка",
+	"canceled":    "отменено",
+	"interrupted": "прервано",
+
+	// Sharing
+	"Link lifetime":        "Срок действия ссылки",
+	"1 day":                "1 день",
+	"7 days":               "7 дней",
+	"30 days":              "30 дней",
+	"Never expires":        "Бессрочно",
+	"Share link":           "Поделиться ссылкой",
+	"Shared by %d link(s)": "Ссылок: %d",
+	"Stop sharing":         "Закрыть доступ",
+	"Share Result":         "Ссылка на результат",
+	"Anyone with this link can download the result, without an account.": "Любой, у кого есть эта ссылка, может скачать результат без учётной записи.",
+	"Copy it now: it is not shown again.":                                "Скопируйте её сейчас: повторно она не показывается.",
+	"It does not expire.":                                                "Срок действия не ограничен.",
+	"It works until %s.":                                                 "Она действует до %s.",
+	"Back to my results":                                                 "Вернуться к результатам",
+
+	// Completion e-mail
+	"E-mail me at %s when a long job is done; the job goes on if I close the page": "Написать мне на %s, когда долгое задание завершится; задание продолжится, даже если закрыть страницу",
+	"Super-resolution job %s is done":                                              "Задание сверхразрешения %s выполнено",
+	"Your super-resolution job %s finished after %s.":                              "Ваше задание сверхразрешения %s завершилось за %s.",
+	"Super-resolution job %s failed":                                               "Задание сверхразрешения %s не выполнено",
+	"Your super-resolution job %s failed after %s: %s":                             "Ваше задание сверхразрешения %s завершилось ошибкой через %s: %s",
+	"The result: %s": "Результат: %s",
+	"The result is not kept on the server, so it went only to the page or program that submitted the job.": "Результат не хранится на сервере, поэтому он был передан только странице или программе, отправившей задание.",
+	"the result could not be encoded": "не удалось закодировать результат",
+
+	// Cloud drives
+	"Or use a folder of images from": "Или взять папку со снимками из",
+	"The images in the %s folder %s are used as frames, with any files chosen above.": "Кадрами станут снимки из папки %[2]s в %[1]s, вместе с выбранными выше файлами.",
+	"Choose another folder":  "Выбрать другую папку",
+	"Frames from %s":         "Кадры из %s",
+	"Back to the top folder": "К верхней папке",
+	"No subfolders":          "Вложенных папок нет",
+	"No JPEG, PNG, GIF or TIFF images in this folder.": "В этой папке нет снимков JPEG, PNG, GIF или TIFF.",
+	"Use the %d images in this folder":                 "Взять снимки из этой папки: %d",
+
+	// Workspaces
+	"%d members":         "участников: %d",
+	"e-mail or key:name": "e-mail или key:имя",
+	"Add member":         "Добавить участника",
+	"Delete workspace":   "Удалить пространство",
+	"New workspace name": "Название нового пространства",
+	"Create":             "Создать",
+
+	// Admin dashboard
+	"Queue": "Очередь",
+	"%d queued of %d slots &middot; %d running &middot; %d of %d workers alive": "в очереди %d из %d мест &middot; выполняется %d &middot; работает обработчиков: %d из %d",
+	"draining":                     "завершение работы",
+	"accumulation memory %s":       "память накопления %s",
+	"Active jobs":                  "Активные задания",
+	"Recent jobs":                  "Недавние задания",
+	"Job":                          "Задание",
+	"Owner":                        "Владелец",
+	"Status":                       "Состояние",
+	"Scale":                        "Увеличение",
+	"Memory":                       "Память",
+	"Age":                          "Возраст",
+	"Processing time":              "Время обработки",
+	"Cancel":                       "Отменить",
+	"No active jobs":               "Активных заданий нет",
+	"Throughput, last 24 hours":    "Производительность за последние 24 часа",
+	"%d jobs, %d frames, %d h ago": "заданий: %d, кадров: %d, %d ч назад",
+	"Hover a bar for details. Tallest bar: %d jobs.": "Наведите на столбец, чтобы увидеть подробности. Заданий в самом высоком столбце: %d.",
+	"Disk":      "Диск",
+	"Directory": "Каталог",
+	"Free":      "Свободно",
+	"Total":     "Всего",
+	"Disk budget: %s of %d MB used or reserved.": "Бюджет диска: занято или зарезервировано %s из %d МБ.",
+	"%d stored results use %s.":                  "Сохранённых результатов: %d, занимают %s.",
+	"Delete results older than":                  "Удалить результаты старше",
+	"days":                                       "дней",
+	"Purge":                                      "Очистить",
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// histogram is a Prometheus-style cumulative histogram partitioned by one label
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // Upper bounds in ascending order, +Inf is implicit
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Per-bucket counts, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// observe records value v for the series identified by label
+func (h *histogram) observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.series[label]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[label] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// write emits the histogram in the Prometheus text exposition format
+func (h *histogram) write(w io.Writer, name, help, labelName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	labels := make([]string, 0, len(h.series))
+	for label := range h.series {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		s := h.series[label]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, labelName, label, formatFloat(upper), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, labelName, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", name, labelName, label, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, labelName, label, s.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// metrics holds every value exported at /metrics
+var metrics = struct {
+	jobsSubmitted    atomic.Int64
+	jobsCompleted    atomic.Int64
+	jobsFailed       atomic.Int64
+	framesProcessed  atomic.Int64
+	accumulatorBytes atomic.Int64 // Memory held by live fusion accumulators
+	stageSeconds     *histogram   // Duration of each pipeline stage
+	jobSeconds       *histogram   // Duration of whole jobs by outcome
+}{
+	stageSeconds: newHistogram(0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300),
+	jobSeconds:   newHistogram(0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800),
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeCounter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	writeGauge := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+
+	st := jobs.stats()
+	writeCounter("chicha_sr_jobs_submitted_total", "Jobs accepted into the queue.", metrics.jobsSubmitted.Load())
+	writeCounter("chicha_sr_jobs_completed_total", "Jobs that finished successfully.", metrics.jobsCompleted.Load())
+	writeCounter("chicha_sr_jobs_failed_total", "Jobs that finished with an error.", metrics.jobsFailed.Load())
+	writeCounter("chicha_sr_frames_processed_total", "Input frames fused by completed jobs.", metrics.framesProcessed.Load())
+	writeGauge("chicha_sr_queue_depth", "Jobs waiting for a worker.", int64(st.Queued))
+	writeGauge("chicha_sr_jobs_running", "Jobs currently being processed.", int64(st.Running))
+	writeGauge("chicha_sr_workers_alive", "Worker goroutines running their loop.", int64(st.WorkersAlive))
+	writeGauge("chicha_sr_accumulator_bytes", "Memory held by fusion accumulation buffers.", metrics.accumulatorBytes.Load())
+	diskUsed, _ := diskBudgetUsage()
+	writeGauge("chicha_sr_disk_budget_used_bytes", "Disk space used by stored results or reserved for upload copies and results of jobs in progress.", diskUsed)
+	metrics.stageSeconds.write(w, "chicha_sr_stage_duration_seconds", "Duration of pipeline stages.", "stage")
+	metrics.jobSeconds.write(w, "chicha_sr_job_duration_seconds", "Duration of jobs from start to finish.", "status")
+}
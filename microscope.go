@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// Microscope stacks differ from handheld bursts in how the frames move: the
+// stage creeps steadily in one direction as it settles and warms, so by the
+// end of a stack a frame may sit far beyond the reach of the shift search.
+// Cameras on microscopes also record how large their pixels are, which the
+// result keeps, made finer by the scale, so measurements and scale bars drawn
+// on it stay true.
+
+// alignDrift is the align value for microscope stacks: every frame is searched
+// for against the one before it, around the step the drift took last, over a
+// range several times that of the shift search
+const alignDrift = "drift"
+
+// Drift alignment
+const (
+	driftSearch = 200 // Pixels around the predicted step a frame is searched for
+	driftLevels = 3   // Halvings of the frames the search starts at, refined a level at a time
+)
+
+// driftOffsets registers every frame after the first against the frame before
+// it, coarse to fine, starting around the step the drift took between the two
+// before, and adds the steps up into the offset that aligns each frame with the
+// first, as one set by hand would: by the end of a stack a frame may overlap the
+// reference too little to be matched with it. Frames after a link of the chain
+// that matches nothing get a nil entry.
+func driftOffsets(ctx context.Context, images []image.Image) []*frameOffset {
+	found := make([]*frameOffset, len(images))
+	b := images[0].Bounds()
+	levels := 0
+	for levels < driftLevels && min(b.Dx(), b.Dy())>>(levels+1) >= 32 { // Coarse frames too small match anywhere
+		levels++
+	}
+	pyramid := func(img image.Image) []grayPatch {
+		p := []grayPatch{centerPatch(img, max(b.Dx(), b.Dy()))}
+		for range levels {
+			p = append(p, p[len(p)-1].halve())
+		}
+		return p
+	}
+	previous := pyramid(images[0])
+	var drift, step image.Point // How far the last frame had moved from the first, and from the one before it
+	for i := 1; i < len(images); i++ {
+		if ctx.Err() != nil {
+			return found
+		}
+		frame := pyramid(images[i])
+		dx, dy, diff := bestShift(previous[levels], frame[levels], step.X>>levels, step.Y>>levels, driftSearch>>levels)
+		for level := levels - 1; level >= 0; level-- {
+			dx, dy, diff = bestShift(previous[level], frame[level], 2*dx, 2*dy, 2)
+		}
+		if math.IsInf(diff, 1) {
+			slog.WarnContext(ctx, "Frame matches nothing of the one before it, searching for the shift of the rest instead", "frame", i)
+			return found
+		}
+		// The frame is found dx, dy further into itself than the one before
+		step = image.Pt(dx, dy)
+		drift = drift.Add(step)
+		found[i] = &frameOffset{DX: -drift.X, DY: -drift.Y}
+		previous = frame
+		slog.InfoContext(ctx, "Frame registered along the stage drift", "frame", i, "dx", -drift.X, "dy", -drift.Y)
+	}
+	return found
+}
+
+// TIFF resolution units
+const (
+	resolutionInch       = 2
+	resolutionCentimetre = 3
+)
+
+// pixelResolution is the size of the pixels of a frame as its TIFF tags record
+// it. ImageJ adds its own unit, such as microns, which it reads instead of
+// ResolutionUnit.
+type pixelResolution struct {
+	X, Y       float64 // Pixels per unit
+	Unit       uint16  // ResolutionUnit of TIFF: 1 none, resolutionInch or resolutionCentimetre
+	ImageJUnit string  // Unit of the ImageJ description, "" for frames ImageJ did not write
+}
+
+// imageJUnit returns the unit an ImageJ image description gives its pixels in,
+// or "" when description is not ImageJ's
+func imageJUnit(description string) string {
+	if !strings.HasPrefix(description, "ImageJ=") {
+		return ""
+	}
+	for _, line := range strings.Split(strings.TrimRight(description, "\x00"), "\n") {
+		if unit, ok := strings.CutPrefix(line, "unit="); ok {
+			return unit
+		}
+	}
+	return ""
+}
+
+// resampled returns the resolution of a copy of the frame made factor times
+// finer, nil when p is
+func (p *pixelResolution) resampled(factor float64) *pixelResolution {
+	if p == nil {
+		return nil
+	}
+	out := *p
+	out.X, out.Y = p.X*factor, p.Y*factor
+	return &out
+}
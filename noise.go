@@ -0,0 +1,123 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"image"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+)
+
+// Fusion, the rejection of dust and ghosts and the denoiser go by fixed
+// constants tuned for frames of middling noise: a burst from a good camera in
+// daylight and one from a phone at night are weighed alike, clipped at the same
+// levels and smoothed as much as asked. With the adaptive option, the noise of
+// every frame is measured where the frame is flat, and the weight each frame is
+// fused with, the levels dust and ghosts are told apart from noise at and the
+// strength of the denoiser left at 0 are taken from it.
+
+// Noise estimation
+const (
+	noiseBlock     = 16  // Side of the square blocks a frame is split into to find where it is flat
+	noiseFlatShare = 0.1 // Share of the blocks, the flattest, the noise is measured over
+	minFrameNoise  = 0.5 // Least noise level of a frame, in 8-bit levels, about what rounding to 8 bits adds
+)
+
+// adaptiveDenoise is the denoise strength, per 8-bit level of noise the fused
+// result is left with, that adaptive applies when denoise is left at 0
+const adaptiveDenoise = 20
+
+// flatNoise estimates the noise standard deviation of a patch as patchNoise
+// does, over its flattest blocks alone: the differences there are noise, not
+// texture or edges, which patchNoise sees through only in part. Blocks with
+// pixels clipped to black or white, which show no noise, are left out; a patch
+// with none left is measured whole.
+func flatNoise(p grayPatch) float64 {
+	type block struct {
+		texture  float64 // Mean gradient, noise included
+		response float64 // Sum of the magnitudes of Immerkaer's mask
+		n        int
+	}
+	var blocks []block
+	for by := 1; by+noiseBlock <= p.h-1; by += noiseBlock {
+	blocks:
+		for bx := 1; bx+noiseBlock <= p.w-1; bx += noiseBlock {
+			var bl block
+			for y := by; y < by+noiseBlock; y++ {
+				for x := bx; x < bx+noiseBlock; x++ {
+					if v := p.at(x, y); v < 0.5 || v > 254.5 {
+						continue blocks
+					}
+					bl.texture += math.Abs(p.at(x+1, y)-p.at(x, y)) + math.Abs(p.at(x, y+1)-p.at(x, y))
+					bl.response += math.Abs(p.at(x-1, y-1) - 2*p.at(x, y-1) + p.at(x+1, y-1) -
+						2*p.at(x-1, y) + 4*p.at(x, y) - 2*p.at(x+1, y) +
+						p.at(x-1, y+1) - 2*p.at(x, y+1) + p.at(x+1, y+1))
+					bl.n++
+				}
+			}
+			bl.texture /= float64(bl.n)
+			blocks = append(blocks, bl)
+		}
+	}
+	if len(blocks) == 0 {
+		return patchNoise(p)
+	}
+	slices.SortFunc(blocks, func(a, b block) int { return cmp.Compare(a.texture, b.texture) })
+	response, n := 0.0, 0
+	for _, bl := range blocks[:max(1, int(float64(len(blocks))*noiseFlatShare))] {
+		response += bl.response
+		n += bl.n
+	}
+	return response * math.Sqrt(math.Pi/2) / (6 * float64(n))
+}
+
+// frameNoise measures the noise level of every frame with flatNoise, in 8-bit
+// levels, at least minFrameNoise
+func frameNoise(ctx context.Context, images []image.Image) []float64 {
+	noise := make([]float64, len(images))
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := img.Bounds()
+			noise[i] = max(flatNoise(centerPatch(img, max(b.Dx(), b.Dy()))), minFrameNoise)
+			slog.InfoContext(ctx, "Frame noise measured", "frame", i, "noise", noise[i])
+		}()
+	}
+	wg.Wait()
+	return noise
+}
+
+// noiseWeights returns the weight each frame is fused with for the least noise
+// in the result, the inverse of its noise level squared, scaled so the weights
+// average 1
+func noiseWeights(noise []float64) []float64 {
+	weights := make([]float64, len(noise))
+	sum := 0.0
+	for i, n := range noise {
+		weights[i] = 1 / (n * n)
+		sum += weights[i]
+	}
+	for i := range weights {
+		weights[i] *= float64(len(weights)) / sum
+	}
+	return weights
+}
+
+// fusedNoise returns the noise level left in frames of the given noise levels
+// averaged with the given weights, nil weighing them alike
+func fusedNoise(noise, weights []float64) float64 {
+	variance, sum := 0.0, 0.0
+	for i, n := range noise {
+		w := 1.0
+		if weights != nil {
+			w = weights[i]
+		}
+		variance += w * w * n * n
+		sum += w
+	}
+	return math.Sqrt(variance) / sum
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// jobNotice is how the end of a job is reported to its submitter, gathered from
+// the request while it is at hand, as the job may outlive it
+type jobNotice struct {
+	callbackURL string // Webhook, see notifyCallback
+	email       string // Recipient of the completion e-mail, empty for none
+	root        string // Absolute URL of the application as the submitter reaches it
+
+	// Texts of the e-mail in the submitter's language, formats for the job ID,
+	// its duration and the result line
+	doneSubject, doneBody     string
+	failedSubject, failedBody string
+	resultLine, noResultLine  string
+	encodingFailed            string
+}
+
+// newJobNotice returns how to report the end of the job of r, or nil when the
+// request asked for no report. A delivery counts as one: it too is made when
+// the submitter may have hung up.
+func newJobNotice(r *http.Request, opts processOptions) (*jobNotice, *requestError) {
+	if opts.CallbackURL == "" && !opts.NotifyEmail && opts.DeliverTo == "" {
+		return nil, nil
+	}
+	n := &jobNotice{callbackURL: opts.CallbackURL, root: absoluteURL(r, "")}
+	if opts.NotifyEmail {
+		n.email = submitterEmail(r)
+		if n.email == "" {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "no_email_address", Message: "Parameter notify_email needs an e-mail address: log in with an account that has one, or use an API key with an email in the key store"}
+		}
+		n.doneSubject = tr(r, "Super-resolution job %s is done")
+		n.doneBody = tr(r, "Your super-resolution job %s finished after %s.")
+		n.failedSubject = tr(r, "Super-resolution job %s failed")
+		n.failedBody = tr(r, "Your super-resolution job %s failed after %s: %s")
+		n.resultLine = tr(r, "The result: %s")
+		n.noResultLine = tr(r, "The result is not kept on the server, so it went only to the page or program that submitted the job.")
+		n.encodingFailed = tr(r, "the result could not be encoded")
+	}
+	return n, nil
+}
+
+// submitterEmail returns the e-mail address of whoever submitted r: the logged-in
+// user's, or the one set for their API key
+func submitterEmail(r *http.Request) string {
+	var address string
+	if u := userFromContext(r.Context()); u != nil {
+		address = u.Email
+	} else if k := apiKeyFromContext(r.Context()); k != nil {
+		address = k.Email
+	}
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	return ""
+}
+
+// checkNotifyEmail refuses notify_email when the server sends no e-mail
+func checkNotifyEmail(notify bool) *requestError {
+	if notify && config.SMTPAddr == "" {
+		return &requestError{Status: http.StatusBadRequest, Code: "email_disabled", Message: "This server does not send e-mail. Please poll the job instead."}
+	}
+	return nil
+}
+
+// notifyEmailField renders the upload form checkbox asking for a completion
+// e-mail, when the server sends e-mail and knows the user's address
+func notifyEmailField(r *http.Request) string {
+	address := submitterEmail(r)
+	if config.SMTPAddr == "" || address == "" {
+		return ""
+	}
+	return `<div class="form-check mb-3">
+	<input type="checkbox" name="notify_email" value="true" id="notify_email" class="form-check-input">
+	<label for="notify_email" class="form-check-label">` + trf(r, "E-mail me at %s when a long job is done; the job goes on if I close the page", html.EscapeString(address)) + `</label>
+	</div>`
+}
+
+// send reports the end of job id as event, callbackDone or callbackFailed, in
+// the background
+func (n *jobNotice) send(ctx context.Context, event, id string) {
+	if n == nil {
+		return
+	}
+	if n.callbackURL != "" {
+		notifyCallback(ctx, n.callbackURL, event, id, n.root+"/api/v1/jobs/"+id+"/result")
+	}
+	if n.email != "" {
+		n.sendEmail(ctx, event, id)
+	}
+}
+
+// sendEmail mails the outcome of a job that ran at least -notify-after
+func (n *jobNotice) sendEmail(ctx context.Context, event, id string) {
+	record, ok := jobs.get(id)
+	if !ok {
+		return
+	}
+	took := record.Finished.Sub(record.Created)
+	if record.Finished.IsZero() {
+		took = time.Since(record.Created) // The job finished, but encoding its result failed
+	}
+	if took < config.NotifyAfter {
+		return
+	}
+	took = took.Round(time.Second)
+
+	var subject, body string
+	switch event {
+	case callbackDone:
+		subject = fmt.Sprintf(n.doneSubject, id)
+		body = fmt.Sprintf(n.doneBody, id, took)
+		if record.Result != "" {
+			body += "\n\n" + fmt.Sprintf(n.resultLine, n.root+"/results/"+id)
+		} else {
+			body += "\n\n" + n.noResultLine
+		}
+	default:
+		reason := record.Error
+		if reason == "" {
+			reason = n.encodingFailed
+		}
+		subject = fmt.Sprintf(n.failedSubject, id)
+		body = fmt.Sprintf(n.failedBody, id, took, reason)
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := sendMail(n.email, subject, body); err != nil {
+			slog.ErrorContext(ctx, "Error sending job e-mail", "job_id", id, "event", event, "error", err)
+			return
+		}
+		slog.InfoContext(ctx, "Job e-mail sent", "job_id", id, "event", event)
+	}()
+}
+
+// sendMail sends a plain-text UTF-8 message through -smtp-addr, which net/smtp
+// upgrades to TLS when the server offers STARTTLS
+func sendMail(to, subject, body string) error {
+	var auth smtp.Auth
+	if config.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(config.SMTPAddr)
+		auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, host)
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", config.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n") + "\r\n")
+	from := config.SMTPFrom
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		from = parsed.Address // The envelope takes the bare address of "Name <address>"
+	}
+	return smtp.SendMail(config.SMTPAddr, auth, from, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// maxNudgeAngle is the largest rotation a frame can be given by hand, in degrees
+const maxNudgeAngle = 10
+
+// frameOffset is the alignment of a frame set by hand, used instead of the one
+// found automatically: a rotation about the frame's centre, then a move, as the
+// shifts of automatic alignment are
+type frameOffset struct {
+	DX, DY int     // Pixels the frame is moved by
+	Angle  float64 // Degrees the frame is turned by, clockwise
+}
+
+// parseFrameOffsets reads the offsets parameter: whitespace-separated entries
+// frame:dx,dy or frame:dx,dy,degrees, the frame counted as for reference. The
+// result holds an offset for every frame, nil where none was given.
+func parseFrameOffsets(field string, frameCount, reference int) ([]*frameOffset, *requestError) {
+	entries := strings.Fields(field)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	invalid := func(entry, why string) *requestError {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter offsets has an invalid entry %q: %s", entry, why)}
+	}
+	offsets := make([]*frameOffset, frameCount)
+	for _, entry := range entries {
+		frame, values, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, invalid(entry, "expected frame:dx,dy[,degrees]")
+		}
+		i, err := strconv.Atoi(frame)
+		if err != nil || i < 0 || i >= frameCount {
+			return nil, invalid(entry, fmt.Sprintf("the frame must be the index of one of the %d frames, from 0", frameCount))
+		}
+		if i == reference {
+			return nil, invalid(entry, "the reference frame stays where it is; offsets move the other frames onto it")
+		}
+		parts := strings.Split(values, ",")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, invalid(entry, "expected frame:dx,dy[,degrees]")
+		}
+		o := &frameOffset{}
+		o.DX, err = strconv.Atoi(parts[0])
+		if err == nil {
+			o.DY, err = strconv.Atoi(parts[1])
+		}
+		if err != nil {
+			return nil, invalid(entry, "dx and dy must be whole pixels")
+		}
+		if len(parts) == 3 {
+			o.Angle, err = strconv.ParseFloat(parts[2], 64)
+			if err != nil || math.Abs(o.Angle) > maxNudgeAngle {
+				return nil, invalid(entry, fmt.Sprintf("the rotation must be a number of degrees from -%d to %d", maxNudgeAngle, maxNudgeAngle))
+			}
+		}
+		offsets[i] = o
+	}
+	return offsets, nil
+}
+
+// apply moves and turns a frame by the offset
+func (o frameOffset) apply(img image.Image) image.Image {
+	if o.Angle == 0 {
+		return shiftImage(img, o.DX, o.DY)
+	}
+	return transformFrame(img, float64(o.DX), float64(o.DY), o.Angle)
+}
+
+// scaled returns the offset for a copy of the frame resized by factor
+func (o frameOffset) scaled(factor float64) frameOffset {
+	return frameOffset{DX: int(math.Round(float64(o.DX) * factor)), DY: int(math.Round(float64(o.DY) * factor)), Angle: o.Angle}
+}
+
+// transformFrame turns img by degrees clockwise about its centre and moves it by
+// dx, dy, filling the uncovered area with black as shiftImage does
+func transformFrame(img image.Image, dx, dy, degrees float64) draw.Image {
+	b := img.Bounds()
+	out := blankFrame(img, b)
+	draw.Draw(out, b, &image.Uniform{C: uncoveredColour(out)}, image.Point{}, draw.Src)
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	cx, cy := float64(b.Min.X)+float64(b.Dx())/2, float64(b.Min.Y)+float64(b.Dy())/2
+	// Source to destination: p' = R(p - c) + c + d
+	m := f64.Aff3{
+		cos, -sin, cx - cos*cx + sin*cy + dx,
+		sin, cos, cy - sin*cx - cos*cy + dy,
+	}
+	draw.BiLinear.Transform(out, m, img, b, draw.Over, nil)
+	return out
+}
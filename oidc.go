@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "chicha_sr_session"
+	oidcStateCookie   = "chicha_sr_oidc"
+	sessionLifetime   = 12 * time.Hour
+)
+
+// oidcProvider holds the endpoints discovered from the identity provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// oidc is the configured provider; nil when -oidc-issuer is not set and the web UI is open
+var oidc *oidcProvider
+
+// sessionUser is the identity stored in the signed session cookie
+type sessionUser struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// discoverOIDC fetches the provider metadata from the issuer's well-known document
+func discoverOIDC(issuer string) (*oidcProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery at %s returned %s", issuer, resp.Status)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, fmt.Errorf("parsing discovery document: %w", err)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("discovery document of %s lacks the authorization, token or userinfo endpoint", issuer)
+	}
+	return &p, nil
+}
+
+// signCookie returns data with an HMAC bound to purpose, so values signed for one
+// cookie cannot be replayed as another
+func signCookie(purpose string, data []byte) string {
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(purpose + ":" + encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookie returns the data of a value produced by signCookie, or false
+func verifyCookie(purpose, value string) ([]byte, bool) {
+	encoded, _, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signCookie(purpose, decodeCookieData(encoded))), []byte(value)) {
+		return nil, false
+	}
+	return decodeCookieData(encoded), true
+}
+
+func decodeCookieData(s string) []byte {
+	b, _ := base64.RawURLEncoding.DecodeString(s)
+	return b
+}
+
+// setAppCookie sets an HttpOnly cookie scoped to the application's base path
+func setAppCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     config.url("/"),
+		MaxAge:   max(int(maxAge.Seconds()), -1), // Negative deletes the cookie
+		HttpOnly: true,
+		Secure:   config.tlsEnabled(),
+		SameSite: http.SameSiteLaxMode, // Lax so the cookie survives the redirect back from the provider
+	})
+}
+
+// sessionFromRequest returns the logged-in user, or nil
+func sessionFromRequest(r *http.Request) *sessionUser {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	data, ok := verifyCookie("session", cookie.Value)
+	if !ok {
+		return nil
+	}
+	var u sessionUser
+	if json.Unmarshal(data, &u) != nil || time.Now().Unix() > u.Expires {
+		return nil
+	}
+	return &u
+}
+
+type userContextKey struct{}
+
+// userFromContext returns the user the request was authenticated as, or nil
+func userFromContext(ctx context.Context) *sessionUser {
+	u, _ := ctx.Value(userContextKey{}).(*sessionUser)
+	return u
+}
+
+// requireLogin sends visitors without a session to the identity provider when
+// OIDC is configured; page loads are redirected, form posts get 401
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if oidc == nil {
+			next(w, r)
+			return
+		}
+		u := sessionFromRequest(r)
+		if u == nil {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, config.url("/login")+"?next="+url.QueryEscape(config.url(r.URL.Path)), http.StatusFound)
+				return
+			}
+			writePlainError(w, &requestError{Status: http.StatusUnauthorized, Code: "login_required", Message: "Your session has expired. Please reload the page and log in again."})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, u)))
+	}
+}
+
+// oidcState is kept in a short-lived cookie between the login redirect and the callback
+type oidcState struct {
+	State       string `json:"state"`
+	Verifier    string `json:"verifier"` // PKCE code verifier
+	RedirectURI string `json:"redirect_uri"`
+	Next        string `json:"next"`
+}
+
+// callbackURL returns the redirect URI registered with the provider
+func callbackURL(r *http.Request) string {
+	if config.OIDCRedirectURL != "" {
+		return config.OIDCRedirectURL
+	}
+	return absoluteURL(r, "/auth/callback")
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// loginHandler starts the authorization code flow with PKCE
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = config.url("/") // Only local redirects, never to another site; browsers read "/\" as "//"
+	}
+	st := oidcState{State: randomToken(), Verifier: randomToken(), RedirectURI: callbackURL(r), Next: next}
+	data, _ := json.Marshal(st)
+	setAppCookie(w, oidcStateCookie, signCookie("oidc-state", data), 10*time.Minute)
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.OIDCClientID},
+		"redirect_uri":          {st.RedirectURI},
+		"scope":                 {"openid email profile"},
+		"state":                 {st.State},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(oidc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, oidc.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callbackHandler completes the login: it exchanges the code, asks the userinfo
+// endpoint who the user is and issues the session cookie
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	fail := func(status int, message string, err error) {
+		slog.WarnContext(r.Context(), "Login failed", "reason", message, "error", err)
+		writePlainError(w, &requestError{Status: status, Code: "login_failed", Message: message})
+	}
+
+	var st oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		fail(http.StatusBadRequest, "The login has expired, please try again.", err)
+		return
+	}
+	data, ok := verifyCookie("oidc-state", cookie.Value)
+	if !ok || json.Unmarshal(data, &st) != nil || st.State == "" || r.URL.Query().Get("state") != st.State {
+		fail(http.StatusBadRequest, "The login state does not match, please try again.", nil)
+		return
+	}
+	setAppCookie(w, oidcStateCookie, "", -time.Second)
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail(http.StatusForbidden, "The identity provider refused the login: "+e, nil)
+		return
+	}
+
+	token, err := exchangeCode(r.Context(), r.URL.Query().Get("code"), st)
+	if err != nil {
+		fail(http.StatusBadGateway, "Could not complete the login with the identity provider.", err)
+		return
+	}
+	u, err := fetchUserinfo(r.Context(), token)
+	if err != nil {
+		fail(http.StatusBadGateway, "Could not read the user profile from the identity provider.", err)
+		return
+	}
+	if !emailAllowed(u.Email) {
+		if u.Email == "" {
+			fail(http.StatusForbidden, "The identity provider has not verified the e-mail address of the account, which this server needs.", nil)
+			return
+		}
+		fail(http.StatusForbidden, fmt.Sprintf("The account %s is not allowed to use this server.", u.Email), nil)
+		return
+	}
+
+	u.Expires = time.Now().Add(sessionLifetime).Unix()
+	session, _ := json.Marshal(u)
+	setAppCookie(w, sessionCookieName, signCookie("session", session), sessionLifetime)
+	slog.InfoContext(r.Context(), "User logged in", "subject", u.Subject, "email", u.Email)
+	http.Redirect(w, r, st.Next, http.StatusFound)
+}
+
+// logoutHandler drops the session cookie
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	setAppCookie(w, sessionCookieName, "", -time.Second)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "You have been logged out.")
+}
+
+// exchangeCode trades the authorization code for an access token
+func exchangeCode(ctx context.Context, code string, st oidcState) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {st.RedirectURI},
+		"code_verifier": {st.Verifier},
+		"client_id":     {config.OIDCClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oidc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.OIDCClientID), url.QueryEscape(config.OIDCClientSecret))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access_token")
+	}
+	return token.AccessToken, nil
+}
+
+// fetchUserinfo asks the provider who the access token belongs to
+func fetchUserinfo(ctx context.Context, accessToken string) (*sessionUser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oidc.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	var claims struct {
+		sessionUser
+		EmailVerified any `json:"email_verified"` // A boolean, or "true" as a string from some providers
+	}
+	if err := doJSON(req, &claims); err != nil {
+		return nil, err
+	}
+	u := claims.sessionUser
+	if u.Subject == "" {
+		return nil, fmt.Errorf("userinfo response has no sub claim")
+	}
+	if verified := claims.EmailVerified; verified != true && verified != "true" {
+		// Anyone can put any address on an account; one the provider has not
+		// confirmed must not pass for the admin or member it names
+		u.Email = ""
+	}
+	return &u, nil
+}
+
+// doJSON performs req and decodes a successful JSON response into v
+func doJSON(req *http.Request, v any) error {
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// emailAllowed checks the user's e-mail domain against -oidc-allowed-domains
+func emailAllowed(email string) bool {
+	cfg := liveConfig()
+	if cfg.OIDCAllowedDomains == "" {
+		return true
+	}
+	_, domain, ok := strings.Cut(strings.ToLower(email), "@")
+	if !ok {
+		return false
+	}
+	for _, allowed := range strings.Split(cfg.OIDCAllowedDomains, ",") {
+		if strings.ToLower(strings.TrimSpace(allowed)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionUserLabel identifies the user for display, preferring the name
+func sessionUserLabel(u *sessionUser) string {
+	switch {
+	case u == nil:
+		return ""
+	case u.Name != "":
+		return u.Name
+	case u.Email != "":
+		return u.Email
+	}
+	return u.Subject
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// withOIDC points the login handlers at a provider whose endpoints are served
+// by idp, which may be nil for tests that never reach it
+func withOIDC(t *testing.T, idp *httptest.Server) {
+	t.Helper()
+	saved, savedSecret, savedConfig := oidc, csrfSecret, config
+	t.Cleanup(func() { oidc, csrfSecret, config = saved, savedSecret, savedConfig })
+	initCSRF("test secret")
+	base := "https://idp.example"
+	if idp != nil {
+		base = idp.URL
+	}
+	oidc = &oidcProvider{Issuer: base, AuthorizationEndpoint: base + "/auth", TokenEndpoint: base + "/token", UserinfoEndpoint: base + "/userinfo"}
+	config.OIDCClientID = "chicha"
+}
+
+// responseCookie returns the value of the cookie name set by a response
+func responseCookie(w *httptest.ResponseRecorder, name string) (string, bool) {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// startLogin runs the login handler for next and returns the state it kept
+// and the cookie it kept it in
+func startLogin(t *testing.T, next string) (oidcState, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	loginHandler(w, httptest.NewRequest(http.MethodGet, "/login?next="+url.QueryEscape(next), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login answered %d, want a redirect", w.Code)
+	}
+	value, ok := responseCookie(w, oidcStateCookie)
+	if !ok {
+		t.Fatal("login set no state cookie")
+	}
+	data, ok := verifyCookie("oidc-state", value)
+	if !ok {
+		t.Fatal("state cookie is not signed")
+	}
+	var st oidcState
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := location.Query()
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	if q.Get("state") != st.State || q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request %s does not carry the state and PKCE challenge of the cookie", location)
+	}
+	return st, &http.Cookie{Name: oidcStateCookie, Value: value}
+}
+
+func TestLoginKeepsRedirectsLocal(t *testing.T) {
+	withOIDC(t, nil)
+	for next, want := range map[string]string{
+		"/results?page=2":         "/results?page=2",
+		"":                        config.url("/"),
+		"//evil.example/":         config.url("/"),
+		"https://evil.example/":   config.url("/"),
+		"javascript:alert(1)":     config.url("/"),
+		"evil.example/results":    config.url("/"),
+		"/\\evil.example/results": config.url("/"),
+	} {
+		if st, _ := startLogin(t, next); st.Next != want {
+			t.Errorf("next %q: kept %q, want %q", next, st.Next, want)
+		}
+	}
+	a, _ := startLogin(t, "/")
+	b, _ := startLogin(t, "/")
+	if a.State == b.State || a.Verifier == b.Verifier {
+		t.Error("two logins share their state or verifier")
+	}
+}
+
+func TestCallbackChecksState(t *testing.T) {
+	withOIDC(t, nil)
+	st, cookie := startLogin(t, "/results")
+	forged := &http.Cookie{Name: oidcStateCookie, Value: signCookie("session", []byte(`{"state":"x"}`))}
+	for _, tc := range []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+	}{
+		{"no cookie", st.State, nil},
+		{"other state", "x" + st.State, cookie},
+		{"no state", "", cookie},
+		{"cookie signed for another purpose", "x", forged},
+		{"cookie not signed", st.State, &http.Cookie{Name: oidcStateCookie, Value: cookie.Value + "x"}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/auth/callback?code=c&state="+url.QueryEscape(tc.state), nil)
+		if tc.cookie != nil {
+			r.AddCookie(tc.cookie)
+		}
+		w := httptest.NewRecorder()
+		callbackHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: answered %d, want %d", tc.name, w.Code, http.StatusBadRequest)
+		}
+		if _, ok := responseCookie(w, sessionCookieName); ok {
+			t.Errorf("%s: a session was issued", tc.name)
+		}
+	}
+}
+
+// fakeIdP serves the token and userinfo endpoints, answering userinfo with claims
+func fakeIdP(t *testing.T, claims map[string]any) *httptest.Server {
+	t.Helper()
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.FormValue("code") != "good code" || r.FormValue("code_verifier") == "" {
+				http.Error(w, "bad code", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "bad token", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(claims)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// completeLogin runs a login through the callback and returns the response
+func completeLogin(t *testing.T, next string) *httptest.ResponseRecorder {
+	t.Helper()
+	st, cookie := startLogin(t, next)
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback?code=good+code&state="+url.QueryEscape(st.State), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	callbackHandler(w, r)
+	return w
+}
+
+func TestCallbackTrustsVerifiedEmailsOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		verified any
+		want     string
+	}{
+		{"verified", true, "ann@example.com"},
+		{"verified as a string", "true", "ann@example.com"},
+		{"unverified", false, ""},
+		{"unverified as a string", "false", ""},
+		{"not said", nil, ""},
+	} {
+		claims := map[string]any{"sub": "ann", "email": "ann@example.com"}
+		if tc.verified != nil {
+			claims["email_verified"] = tc.verified
+		}
+		withOIDC(t, fakeIdP(t, claims))
+		w := completeLogin(t, "/results")
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/results" {
+			t.Fatalf("%s: answered %d to %q, want a redirect to /results", tc.name, w.Code, w.Header().Get("Location"))
+		}
+		value, ok := responseCookie(w, sessionCookieName)
+		if !ok {
+			t.Fatalf("%s: no session was issued", tc.name)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+		u := sessionFromRequest(r)
+		if u == nil || u.Subject != "ann" || u.Email != tc.want {
+			t.Errorf("%s: session of %+v, want the e-mail %q", tc.name, u, tc.want)
+		}
+	}
+}
+
+func TestCallbackRefusesUnverifiedEmailsOfAllowedDomains(t *testing.T) {
+	withOIDC(t, fakeIdP(t, map[string]any{"sub": "eve", "email": "boss@example.com", "email_verified": false}))
+	config.OIDCAllowedDomains = "example.com"
+	w := completeLogin(t, "/")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("answered %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, ok := responseCookie(w, sessionCookieName); ok {
+		t.Error("a session was issued")
+	}
+}
+
+func TestEmailAllowed(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.OIDCAllowedDomains = ""
+	if !emailAllowed("anyone@anywhere.example") || !emailAllowed("") {
+		t.Error("without -oidc-allowed-domains every account should be allowed")
+	}
+	config.OIDCAllowedDomains = "example.com, Corp.Example.org"
+	for email, want := range map[string]bool{
+		"ann@example.com":           true,
+		"Ann@EXAMPLE.COM":           true,
+		"bob@corp.example.org":      true,
+		"eve@evil.example":          false,
+		"eve@sub.example.com":       false,
+		"eve@example.com.evil.test": false,
+		"eve@evilexample.com":       false,
+		"example.com":               false,
+		"":                          false,
+		"eve@example.com@evil.test": false,
+		"eve@ example.com":          false,
+		"eve@corp.example.org.":     false,
+	} {
+		if got := emailAllowed(email); got != want {
+			t.Errorf("emailAllowed(%q) = %v, want %v", email, got, want)
+		}
+	}
+}
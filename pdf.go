@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+)
+
+// A4 page size and margin of PDF results, in points (1/72 inch)
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfPageMargin = 36
+)
+
+// encodePDF writes img as a one-page PDF fitted within the margins of an A4
+// page, turned to landscape for wide images, ready to print. Gray pages are
+// stored with one channel, which is all a binarized page needs; colour ones
+// are tagged with the ICC profile unless it is nil.
+func encodePDF(w io.Writer, img image.Image, gray bool, profile []byte) error {
+	b := img.Bounds()
+	var raw bytes.Buffer
+	zw := zlib.NewWriter(&raw)
+	row := make([]byte, 0, b.Dx()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if gray {
+				row = append(row, byte(r>>8))
+			} else {
+				row = append(row, byte(r>>8), byte(g>>8), byte(bl>>8))
+			}
+		}
+		if _, err := zw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	pageW, pageH := float64(pdfPageWidth), float64(pdfPageHeight)
+	if b.Dx() > b.Dy() {
+		pageW, pageH = pageH, pageW
+	}
+	fit := min((pageW-2*pdfPageMargin)/float64(b.Dx()), (pageH-2*pdfPageMargin)/float64(b.Dy()))
+	drawW, drawH := float64(b.Dx())*fit, float64(b.Dy())*fit
+	content := fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Im0 Do Q\n", drawW, drawH, (pageW-drawW)/2, (pageH-drawH)/2)
+	colorSpace := "/DeviceRGB"
+	if gray {
+		colorSpace = "/DeviceGray"
+	} else if profile != nil {
+		colorSpace = "[/ICCBased 6 0 R]"
+	}
+
+	// Objects are written in order, their offsets kept for the cross-reference table
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	var offsets []int
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object("<< /Type /Pages /Kids [3 0 R] /Count 1 >>", nil)
+	object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /XObject << /Im0 5 0 R >> >> /Contents 4 0 R >>", pageW, pageH), nil)
+	object(fmt.Sprintf("<< /Length %d >>", len(content)), []byte(content))
+	object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>", b.Dx(), b.Dy(), colorSpace, raw.Len()), raw.Bytes())
+	if !gray && profile != nil {
+		object(fmt.Sprintf("<< /N 3 /Alternate /DeviceRGB /Length %d >>", len(profile)), profile)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"log/slog"
+	"math"
+	"sync"
+)
+
+// Bursts shot with a phone held in the hand differ from those of a fixed
+// camera in more than the shake. The phone stores its frames as the sensor
+// reads them and records in EXIF how to turn them upright; it sets the
+// exposure and white balance of every frame afresh, so they do not agree in
+// brightness; the hand turns it a little as well as moving it; and people and
+// cars move through the scene between frames, leaving ghosts where they are
+// averaged in.
+
+// exifSearch is how far into a JPEG file its EXIF orientation is looked for:
+// the APP1 segment holding it comes first and is at most 64 KiB long
+const exifSearch = 1 << 16
+
+// exifOrientation is the EXIF tag of how a frame is to be turned to be upright
+const exifOrientation = 0x0112
+
+// jpegOrientation returns the EXIF orientation, 1-8, recorded in the start of
+// a JPEG file head, or 1, upright, when it records none
+func jpegOrientation(head []byte) int {
+	if len(head) < 4 || head[0] != 0xFF || head[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(head) && head[i] == 0xFF; {
+		marker, length := head[i+1], int(binary.BigEndian.Uint16(head[i+2:]))
+		if marker == 0xDA || length < 2 { // The image data starts; no EXIF came before it
+			return 1
+		}
+		segment := head[i+4 : min(i+2+length, len(head))]
+		if marker == 0xE1 && len(segment) >= 14 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of the TIFF
+// structure EXIF is stored in
+func tiffOrientation(data []byte) int {
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	ifd := order.Uint32(data[4:8])
+	if ifd < 8 || uint64(ifd)+2 > uint64(len(data)) {
+		return 1
+	}
+	for n := range int(order.Uint16(data[ifd:])) {
+		entry := int(ifd) + 2 + n*12
+		if entry+12 > len(data) {
+			break
+		}
+		if order.Uint16(data[entry:]) == exifOrientation && order.Uint16(data[entry+2:]) == 3 { // SHORT
+			if o := int(order.Uint16(data[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// uprightFrame turns and mirrors img as its EXIF orientation says, so it shows
+// the way the phone did when it was shot
+func uprightFrame(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := sw, sh
+	if orientation >= 5 { // Turned a quarter, so the sides swap
+		w, h = sh, sw
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sx, sy int // Where the pixel comes from
+			switch orientation {
+			case 2: // Mirror
+				sx, sy = sw-1-x, y
+			case 3: // Turn half way round
+				sx, sy = sw-1-x, sh-1-y
+			case 4: // Flip
+				sx, sy = x, sh-1-y
+			case 5: // Mirror across the diagonal
+				sx, sy = y, x
+			case 6: // Turn a quarter clockwise
+				sx, sy = y, sh-1-x
+			case 7: // Mirror across the other diagonal
+				sx, sy = sw-1-y, sh-1-x
+			case 8: // Turn a quarter anticlockwise
+				sx, sy = sw-1-y, x
+			}
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return out
+}
+
+// maxExposureGain bounds how far matchExposure brightens or darkens a frame
+const maxExposureGain = 4
+
+// matchExposure scales every channel of every frame so its mean matches that
+// of the reference, evening out the exposure and white balance the phone set
+// for each frame, which would otherwise blend into blotches where frames
+// overlap differently
+func matchExposure(ctx context.Context, images []image.Image) []image.Image {
+	means := make([][3]float64, len(images))
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := img.Bounds()
+			n := 0.0
+			for y := b.Min.Y; y < b.Max.Y; y += 2 { // Every fourth pixel is plenty for a mean
+				for x := b.Min.X; x < b.Max.X; x += 2 {
+					r, g, bl, _ := img.At(x, y).RGBA()
+					means[i][0] += float64(r)
+					means[i][1] += float64(g)
+					means[i][2] += float64(bl)
+					n++
+				}
+			}
+			for c := range means[i] {
+				means[i][c] /= max(n, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	matched := make([]image.Image, len(images))
+	matched[0] = images[0]
+	for i := 1; i < len(images); i++ {
+		var gain [3]float64
+		for c := range gain {
+			gain[c] = 1
+			if means[i][c] > 0 {
+				gain[c] = math.Min(math.Max(means[0][c]/means[i][c], 1.0/maxExposureGain), maxExposureGain)
+			}
+		}
+		if math.Abs(gain[0]-1) < 0.005 && math.Abs(gain[1]-1) < 0.005 && math.Abs(gain[2]-1) < 0.005 {
+			matched[i] = images[i]
+			continue
+		}
+		slog.InfoContext(ctx, "Exposure matched to the reference", "frame", i, "ev", math.Log2(0.299*gain[0]+0.587*gain[1]+0.114*gain[2]), "gain_r", gain[0], "gain_g", gain[1], "gain_b", gain[2])
+		b := images[i].Bounds()
+		out := image.NewRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := images[i].At(x, y).RGBA()
+				p := out.Pix[out.PixOffset(x, y):]
+				for c, v := range [3]uint32{r, g, bl} {
+					p[c] = uint8(math.Min(math.Round(float64(v)*gain[c]/257), 255))
+				}
+				p[3] = 0xff
+			}
+		}
+		matched[i] = out
+	}
+	return matched
+}
+
+// alignHandheld is the align value for bursts shot with the phone or camera in
+// the hand: every frame is searched for turned as well as moved, coarse to fine
+const alignHandheld = "handheld"
+
+// Handheld alignment
+const (
+	handheldPatch  = 1024 // Side of the centre crop frames are matched on
+	handheldLevels = 3    // Halvings of the crop the search starts at, refined a level at a time
+	handheldAngle  = 3.0  // Degrees a frame is searched for turned either way
+	handheldStep   = 0.5  // Degrees between the turns tried at the coarsest level, halved at every finer one
+)
+
+// rotatedPatch returns p turned by degrees clockwise about its centre, as
+// transformFrame turns a frame, its edges stretched into the corners it uncovers
+func rotatedPatch(p grayPatch, degrees float64) grayPatch {
+	if degrees == 0 {
+		return p
+	}
+	out := grayPatch{w: p.w, h: p.h, pix: make([]float64, len(p.pix))}
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	cx, cy := float64(p.w)/2, float64(p.h)/2
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			// Where the pixel came from: the turn undone
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			sx := math.Min(math.Max(cos*dx+sin*dy+cx-0.5, 0), float64(p.w-1))
+			sy := math.Min(math.Max(-sin*dx+cos*dy+cy-0.5, 0), float64(p.h-1))
+			x0, y0 := int(sx), int(sy)
+			x1, y1 := min(x0+1, p.w-1), min(y0+1, p.h-1)
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			top := p.at(x0, y0)*(1-fx) + p.at(x1, y0)*fx
+			bottom := p.at(x0, y1)*(1-fx) + p.at(x1, y1)*fx
+			out.pix[y*p.w+x] = top*(1-fy) + bottom*fy
+		}
+	}
+	return out
+}
+
+// handheldOffsets registers every frame after the first against it by shift
+// and turn: every turn within handheldAngle is tried on copies halved
+// handheldLevels times with the full reach of the shift search, then the best
+// is refined at every finer level, a pixel or two and half the last step of
+// turn either way. It returns the offset that aligns each frame, as one set by
+// hand would; frames that match nothing get a nil entry.
+func handheldOffsets(ctx context.Context, images []image.Image) []*frameOffset {
+	found := make([]*frameOffset, len(images))
+	b := images[0].Bounds()
+	levels := 0
+	for levels < handheldLevels && min(b.Dx(), b.Dy(), handheldPatch)>>(levels+1) >= 32 { // Coarse frames too small match anywhere
+		levels++
+	}
+	pyramid := func(img image.Image) []grayPatch {
+		p := []grayPatch{centerPatch(img, handheldPatch)}
+		for range levels {
+			p = append(p, p[len(p)-1].halve())
+		}
+		return p
+	}
+	reference := pyramid(images[0])
+	var wg sync.WaitGroup
+	for i := 1; i < len(images); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ctx.Err() != nil {
+				return
+			}
+			frame := pyramid(images[i])
+			best := math.Inf(1)
+			var dx, dy int
+			var angle float64
+			for a := -handheldAngle; a <= handheldAngle+1e-9; a += handheldStep {
+				x, y, diff := bestShift(reference[levels], rotatedPatch(frame[levels], a), 0, 0, maxAlignShift>>levels)
+				if diff < best {
+					best, dx, dy, angle = diff, x, y, a
+				}
+			}
+			step := handheldStep
+			for level := levels - 1; level >= 0; level-- {
+				step /= 2
+				cx, cy, centre := 2*dx, 2*dy, angle
+				best = math.Inf(1)
+				for _, a := range []float64{centre - step, centre, centre + step} {
+					x, y, diff := bestShift(reference[level], rotatedPatch(frame[level], a), cx, cy, 2)
+					if diff < best {
+						best, dx, dy, angle = diff, x, y, a
+					}
+				}
+			}
+			if math.IsInf(best, 1) {
+				slog.WarnContext(ctx, "Frame matches nothing of the reference, searching for the shift instead", "frame", i)
+				return
+			}
+			// The turned frame is found dx, dy further into itself than the reference
+			found[i] = &frameOffset{DX: -dx, DY: -dy, Angle: angle}
+			slog.InfoContext(ctx, "Handheld frame registered", "frame", i, "dx", -dx, "dy", -dy, "angle", angle)
+		}()
+	}
+	wg.Wait()
+	return found
+}
+
+// Ghost rejection
+const (
+	ghostSigma = 5 // Noise levels the neighbourhood of a pixel must differ from the reference by to be a ghost
+	ghostFloor = 4 // Least difference, in 8-bit levels of brightness, that makes a ghost, so clean frames keep their detail
+)
+
+// ghostDifference returns the difference in brightness of frame from refLuma,
+// the reference's, averaged over the 3x3 neighbourhood of every pixel, so noise
+// cancels out and a moved subject does not, and the limit beyond which a pixel
+// is a ghost: ghostSigma noise levels, the noise level being the robust spread
+// of those differences over the frame, but no lower than floor
+func ghostDifference(refLuma []float64, frame image.Image, w, h int, floor float64) ([]float64, float64) {
+	luma := lumaPlane(frame)
+	for j := range luma {
+		luma[j] -= refLuma[j]
+	}
+	diff := make([]float64, w*h)
+	histogram := make([]int, 4*256) // Of its size, in quarter levels
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum, n := 0.0, 0.0
+			for yy := max(y-1, 0); yy <= min(y+1, h-1); yy++ {
+				for xx := max(x-1, 0); xx <= min(x+1, w-1); xx++ {
+					sum += luma[yy*w+xx]
+					n++
+				}
+			}
+			diff[y*w+x] = sum / n
+			histogram[min(int(math.Abs(sum/n)*4), len(histogram)-1)]++
+		}
+	}
+	return diff, max(ghostSigma*1.4826*histogramShare(histogram, 0.5)/4, floor) // The median absolute difference, as the standard deviation of Gaussian noise
+}
+
+// ghostLimitFloor returns the least limit of ghostDifference for frame i:
+// ghostFloor, or with the noise measured for every frame, ghostSigma times the
+// noise of the 3x3 mean of its difference from the reference
+func ghostLimitFloor(noise []float64, i int) float64 {
+	if noise == nil {
+		return ghostFloor
+	}
+	return ghostSigma * math.Hypot(noise[i], noise[0]) / 3
+}
+
+// rejectGhosts returns the aligned frames with whatever moved against the
+// reference replaced by the reference: pixels whose 3x3 neighbourhood differs
+// from the reference's in brightness by more than ghostSigma noise levels, the
+// noise level being the robust spread of those differences over the frame.
+// Someone walking through the burst is then fused where the reference shows
+// them, instead of as a faint ghost at every place they passed. The limit is
+// no lower than ghostFloor or, with the noise measured for every frame, than
+// ghostSigma times the noise of the 3x3 mean of their difference.
+func rejectGhosts(ctx context.Context, aligned []image.Image, noise []float64) []image.Image {
+	b := aligned[0].Bounds()
+	w, h := b.Dx(), b.Dy()
+	ref := image.NewRGBA(b)
+	draw.Draw(ref, b, aligned[0], b.Min, draw.Src)
+	refLuma := lumaPlane(ref)
+	out := make([]image.Image, len(aligned))
+	out[0] = aligned[0]
+	var wg sync.WaitGroup
+	for i := 1; i < len(aligned); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i] = aligned[i]
+			if ctx.Err() != nil {
+				return
+			}
+			diff, limit := ghostDifference(refLuma, aligned[i], w, h, ghostLimitFloor(noise, i))
+			frame := image.NewRGBA(b)
+			draw.Draw(frame, b, aligned[i], b.Min, draw.Src)
+			ghosts := 0
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					if math.Abs(diff[y*w+x]) > limit {
+						o := frame.PixOffset(b.Min.X+x, b.Min.Y+y)
+						copy(frame.Pix[o:o+4], ref.Pix[o:o+4])
+						ghosts++
+					}
+				}
+			}
+			out[i] = frame
+			slog.InfoContext(ctx, "Ghosts rejected", "frame", i, "limit", limit, "share", float64(ghosts)/float64(w*h))
+		}()
+	}
+	wg.Wait()
+	return out
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// alignPlanet is the align value for the Moon and planets: frames are tracked
+// by their centre of brightness, the disk drifting across the sensor far more
+// than a shift search reaches, then matched point by point within the disk,
+// where the turbulent air bends each part of it its own way
+const alignPlanet = "planet"
+
+// Multi-point alignment within the disk
+const (
+	planetPointSpacing = 32  // Pixels between the alignment points laid over the disk
+	planetPointBox     = 24  // Side of the patch each point is matched on
+	planetPointSearch  = 4   // Pixels a point is searched for around the disk's motion
+	planetPatch        = 128 // Side of the patch about the disk frames are ranked on
+)
+
+// lumaPlane returns the luminance of img, 0-255, row by row
+func lumaPlane(img image.Image) []float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			luma[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+		}
+	}
+	return luma
+}
+
+// brightnessCentre returns the centroid of the pixels of luma, a w-pixel-wide
+// plane, brighter than the threshold Otsu's method puts between the disk and
+// the sky, weighted by how much brighter, and the disk as a mask. A frame with
+// nothing bright in it has its centre returned.
+func brightnessCentre(luma []float64, w int) (x, y float64, disk []bool) {
+	histogram := make([]int, 256)
+	for _, v := range luma {
+		histogram[int(v)]++
+	}
+	threshold := float64(otsuThreshold(histogram, len(luma)))
+	disk = make([]bool, len(luma))
+	var sum float64
+	for i, v := range luma {
+		if v <= threshold {
+			continue
+		}
+		disk[i] = true
+		weight := v - threshold
+		x += weight * float64(i%w)
+		y += weight * float64(i/w)
+		sum += weight
+	}
+	if sum == 0 {
+		return float64(w) / 2, float64(len(luma)/w) / 2, disk
+	}
+	return x / sum, y / sum, disk
+}
+
+// selectSharpest ranks the frames, the reference first, by the variance of the
+// Laplacian and keeps the sharpest n of them, see keptFrames. The
+// reference stays first unless planet is set, when the sharpest frame becomes
+// the reference: of a planet shot through turbulent air, most frames are
+// smeared and the sharpest are the ones to stack. Frames are measured about
+// the centre of the frame, or of the disk for a planet.
+func selectSharpest(ctx context.Context, images []image.Image, n int, planet bool) []image.Image {
+	type ranked struct {
+		img       image.Image
+		sharpness float64
+	}
+	frames := make([]ranked, len(images))
+	for i, img := range images {
+		region := img
+		if sub, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}); ok && planet {
+			b := img.Bounds()
+			x, y, _ := brightnessCentre(lumaPlane(img), b.Dx())
+			centre := b.Min.Add(image.Pt(int(x), int(y)))
+			region = sub.SubImage(image.Rectangle{centre, centre}.Inset(-planetPatch / 2).Intersect(b))
+		}
+		frames[i] = ranked{img, patchSharpness(centerPatch(region, planetPatch))}
+	}
+	first := 1 // The reference is not ranked
+	if planet {
+		first = 0
+	}
+	slices.SortStableFunc(frames[first:], func(a, b ranked) int { return cmp.Compare(b.sharpness, a.sharpness) })
+	slog.InfoContext(ctx, "Sharpest frames selected", "kept", n, "frames", len(frames))
+	kept := make([]image.Image, n)
+	for i := range kept {
+		kept[i] = frames[i].img
+	}
+	return kept
+}
+
+// keptFrames returns how many of frames the sharpest keep percent are, at
+// least two, or all of them when keep is 0
+func keptFrames(frames, keep int) int {
+	if keep <= 0 {
+		return frames
+	}
+	return min(max(2, (frames*keep+99)/100), frames)
+}
+
+// alignPoint is a point of the reference disk frames are matched at
+type alignPoint struct {
+	x, y int // Top left of its box, in pixels from the frame's corner
+}
+
+// alignPlanetFrames aligns every frame to the first by its centre of
+// brightness, then warps it so each alignment point of the disk lands on the
+// reference, the parts of the disk between points following the nearest ones.
+// It returns the aligned frames and the shift of each disk.
+func alignPlanetFrames(ctx context.Context, images []image.Image) ([]image.Image, []image.Point) {
+	b := images[0].Bounds()
+	w, h := b.Dx(), b.Dy()
+	refLuma := lumaPlane(images[0])
+	refX, refY, disk := brightnessCentre(refLuma, w)
+
+	// Points are laid where their whole box is on the disk and has detail to match
+	var points []alignPoint
+	for y := 0; y+planetPointBox <= h; y += planetPointSpacing {
+		for x := 0; x+planetPointBox <= w; x += planetPointSpacing {
+			if !disk[y*w+x] || !disk[y*w+x+planetPointBox-1] || !disk[(y+planetPointBox-1)*w+x] || !disk[(y+planetPointBox-1)*w+x+planetPointBox-1] {
+				continue
+			}
+			var sum, sumSq float64
+			for py := y; py < y+planetPointBox; py++ {
+				for px := x; px < x+planetPointBox; px++ {
+					v := refLuma[py*w+px]
+					sum += v
+					sumSq += v * v
+				}
+			}
+			n := float64(planetPointBox * planetPointBox)
+			if sumSq/n-(sum/n)*(sum/n) >= 4 { // Flat patches match anywhere
+				points = append(points, alignPoint{x, y})
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Alignment points laid over the disk", "points", len(points), "centre_x", refX, "centre_y", refY)
+
+	aligned := make([]image.Image, len(images))
+	aligned[0] = images[0]
+	shifts := make([]image.Point, len(images))
+	var done atomic.Int32
+	reportProgress(ctx, "align", 0, len(images)-1)
+	var wg sync.WaitGroup
+	for i := 1; i < len(images); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { reportProgress(ctx, "align", int(done.Add(1)), len(images)-1) }()
+			if ctx.Err() != nil {
+				aligned[i] = images[i]
+				return
+			}
+			luma := lumaPlane(images[i])
+			x, y, _ := brightnessCentre(luma, w)
+			shift := image.Pt(int(math.Round(refX-x)), int(math.Round(refY-y)))
+			shifts[i] = shift
+
+			// Each point's own move, on top of the disk's
+			moves := make([]image.Point, len(points))
+			for p, point := range points {
+				best := math.Inf(1)
+				for dy := -planetPointSearch; dy <= planetPointSearch; dy++ {
+					for dx := -planetPointSearch; dx <= planetPointSearch; dx++ {
+						ssd := 0.0
+						for py := point.y; py < point.y+planetPointBox; py++ {
+							sy := min(max(py-shift.Y-dy, 0), h-1)
+							for px := point.x; px < point.x+planetPointBox; px++ {
+								sx := min(max(px-shift.X-dx, 0), w-1)
+								d := refLuma[py*w+px] - luma[sy*w+sx]
+								ssd += d * d
+							}
+						}
+						if ssd < best {
+							best, moves[p] = ssd, image.Pt(dx, dy)
+						}
+					}
+				}
+			}
+			aligned[i] = warpByPoints(images[i], shift, points, moves)
+			slog.DebugContext(ctx, "Planet frame aligned", "frame", i, "dx", shift.X, "dy", shift.Y)
+		}()
+	}
+	wg.Wait()
+	return aligned, shifts
+}
+
+// warpByPoints moves img by shift and, about every alignment point, by that
+// point's move, blending the moves of nearby points with Gaussian weights that
+// fade to the plain shift away from the disk
+func warpByPoints(img image.Image, shift image.Point, points []alignPoint, moves []image.Point) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(b)
+	draw.Draw(src, b, img, b.Min, draw.Src)
+	out := image.NewRGBA(b)
+	const sigma = planetPointSpacing
+	const anchor = 0.05 // Weight of staying put, which wins once every point is a few spacings away
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			mx, my, weights := 0.0, 0.0, anchor
+			for p, point := range points {
+				dx := float64(x - point.x - planetPointBox/2)
+				dy := float64(y - point.y - planetPointBox/2)
+				if dx*dx+dy*dy > 9*sigma*sigma {
+					continue
+				}
+				weight := math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+				mx += weight * float64(moves[p].X)
+				my += weight * float64(moves[p].Y)
+				weights += weight
+			}
+			sx := float64(b.Min.X+x-shift.X) - mx/weights
+			sy := float64(b.Min.Y+y-shift.Y) - my/weights
+			if sx < float64(b.Min.X) || sy < float64(b.Min.Y) || sx > float64(b.Max.X-1) || sy > float64(b.Max.Y-1) {
+				out.SetRGBA(b.Min.X+x, b.Min.Y+y, color.RGBA{A: 0xff}) // Uncovered, black as shiftImage leaves it
+				continue
+			}
+			out.SetRGBA(b.Min.X+x, b.Min.Y+y, bilinearAt(src, sx, sy))
+		}
+	}
+	return out
+}
+
+// waveletLayers and waveletGains shape wavelet sharpening: the result is split
+// into detail layers of doubling size, finest first, and at a strength of 100
+// each is boosted by 1 plus twice its gain. The finest layer is mostly noise
+// and gains least of the small ones.
+const waveletLayers = 4
+
+var waveletGains = [waveletLayers]float64{1, 1.5, 1, 0.5}
+
+// waveletMargin is the number of rows a wavelet-sharpened strip needs from
+// each neighbour: the reach of every layer's blur added up
+func waveletMargin(opts processOptions) int {
+	if opts.Wavelet == 0 {
+		return 0
+	}
+	return 2 * (1<<waveletLayers - 1)
+}
+
+// waveletSharpen boosts the detail layers of img in place, as planetary
+// stacking programs do: the à trous wavelet transform takes each layer as the
+// difference between B3-spline blurs a step apart, which brings out the bands
+// and craters of a stacked disk without the halos of one unsharp mask
+func waveletSharpen(img *image.RGBA, strength int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	amount := 2 * float64(strength) / 100
+	var wg sync.WaitGroup
+	for c := 0; c < 3; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			smooth := make([]float64, w*h)
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					smooth[y*w+x] = float64(img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y)+c])
+				}
+			}
+			result := slices.Clone(smooth)
+			coarser := make([]float64, w*h)
+			scratch := make([]float64, w*h)
+			for layer := range waveletLayers {
+				atrousBlur(smooth, coarser, scratch, w, h, 1<<layer)
+				for i := range result {
+					result[i] += amount * waveletGains[layer] * (smooth[i] - coarser[i])
+				}
+				smooth, coarser = coarser, smooth
+			}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y)+c] = uint8(math.Min(math.Max(math.Round(result[y*w+x]), 0), 255))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// atrousBlur blurs the w by h plane src into dst with the B3-spline kernel
+// 1 4 6 4 1, its taps step pixels apart, clamping at the edges
+func atrousBlur(src, dst, scratch []float64, w, h, step int) {
+	kernel := [5]float64{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16, 1.0 / 16}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum := 0.0
+			for k, weight := range kernel {
+				sum += weight * src[y*w+min(max(x+(k-2)*step, 0), w-1)]
+			}
+			scratch[y*w+x] = sum
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum := 0.0
+			for k, weight := range kernel {
+				sum += weight * scratch[min(max(y+(k-2)*step, 0), h-1)*w+x]
+			}
+			dst[y*w+x] = sum
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Fusion algorithms a request can choose
+const (
+	algorithmAverage   = "average"   // Average every aligned, upscaled frame
+	algorithmReference = "reference" // Upscale the reference frame alone, as a baseline to compare against
+	algorithmWeighted  = "weighted"  // Average the frames, each pixel weighed by how well it lines up with the reference, see residual.go
+	algorithmMedian    = "median"    // Take the median of the frames, erasing what moved through them, see median.go
+)
+
+// fusionAlgorithms lists the accepted values of the algorithm parameter, the default first
+var fusionAlgorithms = []string{algorithmAverage, algorithmReference, algorithmWeighted, algorithmMedian}
+
+// interpolationKernels are the resampling kernels frames can be upscaled with
+var interpolationKernels = map[string]draw.Interpolator{
+	"nearest":  draw.NearestNeighbor,
+	"bilinear": draw.BiLinear,
+	"bicubic":  draw.CatmullRom,
+}
+
+// defaultKernel is the kernel used unless a request names another
+const defaultKernel = "bilinear"
+
+// Output formats of the result
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+	formatPDF  = "pdf"  // A printable page holding the image, see encodePDF
+	formatTIFF = "tiff" // Georeferenced when the frames are GeoTIFFs, see encodeTIFF
+)
+
+// defaultJPEGQuality is the quality results are encoded with unless a request sets one
+const defaultJPEGQuality = jpeg.DefaultQuality
+
+// kernelNames returns the accepted values of the kernel parameter in a stable order
+func kernelNames() []string {
+	names := make([]string, 0, len(interpolationKernels))
+	for name := range interpolationKernels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// contentType returns the media type of results encoded in format
+func contentType(format string) string {
+	switch format {
+	case formatPNG:
+		return "image/png"
+	case formatPDF:
+		return "application/pdf"
+	case formatTIFF:
+		return "image/tiff"
+	}
+	return "image/jpeg"
+}
+
+// fileExtension returns the extension stored results in format are named with
+func fileExtension(format string) string {
+	switch format {
+	case formatPNG:
+		return ".png"
+	case formatPDF:
+		return ".pdf"
+	case formatTIFF:
+		return ".tif"
+	}
+	return ".jpg"
+}
+
+// encodeResult writes img in the output format of the request
+func encodeResult(w io.Writer, img image.Image, opts processOptions) error {
+	profile := opts.outputProfile()
+	switch opts.Format {
+	case formatPNG:
+		return writeProfiled(w, formatPNG, profile, func(w io.Writer) error { return png.Encode(w, img) })
+	case formatPDF:
+		return encodePDF(w, img, opts.Binarize, profile)
+	case formatTIFF:
+		return encodeTIFF(w, img, opts.resultTags(), profile)
+	}
+	return writeProfiled(w, formatJPEG, profile, func(w io.Writer) error {
+		if opts.Progressive || (opts.Chroma != "" && opts.Chroma != chroma420) {
+			return encodeJPEG(w, img, opts.Quality, opts.Chroma, opts.Progressive)
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality})
+	})
+}
+
+// filterMargin is the number of rows a filtered strip needs from each neighbour:
+// one per 3x3 pass, so strips join without seams
+const filterMargin = 2
+
+// renderResult renders the rows [y0, y1) of the fused result with the request's
+// deconvolution, wavelet, denoise, local contrast and sharpen filters and binarization applied
+func renderResult(acc *fusionAccumulator, y0, y1 int, opts processOptions) *image.RGBA {
+	if opts.Adaptive && opts.Denoise == 0 {
+		opts.Denoise = acc.denoise
+	}
+	if opts.Denoise == 0 && opts.Sharpen == 0 && opts.Deconvolve == 0 && opts.Wavelet == 0 && opts.CLAHE == 0 {
+		strip := acc.renderRows(y0, y1)
+		if opts.Binarize {
+			binarize(strip)
+		}
+		convertResult(strip, opts)
+		return strip
+	}
+	margin := filterMargin + deconvolveMargin(opts) + waveletMargin(opts)
+	top, bottom := max(y0-margin, 0), min(y1+margin, acc.height)
+	img := acc.renderRows(top, bottom)
+	if opts.Deconvolve > 0 {
+		// Before denoising, which would blur what deconvolution restores
+		deconvolve(img, opts.Scale, opts.Deconvolve)
+	}
+	if opts.Wavelet > 0 {
+		waveletSharpen(img, opts.Wavelet)
+	}
+	if opts.Denoise > 0 {
+		// Blend towards the blurred image, smoothing sensor noise along with fine detail
+		blendWithBlur(img, -float64(opts.Denoise)/100)
+	}
+	if opts.CLAHE > 0 {
+		// On the whole result, which is never streamed in strips; after denoising, so noise is not stretched
+		clahe(img, opts.CLAHE, opts.CLAHETile)
+	}
+	if opts.Sharpen > 0 {
+		// Unsharp mask: push pixels away from the blurred image, up to twice the detail
+		blendWithBlur(img, float64(opts.Sharpen)/100)
+	}
+	strip := image.NewRGBA(image.Rect(0, 0, acc.width, y1-y0))
+	draw.Copy(strip, image.Point{}, img, image.Rect(0, y0-top, acc.width, y1-top), draw.Src, nil)
+	if opts.Binarize {
+		binarize(strip) // Last, on the finished tones
+	}
+	convertResult(strip, opts) // After every filter, which work on the levels the frames were in
+	return strip
+}
+
+// blendWithBlur sets every pixel to p + amount*(p - blur(p)), where blur is a
+// 3x3 Gaussian with edges clamped: a negative amount smooths, a positive one sharpens
+func blendWithBlur(img *image.RGBA, amount float64) {
+	b := img.Bounds()
+	src := slices.Clone(img.Pix)
+	at := func(x, y, c int) float64 {
+		x = min(max(x, b.Min.X), b.Max.X-1)
+		y = min(max(y, b.Min.Y), b.Max.Y-1)
+		return float64(src[img.PixOffset(x, y)+c])
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ { // Alpha stays opaque
+				blur := (4*at(x, y, c) +
+					2*(at(x-1, y, c)+at(x+1, y, c)+at(x, y-1, c)+at(x, y+1, c)) +
+					at(x-1, y-1, c) + at(x+1, y-1, c) + at(x-1, y+1, c) + at(x+1, y+1, c)) / 16
+				p := float64(src[i+c])
+				img.Pix[i+c] = uint8(math.Min(math.Max(math.Round(p+amount*(p-blur)), 0), 255))
+			}
+		}
+	}
+}
+
+// optionFields renders the processing controls of the upload and capture forms,
+// preset to the defaults the server applies when a field is left out
+func optionFields(r *http.Request) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<details class="mb-3"><summary>%s</summary><div class="row g-2 mt-1">`, tr(r, "Processing options"))
+	fmt.Fprintf(&b, `<div class="col-12 col-md-4"><label for="preset" class="form-label">%s</label><select name="preset" id="preset" class="form-select"><option value="">%s</option>`, tr(r, "Preset"), tr(r, "None"))
+	for _, name := range presetNames() {
+		fmt.Fprintf(&b, `<option value="%s">%s</option>`, name, tr(r, presetLabels[name]))
+	}
+	b.WriteString(`</select></div>`)
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="scale" class="form-label">%s</label><select name="scale" id="scale" class="form-select"><option value="">%s</option>`, tr(r, "Scale factor"), tr(r, "Auto"))
+	for scale := 1; scale <= maxUpscaleFactor; scale++ {
+		fmt.Fprintf(&b, `<option value="%d">%dx</option>`, scale, scale)
+	}
+	b.WriteString(`</select></div>`)
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="algorithm" class="form-label">%s</label><select name="algorithm" id="algorithm" class="form-select">`, tr(r, "Algorithm"))
+	fmt.Fprintf(&b, `<option value="average">%s</option><option value="reference">%s</option><option value="weighted">%s</option><option value="median">%s</option></select></div>`, tr(r, "Average of all frames"), tr(r, "Reference frame only (for comparison)"), tr(r, "Average, leaving out what lines up badly"), tr(r, "Median, removing people and cars that pass"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="kernel" class="form-label">%s</label><select name="kernel" id="kernel" class="form-select">`, tr(r, "Interpolation"))
+	for _, name := range kernelNames() {
+		selected := ""
+		if name == defaultKernel {
+			selected = " selected"
+		}
+		fmt.Fprintf(&b, `<option value="%s"%s>%s</option>`, name, selected, name)
+	}
+	b.WriteString(`</select></div>`)
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="format" class="form-label">%s</label><select name="format" id="format" class="form-select"><option value="jpeg">JPEG</option><option value="png">%s</option><option value="pdf">%s</option><option value="tiff">%s</option></select></div>`, tr(r, "Output format"), tr(r, "PNG (lossless)"), tr(r, "PDF (A4 page)"), tr(r, "TIFF (GeoTIFF for maps)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="lossless" id="lossless" value="true"><label class="form-check-label" for="lossless">%s</label></div></div>`, tr(r, "Lossless only (for archiving, JPEG refused)"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="quality" class="form-label">%s</label><input type="number" name="quality" id="quality" min="1" max="100" value="%d" class="form-control"></div>`, tr(r, "JPEG quality"), defaultJPEGQuality)
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="chroma" class="form-label">%s</label><select name="chroma" id="chroma" class="form-select"><option value="">4:2:0</option><option value="422">4:2:2</option><option value="444">%s</option></select></div>`, tr(r, "JPEG chroma subsampling"), tr(r, "4:4:4 (full colour resolution)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="progressive" id="progressive" value="true"><label class="form-check-label" for="progressive">%s</label></div></div>`, tr(r, "Progressive JPEG"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="roi" class="form-label">%s</label><input type="text" name="roi" id="roi" placeholder="x,y,%s,%s" pattern="\d+,\d+,\d+,\d+" class="form-control"></div>`, tr(r, "Region of interest"), tr(r, "width"), tr(r, "height"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="fit" class="form-label">%s</label><select name="fit" id="fit" class="form-select"><option value="">%s</option><option value="crop">%s</option><option value="resize">%s</option></select></div>`, tr(r, "Frames of another size"), tr(r, "Reject them"), tr(r, "Crop all to the common size"), tr(r, "Resize to the reference"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="many_frames" class="form-label">%s</label><select name="many_frames" id="many_frames" class="form-select"><option value="">%s</option><option value="all">%s</option></select></div>`, tr(r, "Bursts of many frames"), trf(r, "Fuse the sharpest %d", maxFusedFrames), tr(r, "Fuse every frame"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-2"><label for="deconvolve" class="form-label">%s</label><input type="range" name="deconvolve" id="deconvolve" min="0" max="100" value="0" class="form-range"></div>`, tr(r, "Deconvolve"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-2"><label for="denoise" class="form-label">%s</label><input type="range" name="denoise" id="denoise" min="0" max="100" value="0" class="form-range"></div>`, tr(r, "Denoise"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-2"><label for="sharpen" class="form-label">%s</label><input type="range" name="sharpen" id="sharpen" min="0" max="100" value="0" class="form-range"></div>`, tr(r, "Sharpen"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-2"><label for="wavelet" class="form-label">%s</label><input type="range" name="wavelet" id="wavelet" min="0" max="100" value="0" class="form-range"></div>`, tr(r, "Wavelet sharpening"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-2"><label for="clahe" class="form-label">%s</label><input type="range" name="clahe" id="clahe" min="0" max="100" value="0" class="form-range"></div>`, tr(r, "Local contrast"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="keep" class="form-label">%s</label><input type="number" name="keep" id="keep" min="1" max="100" placeholder="100" class="form-control"></div>`, tr(r, "Sharpest frames kept, %"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="tile_reject" class="form-label">%s</label><input type="number" name="tile_reject" id="tile_reject" min="0" max="%d" placeholder="0" class="form-control"></div>`, tr(r, "Frames left out of every tile, %"), maxTileReject)
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="binarize" id="binarize" value="true"><label class="form-check-label" for="binarize">%s</label></div></div>`, tr(r, "Black and white text (for documents)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="thermal" id="thermal" value="true"><label class="form-check-label" for="thermal">%s</label></div></div>`, tr(r, "Thermal camera frames (16-bit radiometric TIFF or PNG)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="mono16" id="mono16" value="true"><label class="form-check-label" for="mono16">%s</label></div></div>`, tr(r, "16-bit grayscale frames at full depth (microscope cameras)"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="tonemap" class="form-label">%s</label><select name="tonemap" id="tonemap" class="form-select"><option value="">%s</option>`, tr(r, "Tone mapping of 16-bit results"), tr(r, "Linear, brightest clipped"))
+	for _, name := range tonemapOperators {
+		fmt.Fprintf(&b, `<option value="%s">%s</option>`, name, name)
+	}
+	b.WriteString(`</select></div>`)
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="film" id="film" value="true"><label class="form-check-label" for="film">%s</label></div></div>`, tr(r, "Passes of a film scanner (removes dust)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="negative" id="negative" value="true"><label class="form-check-label" for="negative">%s</label></div></div>`, tr(r, "Scans of a negative"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="match_exposure" id="match_exposure" value="true"><label class="form-check-label" for="match_exposure">%s</label></div></div>`, tr(r, "Match the exposure of the frames"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="deghost" id="deghost" value="true"><label class="form-check-label" for="deghost">%s</label></div></div>`, tr(r, "Remove ghosts of moving people and cars"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="subject" id="subject" value="true"><label class="form-check-label" for="subject">%s</label></div></div>`, tr(r, "Keep a moving subject sharp (portraits)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="luma_only" id="luma_only" value="true"><label class="form-check-label" for="luma_only">%s</label></div></div>`, tr(r, "Fuse brightness only (about 3x faster)"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="input_space" class="form-label">%s</label><select name="input_space" id="input_space" class="form-select"><option value="">sRGB</option><option value="display-p3">Display P3</option><option value="adobe-rgb">Adobe RGB</option></select></div>`, tr(r, "Colour space of the frames"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="working_space" class="form-label">%s</label><select name="working_space" id="working_space" class="form-select"><option value="">%s</option><option value="linear">%s</option></select></div>`, tr(r, "Fuse in"), tr(r, "Encoded levels"), tr(r, "Linear light"))
+	fmt.Fprintf(&b, `<div class="col-6 col-md-4"><label for="output_space" class="form-label">%s</label><select name="output_space" id="output_space" class="form-select"><option value="">%s</option><option value="srgb">sRGB</option><option value="display-p3">Display P3</option><option value="adobe-rgb">Adobe RGB</option><option value="linear">%s</option></select></div>`, tr(r, "Colour space of the result"), tr(r, "As the frames"), tr(r, "Linear sRGB"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="deterministic" id="deterministic" value="true"><label class="form-check-label" for="deterministic">%s</label></div></div>`, tr(r, "Reproducible result (same frames, same bytes)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="ycbcr" id="ycbcr" value="true"><label class="form-check-label" for="ycbcr">%s</label></div></div>`, tr(r, "Fuse JPEG frames in Y'CbCr (faster)"))
+	fmt.Fprintf(&b, `<div class="col-12"><div class="form-check"><input class="form-check-input" type="checkbox" name="adaptive" id="adaptive" value="true"><label class="form-check-label" for="adaptive">%s</label></div></div>`, tr(r, "Adapt to the noise of every frame"))
+	b.WriteString(`</div></details>`)
+	return b.String()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Pre-flight analysis of a burst: how far apart the frames sit on the sub-pixel
+// grid, how noisy and how evenly sharp they are. Super-resolution only adds
+// detail where frames sample the scene between each other's pixels, so these
+// decide the scale worth asking for.
+
+const (
+	assessPatch     = 256 // Side of the centre crop the frames are measured on, in pixels
+	assessMaxFrames = 16  // Frames measured at most; larger bursts are sampled evenly
+	assessCoverage  = 0.5 // Share of the sub-pixel positions of a scale the frames must cover to recommend it
+	assessNoisy     = 4.0 // Noise level, 0-255, above which fusing is worth it for the noise alone
+	assessSoft      = 0.5 // Sharpness relative to the sharpest frame below which a frame counts as soft
+	assessMaxScale  = 4   // Highest scale recommended: beyond it lens blur rather than sampling limits detail
+)
+
+// Expected benefit of fusing a burst, from none to strong
+const (
+	benefitNone     = "none"
+	benefitSmall    = "small"
+	benefitModerate = "moderate"
+	benefitStrong   = "strong"
+)
+
+// burstAssessment is what the pre-flight analysis found out about a burst
+type burstAssessment struct {
+	Frames           int            `json:"frames"`
+	Measured         int            `json:"measured"`          // Frames the figures below were taken from
+	Offsets          []offsetReport `json:"subpixel_offsets"`  // Position of each measured frame within a pixel, the reference at 0,0
+	Coverage         float64        `json:"subpixel_coverage"` // Share of the 2x2 sub-pixel positions the frames fall on
+	Noise            float64        `json:"noise"`             // Noise standard deviation of the reference frame, 0-255
+	SharpnessSpread  float64        `json:"sharpness_spread"`  // Sharpness of the softest measured frame relative to the sharpest, 0-1
+	SoftFrames       int            `json:"soft_frames"`       // Measured frames well below the sharpest one
+	Mismatched       int            `json:"mismatched"`        // Frames of another size, or too far off to measure
+	RecommendedScale int            `json:"recommended_scale"`
+	Benefit          string         `json:"benefit"` // One of none, small, moderate or strong
+	Notes            []string       `json:"notes"`   // The findings in words
+}
+
+// offsetReport is the sub-pixel position of a frame, each coordinate in [0, 1)
+type offsetReport struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// grayPatch is a luminance crop of a frame
+type grayPatch struct {
+	w, h int
+	pix  []float64
+}
+
+func (p grayPatch) at(x, y int) float64 {
+	return p.pix[y*p.w+x]
+}
+
+// centerPatch takes the luminance of the centre of img, at most size pixels square
+func centerPatch(img image.Image, size int) grayPatch {
+	b := img.Bounds()
+	w, h := min(b.Dx(), size), min(b.Dy(), size)
+	x0, y0 := b.Min.X+(b.Dx()-w)/2, b.Min.Y+(b.Dy()-h)/2
+	p := grayPatch{w: w, h: h, pix: make([]float64, w*h)}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(x0+x, y0+y).RGBA()
+			p.pix[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+		}
+	}
+	return p
+}
+
+// halve averages 2x2 blocks of the patch
+func (p grayPatch) halve() grayPatch {
+	h := grayPatch{w: p.w / 2, h: p.h / 2}
+	h.pix = make([]float64, h.w*h.h)
+	for y := 0; y < h.h; y++ {
+		for x := 0; x < h.w; x++ {
+			h.pix[y*h.w+x] = (p.at(2*x, 2*y) + p.at(2*x+1, 2*y) + p.at(2*x, 2*y+1) + p.at(2*x+1, 2*y+1)) / 4
+		}
+	}
+	return h
+}
+
+// patchDifference is the mean squared difference of p shifted by (dx, dy) against
+// ref, or +Inf when less than half of them overlap
+func patchDifference(ref, p grayPatch, dx, dy int) float64 {
+	sum, n := 0.0, 0
+	for y := max(0, -dy); y < min(ref.h, p.h-dy); y++ {
+		for x := max(0, -dx); x < min(ref.w, p.w-dx); x++ {
+			d := ref.at(x, y) - p.at(x+dx, y+dy)
+			sum += d * d
+			n++
+		}
+	}
+	if n < ref.w*ref.h/2 {
+		return math.Inf(1)
+	}
+	return sum / float64(n)
+}
+
+// bestShift searches the shifts within radius of (cx, cy) for the smallest difference
+func bestShift(ref, p grayPatch, cx, cy, radius int) (dx, dy int, diff float64) {
+	diff = math.Inf(1)
+	for y := cy - radius; y <= cy+radius; y++ {
+		for x := cx - radius; x <= cx+radius; x++ {
+			if d := patchDifference(ref, p, x, y); d < diff {
+				dx, dy, diff = x, y, d
+			}
+		}
+	}
+	return dx, dy, diff
+}
+
+// subpixelShift estimates the shift of p against ref to a fraction of a pixel: a
+// coarse search on quarter-size copies, a fine one around it, then one gradient
+// (Lucas-Kanade) step for the fraction. ok is false when nothing matches.
+func subpixelShift(ref, p grayPatch) (x, y float64, ok bool) {
+	coarseRef, coarse := ref.halve().halve(), p.halve().halve()
+	cx, cy, diff := bestShift(coarseRef, coarse, 0, 0, (maxAlignShift+3)/4)
+	if math.IsInf(diff, 1) {
+		return 0, 0, false
+	}
+	dx, dy, _ := bestShift(ref, p, 4*cx, 4*cy, 3)
+	x, y = refineShift(ref, p, dx, dy)
+	return x, y, true
+}
+
+// refineShift takes the whole-pixel shift dx, dy of p against ref to a fraction
+// of a pixel with one gradient (Lucas-Kanade) step, of at most a pixel
+func refineShift(ref, p grayPatch, dx, dy int) (x, y float64) {
+	var sxx, sxy, syy, sxt, syt float64
+	for yy := max(1, 1-dy); yy < min(ref.h-1, p.h-dy-1); yy++ {
+		for xx := max(1, 1-dx); xx < min(ref.w-1, p.w-dx-1); xx++ {
+			ix := (ref.at(xx+1, yy) - ref.at(xx-1, yy)) / 2
+			iy := (ref.at(xx, yy+1) - ref.at(xx, yy-1)) / 2
+			it := p.at(xx+dx, yy+dy) - ref.at(xx, yy)
+			sxx += ix * ix
+			sxy += ix * iy
+			syy += iy * iy
+			sxt += ix * it
+			syt += iy * it
+		}
+	}
+	det := sxx*syy - sxy*sxy
+	if det <= 1e-9 {
+		return float64(dx), float64(dy) // A flat patch: no fraction to be had
+	}
+	u := (syy*sxt - sxy*syt) / det
+	v := (sxx*syt - sxy*sxt) / det
+	return float64(dx) - clampUnit(u), float64(dy) - clampUnit(v)
+}
+
+func clampUnit(v float64) float64 {
+	return math.Max(-1, math.Min(1, v))
+}
+
+// patchNoise estimates the noise standard deviation of a patch (Immerkaer's method),
+// which sees through texture better than the plain variance
+func patchNoise(p grayPatch) float64 {
+	if p.w < 3 || p.h < 3 {
+		return 0
+	}
+	sum := 0.0
+	for y := 1; y < p.h-1; y++ {
+		for x := 1; x < p.w-1; x++ {
+			v := p.at(x-1, y-1) - 2*p.at(x, y-1) + p.at(x+1, y-1) -
+				2*p.at(x-1, y) + 4*p.at(x, y) - 2*p.at(x+1, y) +
+				p.at(x-1, y+1) - 2*p.at(x, y+1) + p.at(x+1, y+1)
+			sum += math.Abs(v)
+		}
+	}
+	return sum * math.Sqrt(math.Pi/2) / (6 * float64((p.w-2)*(p.h-2)))
+}
+
+// patchSharpness is the variance of the Laplacian of a patch, as on the upload page
+func patchSharpness(p grayPatch) float64 {
+	sum, sumSq, n := 0.0, 0.0, 0.0
+	for y := 1; y < p.h-1; y++ {
+		for x := 1; x < p.w-1; x++ {
+			lap := p.at(x-1, y) + p.at(x+1, y) + p.at(x, y-1) + p.at(x, y+1) - 4*p.at(x, y)
+			sum += lap
+			sumSq += lap * lap
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sumSq/n - (sum/n)*(sum/n)
+}
+
+// subpixelCoverage is the share of the scale x scale positions within a pixel
+// that at least one of the offsets falls on. Offsets count for the nearest
+// position, so 0.98 is the same position as 0.
+func subpixelCoverage(offsets []offsetReport, scale int) float64 {
+	seen := make(map[[2]int]bool)
+	for _, o := range offsets {
+		seen[[2]int{int(math.Round(o.X*float64(scale))) % scale, int(math.Round(o.Y*float64(scale))) % scale}] = true
+	}
+	return float64(len(seen)) / float64(scale*scale)
+}
+
+// assessBurst analyzes the frames, the reference first, and recommends a scale
+func assessBurst(images []image.Image) burstAssessment {
+	a := burstAssessment{Frames: len(images), RecommendedScale: 1, Benefit: benefitNone}
+	if len(images) == 0 {
+		return a
+	}
+
+	// Measure the reference and an even sample of the others
+	picked := []int{0}
+	others := len(images) - 1
+	for i := range min(others, assessMaxFrames-1) {
+		picked = append(picked, 1+i*others/min(others, assessMaxFrames-1))
+	}
+	size := images[0].Bounds().Size()
+	ref := centerPatch(images[0], assessPatch)
+	a.Noise = patchNoise(ref)
+	sharpness := []float64{patchSharpness(ref)}
+	a.Offsets = []offsetReport{{}}
+	for _, i := range picked[1:] {
+		if images[i].Bounds().Size() != size {
+			a.Mismatched++
+			continue
+		}
+		p := centerPatch(images[i], assessPatch)
+		x, y, ok := subpixelShift(ref, p)
+		if !ok {
+			a.Mismatched++
+			continue
+		}
+		a.Offsets = append(a.Offsets, offsetReport{X: x - math.Floor(x), Y: y - math.Floor(y)})
+		sharpness = append(sharpness, patchSharpness(p))
+	}
+	a.Measured = len(a.Offsets)
+	a.Coverage = subpixelCoverage(a.Offsets, 2)
+	if sharpest := slices.Max(sharpness); sharpest > 0 {
+		a.SharpnessSpread = slices.Min(sharpness) / sharpest
+		for _, s := range sharpness {
+			if s < assessSoft*sharpest {
+				a.SoftFrames++
+			}
+		}
+	}
+
+	// A scale is worth it when the frames fill enough of its sub-pixel positions.
+	// A sample covers at most as many positions as it has frames, so coverage is
+	// taken of those it could reach, and the whole burst must be large enough.
+	// Frames all on the reference's position add nothing however many there are.
+	for scale := 2; scale <= assessMaxScale; scale++ {
+		positions := scale * scale
+		covered := subpixelCoverage(a.Offsets, scale) * float64(positions)
+		if covered < 2 || covered/float64(min(positions, a.Measured)) < assessCoverage || float64(len(images)) < assessCoverage*float64(positions) {
+			break
+		}
+		a.RecommendedScale = scale
+	}
+	switch {
+	case a.RecommendedScale >= 3:
+		a.Benefit = benefitStrong
+	case a.RecommendedScale == 2:
+		a.Benefit = benefitModerate
+	case len(images) >= 4 && a.Noise > assessNoisy:
+		a.Benefit = benefitSmall // Less noise, but no more detail
+	}
+	a.Notes = a.notes(fmt.Sprintf)
+	return a
+}
+
+// notes puts the findings into words with format, which translates them for a page
+func (a burstAssessment) notes(format func(string, ...any) string) []string {
+	var notes []string
+	switch {
+	case a.Frames == 1:
+		notes = append(notes, format("Only one frame was uploaded: the result can only be a plain upscale without added detail. Upload a burst of several frames taken from slightly different positions."))
+	case a.Measured < 2:
+		notes = append(notes, format("No other frame lines up with the reference, so the frames cannot be fused."))
+	case a.RecommendedScale == 1:
+		notes = append(notes, format("The frames sit on nearly the same pixel positions, so fusing them adds little detail. Moving the camera slightly between shots helps."))
+	default:
+		notes = append(notes, format("The frames cover %.0f%% of the half-pixel positions; up to %dx upscaling can add real detail.", 100*a.Coverage, a.RecommendedScale))
+	}
+	if a.Frames >= 2 && a.Noise > assessNoisy {
+		notes = append(notes, format("The frames are noisy (noise level %.1f); fusing %d frames reduces the noise about %.1f times.", a.Noise, a.Frames, math.Sqrt(float64(a.Frames))))
+	}
+	if a.SoftFrames > 0 {
+		notes = append(notes, format("%d of the measured frames are much softer than the sharpest one; leaving them out may give a crisper result.", a.SoftFrames))
+	}
+	if a.Mismatched > 0 {
+		notes = append(notes, format("%d frame(s) differ in size or could not be matched to the reference.", a.Mismatched))
+	}
+	return notes
+}
+
+// assessmentHTML renders the findings for a page, with the requested scale
+// compared against the recommended one when scale is not 0
+func assessmentHTML(r *http.Request, a burstAssessment, scale int) string {
+	class := "alert-info"
+	if a.Benefit == benefitNone {
+		class = "alert-warning"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div class="alert %s"><strong>%s</strong><ul class="mb-0">`, class,
+		html.EscapeString(trf(r, "Expected benefit: %s. Recommended scale: %dx.", tr(r, a.Benefit), a.RecommendedScale)))
+	for _, note := range a.notes(func(format string, args ...any) string { return trf(r, format, args...) }) {
+		fmt.Fprintf(&b, "<li>%s</li>", html.EscapeString(note))
+	}
+	if scale > a.RecommendedScale {
+		fmt.Fprintf(&b, "<li>%s</li>", html.EscapeString(trf(r, "The requested %dx is more than this burst supports: the extra pixels are interpolated, not resolved.", scale)))
+	}
+	b.WriteString("</ul></div>")
+	return b.String()
+}
+
+// assessmentNotice renders the findings on a result page when they matter: when
+// fusing could not add detail or the scale asked for more than the burst holds
+func assessmentNotice(r *http.Request, a burstAssessment, opts processOptions) string {
+	if a.Frames == 0 || (a.Benefit != benefitNone && opts.Scale <= a.RecommendedScale) {
+		return ""
+	}
+	return assessmentHTML(r, a, opts.Scale)
+}
+
+// preflightHandler checks a burst posted from the upload form without processing it
+func preflightHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := limitUploadSize(w, r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	servePreflight(w, r, writePlainError)
+}
+
+// apiV1PreflightHandler checks a burst posted like to /api/v1/superresolve
+func apiV1PreflightHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	if reqErr := limitUploadSize(w, r); reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	servePreflight(w, r, writeAPIErrorV1)
+}
+
+// servePreflight decodes the uploaded frames and reports what fusing them can
+// achieve, as JSON or, for browsers, as a page
+func servePreflight(w http.ResponseWriter, r *http.Request, writeError errorWriter) {
+	images, _, reqErr := decodeUploadedImages(w, r)
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	req, reqErr := parseSuperResolutionRequestV1(r)
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	opts, reqErr := req.options(len(images))
+	if reqErr != nil {
+		writeError(w, reqErr)
+		return
+	}
+	_, endStage := startStage(r.Context(), "assess")
+	a := assessBurst(referenceFirst(images, opts.Reference))
+	endStage()
+	if !acceptsHTML(r) {
+		writeJSON(w, http.StatusOK, a)
+		return
+	}
+
+	const preflightPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Burst check}}</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Burst check}}</h1>
+	%s
+	<div id="assessment" class="bg-body p-4 rounded shadow" data-recommended-scale="%d">
+	%s
+	<a href="%s" class="btn btn-outline-secondary">{{Back}}</a>
+	</div>
+	</div>
+	%s
+	</body>
+	</html>
+	`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(w, localize(r, preflightPageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), a.RecommendedScale, assessmentHTML(r, a, opts.Scale), config.url("/"), pageFooter(r))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Presets of the preset parameter: defaults tuned for a kind of footage
+const (
+	presetCCTV       = "cctv"       // Security-camera clips: interlaced, noisy, with a burned-in clock
+	presetPlate      = "plate"      // Number plates and other small text, given as the roi
+	presetDocument   = "document"   // Several photographs of a page
+	presetAstro      = "astro"      // Exposures of the night sky from a fixed tripod
+	presetPlanet     = "planet"     // Video of the Moon or a planet through a telescope
+	presetMicroscope = "microscope" // Captures of a microscope camera, drifting with the stage
+	presetFilm       = "film"       // Several passes of a film scanner over one frame
+	presetPhone      = "phone"      // A burst shot with a phone held in the hand
+	presetClean      = "clean"      // A burst of a scene people and cars pass through, to empty it
+)
+
+// pipelinePresets are the accepted values of the preset parameter, each filling
+// in the parameters a request leaves out
+var pipelinePresets = map[string]func(req *superResolutionRequestV1){
+	presetCCTV: func(req *superResolutionRequestV1) {
+		req.Deinterlace = true
+		req.MaskOverlays = true // The clock changes from frame to frame and sits still while the scene moves
+		if req.Scale == 0 {
+			req.Scale = 2 // More frames per output pixel average out more noise
+		}
+		if req.Denoise == 0 {
+			req.Denoise = 50
+		}
+		if req.Sharpen == 0 {
+			req.Sharpen = 10 // Compression blocks and noise turn into halos under strong sharpening
+		}
+	},
+	presetPlate: func(req *superResolutionRequestV1) {
+		if req.Scale == 0 {
+			req.Scale = 4 // Characters a few pixels high need room to take shape
+		}
+		if req.Kernel == "" {
+			req.Kernel = "bicubic"
+		}
+		if req.Deconvolve == 0 {
+			req.Deconvolve = 40
+		}
+		if req.Format == "" {
+			req.Format = formatPNG // JPEG blocks blur the strokes of small characters
+		}
+	},
+	presetDocument: func(req *superResolutionRequestV1) {
+		req.Rectify = true
+		req.Flatten = true
+		if req.Scale == 0 {
+			req.Scale = 2 // Enough for print from a phone photograph
+		}
+		if req.Sharpen == 0 {
+			req.Sharpen = 20
+		}
+		if req.Format == "" {
+			req.Format = formatPNG
+		}
+	},
+	presetAstro: func(req *superResolutionRequestV1) {
+		if req.Align == "" {
+			req.Align = alignStars
+		}
+		if req.Scale == 0 {
+			req.Scale = 2 // Long sessions run to dozens of frames, whose square root would not fit in memory
+		}
+		if req.Format == "" {
+			req.Format = formatPNG // JPEG blocks wipe out faint stars and smear the dark sky
+		}
+	},
+	presetPlanet: func(req *superResolutionRequestV1) {
+		if req.Align == "" {
+			req.Align = alignPlanet
+		}
+		if req.Keep == 0 {
+			req.Keep = 50 // Turbulence smears most frames; stacking them only blurs the sharp ones
+		}
+		if req.Scale == 0 {
+			req.Scale = 2
+		}
+		if req.Wavelet == 0 {
+			req.Wavelet = 50
+		}
+		if req.Format == "" {
+			req.Format = formatPNG
+		}
+	},
+	presetMicroscope: func(req *superResolutionRequestV1) {
+		req.Mono16 = true // Frames of 8 bits or in colour are fused as usual
+		if req.Align == "" {
+			req.Align = alignDrift
+		}
+		if req.Scale == 0 {
+			req.Scale = 2 // Beyond what the optics resolve, more only magnifies the blur
+		}
+		if req.Format == "" {
+			req.Format = formatTIFF // Keeps the size of the pixels, so scale bars and measurements hold
+		}
+	},
+	presetFilm: func(req *superResolutionRequestV1) {
+		req.Film = true
+		if req.Scale == 0 {
+			req.Scale = 1 // The passes fall on the same pixels: they hold noise and dust to remove, not detail between them
+		}
+		if req.Format == "" {
+			req.Format = formatPNG // JPEG blocks turn the grain to mush
+		}
+	},
+	presetPhone: func(req *superResolutionRequestV1) {
+		req.MatchExposure = true // The phone sets exposure and white balance afresh for every frame
+		req.Deghost = true
+		if req.Align == "" {
+			req.Align = alignHandheld
+		}
+		if req.Scale == 0 {
+			req.Scale = 2 // The shake of a hand spreads the frames over the pixels between
+		}
+		if req.Sharpen == 0 {
+			req.Sharpen = 15 // Phones sharpen their frames already; more only rings
+		}
+	},
+	presetClean: func(req *superResolutionRequestV1) {
+		if req.Algorithm == "" {
+			req.Algorithm = algorithmMedian
+		}
+		if req.Align == "" {
+			req.Align = alignHandheld // Often shot in the hand, waiting for a gap in the crowd
+		}
+		if req.Scale == 0 {
+			req.Scale = 1 // The point is an empty scene; the median adds no detail between the pixels
+		}
+	},
+}
+
+// presetLabels name the presets on the processing options of the forms
+var presetLabels = map[string]string{
+	presetCCTV:       "Security camera footage",
+	presetPlate:      "Number plate or small text",
+	presetDocument:   "Document page",
+	presetAstro:      "Night sky",
+	presetPlanet:     "Moon or planet",
+	presetMicroscope: "Microscope captures",
+	presetFilm:       "Film scan passes",
+	presetPhone:      "Phone burst",
+	presetClean:      "Remove passers-by",
+}
+
+// presetWarnings are shown with the results of the presets whose output is easily
+// taken for more than it is
+var presetWarnings = map[string]string{
+	presetPlate: "Characters in this result are reconstructed from the frames and can look legible while being wrong: it is an investigative aid, not evidence. Confirm any reading against the original frames, and have forensic work done with validated tools.",
+}
+
+// presetNames returns the names of the presets in alphabetical order
+func presetNames() []string {
+	return slices.Sorted(maps.Keys(pipelinePresets))
+}
+
+// applyPreset fills in the parameters req leaves out with the values of its preset
+func (req *superResolutionRequestV1) applyPreset() *requestError {
+	if req.Preset == "" {
+		return nil
+	}
+	preset, ok := pipelinePresets[req.Preset]
+	if !ok {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter preset must be one of %s, got %q", strings.Join(presetNames(), ", "), req.Preset)}
+	}
+	preset(req)
+	return nil
+}
+
+// presetNotice renders the warning of the preset of opts for the result page, if it has one
+func presetNotice(r *http.Request, opts processOptions) string {
+	warning, ok := presetWarnings[opts.Preset]
+	if !ok {
+		return ""
+	}
+	return `<div class="alert alert-warning" role="alert">` + tr(r, warning) + `</div>`
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"image"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+// previewDownsample is how much a preview shrinks the frames before running the
+// pipeline: a sixteenth of the pixels takes seconds where the full job takes minutes
+const previewDownsample = 4
+
+// downsampleFrames shrinks every frame by factor for a preview
+func downsampleFrames(images []image.Image, factor int) []image.Image {
+	small := make([]image.Image, len(images))
+	for i, img := range images {
+		b := img.Bounds()
+		dst := image.NewRGBA(image.Rect(0, 0, max(b.Dx()/factor, 1), max(b.Dy()/factor, 1)))
+		draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+		small[i] = dst
+	}
+	return small
+}
+
+// previewNotice tells the viewer of a preview's result page how to run the full job
+func previewNotice(r *http.Request, opts processOptions) string {
+	if !opts.Preview {
+		return ""
+	}
+	return `<div class="alert alert-info">` + trf(r, "This is a quick preview at 1/%d of the resolution and is not kept. Go back to the upload page and submit the same images to run the full job.", previewDownsample) + `</div>`
+}
@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+// processAlive cannot tell on this platform, so directories of other processes are kept
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// processAlive reports whether a process with the given ID is running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid) // Opens a handle, which fails for processes that are gone
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
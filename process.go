@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Ways processCommand splits an input directory into bursts
+const (
+	groupByFolder = "folder" // Each subfolder is a burst
+	groupByPrefix = "prefix" // Files named alike but for a trailing number are a burst
+	groupByTime   = "time"   // Files modified within -gap of the previous one are a burst
+	groupByNone   = "none"   // All the files are one burst
+)
+
+// burstGroup is one burst of a batch: the frames and the name of its result
+type burstGroup struct {
+	name   string
+	frames []string
+}
+
+// processCommand processes one burst given as files, or every burst of an
+// input directory, going on past bursts that fail
+func processCommand(args []string) int {
+	fs := flag.NewFlagSet("process", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %[1]s process -output <file> [flags] <frame>...\n       %[1]s process -output - [flags] - < frames\n       %[1]s process -input-dir <dir> [-group-by folder|prefix|time|none] [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "", "result file of the frames given as arguments, or - for standard output; its extension picks the format unless -format is set. The frame - reads a tar archive or concatenated images from standard input")
+	inputDir := fs.String("input-dir", "", "directory of bursts to process in one run")
+	outputDir := fs.String("output-dir", "", "directory the results of -input-dir are written to, named by -name (default the input directory)")
+	name := nameTemplateFlag(fs)
+	groupBy := fs.String("group-by", groupByFolder, "how -input-dir is split into bursts: folder (each subfolder), prefix (file names alike but for a trailing number), time (files modified within -gap of each other) or none (all files)")
+	gap := fs.Duration("gap", 2*time.Second, "longest pause between the modification times of two frames of one burst, for -group-by time")
+	dryRun := fs.Bool("dry-run", false, "check the frames and options and print what each burst would be processed with, without processing")
+	manifest := fs.Bool("manifest", false, "write <result>-manifest.json beside every result, with the SHA-256 of the frames and of the result, the parameters and the versions it was made with, for the verify command; implies -deterministic")
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	req := pipelineFlags(fs)
+	clip := videoFlags(fs)
+	loadCalibration := calibrationFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if (*inputDir == "") == (fs.NArg() == 0) || (*inputDir == "" && *output == "") {
+		fs.Usage()
+		return exitBadInput
+	}
+	if *manifest {
+		if *output == stdioPath || slices.Contains(fs.Args(), stdioPath) {
+			fmt.Fprintln(os.Stderr, "-manifest needs the frames and the result in files, not standard input or output")
+			return exitBadInput
+		}
+		req.Deterministic = true
+	}
+
+	var groups []burstGroup
+	resultPath := func(g burstGroup, opts processOptions, frames int) string { return *output }
+	if *inputDir != "" {
+		if err := checkNameTemplate(*name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitBadInput
+		}
+		var err error
+		if groups, err = groupBursts(*inputDir, *groupBy, *gap); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitBadInput
+		}
+		if len(groups) == 0 {
+			fmt.Fprintf(os.Stderr, "No bursts found in %s with -group-by %s\n", *inputDir, *groupBy)
+			return exitBadInput
+		}
+		if *outputDir == "" {
+			*outputDir = *inputDir
+		}
+		if err := os.MkdirAll(*outputDir, 0o755); err != nil && !*dryRun {
+			fmt.Fprintln(os.Stderr, err)
+			return exitInternal
+		}
+		resultPath = func(g burstGroup, opts processOptions, frames int) string {
+			return resultFileName(*outputDir, *name, g.name, frames, opts)
+		}
+	} else {
+		if req.Format == "" {
+			req.Format = extensionFormat(*output) // Ahead of a preset, which could pick another
+		}
+		groups = []burstGroup{{name: strings.TrimSuffix(filepath.Base(*output), filepath.Ext(*output)), frames: fs.Args()}}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *dryRun {
+		return planBursts(ctx, groups, *clip, *req, jsonEvents(false), resultPath)
+	}
+
+	cal, err := loadCalibration(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	events := jsonEvents(*output == stdioPath)
+	failed, code := 0, exitOK
+	for _, g := range groups {
+		start := time.Now()
+		run, err := runBurst(ctx, g.frames, *clip, cal, *req, events, g.name, func(opts processOptions, n int) string { return resultPath(g, opts, n) })
+		if errors.Is(err, context.Canceled) {
+			events.emit("canceled", g.name, nil)
+			return exitInterrupted
+		}
+		if err != nil {
+			failed++
+			if code == exitOK {
+				code = exitCode(err)
+			}
+			slog.Error("Error processing burst", "burst", g.name, "frames", len(g.frames), "error", err)
+			events.emit("error", g.name, map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+			continue
+		}
+		if *manifest {
+			path := manifestPath(run.path)
+			if err := writeManifest(path, g.frames, *clip, cal, *req, run); err != nil {
+				failed++
+				if code == exitOK {
+					code = exitInternal
+				}
+				slog.Error("Error writing manifest", "burst", g.name, "manifest", path, "error", err)
+				events.emit("error", g.name, map[string]any{"error": err.Error(), "exit_code": exitInternal})
+				continue
+			}
+			if run.result != nil {
+				run.result["manifest_path"] = path
+			}
+		}
+		slog.Info("Burst processed", "burst", g.name, "frames", run.frames, "result", run.path, "duration", time.Since(start).Round(time.Millisecond))
+		events.emit("result", g.name, run.result)
+	}
+	if len(groups) > 1 {
+		slog.Info("Batch finished", "bursts", len(groups), "failed", failed)
+	}
+	events.emit("summary", "", map[string]any{"bursts": len(groups), "failed": failed, "exit_code": code})
+	return code // That of the first burst that failed
+}
+
+// planBursts checks every burst for -dry-run and prints the options it would be
+// processed with and where its result would go, as text or as plan events
+func planBursts(ctx context.Context, groups []burstGroup, clip videoClip, req superResolutionRequestV1, events *commandEvents, resultPath func(g burstGroup, opts processOptions, frames int) string) int {
+	code := exitOK
+	for _, g := range groups {
+		sizes, err := frameSizes(ctx, g.frames, clip)
+		var opts processOptions
+		if err == nil {
+			opts, err = checkBurst(sizes, frameNames(g.frames, len(sizes)), req)
+		}
+		if err != nil {
+			if code == exitOK {
+				code = exitCode(err)
+			}
+			if events == nil {
+				fmt.Printf("%s: %v\n", g.name, err)
+			}
+			events.emit("error", g.name, map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+			continue
+		}
+		size := fittedSize(sizes, opts.Reference, opts.Fit)
+		plan := map[string]any{
+			"frames":    len(sizes),
+			"width":     size.X * opts.Scale,
+			"height":    size.Y * opts.Scale,
+			"scale":     opts.Scale,
+			"algorithm": opts.Algorithm,
+			"kernel":    opts.Kernel,
+			"format":    opts.Format,
+			"reference": opts.Reference,
+			"denoise":   opts.Denoise,
+			"sharpen":   opts.Sharpen,
+			"path":      resultPath(g, opts, len(sizes)),
+		}
+		if opts.Format == formatJPEG {
+			plan["quality"] = opts.Quality
+		}
+		if events != nil {
+			events.emit("plan", g.name, plan)
+			continue
+		}
+		format := opts.Format
+		if opts.Format == formatJPEG {
+			format = fmt.Sprintf("%s quality %d", opts.Format, opts.Quality)
+		}
+		fmt.Printf("%s: %d frames of %dx%d, reference %d -> %dx%d at scale %d, %s fusion, %s kernel, %s, denoise %d, sharpen %d -> %s\n",
+			g.name, len(sizes), size.X, size.Y, opts.Reference, size.X*opts.Scale, size.Y*opts.Scale, opts.Scale,
+			opts.Algorithm, opts.Kernel, format, opts.Denoise, opts.Sharpen, plan["path"])
+	}
+	return code
+}
+
+// groupBursts splits the frames of dir into bursts named after their folder,
+// file name prefix or first frame
+func groupBursts(dir, groupBy string, gap time.Duration) ([]burstGroup, error) {
+	if groupBy == groupByFolder {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var groups []burstGroup
+		for _, e := range entries {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			frames, err := burstFrames(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if len(frames) > 0 {
+				groups = append(groups, burstGroup{name: e.Name(), frames: frames})
+			}
+		}
+		return groups, nil
+	}
+
+	frames, err := burstFrames(dir)
+	if err != nil || len(frames) == 0 {
+		return nil, err
+	}
+	switch groupBy {
+	case groupByNone:
+		return []burstGroup{{name: filepath.Base(filepath.Clean(dir)), frames: frames}}, nil
+	case groupByPrefix:
+		var groups []burstGroup
+		for _, frame := range frames { // In name order, so a prefix's frames are adjacent
+			prefix := framePrefix(filepath.Base(frame))
+			if n := len(groups); n > 0 && groups[n-1].name == prefix {
+				groups[n-1].frames = append(groups[n-1].frames, frame)
+				continue
+			}
+			groups = append(groups, burstGroup{name: prefix, frames: []string{frame}})
+		}
+		return groups, nil
+	case groupByTime:
+		type timedFrame struct {
+			path     string
+			modified time.Time
+		}
+		timed := make([]timedFrame, len(frames))
+		for i, frame := range frames {
+			info, err := os.Stat(frame)
+			if err != nil {
+				return nil, err
+			}
+			timed[i] = timedFrame{frame, info.ModTime()}
+		}
+		slices.SortStableFunc(timed, func(a, b timedFrame) int { return a.modified.Compare(b.modified) })
+		var groups []burstGroup
+		for i, f := range timed {
+			if i == 0 || f.modified.Sub(timed[i-1].modified) > gap {
+				name := strings.TrimSuffix(filepath.Base(f.path), filepath.Ext(f.path))
+				groups = append(groups, burstGroup{name: name})
+			}
+			groups[len(groups)-1].frames = append(groups[len(groups)-1].frames, f.path)
+		}
+		return groups, nil
+	}
+	return nil, fmt.Errorf("-group-by must be %s, %s, %s or %s, got %q", groupByFolder, groupByPrefix, groupByTime, groupByNone, groupBy)
+}
+
+// framePrefix returns a frame's file name without its extension, trailing number
+// and the separators before it: IMG_0042.jpg and IMG_0043.jpg share IMG
+func framePrefix(name string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	prefix := strings.TrimRight(stem, "0123456789")
+	prefix = strings.TrimRight(prefix, "_-. ")
+	if prefix == "" {
+		return stem // A name that is only a number has no prefix to share
+	}
+	return prefix
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	_ "embed" // Required for embedding
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//go:embed static/progress.js
+var progressJS string
+
+// Stages of a running job that report per-frame progress, in the order they run
+var progressStages = []string{"align", "fuse"}
+
+// jobProgress is how far a running job has come through its current stage
+type jobProgress struct {
+	Stage        string    `json:"stage"`
+	Done         int       `json:"done"`  // Frames finished in this stage
+	Total        int       `json:"total"` // Frames this stage handles
+	StageStarted time.Time `json:"stage_started"`
+}
+
+// frameThroughput remembers the recent seconds per frame of every stage, to
+// estimate stages a job has not reached yet
+var frameThroughput = struct {
+	mu       sync.Mutex
+	perFrame map[string]float64
+}{perFrame: make(map[string]float64)}
+
+// recordThroughput folds the per-frame time of a finished stage into the
+// running estimate, weighting recent jobs more
+func recordThroughput(stage string, elapsed time.Duration, frames int) {
+	if frames <= 0 {
+		return
+	}
+	seconds := elapsed.Seconds() / float64(frames)
+	frameThroughput.mu.Lock()
+	defer frameThroughput.mu.Unlock()
+	if previous, ok := frameThroughput.perFrame[stage]; ok {
+		seconds = 0.7*seconds + 0.3*previous
+	}
+	frameThroughput.perFrame[stage] = seconds
+}
+
+// setProgress records that a job has finished done of total frames in stage
+func (m *jobManager) setProgress(id, stage string, done, total int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return
+	}
+	// Copies of the job share the old record, so it is replaced rather than changed
+	p := jobProgress{Stage: stage, Done: done, Total: total, StageStarted: time.Now()}
+	if j.Progress != nil && j.Progress.Stage == stage {
+		p.StageStarted = j.Progress.StageStarted
+	}
+	j.Progress = &p
+	if done == total {
+		recordThroughput(stage, time.Since(p.StageStarted), total)
+	}
+}
+
+// progressFuncContextKey keys the function withProgressFunc stores in a context
+type progressFuncContextKey struct{}
+
+// withProgressFunc returns a context whose progress reports are also passed to
+// fn, for commands that run the pipeline outside a job; fn must be safe for
+// concurrent use
+func withProgressFunc(ctx context.Context, fn func(stage string, done, total int)) context.Context {
+	return context.WithValue(ctx, progressFuncContextKey{}, fn)
+}
+
+// reportProgress records the progress of the job running in ctx, if any
+func reportProgress(ctx context.Context, stage string, done, total int) {
+	if id := jobIDFromContext(ctx); id != "" {
+		jobs.setProgress(id, stage, done, total)
+	}
+	if fn, ok := ctx.Value(progressFuncContextKey{}).(func(stage string, done, total int)); ok {
+		fn(stage, done, total)
+	}
+}
+
+// byRequestID returns a copy of the job submitted by the request with the given ID
+func (m *jobManager) byRequestID(requestID string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.order) - 1; i >= 0; i-- {
+		if j := m.jobs[m.order[i]]; j.RequestID == requestID {
+			return *j, true
+		}
+	}
+	return job{}, false
+}
+
+// estimatedRemaining estimates how long a running job still needs: its current
+// stage at the pace measured so far, later stages at the pace of recent jobs
+func estimatedRemaining(j job) (time.Duration, bool) {
+	p := j.Progress
+	if j.Status != jobRunning || p == nil {
+		return 0, false
+	}
+	frameThroughput.mu.Lock()
+	defer frameThroughput.mu.Unlock()
+
+	var seconds float64
+	later := false
+	for _, stage := range progressStages {
+		switch {
+		case stage == p.Stage:
+			perFrame, known := frameThroughput.perFrame[stage]
+			if p.Done > 0 {
+				perFrame, known = time.Since(p.StageStarted).Seconds()/float64(p.Done), true
+			}
+			if !known {
+				return 0, false
+			}
+			seconds += perFrame * float64(p.Total-p.Done)
+			later = true
+		case later:
+			perFrame, known := frameThroughput.perFrame[stage]
+			if !known {
+				return 0, false
+			}
+			seconds += perFrame * float64(j.Frames)
+		}
+	}
+	return time.Duration(math.Ceil(seconds)) * time.Second, true
+}
+
+// progressResponse is the progress document of a job
+func progressResponse(j job) map[string]any {
+	response := map[string]any{
+		"job_id": j.ID,
+		"status": j.Status,
+		"frames": j.Frames,
+	}
+	if j.Progress != nil && j.Status == jobRunning {
+		response["stage"] = j.Progress.Stage
+		response["done"] = j.Progress.Done
+		response["total"] = j.Progress.Total
+		response["elapsed_seconds"] = math.Round(time.Since(j.Started).Seconds())
+	}
+	if j.Status == jobQueued {
+		response["queue_position"] = jobs.queuePosition(j.ID)
+	}
+	if eta, ok := estimatedRemaining(j); ok {
+		response["eta_seconds"] = eta.Seconds()
+	}
+	return response
+}
+
+// queuePosition returns how many jobs wait ahead of a queued one, plus one
+func (m *jobManager) queuePosition(id string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	position := 1
+	for _, other := range m.order {
+		if other == id {
+			return position
+		}
+		if m.jobs[other].Status == jobQueued {
+			position++
+		}
+	}
+	return position
+}
+
+// progressHandler reports the progress of the caller's upload form submission,
+// found by the request ID the page sent with it since the job ID is only
+// returned with the result
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	j, ok := jobs.byRequestID(r.PathValue("request"))
+	if !ok || j.Owner != requestOwner(r) {
+		// Not queued yet while the upload is still being read
+		writeJSON(w, http.StatusOK, map[string]any{"status": "uploading"})
+		return
+	}
+	writeJSON(w, http.StatusOK, progressResponse(j))
+}
+
+// apiV1JobProgressHandler reports the stage, frame counts and estimated time
+// remaining of one of the caller's jobs
+func apiV1JobProgressHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	j, ok := visibleJob(r)
+	if !ok {
+		writeAPIErrorV1(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No job with this ID"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, progressResponse(j))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed" // Required for embedding
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+//go:embed static/sw.js
+var serviceWorkerJS string
+
+// appVersion identifies the page assets, so an upgraded server replaces the pages
+// the service worker keeps instead of mixing them with the new scripts
+var appVersion = sync.OnceValue(func() string {
+	sum := sha256.New()
+	for _, asset := range []string{bootstrapCSS, uploadJS, progressJS, captureJS, offlineJS, workflowJS, i18nJS, serviceWorkerJS} {
+		sum.Write([]byte(asset))
+	}
+	return hex.EncodeToString(sum.Sum(nil))[:8]
+})
+
+// appIconSizes are the sizes of the app icons, in pixels
+var appIconSizes = []int{192, 512}
+
+// appHead renders the links to the web manifest and icons and registers the
+// service worker, which lets phones install the web UI and open it offline
+func appHead() string {
+	return fmt.Sprintf(`<link rel="manifest" href="%s"><meta name="theme-color" content="%s"><link rel="apple-touch-icon" href="%s">`,
+		config.url("/manifest.webmanifest"), themeColor(), config.url("/icon-192.png")) +
+		fmt.Sprintf(`<script>if ('serviceWorker' in navigator) { navigator.serviceWorker.register('%s?v=%s', {scope: '%s'}).catch(function () {}); }</script>`,
+			config.url("/sw.js"), appVersion(), config.url("/"))
+}
+
+// serviceWorkerHandler serves the service worker. Browsers check it for updates
+// on every visit, so it must not be cached.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(serviceWorkerJS))
+}
+
+// manifestHandler serves the web manifest describing the installed app
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	type manifestIcon struct {
+		Src     string `json:"src"`
+		Sizes   string `json:"sizes"`
+		Type    string `json:"type"`
+		Purpose string `json:"purpose"`
+	}
+	type manifestShortcut struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	var icons []manifestIcon
+	for _, size := range appIconSizes {
+		icons = append(icons, manifestIcon{
+			Src:     config.url(fmt.Sprintf("/icon-%d.png", size)),
+			Sizes:   fmt.Sprintf("%dx%d", size, size),
+			Type:    "image/png",
+			Purpose: "any maskable",
+		})
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Name            string             `json:"name"`
+		ShortName       string             `json:"short_name"`
+		Lang            string             `json:"lang"`
+		StartURL        string             `json:"start_url"`
+		Scope           string             `json:"scope"`
+		Display         string             `json:"display"`
+		ThemeColor      string             `json:"theme_color"`
+		BackgroundColor string             `json:"background_color"`
+		Icons           []manifestIcon     `json:"icons"`
+		Shortcuts       []manifestShortcut `json:"shortcuts"`
+	}{
+		Name:            tr(r, "Super Resolution Tool"),
+		ShortName:       tr(r, "Super Resolution"),
+		Lang:            requestLocale(r),
+		StartURL:        config.url("/"),
+		Scope:           config.url("/"),
+		Display:         "standalone",
+		ThemeColor:      themeColor(),
+		BackgroundColor: themeColor(),
+		Icons:           icons,
+		Shortcuts:       []manifestShortcut{{Name: tr(r, "Capture a Burst"), URL: config.url("/capture")}},
+	})
+}
+
+// appIconHandler serves the app icon of a size, drawn once
+func appIconHandler(size int) http.HandlerFunc {
+	encoded := sync.OnceValues(func() ([]byte, error) {
+		var buf bytes.Buffer
+		err := png.Encode(&buf, appIcon(size))
+		return buf.Bytes(), err
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := encoded()
+		if err != nil {
+			writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Could not draw the icon"})
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		_, _ = w.Write(data)
+	}
+}
+
+// appIcon draws the app icon: a square of the theme colour with a 4x4 mosaic of
+// white pixels, fading in towards one corner like detail emerging from a blur.
+// The mosaic stays within the middle 60%, the safe zone of maskable icons.
+func appIcon(size int) image.Image {
+	red, green, blue := colorChannels(themeColor())
+	background := color.RGBA{R: red, G: green, B: blue, A: 255}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+	const cells = 4
+	margin, cell := size/5, size*3/5/cells
+	gap := max(1, cell/10)
+	for row := range cells {
+		for col := range cells {
+			alpha := float64(row+col+2) / (2 * cells) // 0.25 in one corner to 1 in the other
+			shade := color.RGBA{
+				R: uint8(float64(background.R) + alpha*float64(255-int(background.R))),
+				G: uint8(float64(background.G) + alpha*float64(255-int(background.G))),
+				B: uint8(float64(background.B) + alpha*float64(255-int(background.B))),
+				A: 255,
+			}
+			x0, y0 := margin+col*cell+gap, margin+row*cell+gap
+			for y := y0; y < y0+cell-2*gap; y++ {
+				for x := x0; x < x0+cell-2*gap; x++ {
+					img.SetRGBA(x, y, shade)
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With -queue-redis, jobs wait in a Redis list that every instance of the server
+// takes jobs from, so replicas behind a load balancer share one queue. The
+// frames of a job are staged in the object store of -s3-bucket; the instance
+// that runs it leaves the unfiltered result there for the instance that took
+// the request, which renders and delivers it as if it had processed it itself.
+
+// Keys of the shared queue in Redis
+const (
+	redisQueueKey  = "chicha-sr:queue"        // List of queued tasks, pushed on the left and taken from the right
+	redisStateKey  = "chicha-sr:task:"        // + task ID: taskState of a task taken up by a worker
+	redisWaiterKey = "chicha-sr:task-waiter:" // + task ID: present while the submitting instance waits for the result
+)
+
+const (
+	taskHeartbeat = 5 * time.Second  // How often the waiter and the runner of a task show they are still there
+	taskAbsence   = 30 * time.Second // How long either may go unheard of before the other gives up on the task
+	taskStateTTL  = time.Hour        // How long the outcome of a task is kept for its waiter
+)
+
+var (
+	// errTaskAbandoned cancels tasks whose submitting instance stopped waiting
+	errTaskAbandoned = errors.New("the instance that took the request stopped waiting for the result")
+	// errTaskLost fails jobs whose running instance went away
+	errTaskLost = errors.New("the instance running the job stopped")
+)
+
+// Keys under which the object store keeps the frames and result of a queued task
+func taskFrameKey(id string, i int) string { return fmt.Sprintf("queue/%s/frame-%03d.png", id, i) }
+func taskResultKey(id string) string       { return "queue/" + id + "/result.png" }
+func taskReportKey(id string) string       { return "queue/" + id + "/result.json" }
+
+// fusionTask is the processing of a job in a form any instance can run: the
+// options it needs and where its frames are
+type fusionTask struct {
+	ID        string         `json:"id"`
+	JobID     string         `json:"job_id"`
+	RequestID string         `json:"request_id,omitempty"`
+	Frames    int            `json:"frames"` // Staged as frame-000.png onwards, the reference first
+	Offsets   []*frameOffset `json:"offsets,omitempty"`
+	Scale     int            `json:"scale"`
+	Algorithm string         `json:"algorithm"`
+	Kernel    string         `json:"kernel"`
+	Preview   bool           `json:"preview,omitempty"`
+
+	Deinterlace  bool   `json:"deinterlace,omitempty"`
+	MaskOverlays bool   `json:"mask_overlays,omitempty"`
+	Align        string `json:"align,omitempty"`
+	Thermal      bool   `json:"thermal,omitempty"` // The result is staged as the fused 16-bit counts
+	Mono16       bool   `json:"mono16,omitempty"`  // So is that of frames kept at 16 bits
+	Film         bool   `json:"film,omitempty"`
+	Deghost      bool   `json:"deghost,omitempty"`
+	Adaptive     bool   `json:"adaptive,omitempty"`
+	LumaOnly     bool   `json:"luma_only,omitempty"`
+	Tonemap      string `json:"tonemap,omitempty"`
+}
+
+// taskState is what the instance running a task reports about it
+type taskState struct {
+	Status   jobStatus    `json:"status"` // Running until it ends done, failed or canceled
+	Started  time.Time    `json:"started"`
+	Progress *jobProgress `json:"progress,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// taskReport is the part of a task's outcome besides the result image
+type taskReport struct {
+	Shifts     []image.Point   `json:"shifts"`
+	Assessment burstAssessment `json:"assessment"`
+	Denoise    int             `json:"denoise,omitempty"` // Strength the noise left in the result calls for, with adaptive
+}
+
+// options returns the pipeline options the task runs with
+func (t *fusionTask) options() processOptions {
+	return processOptions{Scale: t.Scale, Algorithm: t.Algorithm, Kernel: t.Kernel, Preview: t.Preview, Offsets: t.Offsets,
+		Deinterlace: t.Deinterlace, MaskOverlays: t.MaskOverlays, Align: t.Align, Thermal: t.Thermal, Mono16: t.Mono16, Film: t.Film, Deghost: t.Deghost, Adaptive: t.Adaptive, LumaOnly: t.LumaOnly, Tonemap: t.Tonemap}
+}
+
+// stageFusionTask stores the frames of a job, prepared for the pipeline, in the
+// object store so whichever instance takes the job up can run it
+func stageFusionTask(ctx context.Context, images []image.Image, opts processOptions) (*fusionTask, error) {
+	t := &fusionTask{ID: newJobID(), Frames: len(images), Offsets: opts.Offsets, Scale: opts.Scale, Algorithm: opts.Algorithm, Kernel: opts.Kernel, Preview: opts.Preview,
+		Deinterlace: opts.Deinterlace, MaskOverlays: opts.MaskOverlays, Align: opts.Align, Thermal: opts.Thermal, Mono16: opts.Mono16, Film: opts.Film, Deghost: opts.Deghost, Adaptive: opts.Adaptive, LumaOnly: opts.LumaOnly, Tonemap: opts.Tonemap}
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	for i, img := range images {
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		if err := sharedStore.put(ctx, taskFrameKey(t.ID, i), &buf, int64(buf.Len())); err != nil {
+			t.remove(ctx)
+			return nil, fmt.Errorf("staging frame %d: %w", i, err)
+		}
+	}
+	return t, nil
+}
+
+// remove deletes what the object store keeps for the task
+func (t *fusionTask) remove(ctx context.Context) {
+	keys := []string{taskResultKey(t.ID), taskReportKey(t.ID)}
+	for i := range t.Frames {
+		keys = append(keys, taskFrameKey(t.ID, i))
+	}
+	for _, key := range keys {
+		if err := sharedStore.remove(ctx, key); err != nil {
+			slog.WarnContext(ctx, "Error removing queued task data", "key", key, "error", err)
+		}
+	}
+}
+
+// run processes the staged frames and leaves the outcome in the object store
+func (t *fusionTask) run(ctx context.Context) error {
+	images := make([]image.Image, t.Frames)
+	for i := range images {
+		body, err := sharedStore.get(ctx, taskFrameKey(t.ID, i))
+		if err != nil {
+			return fmt.Errorf("fetching frame %d: %w", i, err)
+		}
+		images[i], err = png.Decode(body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding frame %d: %w", i, err)
+		}
+	}
+	acc, assessment, err := fuseFrames(ctx, images, t.options())
+	if err != nil {
+		return err
+	}
+	// The accumulation is handed over unfiltered: the submitting instance applies
+	// the options that only concern the output
+	var result image.Image = acc.renderRows(0, acc.height)
+	if acc.radiometric {
+		result = acc.radiometricRows(0, acc.height) // PNG holds 16-bit gray as it is
+	}
+	report := taskReport{Shifts: acc.shifts, Assessment: assessment, Denoise: acc.denoise}
+	acc.release()
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buf, result); err != nil {
+		return err
+	}
+	if err := sharedStore.put(ctx, taskResultKey(t.ID), &buf, int64(buf.Len())); err != nil {
+		return fmt.Errorf("storing the result: %w", err)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return sharedStore.put(ctx, taskReportKey(t.ID), bytes.NewReader(data), int64(len(data)))
+}
+
+// result fetches the outcome of a task another instance ran as an accumulator,
+// as if the frames had been fused here
+func (t *fusionTask) result(ctx context.Context) (*fusionAccumulator, burstAssessment, error) {
+	var report taskReport
+	body, err := sharedStore.get(ctx, taskReportKey(t.ID))
+	if err != nil {
+		return nil, report.Assessment, fmt.Errorf("fetching the result: %w", err)
+	}
+	err = json.NewDecoder(body).Decode(&report)
+	body.Close()
+	if err != nil {
+		return nil, report.Assessment, fmt.Errorf("reading the result: %w", err)
+	}
+	body, err = sharedStore.get(ctx, taskResultKey(t.ID))
+	if err != nil {
+		return nil, report.Assessment, fmt.Errorf("fetching the result: %w", err)
+	}
+	img, err := png.Decode(body)
+	body.Close()
+	if err != nil {
+		return nil, report.Assessment, fmt.Errorf("decoding the result: %w", err)
+	}
+	var acc *fusionAccumulator
+	if t.Thermal || t.Mono16 {
+		acc = radiometricAccumulator(img, t.options().radiometricPalette(), t.Tonemap)
+	} else {
+		acc = accumulatorFromImage(img)
+	}
+	acc.shifts = report.Shifts
+	acc.denoise = report.Denoise
+	metrics.accumulatorBytes.Add(acc.bytes())
+	jobs.recordMemory(jobIDFromContext(ctx), acc.bytes())
+	return acc, report.Assessment, nil
+}
+
+// accumulatorFromImage holds img as an accumulation of one frame, which renders
+// back to the same pixels
+func accumulatorFromImage(img image.Image) *fusionAccumulator {
+	bounds := img.Bounds()
+	acc := &fusionAccumulator{
+		width:   bounds.Dx(),
+		height:  bounds.Dy(),
+		accR:    make([][]float64, bounds.Dy()),
+		accG:    make([][]float64, bounds.Dy()),
+		accB:    make([][]float64, bounds.Dy()),
+		weights: make([][]float64, bounds.Dy()),
+	}
+	for y := range acc.height {
+		acc.accR[y] = make([]float64, acc.width)
+		acc.accG[y] = make([]float64, acc.width)
+		acc.accB[y] = make([]float64, acc.width)
+		acc.weights[y] = make([]float64, acc.width)
+		for x := range acc.width {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			acc.accR[y][x], acc.accG[y][x], acc.accB[y][x] = float64(r>>8), float64(g>>8), float64(b>>8)
+			acc.weights[y][x] = 1
+		}
+	}
+	return acc
+}
+
+// newJobQueue returns the queue configured with -queue-redis, or one of this instance alone
+func newJobQueue() (jobQueue, error) {
+	if config.QueueRedis == "" {
+		return make(memoryQueue, config.QueueSize), nil
+	}
+	q, err := newRedisQueue(config.QueueRedis, config.QueueSize)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Sharing the job queue through Redis", "address", q.redis.addr)
+	return q, nil
+}
+
+// redisQueue is a jobQueue in Redis shared by every instance configured with it
+type redisQueue struct {
+	redis    *redisClient
+	size     int // Tasks allowed to wait, across all instances
+	stopping atomic.Bool
+}
+
+// newRedisQueue connects to the Redis server at rawURL
+func newRedisQueue(rawURL string, size int) (*redisQueue, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.do(context.Background(), "PING"); err != nil {
+		return nil, err
+	}
+	return &redisQueue{redis: client, size: size}, nil
+}
+
+func (q *redisQueue) capacity() int { return q.size }
+func (q *redisQueue) stop()         { q.stopping.Store(true) }
+
+// push queues the task of j in Redis and follows it until an instance has run it
+func (q *redisQueue) push(j *job) error {
+	if j.task == nil {
+		return fmt.Errorf("job %s cannot be queued for other instances", j.ID)
+	}
+	ctx, cancel := context.WithTimeout(j.ctx, redisDialTimeout)
+	defer cancel()
+	queued, err := q.redis.do(ctx, "LLEN", redisQueueKey)
+	if err != nil {
+		return err
+	}
+	if n, _ := queued.(int64); n >= int64(q.size) {
+		return errQueueFull
+	}
+	j.task.JobID, j.task.RequestID = j.ID, j.RequestID
+	data, err := json.Marshal(j.task)
+	if err != nil {
+		return err
+	}
+	if _, err := q.redis.do(ctx, "SET", redisWaiterKey+j.task.ID, "1", "EX", strconv.Itoa(int(taskAbsence.Seconds()))); err != nil {
+		return err
+	}
+	if _, err := q.redis.do(ctx, "LPUSH", redisQueueKey, string(data)); err != nil {
+		return err
+	}
+	go q.await(j)
+	return nil
+}
+
+// await follows the task of a job submitted here until it ends, mirroring its
+// state into the job, and fetches the result through the job's work once done
+func (q *redisQueue) await(j *job) {
+	ctx, task := j.ctx, j.task // Released when the job completes
+	id := task.ID
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer func() {
+		// A task dropped while queued is skipped, and one running is canceled, once its waiter is gone
+		ctx := context.WithoutCancel(ctx)
+		if _, err := q.redis.do(ctx, "DEL", redisWaiterKey+id, redisStateKey+id); err != nil {
+			slog.WarnContext(ctx, "Error removing the state of a queued task", "job_id", j.ID, "error", err)
+		}
+		task.remove(ctx)
+	}()
+	lastHeartbeat := time.Now()
+	started := false
+	for {
+		select {
+		case <-ctx.Done():
+			jobs.complete(j, context.Cause(ctx))
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(lastHeartbeat) >= taskHeartbeat {
+			if _, err := q.redis.do(ctx, "SET", redisWaiterKey+id, "1", "EX", strconv.Itoa(int(taskAbsence.Seconds()))); err == nil {
+				lastHeartbeat = time.Now()
+			}
+		}
+		reply, err := q.redis.do(ctx, "GET", redisStateKey+id)
+		if errors.Is(err, errRedisNil) {
+			if started {
+				jobs.complete(j, errTaskLost)
+				return
+			}
+			continue // Still queued
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Error checking a queued task", "job_id", j.ID, "error", err)
+			continue
+		}
+		var state taskState
+		if s, _ := reply.(string); json.Unmarshal([]byte(s), &state) != nil {
+			continue
+		}
+		started = true
+		switch state.Status {
+		case jobRunning:
+			jobs.mirror(j.ID, state.Started, state.Progress)
+		case jobDone:
+			jobs.mirror(j.ID, state.Started, nil)
+			jobs.complete(j, runRecovered(j)) // Fetches the result
+			return
+		default:
+			jobs.complete(j, errors.New(state.Error))
+			return
+		}
+	}
+}
+
+// pop takes the next task whose submitting instance is still waiting and
+// returns a job that runs it on this instance
+func (q *redisQueue) pop(ctx context.Context) (*job, error) {
+	for {
+		if q.stopping.Load() {
+			return nil, errDraining // The tasks left are for the instances that keep running
+		}
+		reply, err := q.redis.do(ctx, "BRPOP", redisQueueKey, "2")
+		if errors.Is(err, errRedisNil) {
+			continue // Nothing queued within the timeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		items, _ := reply.([]any) // The list's key and the task
+		if len(items) != 2 {
+			continue
+		}
+		data, _ := items[1].(string)
+		var t fusionTask
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			slog.Error("Dropping an unreadable queued task", "error", err)
+			continue
+		}
+		if waiting, err := q.redis.do(ctx, "EXISTS", redisWaiterKey+t.ID); err == nil && waiting == int64(0) {
+			slog.Info("Dropping a queued task nobody waits for any more", "job_id", t.JobID, "request_id", t.RequestID)
+			t.remove(ctx)
+			continue
+		}
+
+		j := &job{ID: t.JobID, RequestID: t.RequestID, Frames: t.Frames, Scale: t.Scale, Algorithm: t.Algorithm, Kernel: t.Kernel, Preview: t.Preview, task: &t, done: make(chan struct{})}
+		j.ctx, j.cancel = context.WithCancelCause(context.Background())
+		j.work = func(ctx context.Context) error { return q.runTask(ctx, j) }
+		jobs.inflight.Add(1) // Finished by run like the jobs submitted here
+		return j, nil
+	}
+}
+
+// runTask runs the task of a job taken from the queue, reporting its state to
+// the waiting instance and stopping when that instance gives up
+func (q *redisQueue) runTask(ctx context.Context, j *job) (err error) {
+	t, cancel := j.task, j.cancel // Released when the job finishes, maybe before the heartbeat stops
+	state := taskState{Status: jobRunning, Started: time.Now()}
+	var mu sync.Mutex
+	publish := func(ctx context.Context, ttl time.Duration) {
+		mu.Lock()
+		data, _ := json.Marshal(state)
+		mu.Unlock()
+		if _, err := q.redis.do(ctx, "SET", redisStateKey+t.ID, string(data), "EX", strconv.Itoa(int(ttl.Seconds()))); err != nil {
+			slog.WarnContext(ctx, "Error reporting the state of a queued task", "error", err)
+		}
+	}
+	ctx = withProgressFunc(ctx, func(stage string, done, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		p := jobProgress{Stage: stage, Done: done, Total: total, StageStarted: time.Now()}
+		if state.Progress != nil && state.Progress.Stage == stage {
+			p.StageStarted = state.Progress.StageStarted
+		}
+		state.Progress = &p
+	})
+	publish(ctx, taskAbsence)
+
+	// Keep the state fresh and watch for the waiter giving up
+	heartbeat := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(taskHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeat:
+				return
+			case <-ticker.C:
+			}
+			publish(ctx, taskAbsence)
+			if waiting, err := q.redis.do(ctx, "EXISTS", redisWaiterKey+t.ID); err == nil && waiting == int64(0) {
+				cancel(errTaskAbandoned)
+			}
+		}
+	}()
+
+	final := context.WithoutCancel(ctx)
+	defer func() {
+		close(heartbeat)
+		p := recover()
+		mu.Lock()
+		switch {
+		case p != nil:
+			state.Status, state.Error = jobFailed, fmt.Sprintf("internal error: %v", p)
+		case err != nil && ctx.Err() != nil:
+			state.Status, state.Error = jobCanceled, context.Cause(ctx).Error()
+		case err != nil:
+			state.Status, state.Error = jobFailed, err.Error()
+		default:
+			state.Status = jobDone
+		}
+		mu.Unlock()
+		publish(final, taskStateTTL)
+		if p != nil {
+			panic(p) // Reported by runRecovered
+		}
+	}()
+	return t.run(ctx)
+}
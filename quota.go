@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// quotaWindow is the rolling period compute quotas are measured over
+const quotaWindow = 24 * time.Hour
+
+// usageReport is an account's consumption against its quotas; zero limits mean unlimited
+type usageReport struct {
+	StorageBytes        int64   `json:"storage_bytes"`
+	StorageLimitBytes   int64   `json:"storage_limit_bytes"`
+	ComputeSeconds      float64 `json:"compute_seconds"` // Processing time of jobs finished in the last 24 hours
+	ComputeLimitSeconds float64 `json:"compute_limit_seconds"`
+
+	oldest time.Time // Earliest job finish counted in ComputeSeconds
+}
+
+// usageFor reports the usage of the account the request acts for. Anonymous use
+// is not metered, as only authenticated accounts can be told apart reliably.
+func usageFor(r *http.Request) usageReport {
+	cfg := liveConfig()
+	owner := requestOwner(r)
+	if owner == "" {
+		return usageReport{}
+	}
+	u := usageReport{
+		StorageLimitBytes:   cfg.QuotaStorageMB << 20,
+		ComputeLimitSeconds: cfg.QuotaComputeMinutes * 60,
+	}
+	if k := apiKeyFromContext(r.Context()); k != nil {
+		if k.StorageMB > 0 {
+			u.StorageLimitBytes = k.StorageMB << 20
+		}
+		if k.ComputeMinutes > 0 {
+			u.ComputeLimitSeconds = k.ComputeMinutes * 60
+		}
+	}
+	var compute time.Duration
+	u.StorageBytes, compute, u.oldest = jobs.usage(owner, time.Now().Add(-quotaWindow))
+	u.ComputeSeconds = compute.Seconds()
+	return u
+}
+
+// summary describes the usage for the gallery page in the language of r
+func (u usageReport) summary(r *http.Request) string {
+	return trf(r, "Storage used: %s of %s. Processing time in the last 24 hours: %s of %s.",
+		formatMB(u.StorageBytes), limitOrUnlimited(r, u.StorageLimitBytes>>20, "%d MB", "unlimited"),
+		formatMinutes(u.ComputeSeconds), limitOrUnlimited(r, int64(u.ComputeLimitSeconds/60), "%d min", "unlimited"))
+}
+
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
+
+func formatMinutes(seconds float64) string {
+	return fmt.Sprintf("%.1f min", seconds/60)
+}
+
+// checkQuota refuses new jobs from accounts over their storage or compute quota
+func checkQuota(w http.ResponseWriter, r *http.Request) *requestError {
+	u := usageFor(r)
+	if u.StorageLimitBytes > 0 && u.StorageBytes >= u.StorageLimitBytes {
+		return &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "storage_quota_exceeded",
+			Message: fmt.Sprintf("Your stored results use %s of your %d MB quota; delete some results to submit new jobs", formatMB(u.StorageBytes), u.StorageLimitBytes>>20),
+		}
+	}
+	if u.ComputeLimitSeconds > 0 && u.ComputeSeconds >= u.ComputeLimitSeconds {
+		// Capacity returns as the oldest counted job leaves the window
+		retry := time.Until(u.oldest.Add(quotaWindow))
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retry.Seconds())), 1)))
+		return &requestError{
+			Status:  http.StatusTooManyRequests,
+			Code:    "compute_quota_exceeded",
+			Message: fmt.Sprintf("You have used %s of processing time in the last 24 hours, your quota is %s; retry in %s", formatMinutes(u.ComputeSeconds), formatMinutes(u.ComputeLimitSeconds), retry.Round(time.Minute)),
+		}
+	}
+	return nil
+}
+
+// apiV1UsageHandler reports the caller's quota usage
+func apiV1UsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	writeJSON(w, http.StatusOK, usageFor(r))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientLimiter enforces per-client request rates and concurrent job caps
+type clientLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*clientState
+}
+
+// clientState is the token bucket and in-flight job count of one client
+type clientState struct {
+	tokens   float64
+	updated  time.Time
+	inflight int
+}
+
+// limiter is the process-wide client limiter
+var limiter = &clientLimiter{clients: make(map[string]*clientState)}
+
+// clientLimits are the quotas applied to one client
+type clientLimits struct {
+	rate    float64 // Submissions per minute, 0 for unlimited
+	burst   int
+	maxJobs int // Concurrent jobs, 0 for unlimited
+}
+
+// clientKey identifies the client a request is accounted to and returns its limits:
+// requests authenticated with an API key share that key's quota, others are counted by address
+func clientKey(r *http.Request) (string, clientLimits) {
+	cfg := liveConfig()
+	limits := clientLimits{rate: cfg.RateLimit, burst: cfg.RateBurst, maxJobs: cfg.MaxJobsPerClient}
+	if k := apiKeyFromContext(r.Context()); k != nil {
+		if k.RateLimit > 0 {
+			limits.rate = k.RateLimit
+		}
+		if k.RateBurst > 0 {
+			limits.burst = k.RateBurst
+		}
+		if k.MaxJobs > 0 {
+			limits.maxJobs = k.MaxJobs
+		}
+		return "key:" + k.Name, limits
+	}
+	return "ip:" + clientIP(r), limits
+}
+
+// clientIP returns the caller's address, honoring X-Forwarded-For only when the
+// server is configured to sit behind a trusted reverse proxy. Proxies append
+// the address they saw to the header, so only its last entry, the one the
+// trusted proxy added, is not up to the client.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Values("X-Forwarded-For"); config.TrustForwardedFor && len(forwarded) > 0 {
+		last := forwarded[len(forwarded)-1]
+		if i := strings.LastIndex(last, ","); i >= 0 {
+			last = last[i+1:]
+		}
+		if last = strings.TrimSpace(last); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquire takes one request token and one job slot for key, returning how long
+// to wait before retrying when either limit is exhausted
+func (l *clientLimiter) acquire(key string, limits clientLimits) (retryAfter time.Duration, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	c := l.clients[key]
+	if c == nil {
+		c = &clientState{tokens: float64(limits.burst), updated: now}
+		l.clients[key] = c
+	}
+
+	if limits.rate > 0 {
+		// Refill the bucket at the rate per minute, up to the burst size
+		perSecond := limits.rate / 60
+		c.tokens = math.Min(float64(limits.burst), c.tokens+now.Sub(c.updated).Seconds()*perSecond)
+		c.updated = now
+		if c.tokens < 1 {
+			return time.Duration((1 - c.tokens) / perSecond * float64(time.Second)), "rate_limited"
+		}
+	}
+	if limits.maxJobs > 0 && c.inflight >= limits.maxJobs {
+		return 10 * time.Second, "too_many_jobs"
+	}
+
+	if limits.rate > 0 {
+		c.tokens--
+	}
+	c.inflight++
+	return 0, ""
+}
+
+// release frees the job slot taken by acquire
+func (l *clientLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.clients[key]; c != nil && c.inflight > 0 {
+		c.inflight--
+	}
+}
+
+// sweep forgets clients that have no jobs and a full bucket, keeping the map small
+func (l *clientLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, c := range l.clients {
+		if c.inflight == 0 && time.Since(c.updated) > 10*time.Minute {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// startSweeper periodically drops idle client entries
+func (l *clientLimiter) startSweeper() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			l.sweep()
+		}
+	}()
+}
+
+// limitClients guards a job-submitting handler with the per-client limits
+func limitClients(writeError errorWriter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, limits := clientKey(r)
+		retryAfter, reason := limiter.acquire(key, limits)
+		if reason != "" {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			message := fmt.Sprintf("Too many requests, please retry in %d seconds", seconds)
+			if reason == "too_many_jobs" {
+				message = fmt.Sprintf("You already have %d jobs in progress, please wait for them to finish", limits.maxJobs)
+			}
+			writeError(w, &requestError{Status: http.StatusTooManyRequests, Code: reason, Message: message})
+			return
+		}
+		slot := &clientSlot{}
+		defer func() {
+			if slot.until == nil {
+				limiter.release(key)
+				return
+			}
+			go func() {
+				<-slot.until
+				limiter.release(key)
+			}()
+		}()
+		next(w, r.WithContext(context.WithValue(r.Context(), clientSlotKey{}, slot)))
+	}
+}
+
+// clientSlot is the job slot limitClients took for a request, which a job that
+// goes on after the request ends keeps until the job does
+type clientSlot struct {
+	until <-chan struct{} // Closed when the job keeping the slot ends, nil when none does
+}
+
+type clientSlotKey struct{}
+
+// holdClientSlot keeps the job slot of the request until done is closed, for a
+// job that goes on after its submitter hung up
+func holdClientSlot(ctx context.Context, done <-chan struct{}) {
+	if slot, ok := ctx.Value(clientSlotKey{}).(*clientSlot); ok {
+		slot.until = done
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRedisNil is returned for replies that hold no value, such as GET of a missing key
+var errRedisNil = errors.New("redis: nil reply")
+
+// redisClient talks the RESP protocol to a Redis server, or a compatible one
+// such as Valkey or KeyDB, over a small pool of connections
+type redisClient struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	idle     chan *redisConn // Connections ready for the next command
+}
+
+// redisConn is one connection with its reader
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisDialTimeout bounds connecting to the server and each command's reply,
+// beyond the time a blocking command asks the server to wait
+const redisDialTimeout = 10 * time.Second
+
+// newRedisClient parses a redis:// or rediss:// (TLS) URL of the form
+// redis://[[user]:password@]host[:port][/db]
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q, expected redis or rediss", u.Scheme)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss", idle: make(chan *redisConn, 16)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database number %q", db)
+		}
+	}
+	return c, nil
+}
+
+// do sends one command and returns its reply: a string, an int64, a []any, or
+// errRedisNil. Errors replied by the server are returned as errors.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(redisDialTimeout)
+	if strings.HasPrefix(strings.ToUpper(args[0]), "B") { // Blocking commands end with their timeout in seconds
+		if seconds, err := strconv.Atoi(args[len(args)-1]); err == nil {
+			deadline = deadline.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	reply, err := conn.command(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) && !errors.Is(err, errRedisNil) {
+		conn.Close() // The connection is in an unknown state
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection or dials a new one
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var nc net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.username != "" {
+			auth = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.command(auth...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authenticating: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("selecting database %d: %w", c.db, err)
+		}
+	}
+	return conn, nil
+}
+
+// command writes args as an array of bulk strings and reads the reply
+func (conn *redisConn) command(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// reply reads one RESP reply
+func (conn *redisConn) reply() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2) // With the closing CRLF
+		if _, err := io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = conn.reply()
+			if err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
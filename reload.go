@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// configPollInterval is how often the -config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// reloadableFlags are the settings applied by a reload; changes to any other
+// setting are logged and wait for a restart
+var reloadableFlags = map[string]bool{
+	"log-level":             true,
+	"api-keys":              true,
+	"oidc-allowed-domains":  true,
+	"admins":                true,
+	"rate-limit":            true,
+	"rate-burst":            true,
+	"max-jobs-per-client":   true,
+	"max-upload-mb":         true,
+	"max-file-mb":           true,
+	"max-frames":            true,
+	"max-megapixels":        true,
+	"min-free-disk":         true,
+	"disk-budget-mb":        true,
+	"quota-storage-mb":      true,
+	"quota-compute-minutes": true,
+	"default-scale":         true,
+	"strip-height":          true,
+}
+
+// live holds the settings that may change at runtime. Each request reads one
+// snapshot, so a reload never mixes old and new values within a request and jobs
+// already submitted keep the options they were given.
+var live atomic.Pointer[serverConfig]
+
+// startupFlags holds the flag values the server started with, and appliedFlags
+// those of the last applied configuration; parseFlags sets both
+var startupFlags, appliedFlags *flag.FlagSet
+
+// liveConfig returns the current snapshot of the reloadable settings
+func liveConfig() *serverConfig {
+	if c := live.Load(); c != nil {
+		return c
+	}
+	return &config
+}
+
+// applyReloadable copies the reloadable settings from src to dst
+func applyReloadable(dst, src *serverConfig) {
+	dst.LogLevel = src.LogLevel
+	dst.APIKeys = src.APIKeys
+	dst.OIDCAllowedDomains = src.OIDCAllowedDomains
+	dst.Admins = src.Admins
+	dst.RateLimit = src.RateLimit
+	dst.RateBurst = src.RateBurst
+	dst.MaxJobsPerClient = src.MaxJobsPerClient
+	dst.MaxUploadMB = src.MaxUploadMB
+	dst.MaxFileMB = src.MaxFileMB
+	dst.MaxFrames = src.MaxFrames
+	dst.MaxMegapixels = src.MaxMegapixels
+	dst.MinFreeDisk = src.MinFreeDisk
+	dst.DiskBudgetMB = src.DiskBudgetMB
+	dst.QuotaStorageMB = src.QuotaStorageMB
+	dst.QuotaComputeMinutes = src.QuotaComputeMinutes
+	dst.DefaultScale = src.DefaultScale
+	dst.StripHeight = src.StripHeight
+}
+
+// reloadConfig reads the command line, environment and -config file again and
+// applies the reloadable settings. Nothing is applied when any of them is invalid.
+func reloadConfig() error {
+	next := defaultConfig
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerFlags(fs, &next)
+	if err := loadSettings(fs, &next, serverArgs); err != nil {
+		return err
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(next.LogLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q: use debug, info, warn or error", next.LogLevel)
+	}
+	var store *apiKeyStore
+	if next.APIKeys != "" {
+		var err error
+		if store, err = loadAPIKeys(next.APIKeys); err != nil {
+			return fmt.Errorf("loading -api-keys: %w", err)
+		}
+	}
+
+	// Report what changed, comparing flag values as they were given
+	var changed []string
+	fs.VisitAll(func(f *flag.Flag) {
+		switch {
+		case reloadableFlags[f.Name] && f.Value.String() != appliedFlags.Lookup(f.Name).Value.String():
+			changed = append(changed, f.Name)
+		case !reloadableFlags[f.Name] && f.Value.String() != startupFlags.Lookup(f.Name).Value.String():
+			slog.Warn("Setting changed but requires a restart", "setting", f.Name)
+		}
+	})
+
+	applied := *liveConfig()
+	applyReloadable(&applied, &next)
+	logLevel.Set(level)
+	apiKeys.Store(store)
+	live.Store(&applied)
+	appliedFlags = fs
+	slog.Info("Configuration reloaded", "changed", changed)
+	return nil
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the -config file
+// is modified, until ctx is done
+func watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(hup, reloadSignals...) // Notify with no signals would relay all of them
+		defer signal.Stop(hup)
+	}
+
+	var poll <-chan time.Time
+	var modified time.Time
+	if config.ConfigFile != "" {
+		if info, err := os.Stat(config.ConfigFile); err == nil {
+			modified = info.ModTime()
+		}
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration")
+		case <-poll:
+			info, err := os.Stat(config.ConfigFile)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+			slog.Info("Configuration file modified, reloading", "path", config.ConfigFile)
+		}
+		if err := reloadConfig(); err != nil {
+			slog.Error("Error reloading configuration, keeping the current settings", "error", err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !js
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals make the server reload its configuration
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// reloadSignals is empty where there are no signals; the -config file is still watched
+var reloadSignals []os.Signal
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log/slog"
+	"math"
+)
+
+// Alignment moves a whole frame by one shift, and wherever that shift is off
+// (the frame turned a little, the lens drew its corners differently, a branch
+// moved in the wind) averaging it in blurs the result. The weighted algorithm
+// compares every aligned frame with the reference and lets each of its pixels
+// count for less the more its neighbourhood differs from the reference's
+// beyond the noise, so a frame that lines up badly in one corner is left out
+// of that corner alone instead of blurring all of it or being dropped whole.
+
+const (
+	residualRadius = 2   // Of the square neighbourhood the residual of a pixel is measured over, in pixels
+	residualSigma  = 3   // Noise levels of residual at which a pixel counts half
+	residualFloor  = 2.0 // Least such limit, in 8-bit levels of brightness, so clean frames fuse about as averaged
+)
+
+// residualWeights returns the weight of every pixel of the aligned frame i, row
+// by row: 1/(1+(rms/limit)²), rms being the root mean square of its difference
+// in brightness from refLuma, the reference's, over its residualRadius
+// neighbourhood, and limit residualSigma times the robust spread of the
+// differences over the frame, and at least residualFloor. Pixels the shift left
+// uncovered differ the most, so they count for next to nothing.
+func residualWeights(ctx context.Context, refLuma []float64, frame image.Image, i int) []float32 {
+	b := frame.Bounds()
+	w, h := b.Dx(), b.Dy()
+	luma := lumaPlane(frame)
+	histogram := make([]int, 4*256) // Of the size of the differences, in quarter levels
+	// Sums of the squared differences above and left of every pixel, for the
+	// mean over any neighbourhood in four lookups
+	sums := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := 0.0
+		for x := 0; x < w; x++ {
+			d := luma[y*w+x] - refLuma[y*w+x]
+			histogram[min(int(math.Abs(d)*4), len(histogram)-1)]++
+			row += d * d
+			sums[(y+1)*(w+1)+x+1] = sums[y*(w+1)+x+1] + row
+		}
+	}
+	limit := max(residualSigma*1.4826*histogramShare(histogram, 0.5)/4, residualFloor) // The median absolute difference, as the standard deviation of Gaussian noise
+	weights := make([]float32, w*h)
+	total := 0.0
+	for y := 0; y < h; y++ {
+		y0, y1 := max(y-residualRadius, 0), min(y+residualRadius+1, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := max(x-residualRadius, 0), min(x+residualRadius+1, w)
+			sum := sums[y1*(w+1)+x1] - sums[y0*(w+1)+x1] - sums[y1*(w+1)+x0] + sums[y0*(w+1)+x0]
+			ms := sum / float64((y1-y0)*(x1-x0))
+			weight := 1 / (1 + ms/(limit*limit))
+			weights[y*w+x] = float32(weight)
+			total += weight
+		}
+	}
+	slog.InfoContext(ctx, "Residual weights measured", "frame", i, "limit", limit, "mean_weight", total/float64(w*h))
+	return weights
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	_ "embed" // Required for embedding
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+//go:embed static/compare.js
+var compareJS string
+
+// acceptsHTML reports whether the client navigated to the request as a page, as
+// a browser posting the upload form does, rather than fetching the image itself
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// dataURL embeds content in a page as a data: URL
+func dataURL(mediaType string, content []byte) string {
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(content)
+}
+
+// bicubicUpscale resizes a frame to size the way ordinary image editors would,
+// the baseline super-resolution has to beat
+func bicubicUpscale(frame image.Image, size image.Point) *image.RGBA {
+	upscaled := image.NewRGBA(image.Rectangle{Max: size})
+	draw.CatmullRom.Scale(upscaled, upscaled.Bounds(), frame, frame.Bounds(), draw.Src, nil)
+	return upscaled
+}
+
+// writeResultPage renders the result of a browser upload with a wipe slider
+// between a bicubic upscale of the reference frame and the fused result. The
+// result is linked from the gallery when it was stored, and embedded otherwise.
+func writeResultPage(w http.ResponseWriter, r *http.Request, reference, result image.Image, encoded []byte, opts processOptions, storedURL string, assessment burstAssessment) {
+	const resultPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Super Resolution Result}}</title>
+	%s
+	<style>	#compare{position:relative;overflow:hidden;touch-action:none;cursor:ew-resize}
+	#compare img{display:block;width:100%%;height:auto}
+	#compare #after{position:absolute;top:0;left:0;clip-path:inset(0 0 0 50%%)}
+	#divider{position:absolute;top:0;bottom:0;left:50%%;width:2px;background:#fff;box-shadow:0 0 3px #000}
+	</style>
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Super Resolution Result}}</h1>
+	%s
+	%s
+	%s
+	<div class="bg-body p-4 rounded shadow">
+	<div class="d-flex justify-content-between small text-muted mb-1"><span>{{Bicubic upscale of the reference frame}}</span><span>{{Fused result}}</span></div>
+	<div id="compare" class="mb-2">
+	<img id="before" src="%s" alt="{{Bicubic upscale of the reference frame}}">
+	<img id="after" src="%s" alt="{{Super-resolution result}}">
+	<div id="divider"></div>
+	</div>
+	<input type="range" id="wipe" min="0" max="100" value="50" class="form-range mb-3" aria-label="{{Comparison position}}">
+	<div class="d-grid gap-2 d-md-flex">
+	<a href="%s" download="%s" class="btn btn-success btn-lg">{{Download}} %dx%d %s</a>
+	%s
+	<a href="%s" class="btn btn-outline-secondary btn-lg">{{Process more images}}</a>
+	</div>
+	</div>
+	</div>
+	<script>%s</script>
+	%s
+	</body>
+	</html>
+	`
+	// The slider compares against what plain upscaling of one frame would give
+	size := result.Bounds().Size()
+	var before bytes.Buffer
+	if err := jpeg.Encode(&before, bicubicUpscale(reference, size), &jpeg.Options{Quality: 90}); err != nil {
+		writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "encoding_failed", Message: "Error encoding the comparison image"})
+		return
+	}
+
+	download, inspect := storedURL, ""
+	if download == "" {
+		download = dataURL(contentType(opts.Format), encoded)
+	} else if opts.Format != formatPDF {
+		inspect = fmt.Sprintf(`<a href="%s/view" class="btn btn-outline-primary btn-lg">%s</a>`, html.EscapeString(storedURL), tr(r, "Inspect at 1:1"))
+	}
+	after := download
+	if opts.Format == formatPDF || opts.Format == formatTIFF { // Browsers show neither as an image, so the page shows a PNG of it
+		var shown bytes.Buffer
+		if err := png.Encode(&shown, result); err != nil {
+			writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "encoding_failed", Message: "Error encoding the comparison image"})
+			return
+		}
+		after = dataURL("image/png", shown.Bytes())
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(w, localize(r, resultPageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), previewNotice(r, opts)+presetNotice(r, opts)+frameCountNotice(r, opts), assessmentNotice(r, assessment, opts), dataURL("image/jpeg", before.Bytes()), html.EscapeString(after),
+		html.EscapeString(download), "superres"+fileExtension(opts.Format), size.X, size.Y, strings.ToUpper(opts.Format), inspect, config.url("/"), compareJS, pageFooter(r))
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// requestOwner names the account a request acts for: the logged-in user, the
+// API key, or "" for anonymous use when no authentication is configured
+func requestOwner(r *http.Request) string {
+	if u := userFromContext(r.Context()); u != nil {
+		return "user:" + u.Subject
+	}
+	if k := apiKeyFromContext(r.Context()); k != nil {
+		return "key:" + k.Name
+	}
+	return ""
+}
+
+// navBar renders the links shown under the page title: the upload form, the
+// gallery and job history when results or jobs are kept, the logged-in user
+// with a logout link, and the theme and language switches
+func navBar(r *http.Request) string {
+	var links []string
+	if config.ResultsDir != "" || config.JobStore != "" {
+		links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, config.url("/"), tr(r, "Upload")), fmt.Sprintf(`<a href="%s">%s</a>`, config.url("/results"), tr(r, "My results")))
+	}
+	if isAdmin(r) {
+		links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, config.url("/admin"), tr(r, "Admin")))
+	}
+	if u := userFromContext(r.Context()); u != nil {
+		links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, config.url("/workspaces"), tr(r, "Workspaces")))
+		links = append(links, trf(r, "Logged in as %s", html.EscapeString(sessionUserLabel(u))), fmt.Sprintf(`<a href="%s">%s</a>`, config.url("/logout"), tr(r, "Log out")))
+	}
+	links = append(links, themeSwitch(r), languageSwitch(r))
+	return `<p class="text-center text-muted">` + strings.Join(links, " &middot; ") + `</p>`
+}
+
+// resultPath returns where the result of a job is stored
+func resultPath(name string) string {
+	return filepath.Join(config.ResultsDir, name)
+}
+
+// createResultFile opens the file a result is stored in under name, the job ID
+// and the extension of its format, or returns nil when results are not kept or
+// the file cannot be created
+func createResultFile(ctx context.Context, name string) *os.File {
+	if config.ResultsDir == "" {
+		return nil
+	}
+	f, err := os.Create(resultPath(name))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating result file", "error", err)
+		return nil
+	}
+	return f
+}
+
+// finishResultFile closes a result file and attaches it to the job, discarding it
+// when encoding failed
+func finishResultFile(ctx context.Context, id string, f *os.File, encodeErr error) {
+	info, statErr := f.Stat()
+	err := errors.Join(statErr, f.Close())
+	if encodeErr != nil || err != nil {
+		os.Remove(f.Name())
+		if err != nil {
+			slog.ErrorContext(ctx, "Error storing result file", "error", err)
+		}
+		return
+	}
+	jobs.setResult(id, filepath.Base(f.Name()), info.Size())
+	if sharedStore != nil {
+		if err := shareResult(ctx, id); err != nil {
+			slog.ErrorContext(ctx, "Error copying result to object storage", "error", err)
+		}
+	}
+}
+
+// visibleJob returns the job named in the request path if the caller submitted it
+// or belongs to its workspace; other jobs are reported as missing so their IDs
+// cannot be probed
+func visibleJob(r *http.Request) (job, bool) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		j, ok = adoptSharedJob(r.Context(), r.PathValue("id"))
+	}
+	if !ok {
+		return job{}, false
+	}
+	if j.Owner == requestOwner(r) {
+		return j, true
+	}
+	if j.Workspace != "" {
+		if _, member := workspaces.get(r, j.Workspace); member {
+			return j, true
+		}
+	}
+	return job{}, false
+}
+
+// canDelete reports whether the caller may delete the result of j: its submitter
+// or the owner of its workspace
+func canDelete(r *http.Request, j job) bool {
+	if j.Owner == requestOwner(r) {
+		return true
+	}
+	ws, ok := workspaces.get(r, j.Workspace)
+	return ok && ws.Owner == requestOwner(r)
+}
+
+// deleteResult removes the stored result of a job, freeing its submitter's quota
+func deleteResult(r *http.Request) *requestError {
+	j, ok := visibleJob(r)
+	if !ok || j.Result == "" {
+		return &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No stored result with this ID"}
+	}
+	if !canDelete(r, j) {
+		return &requestError{Status: http.StatusForbidden, Code: "forbidden", Message: "Only the submitter or the workspace owner can delete this result"}
+	}
+	if err := removeStoredResult(r.Context(), j); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting result file", "error", err)
+		return &requestError{Status: http.StatusInternalServerError, Code: "delete_failed", Message: "Error deleting the result"}
+	}
+	removeTiles(j.ID)
+	jobs.setResult(j.ID, "", 0)
+	slog.InfoContext(r.Context(), "Result deleted", "job_id", j.ID)
+	return nil
+}
+
+// resultDeleteHandler deletes a result from the gallery page and returns to it
+func resultDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	if reqErr := deleteResult(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	http.Redirect(w, r, config.url("/results")+"?workspace="+url.QueryEscape(r.FormValue("workspace")), http.StatusSeeOther)
+}
+
+// serveResult sends the stored result of a job visible to the caller
+func serveResult(w http.ResponseWriter, r *http.Request, writeError errorWriter) {
+	j, ok := visibleJob(r)
+	if !ok || j.Result == "" {
+		writeError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No stored result with this ID"})
+		return
+	}
+	path, err := localResult(r.Context(), j)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error fetching stored result", "job_id", j.ID, "error", err)
+		writeError(w, &requestError{Status: http.StatusInternalServerError, Code: "result_unavailable", Message: "Error reading the stored result"})
+		return
+	}
+	w.Header().Set("Cache-Control", "private")
+	http.ServeFile(w, r, path)
+}
+
+// resultFileHandler serves a stored result to the browser
+func resultFileHandler(w http.ResponseWriter, r *http.Request) {
+	serveResult(w, r, writePlainError)
+}
+
+// listedJobs returns the caller's own jobs, or those of the workspace named by the
+// workspace query parameter. Previews are left out: they keep no result.
+func listedJobs(r *http.Request) ([]job, string, *requestError) {
+	id := r.FormValue("workspace")
+	if id == "" {
+		owner := requestOwner(r)
+		return jobs.list(func(j *job) bool { return j.Owner == owner && !j.Preview }), tr(r, "My Results"), nil
+	}
+	ws, ok := workspaces.get(r, id)
+	if !ok {
+		return nil, "", errWorkspaceNotFound
+	}
+	return jobs.list(func(j *job) bool { return j.Workspace == id && !j.Preview }), ws.Name, nil
+}
+
+// resultsPageHandler lists the results of the current user or one of their workspaces
+func resultsPageHandler(w http.ResponseWriter, r *http.Request) {
+	list, title, reqErr := listedJobs(r)
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	token := csrfToken(w, r)
+	var cards strings.Builder
+	for _, j := range list {
+		link := config.url("/results/" + j.ID)
+		preview := fmt.Sprintf(`<div class="card-img-top d-flex align-items-center justify-content-center bg-secondary-subtle text-muted" style="height:200px">%s</div>`, jobStatusText(r, j))
+		var actions string
+		if j.Result != "" {
+			preview = fmt.Sprintf(`<a href="%s/view"><img src="%s/thumbnail" class="card-img-top" style="height:200px;object-fit:cover" alt="%s %s" loading="lazy"></a>`, link, link, tr(r, "Result"), j.ID)
+			actions = fmt.Sprintf(`<a href="%s/view" class="btn btn-sm btn-outline-primary">%s</a> <a href="%s" download class="btn btn-sm btn-outline-success">%s</a>`, link, tr(r, "View"), link, tr(r, "Download"))
+			if j.Format == formatPDF { // There is no image to cut into tiles, only the page to print
+				preview = `<div class="card-img-top d-flex align-items-center justify-content-center bg-secondary-subtle text-muted" style="height:200px">PDF</div>`
+				actions = fmt.Sprintf(`<a href="%s" download class="btn btn-sm btn-outline-success">%s</a>`, link, tr(r, "Download"))
+			}
+			if canDelete(r, j) {
+				actions += fmt.Sprintf(` <form action="%s/delete" method="post" class="d-inline"><input type="hidden" name="csrf_token" value="%s"><input type="hidden" name="workspace" value="%s"><button type="submit" class="btn btn-sm btn-outline-danger">%s</button></form>`,
+					link, token, html.EscapeString(r.FormValue("workspace")), tr(r, "Delete"))
+				actions += shareControls(r, j, token)
+			}
+		}
+		fmt.Fprintf(&cards, `<div class="col"><div class="card shadow-sm h-100">%s<div class="card-body"><p class="card-text"><span class="badge %s">%s</span> <small class="text-muted">%s</small><br>%s<br><small class="text-muted">%s</small></p>%s</div></div></div>`,
+			preview, jobStatusBadge(j.Status), tr(r, string(j.Status)), j.ID, html.EscapeString(jobParameters(r, j)), html.EscapeString(jobTimes(r, j)), actions)
+	}
+	var usage string
+	if requestOwner(r) != "" {
+		usage = usageFor(r).summary(r)
+	}
+	if cards.Len() == 0 {
+		fmt.Fprintf(&cards, `<p class="text-muted">%s</p>`, tr(r, "No jobs yet."))
+	}
+
+	const resultsPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>%s</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">%s</h1>
+	%s
+	<p class="text-center">%s</p>
+	<div class="row row-cols-1 row-cols-md-3 g-4">%s</div>
+	</div>
+	%s
+	</body>
+	</html>
+	`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, resultsPageHTML, requestLocale(r), html.EscapeString(title), pageHead(r), brandLogo(), html.EscapeString(title), navBar(r), html.EscapeString(usage), cards.String(), pageFooter(r))
+}
+
+// jobStatusText describes a job without a stored result in place of its thumbnail
+func jobStatusText(r *http.Request, j job) string {
+	switch {
+	case j.Status == jobQueued || j.Status == jobRunning:
+		return tr(r, "In progress")
+	case j.Status == jobDone && config.ResultsDir == "":
+		return tr(r, "Result not kept on this server")
+	case j.Status == jobDone:
+		return tr(r, "Result deleted")
+	case j.Error != "":
+		return html.EscapeString(j.Error)
+	}
+	return tr(r, "No result")
+}
+
+// jobStatusBadge returns the badge colour of a job status
+func jobStatusBadge(status jobStatus) string {
+	switch status {
+	case jobDone:
+		return "bg-success"
+	case jobQueued, jobRunning:
+		return "bg-primary"
+	case jobFailed:
+		return "bg-danger"
+	}
+	return "bg-secondary"
+}
+
+// jobParameters summarizes what a job was asked to do
+func jobParameters(r *http.Request, j job) string {
+	params := []string{trf(r, "%d frames", j.Frames), fmt.Sprintf("%dx", j.Scale)}
+	if j.Algorithm != "" { // Jobs from before processing options were recorded have none
+		params = append(params, j.Algorithm, j.Kernel)
+		if j.Format == formatJPEG {
+			params = append(params, fmt.Sprintf("JPEG q%d", j.Quality))
+		} else {
+			params = append(params, strings.ToUpper(j.Format))
+		}
+		if j.Denoise > 0 {
+			params = append(params, trf(r, "denoise %d", j.Denoise))
+		}
+		if j.Sharpen > 0 {
+			params = append(params, trf(r, "sharpen %d", j.Sharpen))
+		}
+	}
+	if j.Result != "" {
+		params = append(params, formatMB(j.ResultSize))
+	}
+	return strings.Join(params, ", ")
+}
+
+// jobTimes tells when a job was submitted and how long it ran
+func jobTimes(r *http.Request, j job) string {
+	text := trf(r, "Submitted %s", j.Created.Format("2006-01-02 15:04"))
+	if !j.Finished.IsZero() && !j.Started.IsZero() {
+		text += trf(r, ", ran %s", j.Finished.Sub(j.Started).Round(time.Second))
+	}
+	return text
+}
+
+// apiV1JobsHandler lists the jobs submitted with the caller's API key, or those of
+// one of its workspaces
+func apiV1JobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	list, _, reqErr := listedJobs(r)
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	if list == nil {
+		list = []job{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": list})
+}
+
+// apiV1DeleteResultHandler deletes the stored result of one of the caller's jobs
+func apiV1DeleteResultHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	if reqErr := deleteResult(r); reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiV1JobResultHandler returns the stored result of one of the caller's jobs
+func apiV1JobResultHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	serveResult(w, r, writeAPIErrorV1)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minROISize is the smallest width and height of a region of interest, in
+// pixels: alignment needs some detail to match
+const minROISize = 16
+
+// parseROI reads the roi parameter, x,y,width,height in pixels of the
+// reference frame; empty stands for the whole frame
+func parseROI(field string) (image.Rectangle, *requestError) {
+	if field == "" {
+		return image.Rectangle{}, nil
+	}
+	invalid := &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter roi must be x,y,width,height in whole pixels, each side at least %d, got %q", minROISize, field)}
+	parts := strings.Split(field, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, invalid
+	}
+	var values [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, invalid
+		}
+		values[i] = n
+	}
+	if values[2] < minROISize || values[3] < minROISize {
+		return image.Rectangle{}, invalid
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// cropFrames cuts the region roi out of every frame, so alignment matches that
+// region alone and fusion spends its time and memory there: a number plate or
+// a line of text moves with the camera differently from the rest of the
+// scene, and matching the whole frame would settle on the background. An empty
+// roi keeps the frames as they are.
+func cropFrames(images []image.Image, roi image.Rectangle) ([]image.Image, *requestError) {
+	if roi.Empty() {
+		return images, nil
+	}
+	cropped := make([]image.Image, len(images))
+	for i, img := range images {
+		b := img.Bounds()
+		if !roi.Add(b.Min).In(b) {
+			return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter roi %d,%d,%d,%d reaches outside the %dx%d frames", roi.Min.X, roi.Min.Y, roi.Dx(), roi.Dy(), b.Dx(), b.Dy())}
+		}
+		crop := blankFrame(img, image.Rect(0, 0, roi.Dx(), roi.Dy()))
+		draw.Draw(crop, crop.Bounds(), img, roi.Min.Add(b.Min), draw.Src)
+		cropped[i] = crop
+	}
+	return cropped, nil
+}
+
+// prepareFrames turns the decoded frames, the reference first, into what the
+// pipeline fuses: negatives made positive, cut to the region of interest and matched in exposure, or straightened to the page
+// and evened out for documents, and only the sharpest when asked or when
+// there are more than the frame-count policy fuses, see framecount.go
+func prepareFrames(ctx context.Context, images []image.Image, opts processOptions) ([]image.Image, *requestError) {
+	if opts.Thermal {
+		if reqErr := checkThermalFrames(images); reqErr != nil {
+			return nil, reqErr
+		}
+	}
+	if opts.Negative {
+		images = invertNegatives(ctx, images) // On the whole frames, whose borders show the film base
+	}
+	images, reqErr := cropFrames(images, opts.ROI)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if opts.MatchExposure {
+		images = matchExposure(ctx, images) // On what is fused, so a bright sky cut away does not set the gain
+	}
+	if opts.Rectify {
+		images = rectifyFrames(images)
+	}
+	if opts.Flatten {
+		flattened := make([]image.Image, len(images))
+		for i, img := range images {
+			flattened[i] = flattenBackground(img)
+		}
+		images = flattened
+	}
+	switch {
+	case opts.Keep > 0 || opts.Align == alignPlanet:
+		images = selectSharpest(ctx, images, keptFrames(len(images), opts.Keep), opts.Align == alignPlanet)
+	case opts.limitsFrames(len(images)):
+		images = selectSharpest(ctx, images, maxFusedFrames, false)
+	}
+	return images, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errObjectNotFound is returned for keys the object store does not hold
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore keeps data every instance of the server can reach, so results and
+// uploads outlive the instance that received them
+type objectStore interface {
+	put(ctx context.Context, key string, body io.Reader, size int64) error
+	get(ctx context.Context, key string) (io.ReadCloser, error) // errObjectNotFound for missing keys
+	remove(ctx context.Context, key string) error               // Missing keys are not an error
+	list(ctx context.Context, prefix string) ([]string, error)  // Keys starting with prefix
+}
+
+// sharedStore is the configured object store, nil when -s3-bucket is not set and
+// everything stays on the local disk
+var sharedStore objectStore
+
+// s3Store is an objectStore on S3 or an S3-compatible service such as MinIO,
+// addressed path-style and signed with AWS Signature Version 4
+type s3Store struct {
+	endpoint  *url.URL // Scheme and host of the service
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string // Prepended to every key, so buckets can be shared
+	client    *http.Client
+}
+
+// newS3Store returns the store configured by the -s3-* flags
+func newS3Store(c serverConfig) (*s3Store, error) {
+	endpoint, err := url.Parse(c.S3Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("-s3-endpoint must be an http or https URL, got %q", c.S3Endpoint)
+	}
+	if c.S3AccessKey == "" || c.S3SecretKey == "" {
+		return nil, errors.New("-s3-bucket needs -s3-access-key and -s3-secret-key")
+	}
+	return &s3Store{
+		endpoint:  &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host},
+		bucket:    c.S3Bucket,
+		region:    c.S3Region,
+		accessKey: c.S3AccessKey,
+		secretKey: c.S3SecretKey,
+		prefix:    strings.Trim(c.S3Prefix, "/"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// objectURL returns the URL of key in the bucket
+func (s *s3Store) objectURL(key string) *url.URL {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	return &u
+}
+
+func (s *s3Store) put(ctx context.Context, key string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) remove(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, errObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list pages through ListObjectsV2 for the keys under prefix
+func (s *s3Store) list(ctx context.Context, prefix string) ([]string, error) {
+	base := ""
+	if s.prefix != "" {
+		base = s.prefix + "/"
+	}
+	full := base + prefix
+	var keys []string
+	token := ""
+	for {
+		u := *s.endpoint
+		u.Path = "/" + s.bucket
+		query := url.Values{"list-type": {"2"}, "prefix": {full}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading object list: %w", err)
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, base))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// do signs and sends req, turning error responses into errors
+func (s *s3Store) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errObjectNotFound, req.URL.Path)
+	}
+	var failure struct {
+		Code    string
+		Message string
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure)
+	return nil, fmt.Errorf("object store answered %s to %s %s: %s %s", resp.Status, req.Method, req.URL.Path, failure.Code, failure.Message)
+}
+
+// unsignedPayload lets bodies be streamed without reading them twice to hash
+// them first; S3 still checks the signature of the headers
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the AWS Signature Version 4 Authorization header to req
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// Sign the host and every x-amz-* header, plus any the caller set for ranges
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters sorted and escaped as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters of RFC 3986
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -30,6 +31,13 @@ func main() {
 	version := gitVersion
 	fmt.Printf("Building version: %s\n", version)
 
+	// Commit and build time, shown by -version, /version and the web UI footer
+	commit, err := runOutput("git", "rev-parse", "HEAD")
+	if err != nil {
+		log.Fatalf("Error getting Git commit: %v", err)
+	}
+	buildDate := time.Now().UTC().Format(time.RFC3339)
+
 	// Get the root path of the Git repository
 	gitRootPath, err := getGitRootPath()
 	if err != nil {
@@ -84,8 +92,8 @@ func main() {
 
 			outputPath := filepath.Join(outputDir, execFileName)
 
-			ldflags := fmt.Sprintf("-X main.version=%s", version)
-			buildCmd := exec.Command("go", "build", "-ldflags", ldflags, "-o", outputPath, goSourceFile)
+			ldflags := fmt.Sprintf("-X main.version=%s -X main.commit=%s -X main.buildDate=%s", version, commit, buildDate)
+			buildCmd := exec.Command("go", "build", "-ldflags", ldflags, "-o", outputPath, filepath.Dir(goSourceFile))
 			buildCmd.Env = append(os.Environ(), "GOOS="+osName, "GOARCH="+arch)
 			if err := buildCmd.Run(); err != nil {
 				// Remove the directory if build fails
@@ -149,6 +157,15 @@ func runCommand(name string, args ...string) error {
 	return cmd.Run()
 }
 
+// Helper function to get the trimmed output of a command
+func runOutput(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 // Helper function to get the Git root path
 func getGitRootPath() (string, error) {
 	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// resultShare is a link that gives anyone holding it the result of one job. Only
+// the digest of its token is kept, so the job store holds no usable links.
+type resultShare struct {
+	TokenSHA256 string    `json:"token_sha256"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires,omitempty"` // Zero for links that never expire
+}
+
+// shareExpiryChoices are the lifetimes offered when sharing from the gallery
+var shareExpiryChoices = []struct {
+	Label string
+	Value string
+}{
+	{"1 day", "24h"},
+	{"7 days", "168h"},
+	{"30 days", "720h"},
+	{"Never expires", ""},
+}
+
+// addShare attaches a share link to a job
+func (m *jobManager) addShare(ctx context.Context, id string, share resultShare) {
+	refreshShares(ctx, id) // Keep the links other instances gave out
+	m.mu.Lock()
+	if j, ok := m.jobs[id]; ok {
+		j.Shares = append(j.Shares, share)
+	}
+	m.mu.Unlock()
+	syncSharedRecord(id)
+	saveShareToken(ctx, share.TokenSHA256, id)
+}
+
+// clearShares revokes every share link of a job
+func (m *jobManager) clearShares(ctx context.Context, id string) {
+	refreshShares(ctx, id) // Revoke the links other instances gave out too
+	var revoked []resultShare
+	m.mu.Lock()
+	if j, ok := m.jobs[id]; ok {
+		revoked, j.Shares = j.Shares, nil
+	}
+	m.mu.Unlock()
+	syncSharedRecord(id)
+	removeShareTokens(ctx, revoked)
+}
+
+// setShares replaces the share links of a job with those another instance saved
+func (m *jobManager) setShares(id string, shares []resultShare) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.Shares = shares
+	}
+}
+
+// sharedJob returns the job a share token unlocks, if the link has not expired.
+// With an object store the link is looked up there and checked against the job
+// record as stored, so links given out or revoked by any instance count.
+func (m *jobManager) sharedJob(ctx context.Context, token string) (job, bool) {
+	hash := hashAPIKey(token)
+	if sharedStore != nil {
+		return sharedStoreJob(ctx, hash)
+	}
+	j, ok := m.localSharedJob(hash)
+	if !ok || !shareWorks(j.Shares, hash) {
+		return job{}, false
+	}
+	return j, true
+}
+
+// localSharedJob returns the job of this instance with a share link whose
+// token has the digest hash, working or not
+func (m *jobManager) localSharedJob(hash string) (job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		for _, s := range j.Shares {
+			if s.TokenSHA256 == hash {
+				return *j, true
+			}
+		}
+	}
+	return job{}, false
+}
+
+// shareWorks reports whether shares hold an unexpired link whose token has the
+// digest hash
+func shareWorks(shares []resultShare, hash string) bool {
+	now := time.Now()
+	for _, s := range shares {
+		if s.TokenSHA256 == hash && (s.Expires.IsZero() || now.Before(s.Expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// activeShares counts the links of a job that still work
+func activeShares(j job) int {
+	n := 0
+	for _, s := range j.Shares {
+		if s.Expires.IsZero() || time.Now().Before(s.Expires) {
+			n++
+		}
+	}
+	return n
+}
+
+// createShare makes a new link to the result of the job in the request path,
+// expiring after the expires_in duration unless it is empty or zero
+func createShare(r *http.Request) (link string, expires time.Time, reqErr *requestError) {
+	j, ok := visibleJob(r)
+	if !ok || j.Result == "" {
+		return "", time.Time{}, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No stored result with this ID"}
+	}
+	if !canDelete(r, j) {
+		return "", time.Time{}, &requestError{Status: http.StatusForbidden, Code: "forbidden", Message: "Only the submitter or the workspace owner can share this result"}
+	}
+	if value := r.FormValue("expires_in"); value != "" {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil || lifetime < 0 {
+			return "", time.Time{}, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter expires_in must be a duration such as 24h, got %q", value)}
+		}
+		if lifetime > 0 {
+			expires = time.Now().Add(lifetime)
+		}
+	}
+
+	token := randomToken()
+	jobs.addShare(r.Context(), j.ID, resultShare{TokenSHA256: hashAPIKey(token), Created: time.Now(), Expires: expires})
+	slog.InfoContext(r.Context(), "Result shared", "job_id", j.ID, "expires", expires)
+	return absoluteURL(r, "/s/"+token), expires, nil
+}
+
+// revokeShares disables every link to the result of the job in the request path
+func revokeShares(r *http.Request) *requestError {
+	j, ok := visibleJob(r)
+	if !ok {
+		return &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No job with this ID"}
+	}
+	if !canDelete(r, j) {
+		return &requestError{Status: http.StatusForbidden, Code: "forbidden", Message: "Only the submitter or the workspace owner can stop sharing this result"}
+	}
+	jobs.clearShares(r.Context(), j.ID)
+	slog.InfoContext(r.Context(), "Result shares revoked", "job_id", j.ID)
+	return nil
+}
+
+// sharedResultHandler serves a result to anyone holding a valid share link,
+// without a login or API key. Unknown, revoked and expired links look the same.
+func sharedResultHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.sharedJob(r.Context(), r.PathValue("token"))
+	if !ok || j.Result == "" {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "This link does not exist, has expired or was revoked."})
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer") // The token is the only credential
+	path, err := localResult(r.Context(), j)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error fetching stored result", "job_id", j.ID, "error", err)
+		writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "result_unavailable", Message: "Error reading the stored result"})
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="superres-%s%s"`, j.ID, fileExtension(j.Format)))
+	http.ServeFile(w, r, path)
+}
+
+// resultShareHandler creates a share link from the gallery and shows it once
+func resultShareHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	link, expires, reqErr := createShare(r)
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	validity := tr(r, "It does not expire.")
+	if !expires.IsZero() {
+		validity = trf(r, "It works until %s.", expires.Format("2006-01-02 15:04 MST"))
+	}
+
+	const sharePageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Share Result}}</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Share Result}}</h1>
+	%s
+	<div class="bg-body p-4 rounded shadow">
+	<p>{{Anyone with this link can download the result, without an account.}} %s {{Copy it now: it is not shown again.}}</p>
+	<input type="text" readonly value="%s" class="form-control mb-3" onfocus="this.select()">
+	<a href="%s" class="btn btn-outline-secondary">{{Back to my results}}</a>
+	</div>
+	</div>
+	%s
+	</body>
+	</html>
+	`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(w, localize(r, sharePageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), validity, html.EscapeString(link), config.url("/results"), pageFooter(r))
+}
+
+// resultUnshareHandler revokes the links of a result from the gallery
+func resultUnshareHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	if reqErr := revokeShares(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	http.Redirect(w, r, config.url("/results"), http.StatusSeeOther)
+}
+
+// apiV1CreateShareHandler creates a share link to a stored result
+func apiV1CreateShareHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	link, expires, reqErr := createShare(r)
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	response := map[string]any{"url": link}
+	if !expires.IsZero() {
+		response["expires"] = expires
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// apiV1RevokeSharesHandler revokes every share link of a result
+func apiV1RevokeSharesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	if reqErr := revokeShares(r); reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shareControls renders the share form of a gallery card, with a button to
+// revoke the links already given out
+func shareControls(r *http.Request, j job, token string) string {
+	link := config.url("/results/" + j.ID)
+	form := fmt.Sprintf(`<form action="%s/share" method="post" class="input-group input-group-sm mt-2"><input type="hidden" name="csrf_token" value="%s"><select name="expires_in" class="form-select" aria-label="%s">`, link, token, tr(r, "Link lifetime"))
+	for _, choice := range shareExpiryChoices {
+		form += fmt.Sprintf(`<option value="%s">%s</option>`, choice.Value, tr(r, choice.Label))
+	}
+	form += fmt.Sprintf(`</select><button type="submit" class="btn btn-outline-secondary">%s</button></form>`, tr(r, "Share link"))
+	if n := activeShares(j); n > 0 {
+		form += fmt.Sprintf(`<form action="%s/unshare" method="post" class="mt-1"><input type="hidden" name="csrf_token" value="%s"><small class="text-muted">%s</small> <button type="submit" class="btn btn-sm btn-link p-0">%s</button></form>`,
+			link, token, trf(r, "Shared by %d link(s)", n), tr(r, "Stop sharing"))
+	}
+	return form
+}
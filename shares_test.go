@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sharedTestJob adds a finished job to the job manager for the length of the test
+func sharedTestJob(t *testing.T, id string) {
+	t.Helper()
+	if !jobs.adopt(&job{ID: id, Result: id + ".png", Format: "png", Created: time.Now()}) {
+		t.Fatalf("job %s already exists", id)
+	}
+	forgetJobAfter(t, id)
+}
+
+// forgetJobAfter drops job id from the job manager when the test ends
+func forgetJobAfter(t *testing.T, id string) {
+	t.Cleanup(func() {
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+		delete(jobs.jobs, id)
+		jobs.order = slices.DeleteFunc(jobs.order, func(other string) bool { return other == id })
+	})
+}
+
+func TestShareKeepsOnlyTokenDigests(t *testing.T) {
+	ctx := context.Background()
+	sharedTestJob(t, "share-digest")
+	token := randomToken()
+	jobs.addShare(ctx, "share-digest", resultShare{TokenSHA256: hashAPIKey(token), Created: time.Now()})
+
+	j, _ := jobs.get("share-digest")
+	if len(j.Shares) != 1 || j.Shares[0].TokenSHA256 != hashAPIKey(token) {
+		t.Fatalf("job keeps shares %+v, want the digest of the token", j.Shares)
+	}
+	if hashAPIKey(token) == token || strings.Contains(j.Shares[0].TokenSHA256, token) {
+		t.Error("the job keeps the token itself")
+	}
+	if got, ok := jobs.sharedJob(ctx, token); !ok || got.ID != "share-digest" {
+		t.Errorf("the token unlocks %q, %v, want the shared job", got.ID, ok)
+	}
+	if _, ok := jobs.sharedJob(ctx, hashAPIKey(token)); ok {
+		t.Error("the stored digest works as a token")
+	}
+	if _, ok := jobs.sharedJob(ctx, randomToken()); ok {
+		t.Error("an unknown token unlocks a job")
+	}
+}
+
+func TestShareExpiryAndRevocation(t *testing.T) {
+	ctx := context.Background()
+	sharedTestJob(t, "share-revoke")
+	lasting, expired, forever := randomToken(), randomToken(), randomToken()
+	jobs.addShare(ctx, "share-revoke", resultShare{TokenSHA256: hashAPIKey(lasting), Created: time.Now(), Expires: time.Now().Add(time.Hour)})
+	jobs.addShare(ctx, "share-revoke", resultShare{TokenSHA256: hashAPIKey(expired), Created: time.Now(), Expires: time.Now().Add(-time.Second)})
+	jobs.addShare(ctx, "share-revoke", resultShare{TokenSHA256: hashAPIKey(forever), Created: time.Now()})
+
+	for token, want := range map[string]bool{lasting: true, expired: false, forever: true} {
+		if _, ok := jobs.sharedJob(ctx, token); ok != want {
+			t.Errorf("link %s works: %v, want %v", token, ok, want)
+		}
+	}
+	j, _ := jobs.get("share-revoke")
+	if n := activeShares(j); n != 2 {
+		t.Errorf("%d active links, want 2", n)
+	}
+
+	jobs.clearShares(ctx, "share-revoke")
+	for _, token := range []string{lasting, expired, forever} {
+		if _, ok := jobs.sharedJob(ctx, token); ok {
+			t.Errorf("link %s works after revocation", token)
+		}
+	}
+	if j, _ := jobs.get("share-revoke"); len(j.Shares) != 0 {
+		t.Errorf("job keeps %d links after revocation", len(j.Shares))
+	}
+}
+
+// memoryStore is an object store held in memory, standing in for the bucket
+// instances share
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memoryStore) put(_ context.Context, key string, body io.Reader, _ int64) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *memoryStore) get(_ context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStore) remove(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStore) list(_ context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// withMemoryStore shares results through a fresh memoryStore for the length of the test
+func withMemoryStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := &memoryStore{objects: make(map[string][]byte)}
+	saved := sharedStore
+	sharedStore = store
+	t.Cleanup(func() { sharedStore = saved })
+	return store
+}
+
+// storeRecord saves j as another instance would, beside its result
+func (s *memoryStore) storeRecord(t *testing.T, j job) {
+	t.Helper()
+	data, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.objects[resultRecordKey(j.ID)] = data
+}
+
+func TestShareFoundThroughObjectStore(t *testing.T) {
+	ctx := context.Background()
+	store := withMemoryStore(t)
+	token := randomToken()
+	hash := hashAPIKey(token)
+	other := job{ID: "share-elsewhere", Result: "share-elsewhere.png", Format: "png", Created: time.Now(), Shares: []resultShare{{TokenSHA256: hash, Created: time.Now()}}}
+	store.storeRecord(t, other)
+	store.objects[shareKey(hash)] = []byte(other.ID)
+	forgetJobAfter(t, other.ID)
+
+	if j, ok := jobs.sharedJob(ctx, token); !ok || j.ID != other.ID {
+		t.Fatalf("a link another instance gave out unlocks %q, %v, want its job", j.ID, ok)
+	}
+	if _, ok := jobs.get(other.ID); !ok {
+		t.Error("the job of the link was not adopted")
+	}
+
+	other.Shares = nil // Revoked by the other instance
+	store.storeRecord(t, other)
+	if _, ok := jobs.sharedJob(ctx, token); ok {
+		t.Error("a link revoked by another instance still works here")
+	}
+	if j, _ := jobs.get(other.ID); len(j.Shares) != 0 {
+		t.Errorf("the adopted job keeps %d revoked links", len(j.Shares))
+	}
+}
+
+func TestShareSavedToObjectStore(t *testing.T) {
+	ctx := context.Background()
+	store := withMemoryStore(t)
+	sharedTestJob(t, "share-saved")
+	token := randomToken()
+	jobs.addShare(ctx, "share-saved", resultShare{TokenSHA256: hashAPIKey(token), Created: time.Now()})
+
+	if id := string(store.objects[shareKey(hashAPIKey(token))]); id != "share-saved" {
+		t.Errorf("the store maps the link to %q, want its job", id)
+	}
+	for key, data := range store.objects {
+		if strings.Contains(key, token) || bytes.Contains(data, []byte(token)) {
+			t.Errorf("the store keeps the token itself under %s", key)
+		}
+	}
+	if _, ok := jobs.sharedJob(ctx, token); !ok {
+		t.Fatal("the new link does not work")
+	}
+
+	jobs.clearShares(ctx, "share-saved")
+	if _, ok := store.objects[shareKey(hashAPIKey(token))]; ok {
+		t.Error("the revoked link stays in the store")
+	}
+	if _, ok := jobs.sharedJob(ctx, token); ok {
+		t.Error("the revoked link still works")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A clip shot in the hand shakes, and every frame of it is a burst with its
+// neighbours. The stabilize command follows the camera from frame to frame by
+// the shift search, chaining the shifts into the path it took, and writes a
+// video whose every frame is fused from it and the frames nearest it, moved
+// onto it along that path, then moved again from the path onto the path
+// averaged over -smooth frames, which keeps pans and drops the shake. The
+// edges uncovered by the steadiest frame are cropped off every frame alike.
+
+const (
+	defaultStabilizeWindow = 5  // Frames fused into every frame of the video unless -window says otherwise
+	defaultStabilizeSmooth = 30 // Frames the path of the camera is averaged over unless -smooth says otherwise
+	defaultVideoFPS        = 30 // Frame rate of the video written unless -fps says otherwise
+)
+
+// stabilizeCommand writes the frames of a clip as a video, stabilized and fused
+// with their neighbours
+func stabilizeCommand(args []string) int {
+	fs := flag.NewFlagSet("stabilize", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s stabilize -output <video> [flags] <clip or frame>...\n\nWrites the frames as a video, steadied along the path of the camera, each fused with those nearest it and upscaled.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "", "video file written through ffmpeg, its format picked by the extension: "+strings.Join(videoExtensions, ", ")+" (required)")
+	window := fs.Int("window", defaultStabilizeWindow, fmt.Sprintf("frames fused into every frame of the video, it and those nearest it in the clip, 1-%d", maxFusedFrames))
+	smooth := fs.Int("smooth", defaultStabilizeSmooth, "frames the path of the camera is averaged over, which pans slower than that are kept of; 0 holds the view of the first frame still")
+	fps := fs.Float64("fps", defaultVideoFPS, "frame rate of the video written, that of the clip to play it at its speed")
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	req := pipelineFlags(fs)
+	clip := videoFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if *output == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return exitBadInput
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	events := jsonEvents(false)
+	start := time.Now()
+	result, err := stabilizeClip(ctx, fs.Args(), *clip, *req, *window, *smooth, *fps, *output, events)
+	if err != nil {
+		slog.Error("Error stabilizing clip", "error", err)
+		events.emit("error", "", map[string]any{"error": err.Error(), "exit_code": exitCode(err)})
+		return exitCode(err)
+	}
+	slog.Info("Clip stabilized", "frames", len(result.frames), "output", *output, "duration", time.Since(start).Round(time.Millisecond))
+	events.emit("result", "", map[string]any{
+		"path":             *output,
+		"width":            result.width,
+		"height":           result.height,
+		"scale":            result.scale,
+		"algorithm":        result.algorithm,
+		"window":           result.window,
+		"fps":              *fps,
+		"frames":           result.frames,
+		"duration_seconds": time.Since(start).Seconds(),
+	})
+	return exitOK
+}
+
+// stabilizedClip is what stabilizeClip wrote
+type stabilizedClip struct {
+	frames        []frameReport // The move that steadied every frame, in pixels of the frames
+	width, height int           // Of the video
+	scale         int
+	algorithm     string
+	window        int // Frames fused into every frame, fewer than asked of a shorter clip
+}
+
+// stabilizeClip decodes the frames at paths, those of videos as clip selects,
+// and writes them to the video at output, each fused with the window frames
+// nearest it by the options of req and moved onto the path of the camera
+// averaged over smooth frames. Progress is reported to events, which may be nil.
+func stabilizeClip(ctx context.Context, paths []string, clip videoClip, req superResolutionRequestV1, window, smooth int, fps float64, output string, events *commandEvents) (stabilizedClip, error) {
+	invalid := func(format string, a ...any) error {
+		return &commandError{exitBadInput, fmt.Errorf(format, a...)}
+	}
+	switch {
+	case !isVideoFile(output):
+		return stabilizedClip{}, invalid("-output must be a video file, named with one of %s", strings.Join(videoExtensions, ", "))
+	case window < 1 || window > maxFusedFrames:
+		return stabilizedClip{}, invalid("-window must be from 1 to %d frames", maxFusedFrames)
+	case smooth < 0:
+		return stabilizedClip{}, invalid("-smooth must be 0 or more frames")
+	case fps <= 0 || math.IsInf(fps, 0):
+		return stabilizedClip{}, invalid("-fps must be a positive frame rate")
+	}
+	if _, err := findFFmpeg(); err != nil {
+		return stabilizedClip{}, &commandError{exitBadInput, err}
+	}
+	images, _, err := decodeFrameFiles(ctx, paths, clip)
+	if err != nil {
+		return stabilizedClip{}, err
+	}
+	if len(images) == 0 {
+		return stabilizedClip{}, &commandError{exitFewFrames, errors.New("no frames: expected a video file, or JPEG, PNG, GIF or TIFF files")}
+	}
+	window = min(window, len(images))
+	opts, reqErr := req.options(window)
+	if reqErr != nil {
+		return stabilizedClip{}, reqErr
+	}
+	switch {
+	case opts.Align != "":
+		return stabilizedClip{}, invalid("-align %s cannot be used with stabilize, which follows the camera from frame to frame by the shift search", opts.Align)
+	case opts.Keep > 0:
+		return stabilizedClip{}, invalid("-keep cannot be used with stabilize, which fuses every frame of the window")
+	}
+	if opts.Algorithm == algorithmReference {
+		window = 1 // Every frame upscaled alone, only steadied
+	}
+	sizes := make([]image.Point, len(images))
+	for i, img := range images {
+		sizes[i] = img.Bounds().Size()
+	}
+	if mismatch := sizeMismatch(sizes, frameNames(paths, len(images)), 0); mismatch != "" {
+		if opts.Fit == "" {
+			return stabilizedClip{}, &commandError{exitAlignment, fmt.Errorf("%s; use -fit %s or -fit %s to bring the frames to a common size", mismatch, fitCrop, fitResize)}
+		}
+		images, _ = fitFrames(images, 0, opts.Fit)
+	}
+	whole := opts
+	whole.ManyFrames = manyFramesAll // Every frame of the clip is a frame of the video
+	if images, reqErr = prepareFrames(ctx, images, whole); reqErr != nil {
+		return stabilizedClip{}, reqErr
+	}
+	progress := func(stage string, done, total int) {
+		events.emit("progress", "", map[string]any{"stage": stage, "done": done, "total": total})
+	}
+	events.emit("start", "", map[string]any{"frames": len(images)})
+
+	// The path of the camera: how far every frame must move to line up with the first
+	path := make([]image.Point, len(images))
+	for i := 1; i < len(images); i++ {
+		previous := images[i-1]
+		if opts.MaskOverlays {
+			previous = withoutOverlays(previous)
+		}
+		dx, dy := findOverlap(ctx, previous, images[i])
+		if err := ctx.Err(); err != nil {
+			return stabilizedClip{}, err
+		}
+		path[i] = path[i-1].Add(image.Pt(dx, dy))
+		progress("align", i, len(images)-1)
+	}
+	steady := steadyPath(path, smooth)
+	frames := make([]frameReport, len(images))
+	var margin image.Point // The furthest any frame is moved to steady it, cropped off all of them
+	for i, img := range images {
+		move := path[i].Sub(steady[i])
+		frames[i] = frameReport{Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), ShiftX: move.X, ShiftY: move.Y}
+		margin.X = max(margin.X, move.X, -move.X)
+		margin.Y = max(margin.Y, move.Y, -move.Y)
+	}
+	size := images[0].Bounds().Size()
+	if 2*margin.X >= size.X || 2*margin.Y >= size.Y {
+		return stabilizedClip{}, &commandError{exitAlignment, fmt.Errorf("the camera moved %d pixels across and %d down from where the steadied view would be, more than half the %dx%d frame; lower -smooth to follow it closer", margin.X, margin.Y, size.X, size.Y)}
+	}
+	slog.InfoContext(ctx, "Camera path measured", "frames", len(images), "crop_x", margin.X, "crop_y", margin.Y)
+
+	var width, height int
+	err = writeVideo(ctx, output, fps, func(put func(image.Image) error) error {
+		for i := range images {
+			// The window nearest the frame, as many at the ends of the clip
+			lo := max(min(i-(window-1)/2, len(images)-window), 0)
+			burst := []image.Image{images[i]}
+			frameOpts := opts
+			frameOpts.Offsets = []*frameOffset{nil}
+			for j := lo; j < lo+window; j++ {
+				if j == i {
+					continue
+				}
+				d := path[j].Sub(path[i])
+				burst = append(burst, images[j])
+				frameOpts.Offsets = append(frameOpts.Offsets, &frameOffset{DX: d.X, DY: d.Y})
+			}
+			acc, err := accumulateSuperResolution(ctx, burst, frameOpts)
+			if err != nil {
+				return err
+			}
+			fused := renderResult(acc, 0, acc.height, frameOpts)
+			acc.release()
+			scale := fused.Bounds().Dx() / size.X
+			move := image.Pt(frames[i].ShiftX, frames[i].ShiftY).Mul(scale)
+			crop := fused.Bounds()
+			crop.Min = crop.Min.Add(margin.Mul(scale))
+			crop.Max = crop.Max.Sub(margin.Mul(scale))
+			width, height = crop.Dx(), crop.Dy()
+			if err := put(fused.SubImage(crop.Sub(move))); err != nil {
+				return err
+			}
+			progress("fuse", i+1, len(images))
+		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return stabilizedClip{}, ctx.Err()
+		}
+		var ffErr *ffmpegError
+		if errors.As(err, &ffErr) {
+			return stabilizedClip{}, &commandError{exitInternal, fmt.Errorf("%s: %w", output, err)}
+		}
+		return stabilizedClip{}, err
+	}
+	return stabilizedClip{frames: frames, width: width, height: height, scale: opts.Scale, algorithm: opts.Algorithm, window: window}, nil
+}
+
+// steadyPath returns the path of the camera averaged over smooth frames around
+// every frame, fewer at the ends of the clip, or held at the first frame for 0
+func steadyPath(path []image.Point, smooth int) []image.Point {
+	steady := make([]image.Point, len(path))
+	if smooth == 0 {
+		return steady
+	}
+	for i := range path {
+		lo, hi := max(i-smooth/2, 0), min(i+(smooth-1)/2+1, len(path))
+		var x, y float64
+		for _, p := range path[lo:hi] {
+			x += float64(p.X)
+			y += float64(p.Y)
+		}
+		n := float64(hi - lo)
+		steady[i] = image.Pt(int(math.Round(x/n)), int(math.Round(y/n)))
+	}
+	return steady
+}
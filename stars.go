@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"image"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+)
+
+// alignStars is the align value that registers frames by their stars: the shift
+// search compares whole frames, which on a star field is mostly dark sky and
+// noise and settles on whatever shift lines up the noise
+const alignStars = "stars"
+
+// Star detection and matching
+const (
+	starThreshold  = 5   // Noise deviations above the sky a pixel needs to be part of a star
+	maxStarArea    = 400 // Pixels; larger bright patches are the Moon, a planet or the horizon
+	maxStars       = 100 // Brightest stars kept per frame
+	patternStars   = 20  // Brightest stars pairs are drawn from to guess a frame's rotation
+	starTolerance  = 2.0 // Pixels a star may land from its match
+	minStarMatches = 3
+)
+
+// star is a star found in a frame
+type star struct {
+	X, Y float64 // Centroid, in pixels of the frame
+	Flux float64 // Brightness above the sky, summed over the star
+}
+
+// detectStars returns the stars of img, brightest first: the connected patches
+// of pixels well above the sky background, with their brightness-weighted
+// centroid. Single bright pixels are left out, as they are hot pixels or
+// cosmic-ray hits more often than stars.
+func detectStars(img image.Image) []star {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	luma := lumaPlane(img)
+
+	// The sky is the median and its noise the median absolute deviation, which
+	// the stars, being few pixels, barely move
+	sample := make([]float64, 0, len(luma)/4+1)
+	for i := 0; i < len(luma); i += 4 {
+		sample = append(sample, luma[i])
+	}
+	slices.Sort(sample)
+	sky := sample[len(sample)/2]
+	for i, v := range sample {
+		sample[i] = math.Abs(v - sky)
+	}
+	slices.Sort(sample)
+	noise := max(1.4826*sample[len(sample)/2], 1) // Scaled to a standard deviation; 8-bit frames have no less
+	threshold := sky + starThreshold*noise
+
+	var stars []star
+	visited := make([]bool, w*h)
+	var stack []int
+	for start, v := range luma {
+		if visited[start] || v < threshold {
+			continue
+		}
+		var s star
+		area, edge := 0, false
+		visited[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%w, i/w
+			weight := luma[i] - sky
+			s.X += weight * float64(x)
+			s.Y += weight * float64(y)
+			s.Flux += weight
+			area++
+			edge = edge || x == 0 || y == 0 || x == w-1 || y == h-1
+			for _, n := range [4]int{i - 1, i + 1, i - w, i + w} {
+				if n < 0 || n >= len(luma) || (n == i-1 && x == 0) || (n == i+1 && x == w-1) {
+					continue
+				}
+				if !visited[n] && luma[n] >= threshold {
+					visited[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+		if area < 2 || area > maxStarArea || edge { // A star cut by the edge has its centroid pulled inwards
+			continue
+		}
+		s.X = s.X/s.Flux + float64(b.Min.X) + 0.5
+		s.Y = s.Y/s.Flux + float64(b.Min.Y) + 0.5
+		stars = append(stars, s)
+	}
+	slices.SortFunc(stars, func(a, b star) int { return cmp.Compare(b.Flux, a.Flux) })
+	if len(stars) > maxStars {
+		stars = stars[:maxStars]
+	}
+	return stars
+}
+
+// starTransform is a rigid motion of a frame onto the reference: a rotation by
+// angle radians about the origin, then a move by tx, ty
+type starTransform struct {
+	angle, tx, ty float64
+}
+
+// apply returns where the transform takes the point x, y
+func (t starTransform) apply(x, y float64) (float64, float64) {
+	sin, cos := math.Sincos(t.angle)
+	return cos*x - sin*y + t.tx, sin*x + cos*y + t.ty
+}
+
+// matchStars finds the rigid motion that takes the stars of a frame onto those
+// of the reference, both brightest first. Every pair of bright reference stars
+// is tried against every pair of frame stars the same distance apart; the guess
+// landing the most stars on a reference star wins and is refined by least
+// squares over all of them. A field turning about the celestial pole, wherever
+// the pole is, is such a motion. It returns the number of stars matched.
+func matchStars(reference, frame []star) (starTransform, int) {
+	var best starTransform
+	bestMatches := 0
+	refPattern, framePattern := reference[:min(len(reference), patternStars)], frame[:min(len(frame), patternStars)]
+	for i := range refPattern {
+		for j := i + 1; j < len(refPattern); j++ {
+			ri, rj := refPattern[i], refPattern[j]
+			refDist := math.Hypot(rj.X-ri.X, rj.Y-ri.Y)
+			if refDist < 4*starTolerance {
+				continue
+			}
+			for k := range framePattern {
+				for l := range framePattern {
+					fk, fl := framePattern[k], framePattern[l]
+					if k == l || math.Abs(math.Hypot(fl.X-fk.X, fl.Y-fk.Y)-refDist) > starTolerance {
+						continue
+					}
+					angle := math.Atan2(rj.Y-ri.Y, rj.X-ri.X) - math.Atan2(fl.Y-fk.Y, fl.X-fk.X)
+					guess := starTransform{angle: angle}
+					x, y := guess.apply(fk.X, fk.Y)
+					guess.tx, guess.ty = ri.X-x, ri.Y-y
+					if matches := len(starPairs(reference, framePattern, guess)); matches > bestMatches {
+						best, bestMatches = guess, matches
+					}
+				}
+			}
+		}
+	}
+	if bestMatches < minStarMatches {
+		return best, bestMatches
+	}
+	pairs := starPairs(reference, frame, best)
+	return fitRigid(pairs), len(pairs)
+}
+
+// starPairs pairs every star of frame that t lands within starTolerance of a
+// reference star with that star, as frame then reference
+func starPairs(reference, frame []star, t starTransform) [][2]star {
+	var pairs [][2]star
+	for _, f := range frame {
+		x, y := t.apply(f.X, f.Y)
+		for _, r := range reference {
+			if math.Abs(r.X-x) <= starTolerance && math.Abs(r.Y-y) <= starTolerance {
+				pairs = append(pairs, [2]star{f, r})
+				break
+			}
+		}
+	}
+	return pairs
+}
+
+// fitRigid returns the rotation and move that best take the first star of every
+// pair onto the second, in the least-squares sense
+func fitRigid(pairs [][2]star) starTransform {
+	var fx, fy, rx, ry float64
+	for _, p := range pairs {
+		fx += p[0].X
+		fy += p[0].Y
+		rx += p[1].X
+		ry += p[1].Y
+	}
+	n := float64(len(pairs))
+	fx, fy, rx, ry = fx/n, fy/n, rx/n, ry/n
+	var cross, dot float64
+	for _, p := range pairs {
+		ax, ay := p[0].X-fx, p[0].Y-fy
+		bx, by := p[1].X-rx, p[1].Y-ry
+		cross += ax*by - ay*bx
+		dot += ax*bx + ay*by
+	}
+	t := starTransform{angle: math.Atan2(cross, dot)}
+	x, y := t.apply(fx, fy)
+	t.tx, t.ty = rx-x, ry-y
+	return t
+}
+
+// starOffsets registers every frame after the first by its stars and returns
+// the offset that aligns each, as one set by hand would. Frames with too few
+// stars in common with the reference get a nil entry.
+func starOffsets(ctx context.Context, images []image.Image) []*frameOffset {
+	found := make([]*frameOffset, len(images))
+	reference := detectStars(images[0])
+	slog.InfoContext(ctx, "Stars detected in the reference frame", "stars", len(reference))
+	b := images[0].Bounds()
+	cx, cy := float64(b.Min.X)+float64(b.Dx())/2, float64(b.Min.Y)+float64(b.Dy())/2
+	var wg sync.WaitGroup
+	for i := 1; i < len(images); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stars := detectStars(images[i])
+			t, matched := matchStars(reference, stars)
+			if matched < minStarMatches {
+				slog.WarnContext(ctx, "Too few stars matched, searching for the shift instead", "frame", i, "stars", len(stars), "matched", matched)
+				return
+			}
+			// transformFrame turns about the frame's centre: the move is what is
+			// left of t once the centre is turned in place
+			x, y := t.apply(cx, cy)
+			o := &frameOffset{DX: int(math.Round(x - cx)), DY: int(math.Round(y - cy)), Angle: t.angle * 180 / math.Pi}
+			slog.InfoContext(ctx, "Frame registered by its stars", "frame", i, "stars", len(stars), "matched", matched, "dx", o.DX, "dy", o.DY, "angle", o.Angle)
+			found[i] = o
+		}()
+	}
+	wg.Wait()
+	return found
+}
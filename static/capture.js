@@ -0,0 +1,111 @@
+// Burst capture: streams the camera into the viewfinder, grabs a quick series
+// of full-resolution frames and posts them to the upload endpoint as JPEG files,
+// then shows the fused result on the page. Bursts taken offline are handed to
+// offlineQueue.
+(function () {
+  var form = document.getElementById('capture');
+  var video = document.getElementById('viewfinder');
+  var start = document.getElementById('start');
+  var shoot = document.getElementById('shoot');
+  var burst = document.getElementById('burst');
+  var interval = document.getElementById('interval');
+  var status = document.getElementById('status');
+  var result = document.getElementById('result');
+  var stream = null;
+
+  if (!navigator.mediaDevices || !navigator.mediaDevices.getUserMedia) {
+    status.textContent = t('This browser cannot use the camera here. Camera access needs HTTPS (or localhost).');
+    start.disabled = true;
+    return;
+  }
+
+  function wait(ms) {
+    return new Promise(function (resolve) { setTimeout(resolve, ms); });
+  }
+
+  function grab(canvas) {
+    canvas.getContext('2d').drawImage(video, 0, 0, canvas.width, canvas.height);
+    return new Promise(function (resolve) { canvas.toBlob(resolve, 'image/jpeg', 0.95); });
+  }
+
+  start.addEventListener('click', function () {
+    // Ask for the back camera at the highest resolution it offers
+    navigator.mediaDevices.getUserMedia({
+      audio: false,
+      video: {facingMode: {ideal: 'environment'}, width: {ideal: 4096}, height: {ideal: 3072}}
+    }).then(function (s) {
+      stream = s;
+      video.srcObject = s;
+      start.disabled = true;
+      shoot.disabled = false;
+      status.textContent = '';
+    }).catch(function (err) {
+      status.textContent = t('Could not start the camera: {0}', err.message);
+    });
+  });
+
+  form.addEventListener('submit', function (e) {
+    e.preventDefault();
+    if (!stream || !video.videoWidth) {
+      return;
+    }
+    var count = Math.max(2, Math.min(Number(burst.value) || 2, Number(burst.max) || 64));
+    var delay = Math.max(0, Number(interval.value) || 0);
+    var canvas = document.createElement('canvas');
+    canvas.width = video.videoWidth;
+    canvas.height = video.videoHeight;
+    var data = new FormData(form);
+    shoot.disabled = true;
+    result.textContent = '';
+
+    var taken = 0;
+    function next() {
+      if (taken === count) {
+        return Promise.resolve();
+      }
+      status.textContent = t('Capturing frame {0} of {1}…', taken + 1, count);
+      return grab(canvas).then(function (blob) {
+        taken++;
+        data.append('images', blob, 'frame' + String(taken).padStart(3, '0') + '.jpg');
+        return taken < count ? wait(delay).then(next) : null;
+      });
+    }
+
+    next().then(function () {
+      status.textContent = t('Processing {0} frames…', count);
+      // Ask for the image itself rather than the result page
+      return fetch(form.action, {method: 'POST', body: data, credentials: 'same-origin', headers: {Accept: 'image/*'}});
+    }).then(function (resp) {
+      if (!resp.ok) {
+        return resp.text().then(function (text) { throw new Error(text || resp.statusText); });
+      }
+      return resp.blob();
+    }).then(function (blob) {
+      var url = URL.createObjectURL(blob);
+      var img = document.createElement('img');
+      img.className = 'img-fluid rounded mb-2';
+      img.alt = t('Super-resolution result');
+      img.src = url;
+      var link = document.createElement('a');
+      link.className = 'btn btn-primary';
+      link.href = url;
+      link.download = blob.type === 'image/png' ? 'superres.png' : 'superres.jpg';
+      link.textContent = t('Download');
+      result.append(img, link);
+      status.textContent = t('Done.');
+    }).catch(function (err) {
+      // fetch fails with a TypeError when the server cannot be reached: keep
+      // the burst and send it when the connection returns
+      if (err instanceof TypeError && offlineQueue) {
+        return offlineQueue.add(data).then(function () {
+          status.textContent = t('Saved offline: the burst is submitted when the connection returns. Keep this page open or come back to it.');
+        });
+      }
+      status.textContent = t('Error: {0}', err.message);
+    }).catch(function (err) {
+      status.textContent = t('Error: {0}', err.message);
+    }).then(function () {
+      shoot.disabled = false;
+    });
+  });
+})();
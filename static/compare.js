@@ -0,0 +1,31 @@
+// Wipe slider on the result page: the fused result covers the bicubic upscale
+// to the right of the divider, which follows the range input or a drag on the images.
+(function () {
+  var compare = document.getElementById('compare');
+  var after = document.getElementById('after');
+  var divider = document.getElementById('divider');
+  var wipe = document.getElementById('wipe');
+
+  function show(percent) {
+    percent = Math.max(0, Math.min(100, percent));
+    after.style.clipPath = 'inset(0 0 0 ' + percent + '%)';
+    divider.style.left = percent + '%';
+    wipe.value = percent;
+  }
+
+  function follow(e) {
+    var rect = compare.getBoundingClientRect();
+    show((e.clientX - rect.left) / rect.width * 100);
+  }
+
+  wipe.addEventListener('input', function () { show(Number(wipe.value)); });
+  compare.addEventListener('pointerdown', function (e) {
+    compare.setPointerCapture(e.pointerId);
+    follow(e);
+  });
+  compare.addEventListener('pointermove', function (e) {
+    if (compare.hasPointerCapture(e.pointerId)) {
+      follow(e);
+    }
+  });
+})();
@@ -0,0 +1,13 @@
+// Translations for the page scripts: t() looks up the English text of a message
+// in the catalog the server embedded for the page's language, falling back to
+// the English, and fills {0}, {1}... with the remaining arguments.
+var t = (function () {
+  var element = document.getElementById('messages');
+  var catalog = element ? JSON.parse(element.textContent) : {};
+  return function (text) {
+    var args = arguments;
+    return (catalog[text] || text).replace(/\{(\d+)\}/g, function (match, i) {
+      return args[Number(i) + 1];
+    });
+  };
+})();
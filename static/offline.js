@@ -0,0 +1,120 @@
+// Offline queue of the capture page: bursts that could not be sent are kept in
+// IndexedDB and submitted when the connection returns, on this page or the next
+// time it is opened. Each is sent with the token of the current form, since the
+// session the burst was captured in may have ended meanwhile.
+var offlineQueue = (function () {
+  var list = document.getElementById('queued');
+  var form = document.getElementById('capture');
+  var sending = false;
+
+  function open() {
+    return new Promise(function (resolve, reject) {
+      var request = indexedDB.open('chicha-sr', 1);
+      request.onupgradeneeded = function () {
+        request.result.createObjectStore('bursts', {keyPath: 'id', autoIncrement: true});
+      };
+      request.onsuccess = function () { resolve(request.result); };
+      request.onerror = function () { reject(request.error); };
+    });
+  }
+
+  // store runs fn on the bursts store and resolves with the result of its request
+  function store(mode, fn) {
+    return open().then(function (db) {
+      return new Promise(function (resolve, reject) {
+        var request = fn(db.transaction('bursts', mode).objectStore('bursts'));
+        request.onsuccess = function () { resolve(request.result); };
+        request.onerror = function () { reject(request.error); };
+      });
+    });
+  }
+
+  function render() {
+    return store('readonly', function (s) { return s.count(); }).then(function (n) {
+      list.textContent = n ? t('{0} burst(s) waiting to be submitted when the connection returns.', n) : '';
+    });
+  }
+
+  // add keeps a burst for later: its form fields and its frames
+  function add(data) {
+    var burst = {created: Date.now(), fields: [], frames: []};
+    data.forEach(function (value, name) {
+      if (value instanceof Blob) {
+        burst.frames.push({name: name, blob: value, filename: value.name});
+      } else if (name !== 'csrf_token') {
+        burst.fields.push([name, value]);
+      }
+    });
+    return store('readwrite', function (s) { return s.add(burst); }).then(render);
+  }
+
+  // refreshToken loads the capture page again for a token of the current
+  // session: a page opened offline comes from the cache with an old one
+  function refreshToken() {
+    return fetch(location.href, {credentials: 'same-origin', cache: 'no-store'}).then(function (resp) {
+      return resp.text();
+    }).then(function (html) {
+      var field = new DOMParser().parseFromString(html, 'text/html').querySelector('input[name="csrf_token"]');
+      if (field) {
+        form.elements.csrf_token.value = field.value;
+      }
+    });
+  }
+
+  function send(burst, retried) {
+    var data = new FormData();
+    data.append('csrf_token', form.elements.csrf_token.value);
+    burst.fields.forEach(function (field) { data.append(field[0], field[1]); });
+    burst.frames.forEach(function (frame) { data.append(frame.name, frame.blob, frame.filename); });
+    return fetch(form.action, {method: 'POST', body: data, credentials: 'same-origin', headers: {Accept: 'image/*'}}).then(function (resp) {
+      if (resp.status === 403 && !retried) {
+        return refreshToken().then(function () { return send(burst, true); });
+      }
+      if (!resp.ok) {
+        return resp.text().then(function (text) { throw new Error(text || resp.statusText); });
+      }
+      return resp.blob();
+    });
+  }
+
+  // flush submits the queued bursts one by one, oldest first, and offers each
+  // result for download. A burst the server refuses is dropped so it cannot
+  // block the queue; one that fails to reach it waits for the next attempt.
+  function flush() {
+    if (sending || !navigator.onLine) {
+      return;
+    }
+    sending = true;
+    store('readonly', function (s) { return s.getAll(); }).then(function (bursts) {
+      return bursts.reduce(function (previous, burst) {
+        return previous.then(function () {
+          return send(burst).then(function (blob) {
+            var link = document.createElement('a');
+            link.className = 'btn btn-outline-primary btn-sm me-2 mb-2';
+            link.href = URL.createObjectURL(blob);
+            link.download = 'superres-' + new Date(burst.created).toISOString().replace(/[:.]/g, '-') + (blob.type === 'image/png' ? '.png' : '.jpg');
+            link.textContent = t('Download the burst captured at {0}', new Date(burst.created).toLocaleTimeString());
+            document.getElementById('result').appendChild(link);
+            return store('readwrite', function (s) { return s.delete(burst.id); });
+          }, function (err) {
+            if (err instanceof TypeError) {
+              throw err; // Still offline
+            }
+            document.getElementById('status').textContent = t('A queued burst was refused: {0}', err.message);
+            return store('readwrite', function (s) { return s.delete(burst.id); });
+          });
+        });
+      }, Promise.resolve());
+    }).catch(function () {}).then(function () {
+      sending = false;
+      return render();
+    });
+  }
+
+  if (!window.indexedDB || !list || !form) {
+    return null;
+  }
+  window.addEventListener('online', flush);
+  render().then(flush).catch(function () {});
+  return {add: add};
+})();
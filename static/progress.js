@@ -0,0 +1,209 @@
+// Upload progress: posts the upload form in the background so the page can show
+// how much has been sent, then polls the job for its stage and an estimate of the
+// time left. The answer replaces the page or is offered as a download, as a
+// plain form submission would. A preview is shown in place instead, with a button
+// running the full job on the same selection, and so is the check of a burst, which
+// also sets the scale it recommends. A post redirected to a page of its own, as the
+// step-by-step workflow is, goes on to that page. Streamed results are left to the browser.
+(function () {
+  var box = document.getElementById('progress');
+  var form = document.querySelector('form[enctype="multipart/form-data"]');
+  if (!box || !form || !window.XMLHttpRequest) {
+    return;
+  }
+  var bar = box.querySelector('.progress-bar');
+  var stageText = document.getElementById('progress-stage');
+  var detailText = document.getElementById('progress-detail');
+  var stageNames = {assess: t('Checking the burst'), align: t('Aligning frames'), fuse: t('Fusing frames')};
+  var stream = document.getElementById('stream');
+
+  function requestID() {
+    var bytes = new Uint8Array(12);
+    crypto.getRandomValues(bytes);
+    return Array.prototype.map.call(bytes, function (b) { return ('0' + b.toString(16)).slice(-2); }).join('');
+  }
+
+  function duration(seconds) {
+    seconds = Math.round(seconds);
+    if (seconds < 60) {
+      return t('{0} s', seconds);
+    }
+    var minutes = Math.floor(seconds / 60);
+    if (minutes < 60) {
+      return t('{0} min {1} s', minutes, seconds % 60);
+    }
+    return t('{0} h {1} min', Math.floor(minutes / 60), minutes % 60);
+  }
+
+  function buttons(disabled) {
+    form.querySelectorAll('button[type="submit"]').forEach(function (button) { button.disabled = disabled; });
+  }
+
+  function show(stage, percent, detail) {
+    stageText.textContent = stage;
+    bar.style.width = percent + '%';
+    bar.setAttribute('aria-valuenow', Math.round(percent));
+    detailText.textContent = detail || '';
+  }
+
+  function poll(url, xhr) {
+    var timer = setInterval(function () {
+      if (xhr.readyState === 4) {
+        clearInterval(timer);
+        return;
+      }
+      fetch(url, {headers: {Accept: 'application/json'}, credentials: 'same-origin'})
+        .then(function (response) { return response.ok ? response.json() : null; })
+        .then(function (p) {
+          if (!p || xhr.readyState === 4) {
+            return;
+          }
+          if (p.status === 'uploading') {
+            show(t('Reading frames…'), 100);
+          } else if (p.status === 'queued') {
+            show(t('Waiting in the queue'), 0, t('Position {0} in the queue. Keep this page open: leaving it cancels the job.', p.queue_position));
+          } else if (p.stage) {
+            var detail = t('{0} of {1} frames, {2} elapsed', p.done, p.total, duration(p.elapsed_seconds));
+            if (p.eta_seconds !== undefined) {
+              detail += t(', about {0} left', duration(p.eta_seconds));
+            }
+            show(stageNames[p.stage] || p.stage, p.total ? 100 * p.done / p.total : 0, detail);
+          } else if (p.status === 'running') {
+            show(t('Starting…'), 0);
+          }
+        })
+        .catch(function () {});
+    }, 1000);
+  }
+
+  // showPreview puts the preview image under the progress bar, keeping the form
+  // and its files for the full run
+  function showPreview(blob) {
+    var img = document.createElement('img');
+    img.className = 'img-fluid rounded d-block my-2';
+    img.alt = t('Preview of the result');
+    img.src = URL.createObjectURL(blob);
+    var run = document.createElement('button');
+    run.type = 'button';
+    run.className = 'btn btn-success';
+    run.textContent = t('Run at full resolution');
+    run.addEventListener('click', function () {
+      form.requestSubmit(form.querySelector('button[type="submit"]:not([formaction])'));
+    });
+    show(t('Preview ready'), 100, t('A rough look at the result: the full job gives more detail.'));
+    detailText.append(img, run);
+    buttons(false);
+  }
+
+  // showAssessment puts the findings of a burst check under the progress bar and
+  // picks the recommended scale for the run that follows
+  function showAssessment(page) {
+    var found = new DOMParser().parseFromString(page, 'text/html').getElementById('assessment');
+    if (!found) {
+      return false;
+    }
+    found.querySelectorAll('a').forEach(function (link) { link.remove(); });
+    var scale = form.elements.scale;
+    if (scale && found.dataset.recommendedScale) {
+      scale.value = found.dataset.recommendedScale;
+    }
+    show(t('Burst checked'), 100);
+    detailText.append(document.adoptNode(found));
+    buttons(false);
+    return true;
+  }
+
+  function finish(xhr, action, previewing, checking) {
+    var type = xhr.getResponseHeader('Content-Type') || '';
+    if (checking && xhr.status >= 200 && xhr.status < 300 && type.indexOf('text/html') === 0) {
+      xhr.response.text().then(function (page) {
+        if (!showAssessment(page)) {
+          document.open();
+          document.write(page);
+          document.close();
+        }
+      });
+      return;
+    }
+    if (previewing && xhr.status >= 200 && xhr.status < 300 && type.indexOf('image/') === 0) {
+      showPreview(xhr.response);
+      return;
+    }
+    if (xhr.status >= 200 && xhr.status < 300 && type.indexOf('text/html') === 0 && xhr.responseURL && xhr.responseURL !== new URL(action, location.href).href) {
+      location.assign(xhr.responseURL); // Redirected to a page of its own, as the step-by-step workflow is
+      return;
+    }
+    if (xhr.status >= 200 && xhr.status < 300 && type.indexOf('text/html') === 0) {
+      xhr.response.text().then(function (page) {
+        document.open();
+        document.write(page);
+        document.close();
+      });
+      return;
+    }
+    if (xhr.status >= 200 && xhr.status < 300) {
+      var name = 'superres';
+      var match = /filename="([^"]+)"/.exec(xhr.getResponseHeader('Content-Disposition') || '');
+      if (match) {
+        name = match[1];
+      }
+      var link = document.createElement('a');
+      link.href = URL.createObjectURL(xhr.response);
+      link.download = name;
+      link.className = 'btn btn-success mt-2';
+      link.textContent = t('Download {0}', name);
+      show(t('Done'), 100);
+      detailText.textContent = '';
+      detailText.appendChild(link);
+      link.click();
+      return;
+    }
+    buttons(false);
+    xhr.response.text().then(function (message) {
+      bar.classList.add('bg-danger');
+      show(t('Failed'), 100, message.trim() || t('Error {0}', xhr.status));
+    });
+  }
+
+  form.addEventListener('submit', function (e) {
+    var action = (e.submitter && e.submitter.formAction) || form.action;
+    var previewing = /[?&]preview=true/.test(action);
+    var checking = /\/preflight$/.test(action.split('?')[0]);
+    if (e.defaultPrevented || (stream && stream.checked && !previewing && !checking)) {
+      return;
+    }
+    e.preventDefault();
+    var data = new FormData(form);
+    if (previewing || checking) {
+      data.delete('stream'); // Neither a preview nor a check is streamed
+      data.delete('bundle');
+    }
+    var id = requestID();
+    var xhr = new XMLHttpRequest();
+    xhr.open('POST', action);
+    xhr.setRequestHeader('X-Request-ID', id);
+    xhr.setRequestHeader('Accept', previewing ? 'image/*' : 'text/html');
+    xhr.responseType = 'blob';
+    xhr.upload.onprogress = function (p) {
+      if (p.lengthComputable) {
+        show(t('Uploading'), 100 * p.loaded / p.total, t('{0} of {1} MB', Math.round(p.loaded / 1048576), Math.round(p.total / 1048576)));
+      }
+    };
+    xhr.upload.onload = function () {
+      poll(box.dataset.progressUrl + id, xhr);
+    };
+    xhr.onload = function () {
+      finish(xhr, action, previewing, checking);
+    };
+    xhr.onerror = function () {
+      buttons(false);
+      bar.classList.add('bg-danger');
+      show(t('Failed'), 100, t('The connection to the server was lost.'));
+    };
+    bar.classList.remove('bg-danger');
+    box.classList.remove('d-none');
+    buttons(true);
+    show(t('Uploading'), 0);
+    xhr.send(data);
+  });
+})();
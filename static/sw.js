@@ -0,0 +1,54 @@
+// Service worker of the installable web UI: keeps the upload and capture pages
+// and the app icons so the app opens without a connection. Pages are fetched
+// from the network first, so a reachable server always wins over the cache.
+// Captures taken offline are queued by offline.js on the page, not here.
+var version = new URL(location.href).searchParams.get('v') || '0';
+var cacheName = 'chicha-sr-' + version;
+var scope = self.registration.scope;
+var shell = ['', 'capture', 'manifest.webmanifest', 'icon-192.png', 'icon-512.png'].map(function (path) {
+  return scope + path;
+});
+
+self.addEventListener('install', function (e) {
+  e.waitUntil(caches.open(cacheName).then(function (cache) {
+    // Pages behind a login answer with a redirect until the user has a session;
+    // only real pages are kept, so a later visit fills in what is missing
+    return Promise.all(shell.map(function (url) {
+      return fetch(url, {credentials: 'same-origin', redirect: 'manual'}).then(function (response) {
+        return response.ok ? cache.put(url, response) : null;
+      }).catch(function () {});
+    }));
+  }).then(function () {
+    return self.skipWaiting();
+  }));
+});
+
+self.addEventListener('activate', function (e) {
+  e.waitUntil(caches.keys().then(function (names) {
+    return Promise.all(names.filter(function (name) {
+      return name.indexOf('chicha-sr-') === 0 && name !== cacheName;
+    }).map(function (name) {
+      return caches.delete(name);
+    }));
+  }).then(function () {
+    return self.clients.claim();
+  }));
+});
+
+self.addEventListener('fetch', function (e) {
+  var url = e.request.url.split('?')[0].split('#')[0];
+  if (e.request.method !== 'GET' || shell.indexOf(url) < 0) {
+    return; // Results, API calls and uploads always go to the server
+  }
+  e.respondWith(fetch(e.request).then(function (response) {
+    if (response.ok && response.type === 'basic') {
+      var copy = response.clone();
+      caches.open(cacheName).then(function (cache) { cache.put(url, copy); });
+    }
+    return response;
+  }).catch(function () {
+    return caches.match(url).then(function (cached) {
+      return cached || Response.error();
+    });
+  }));
+});
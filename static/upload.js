@@ -0,0 +1,343 @@
+// Drop zone for the upload form: collects frames from drops and the file dialog,
+// previews them with a sharpness score, and lets the user remove or exclude
+// frames and pick the reference before submitting. When the server offers the
+// WebAssembly alignment preview, each frame also shows its approximate shift
+// against the reference and a warning when it will not fuse well. The form is
+// still posted normally, so the server sees the same request as without script.
+(function () {
+  var input = document.getElementById('images');
+  var zone = document.getElementById('dropzone');
+  var list = document.getElementById('previews');
+  var summary = document.getElementById('selection');
+  if (!input || !zone || !window.DataTransfer) {
+    return; // Keep the plain file input
+  }
+  var maxFileMB = Number(input.dataset.maxFileMb) || 0;
+  var maxFrames = Number(input.dataset.maxFrames) || 0;
+  var frames = []; // {file, url, included, sharpness, small, alignment, alignedTo}
+  var reference = null; // The frame the others are aligned to; the first included one by default
+  var previewURL = input.dataset.alignPreview || '';
+  var aligner = null; // Promise of the chichaAlignPreview function once the module runs
+  var aligning = false;
+
+  function formatMB(bytes) {
+    return t('{0} MB', (bytes / 1048576).toFixed(1));
+  }
+
+  function isImage(f) {
+    return f.type.indexOf('image/') === 0;
+  }
+
+  function included() {
+    return frames.filter(function (fr) { return fr.included; });
+  }
+
+  // sync mirrors the selection into the file input the form submits. The
+  // reference goes first, since the server aligns every frame to the first one.
+  function sync() {
+    var chosen = included();
+    if (reference && !reference.included) {
+      reference = null;
+    }
+    var ordered = reference ? [reference].concat(chosen.filter(function (fr) { return fr !== reference; })) : chosen;
+    var dt = new DataTransfer();
+    ordered.forEach(function (fr) { dt.items.add(fr.file); });
+    input.files = dt.files;
+  }
+
+  // sharpness scores a frame by the variance of its Laplacian on a small copy:
+  // blurred or shaken frames score low and are worth leaving out
+  function sharpness(fr) {
+    var img = new Image();
+    img.onload = function () {
+      var scale = Math.min(1, 256 / Math.max(img.width, img.height));
+      var w = Math.max(3, Math.round(img.width * scale));
+      var h = Math.max(3, Math.round(img.height * scale));
+      var canvas = document.createElement('canvas');
+      canvas.width = w;
+      canvas.height = h;
+      var ctx = canvas.getContext('2d');
+      ctx.drawImage(img, 0, 0, w, h);
+      var px = ctx.getImageData(0, 0, w, h).data;
+      var gray = new Float32Array(w * h);
+      for (var i = 0; i < w * h; i++) {
+        gray[i] = 0.299 * px[4 * i] + 0.587 * px[4 * i + 1] + 0.114 * px[4 * i + 2];
+      }
+      var sum = 0, sumSq = 0, n = 0;
+      for (var y = 1; y < h - 1; y++) {
+        for (var x = 1; x < w - 1; x++) {
+          var c = y * w + x;
+          var lap = gray[c - 1] + gray[c + 1] + gray[c - w] + gray[c + w] - 4 * gray[c];
+          sum += lap;
+          sumSq += lap * lap;
+          n++;
+        }
+      }
+      fr.sharpness = n ? sumSq / n - (sum / n) * (sum / n) : 0;
+
+      // A smaller copy still for the alignment preview, which compares every shift
+      var small = Math.min(1, 96 / Math.max(img.width, img.height));
+      canvas.width = Math.max(1, Math.round(img.width * small));
+      canvas.height = Math.max(1, Math.round(img.height * small));
+      ctx.drawImage(img, 0, 0, canvas.width, canvas.height);
+      fr.small = {
+        width: canvas.width,
+        height: canvas.height,
+        data: ctx.getImageData(0, 0, canvas.width, canvas.height).data,
+        fullWidth: img.width,
+        fullHeight: img.height
+      };
+      render();
+    };
+    img.src = fr.url;
+  }
+
+  // loadAligner starts the WebAssembly alignment preview the first time it is needed
+  function loadAligner() {
+    if (!aligner) {
+      aligner = new Promise(function (resolve, reject) {
+        var script = document.createElement('script');
+        script.src = input.dataset.wasmExec;
+        script.onload = resolve;
+        script.onerror = reject;
+        document.head.appendChild(script);
+      }).then(function () {
+        return fetch(previewURL);
+      }).then(function (resp) {
+        if (!resp.ok) {
+          throw new Error(resp.statusText);
+        }
+        return resp.arrayBuffer();
+      }).then(function (module) {
+        var go = new Go();
+        return WebAssembly.instantiate(module, go.importObject).then(function (result) {
+          go.run(result.instance);
+          return window.chichaAlignPreview;
+        });
+      });
+    }
+    return aligner;
+  }
+
+  // align previews the alignment of one frame at a time against the reference,
+  // so the page stays responsive; render calls it again for the next frame
+  function align() {
+    var ref = reference || included()[0];
+    if (!previewURL || aligning || !ref || !ref.small) {
+      return;
+    }
+    var next = included().filter(function (fr) {
+      return fr !== ref && fr.small && fr.alignedTo !== ref;
+    })[0];
+    if (!next) {
+      return;
+    }
+    aligning = true;
+    loadAligner().then(function (preview) {
+      next.alignment = preview(ref.small, next.small);
+      next.alignedTo = ref;
+    }).catch(function () {
+      previewURL = ''; // The preview is optional: uploading works without it
+    }).then(function () {
+      aligning = false;
+      setTimeout(render, 0);
+    });
+  }
+
+  function render() {
+    list.textContent = '';
+    var total = 0;
+    var sharpest = null;
+    included().forEach(function (fr) {
+      if (fr.sharpness !== null && (!sharpest || fr.sharpness > sharpest.sharpness)) {
+        sharpest = fr;
+      }
+    });
+    var first = included()[0];
+    var mismatched = 0;
+    frames.forEach(function (fr, i) {
+      var f = fr.file;
+      if (fr.included) {
+        total += f.size;
+      }
+      var col = document.createElement('div');
+      col.className = 'col';
+      var card = document.createElement('div');
+      card.className = 'card h-100' + (maxFileMB && f.size > maxFileMB * 1048576 ? ' border-danger' : '') +
+        ((reference || first) === fr ? ' border-primary border-2' : '');
+      if (!fr.included) {
+        card.style.opacity = '0.4';
+      }
+      if (fr.url) {
+        var img = document.createElement('img');
+        img.className = 'card-img-top';
+        img.alt = f.name;
+        img.style.objectFit = 'cover';
+        img.style.height = '90px';
+        img.src = fr.url;
+        card.appendChild(img);
+      } else {
+        var icon = document.createElement('div');
+        icon.className = 'card-img-top d-flex align-items-center justify-content-center bg-secondary text-white';
+        icon.style.height = '90px';
+        icon.textContent = 'ZIP';
+        card.appendChild(icon);
+      }
+      var body = document.createElement('div');
+      body.className = 'card-body p-1 small';
+      var name = document.createElement('div');
+      name.className = 'text-truncate';
+      name.title = f.name;
+      name.textContent = f.name;
+      var info = document.createElement('div');
+      info.className = 'text-muted';
+      info.textContent = formatMB(f.size);
+      if (fr.sharpness !== null) {
+        info.textContent += ' · ' + t('sharpness {0}', Math.round(fr.sharpness)) + (fr === sharpest ? ' ★' : '');
+        info.title = t('Variance of the Laplacian; higher is sharper');
+      }
+      body.append(name, info);
+      if (fr.included && fr.alignment && fr.alignedTo === (reference || first) && fr !== fr.alignedTo) {
+        var shift = document.createElement('div');
+        shift.className = fr.alignment.warning ? 'text-warning-emphasis' : 'text-muted';
+        shift.textContent = t('shift ≈ {0}, {1} px', fr.alignment.dx, fr.alignment.dy);
+        shift.title = t('Estimated in the browser against the reference frame, before uploading');
+        if (fr.alignment.warning) {
+          shift.textContent += ' · ' + t(fr.alignment.warning);
+          card.classList.add('border-warning');
+          mismatched++;
+        }
+        body.appendChild(shift);
+      }
+
+      var use = document.createElement('label');
+      use.className = 'd-block';
+      var box = document.createElement('input');
+      box.type = 'checkbox';
+      box.className = 'form-check-input me-1';
+      box.checked = fr.included;
+      box.addEventListener('change', function () {
+        fr.included = box.checked;
+        update();
+      });
+      use.append(box, t('Use'));
+      body.appendChild(use);
+
+      if (fr.url && fr.included) {
+        if ((reference || first) === fr) {
+          var badge = document.createElement('div');
+          badge.className = 'text-primary';
+          badge.textContent = t('Reference');
+          body.appendChild(badge);
+        } else {
+          var pick = document.createElement('button');
+          pick.type = 'button';
+          pick.className = 'btn btn-sm btn-link p-0 d-block';
+          pick.textContent = t('Make reference');
+          pick.title = t('Align the other frames to this one');
+          pick.addEventListener('click', function () {
+            reference = fr;
+            update();
+          });
+          body.appendChild(pick);
+        }
+      }
+
+      var remove = document.createElement('button');
+      remove.type = 'button';
+      remove.className = 'btn btn-sm btn-link text-danger p-0';
+      remove.textContent = t('Remove');
+      remove.addEventListener('click', function () {
+        if (fr.url) {
+          URL.revokeObjectURL(fr.url);
+        }
+        frames.splice(i, 1);
+        if (reference === fr) {
+          reference = null;
+        }
+        update();
+      });
+      body.appendChild(remove);
+      card.appendChild(body);
+      col.appendChild(card);
+      list.appendChild(col);
+    });
+
+    var count = included().length;
+    var text = frames.length ? t(frames.length === 1 ? '{0} of {1} file selected, {2}' : '{0} of {1} files selected, {2}', count, frames.length, formatMB(total)) : t('No files selected');
+    if (maxFrames && count > maxFrames) {
+      text += ' ' + t('(at most {0} frames are accepted)', maxFrames);
+    }
+    if (mismatched) {
+      text += ' ' + t('{0} frame(s) may not fuse well; consider leaving them out.', mismatched);
+    }
+    summary.textContent = text;
+    summary.classList.remove('text-danger');
+    align();
+  }
+
+  function update() {
+    sync();
+    render();
+  }
+
+  function add(fileList) {
+    Array.prototype.forEach.call(fileList, function (f) {
+      if (!isImage(f) && !/\.zip$/i.test(f.name)) {
+        return; // Same choice as the dialog's accept filter
+      }
+      var duplicate = frames.some(function (fr) {
+        return fr.file.name === f.name && fr.file.size === f.size && fr.file.lastModified === f.lastModified;
+      });
+      if (duplicate) {
+        return;
+      }
+      var fr = {file: f, url: isImage(f) ? URL.createObjectURL(f) : null, included: true, sharpness: null};
+      frames.push(fr);
+      if (fr.url) {
+        sharpness(fr);
+      }
+    });
+    update();
+  }
+
+  input.classList.add('d-none');
+  zone.classList.remove('d-none');
+  zone.addEventListener('click', function () { input.click(); });
+  zone.addEventListener('keydown', function (e) {
+    if (e.key === 'Enter' || e.key === ' ') {
+      e.preventDefault();
+      input.click();
+    }
+  });
+  input.addEventListener('change', function () {
+    // The dialog replaces the input's files, so add them to the selection instead
+    var picked = Array.prototype.slice.call(input.files);
+    add(picked);
+  });
+  ['dragenter', 'dragover'].forEach(function (type) {
+    zone.addEventListener(type, function (e) {
+      e.preventDefault();
+      zone.classList.add('border-primary', 'bg-body-secondary');
+    });
+  });
+  ['dragleave', 'drop'].forEach(function (type) {
+    zone.addEventListener(type, function (e) {
+      e.preventDefault();
+      zone.classList.remove('border-primary', 'bg-body-secondary');
+    });
+  });
+  zone.addEventListener('drop', function (e) {
+    add(e.dataTransfer.files);
+  });
+
+  // A hidden required input cannot show its own message, so explain here
+  input.form.addEventListener('submit', function (e) {
+    if (input.required && included().length === 0) {
+      e.preventDefault();
+      summary.textContent = t('Please add at least one image or ZIP archive.');
+      summary.classList.add('text-danger');
+    }
+  });
+  render();
+})();
@@ -0,0 +1,158 @@
+// Tiled result viewer: draws the Deep Zoom style tiles that cover the screen at
+// the current zoom, falling back to coarser tiles while finer ones load. Drag to
+// pan, use the wheel or pinch to zoom around the pointer.
+(function () {
+  var canvas = document.getElementById('viewer');
+  var ctx = canvas.getContext('2d');
+  var base = canvas.dataset.tiles;
+  var width = Number(canvas.dataset.width);
+  var height = Number(canvas.dataset.height);
+  var tileSize = Number(canvas.dataset.tileSize);
+  var maxLevel = Number(canvas.dataset.maxLevel);
+  var label = document.getElementById('zoom-level');
+  var tiles = {}; // Loaded or loading Image objects by "level/col_row"
+  var zoom = 1; // Screen pixels per result pixel
+  var originX = 0, originY = 0; // Result pixel at the top left of the canvas
+  var pending = false;
+
+  function tile(level, col, row) {
+    var key = level + '/' + col + '_' + row;
+    var img = tiles[key];
+    if (!img) {
+      img = new Image();
+      img.onload = redraw;
+      img.src = base + '/' + key + '.jpg';
+      tiles[key] = img;
+    }
+    return img.complete && img.naturalWidth ? img : null;
+  }
+
+  // drawLevel draws the visible tiles of one level and reports whether all were ready
+  function drawLevel(level, load) {
+    var factor = Math.pow(2, maxLevel - level); // Result pixels per tile pixel
+    var levelWidth = Math.ceil(width / factor), levelHeight = Math.ceil(height / factor);
+    var span = tileSize * factor;
+    var x0 = Math.max(0, Math.floor(originX / span));
+    var y0 = Math.max(0, Math.floor(originY / span));
+    var x1 = Math.min(Math.ceil(levelWidth / tileSize), Math.ceil((originX + canvas.width / zoom) / span));
+    var y1 = Math.min(Math.ceil(levelHeight / tileSize), Math.ceil((originY + canvas.height / zoom) / span));
+    var complete = true;
+    for (var row = y0; row < y1; row++) {
+      for (var col = x0; col < x1; col++) {
+        var key = level + '/' + col + '_' + row;
+        var img = load ? tile(level, col, row) : (tiles[key] && tiles[key].complete && tiles[key].naturalWidth ? tiles[key] : null);
+        if (!img) {
+          complete = false;
+          continue;
+        }
+        ctx.drawImage(img, (col * span - originX) * zoom, (row * span - originY) * zoom, img.naturalWidth * factor * zoom, img.naturalHeight * factor * zoom);
+      }
+    }
+    return complete;
+  }
+
+  function draw() {
+    pending = false;
+    ctx.fillStyle = '#222';
+    ctx.fillRect(0, 0, canvas.width, canvas.height);
+    var level = Math.max(0, Math.min(maxLevel, maxLevel + Math.ceil(Math.log2(zoom))));
+    // Paint whatever coarser tiles are already loaded under the wanted ones
+    for (var coarse = Math.max(0, level - 4); coarse < level; coarse++) {
+      drawLevel(coarse, false);
+    }
+    drawLevel(level, true);
+    label.textContent = Math.round(zoom * 100) + '%';
+  }
+
+  function redraw() {
+    if (!pending) {
+      pending = true;
+      requestAnimationFrame(draw);
+    }
+  }
+
+  function clamp() {
+    var viewW = canvas.width / zoom, viewH = canvas.height / zoom;
+    originX = viewW >= width ? (width - viewW) / 2 : Math.max(0, Math.min(width - viewW, originX));
+    originY = viewH >= height ? (height - viewH) / 2 : Math.max(0, Math.min(height - viewH, originY));
+  }
+
+  // zoomAt changes the zoom keeping the result pixel under (sx, sy) in place
+  function zoomAt(newZoom, sx, sy) {
+    var fit = Math.min(canvas.width / width, canvas.height / height);
+    newZoom = Math.max(Math.min(fit, 1), Math.min(8, newZoom));
+    originX += sx / zoom - sx / newZoom;
+    originY += sy / zoom - sy / newZoom;
+    zoom = newZoom;
+    clamp();
+    redraw();
+  }
+
+  function fit() {
+    zoom = Math.min(canvas.width / width, canvas.height / height);
+    clamp();
+    redraw();
+  }
+
+  function resize() {
+    var rect = canvas.getBoundingClientRect();
+    canvas.width = rect.width;
+    canvas.height = rect.height;
+    clamp();
+    redraw();
+  }
+
+  var pointers = {};
+  var pinch = 0;
+  canvas.addEventListener('pointerdown', function (e) {
+    canvas.setPointerCapture(e.pointerId);
+    pointers[e.pointerId] = {x: e.clientX, y: e.clientY};
+    canvas.style.cursor = 'grabbing';
+  });
+  canvas.addEventListener('pointermove', function (e) {
+    var last = pointers[e.pointerId];
+    if (!last) {
+      return;
+    }
+    var ids = Object.keys(pointers);
+    if (ids.length === 2) {
+      var other = pointers[ids[0] == e.pointerId ? ids[1] : ids[0]];
+      var distance = Math.hypot(e.clientX - other.x, e.clientY - other.y);
+      if (pinch) {
+        var rect = canvas.getBoundingClientRect();
+        zoomAt(zoom * distance / pinch, (e.clientX + other.x) / 2 - rect.left, (e.clientY + other.y) / 2 - rect.top);
+      }
+      pinch = distance;
+    } else {
+      originX -= (e.clientX - last.x) / zoom;
+      originY -= (e.clientY - last.y) / zoom;
+      clamp();
+      redraw();
+    }
+    pointers[e.pointerId] = {x: e.clientX, y: e.clientY};
+  });
+  ['pointerup', 'pointercancel'].forEach(function (type) {
+    canvas.addEventListener(type, function (e) {
+      delete pointers[e.pointerId];
+      pinch = 0;
+      canvas.style.cursor = 'grab';
+    });
+  });
+  canvas.addEventListener('wheel', function (e) {
+    e.preventDefault();
+    var rect = canvas.getBoundingClientRect();
+    zoomAt(zoom * Math.pow(1.0015, -e.deltaY), e.clientX - rect.left, e.clientY - rect.top);
+  }, {passive: false});
+
+  function center() {
+    return [canvas.width / 2, canvas.height / 2];
+  }
+  document.getElementById('zoom-in').addEventListener('click', function () { zoomAt.apply(null, [zoom * 2].concat(center())); });
+  document.getElementById('zoom-out').addEventListener('click', function () { zoomAt.apply(null, [zoom / 2].concat(center())); });
+  document.getElementById('zoom-1').addEventListener('click', function () { zoomAt.apply(null, [1].concat(center())); });
+  document.getElementById('zoom-fit').addEventListener('click', fit);
+  window.addEventListener('resize', resize);
+
+  resize();
+  fit();
+})();
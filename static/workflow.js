@@ -0,0 +1,117 @@
+// Step-by-step workflow: fills the options stage with the choices saved so far
+// and keeps the options open, as they are what the stage is for. On the review
+// stage the arrows and fields under a frame move and turn it by hand, redrawing
+// its overlay on the reference, and the frames moved by hand are saved in the
+// offsets field.
+(function () {
+  var options = document.getElementById('workflow-options');
+  if (options) {
+    var saved = JSON.parse(options.dataset.options || '{}');
+    Object.keys(saved).forEach(function (name) {
+      var field = options.querySelector('[name="' + name + '"]');
+      if (field) {
+        field.value = saved[name][0];
+      }
+    });
+    options.querySelectorAll('details').forEach(function (details) { details.open = true; });
+  }
+
+  var review = document.getElementById('review');
+  if (!review) {
+    return;
+  }
+  var form = review.closest('form');
+  var offsets = form.elements.offsets;
+  var maxAngle = parseFloat(review.dataset.maxAngle);
+  var reference = new Image();
+  reference.src = review.dataset.referenceSrc;
+
+  function value(nudge, name) {
+    return parseFloat(nudge.querySelector('[data-field="' + name + '"]').value) || 0;
+  }
+
+  // overlay draws the frame moved and turned as its fields say in cyan over the
+  // reference in red, as the server draws the automatic overlays
+  function overlay(nudge) {
+    var frame = nudge.frameImage;
+    var scale = parseFloat(nudge.dataset.scale);
+    var width = reference.naturalWidth, height = reference.naturalHeight;
+    var canvas = document.createElement('canvas');
+    canvas.width = width;
+    canvas.height = height;
+    var ctx = canvas.getContext('2d');
+    ctx.drawImage(reference, 0, 0);
+    var red = ctx.getImageData(0, 0, width, height);
+    ctx.fillStyle = '#000';
+    ctx.fillRect(0, 0, width, height);
+    ctx.save();
+    ctx.translate(value(nudge, 'dx') * scale + width / 2, value(nudge, 'dy') * scale + height / 2);
+    ctx.rotate(value(nudge, 'angle') * Math.PI / 180);
+    ctx.drawImage(frame, -width / 2, -height / 2, width, height);
+    ctx.restore();
+    var cyan = ctx.getImageData(0, 0, width, height);
+    for (var i = 0; i < red.data.length; i += 4) {
+      var r = 0.299 * red.data[i] + 0.587 * red.data[i + 1] + 0.114 * red.data[i + 2];
+      var c = 0.299 * cyan.data[i] + 0.587 * cyan.data[i + 1] + 0.114 * cyan.data[i + 2];
+      red.data[i] = r;
+      red.data[i + 1] = red.data[i + 2] = c;
+    }
+    ctx.putImageData(red, 0, 0);
+    nudge.card.querySelector('img').src = canvas.toDataURL('image/jpeg', 0.8);
+  }
+
+  function changed(nudge) {
+    nudge.dataset.manual = '';
+    if (nudge.frameImage.complete && reference.complete) {
+      overlay(nudge);
+    } else {
+      nudge.frameImage.onload = reference.onload = function () { overlay(nudge); };
+    }
+  }
+
+  function automatic(nudge) {
+    delete nudge.dataset.manual;
+    nudge.card.querySelector('img').src = nudge.dataset.automaticSrc || nudge.automaticSrc;
+    nudge.querySelectorAll('[data-field]').forEach(function (field) { field.value = field.dataset.auto; });
+  }
+
+  review.querySelectorAll('.nudge').forEach(function (nudge) {
+    nudge.card = nudge.closest('.card');
+    nudge.automaticSrc = nudge.card.querySelector('img').src;
+    nudge.frameImage = new Image();
+    nudge.frameImage.src = nudge.dataset.src;
+    nudge.querySelectorAll('[data-move]').forEach(function (button) {
+      button.addEventListener('click', function () {
+        var move = button.dataset.move.split(',').map(parseFloat);
+        var step = parseInt(nudge.dataset.step, 10) || 1;
+        nudge.querySelector('[data-field="dx"]').value = value(nudge, 'dx') + move[0] * step;
+        nudge.querySelector('[data-field="dy"]').value = value(nudge, 'dy') + move[1] * step;
+        var angle = Math.max(-maxAngle, Math.min(maxAngle, value(nudge, 'angle') + move[2]));
+        nudge.querySelector('[data-field="angle"]').value = Math.round(angle * 10) / 10;
+        changed(nudge);
+      });
+    });
+    nudge.querySelectorAll('[data-field]').forEach(function (field) {
+      field.addEventListener('input', function () { changed(nudge); });
+    });
+    nudge.querySelector('[data-automatic]').addEventListener('click', function () { automatic(nudge); });
+  });
+
+  // Offsets are set against the reference, so choosing another one drops them
+  form.querySelectorAll('input[name="reference"]').forEach(function (radio) {
+    radio.addEventListener('change', function () {
+      review.querySelectorAll('.nudge').forEach(automatic);
+      offsets.value = '';
+    });
+  });
+
+  form.addEventListener('submit', function () {
+    var entries = [];
+    review.querySelectorAll('.nudge[data-manual]').forEach(function (nudge) {
+      var entry = nudge.dataset.frame + ':' + Math.round(value(nudge, 'dx')) + ',' + Math.round(value(nudge, 'dy'));
+      var angle = value(nudge, 'angle');
+      entries.push(angle ? entry + ',' + angle : entry);
+    });
+    offsets.value = entries.join(' ');
+  });
+})();
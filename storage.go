@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Keys under which the shared object store keeps results, their job records and
+// completed uploads
+func resultKey(name string) string     { return "results/" + name }
+func resultRecordKey(id string) string { return "results/" + id + ".json" }
+func uploadKey(id string) string       { return "uploads/" + id }
+func uploadRecordKey(id string) string { return "uploads/" + id + ".json" }
+func shareKey(hash string) string      { return "shares/" + hash } // The ID of the job a share token unlocks, by the token's digest
+
+// startSharedStore connects the object store configured with -s3-bucket and
+// adopts the stored results other instances left in it
+func startSharedStore() error {
+	if config.S3Bucket == "" {
+		return nil
+	}
+	store, err := newS3Store(config)
+	if err != nil {
+		return err
+	}
+	sharedStore = store
+	count, err := loadSharedResults(context.Background())
+	if err != nil {
+		return fmt.Errorf("listing stored results in bucket %s: %w", config.S3Bucket, err)
+	}
+	slog.Info("Keeping results and uploads in object storage", "endpoint", config.S3Endpoint, "bucket", config.S3Bucket, "prefix", config.S3Prefix, "results", count)
+	return nil
+}
+
+// loadSharedResults adds the job records of the results in the object store that
+// this instance does not know yet, oldest first
+func loadSharedResults(ctx context.Context) (int, error) {
+	keys, err := sharedStore.list(ctx, "results/")
+	if err != nil {
+		return 0, err
+	}
+	var records []*job
+	for _, key := range keys {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(key, "results/"), ".json")
+		if !ok {
+			continue
+		}
+		j, err := fetchSharedRecord(ctx, id)
+		if err != nil {
+			slog.Warn("Skipping unreadable result record", "key", key, "error", err)
+			continue
+		}
+		records = append(records, j)
+	}
+	slices.SortFunc(records, func(a, b *job) int { return a.Created.Compare(b.Created) })
+	count := 0
+	for _, j := range records {
+		if jobs.adopt(j) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// fetchSharedRecord reads the job record stored beside a result
+func fetchSharedRecord(ctx context.Context, id string) (*job, error) {
+	body, err := sharedStore.get(ctx, resultRecordKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var j job
+	if err := json.NewDecoder(body).Decode(&j); err != nil {
+		return nil, err
+	}
+	if j.ID != id || j.Result == "" {
+		return nil, fmt.Errorf("record of job %s does not describe a stored result", id)
+	}
+	return &j, nil
+}
+
+// adoptSharedJob looks for a result another instance stored when id is not a
+// job of this one, and keeps its record
+func adoptSharedJob(ctx context.Context, id string) (job, bool) {
+	if sharedStore == nil || !validRequestID(id) {
+		return job{}, false
+	}
+	j, err := fetchSharedRecord(ctx, id)
+	if err != nil {
+		if !errors.Is(err, errObjectNotFound) {
+			slog.ErrorContext(ctx, "Error reading result record", "job_id", id, "error", err)
+		}
+		return job{}, false
+	}
+	jobs.adopt(j)
+	return jobs.get(id)
+}
+
+// shareResult copies a stored result and its job record to the object store
+func shareResult(ctx context.Context, id string) error {
+	j, ok := jobs.get(id)
+	if !ok || j.Result == "" {
+		return nil
+	}
+	f, err := os.Open(resultPath(j.Result))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := sharedStore.put(ctx, resultKey(j.Result), f, info.Size()); err != nil {
+		return err
+	}
+	return saveSharedRecord(ctx, id)
+}
+
+// saveSharedRecord updates the job record kept beside a shared result, after its
+// size or share links changed
+func saveSharedRecord(ctx context.Context, id string) error {
+	j, ok := jobs.get(id)
+	if !ok || j.Result == "" {
+		return nil
+	}
+	j.Progress = nil
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return sharedStore.put(ctx, resultRecordKey(id), bytes.NewReader(data), int64(len(data)))
+}
+
+// syncSharedRecord saves the record of job id when results are shared, logging failures
+func syncSharedRecord(id string) {
+	if sharedStore == nil {
+		return
+	}
+	if err := saveSharedRecord(context.Background(), id); err != nil {
+		slog.Error("Error saving result record to object storage", "job_id", id, "error", err)
+	}
+}
+
+// removeStoredResult deletes a result from the local disk and the object store
+func removeStoredResult(ctx context.Context, j job) error {
+	if err := os.Remove(resultPath(j.Result)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if sharedStore == nil {
+		return nil
+	}
+	removeShareTokens(ctx, j.Shares)
+	return errors.Join(sharedStore.remove(ctx, resultKey(j.Result)), sharedStore.remove(ctx, resultRecordKey(j.ID)))
+}
+
+// saveShareToken records in the object store which job the share token with
+// the digest hash unlocks, for every instance to find
+func saveShareToken(ctx context.Context, hash, id string) {
+	if sharedStore == nil {
+		return
+	}
+	if err := sharedStore.put(ctx, shareKey(hash), strings.NewReader(id), int64(len(id))); err != nil {
+		slog.ErrorContext(ctx, "Error saving share link to object storage", "job_id", id, "error", err)
+	}
+}
+
+// removeShareTokens drops the share links of shares from the object store
+func removeShareTokens(ctx context.Context, shares []resultShare) {
+	if sharedStore == nil {
+		return
+	}
+	for _, s := range shares {
+		if err := sharedStore.remove(ctx, shareKey(s.TokenSHA256)); err != nil {
+			slog.ErrorContext(ctx, "Error removing share link from object storage", "error", err)
+		}
+	}
+}
+
+// refreshShares takes the share links of a job from its record in the object
+// store, where other instances save the links they give out and revoke
+func refreshShares(ctx context.Context, id string) {
+	if sharedStore == nil {
+		return
+	}
+	j, err := fetchSharedRecord(ctx, id)
+	if err != nil {
+		if !errors.Is(err, errObjectNotFound) {
+			slog.ErrorContext(ctx, "Error reading result record", "job_id", id, "error", err)
+		}
+		return
+	}
+	jobs.setShares(id, j.Shares)
+}
+
+// sharedStoreJob returns the job whose share token has the digest hash, as its
+// record in the object store says at the moment, if the link still works there.
+// Links given out before they were saved under shareKey are found by the jobs
+// this instance knows.
+func sharedStoreJob(ctx context.Context, hash string) (job, bool) {
+	var id string
+	body, err := sharedStore.get(ctx, shareKey(hash))
+	switch {
+	case err == nil:
+		data, err := io.ReadAll(io.LimitReader(body, 256))
+		body.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading share link from object storage", "error", err)
+			return job{}, false
+		}
+		id = string(data)
+	case errors.Is(err, errObjectNotFound):
+		j, ok := jobs.localSharedJob(hash)
+		if !ok {
+			return job{}, false
+		}
+		id = j.ID
+	default:
+		slog.ErrorContext(ctx, "Error reading share link from object storage", "error", err)
+		return job{}, false
+	}
+	if !validRequestID(id) {
+		return job{}, false
+	}
+	j, err := fetchSharedRecord(ctx, id)
+	if err != nil {
+		if !errors.Is(err, errObjectNotFound) {
+			slog.ErrorContext(ctx, "Error reading result record", "job_id", id, "error", err)
+		}
+		return job{}, false
+	}
+	if !jobs.adopt(j) {
+		jobs.setShares(id, j.Shares)
+	}
+	if !shareWorks(j.Shares, hash) {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// localResult returns the path of a stored result, first downloading it from the
+// object store when another instance stored it
+func localResult(ctx context.Context, j job) (string, error) {
+	path := resultPath(j.Result)
+	if _, err := os.Stat(path); err == nil || sharedStore == nil {
+		return path, nil
+	}
+	body, err := sharedStore.get(ctx, resultKey(j.Result))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp(config.ResultsDir, "."+j.Result+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	if err := errors.Join(err, tmp.Close()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "Fetched result from object storage", "job_id", j.ID)
+	return path, nil
+}
+
+// shareUpload copies a completed upload and its record to the object store, so
+// a job on any instance can use it
+func shareUpload(ctx context.Context, u *resumableUpload) error {
+	if sharedStore == nil {
+		return nil
+	}
+	f, err := os.Open(u.dataPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := sharedStore.put(ctx, uploadKey(u.ID), f, u.Length); err != nil {
+		return err
+	}
+	data, err := json.Marshal(uploadRecord{ID: u.ID, Owner: u.Owner, Name: u.Name, Length: u.Length, Created: u.Created, Expires: u.Expires})
+	if err != nil {
+		return err
+	}
+	return sharedStore.put(ctx, uploadRecordKey(u.ID), bytes.NewReader(data), int64(len(data)))
+}
+
+// fetchSharedUpload returns a completed upload another instance received
+func fetchSharedUpload(ctx context.Context, id string) (*resumableUpload, error) {
+	body, err := sharedStore.get(ctx, uploadRecordKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var rec uploadRecord
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		return nil, err
+	}
+	if rec.ID != id || time.Now().After(rec.Expires) {
+		return nil, errObjectNotFound
+	}
+	return &resumableUpload{ID: rec.ID, Owner: rec.Owner, Name: rec.Name, Length: rec.Length, Offset: rec.Length, Created: rec.Created, Expires: rec.Expires, release: func() {}}, nil
+}
+
+// openUploadData opens the data of a completed upload, from the object store when
+// this instance does not hold it
+func openUploadData(u *resumableUpload) (io.ReadCloser, error) {
+	f, err := os.Open(u.dataPath())
+	if err == nil {
+		return f, nil
+	}
+	if sharedStore == nil || !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return sharedStore.get(context.Background(), uploadKey(u.ID))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+// defaultStripHeight is the number of output rows encoded per streamed strip
+const defaultStripHeight = 256
+
+// streamResultStrips sends the fused result as a multipart/mixed response made of
+// horizontal strips in the output format, encoding and flushing each one as soon as it is rendered.
+// Clients reassemble the image by drawing every part at its X-Strip-Y offset.
+func streamResultStrips(w http.ResponseWriter, acc *fusionAccumulator, opts processOptions) error {
+	stripHeight := opts.StripHeight
+	if stripHeight <= 0 {
+		stripHeight = defaultStripHeight
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("X-Image-Width", strconv.Itoa(acc.width))
+	w.Header().Set("X-Image-Height", strconv.Itoa(acc.height))
+	w.Header().Set("X-Strip-Count", strconv.Itoa((acc.height+stripHeight-1)/stripHeight))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher) // Not every ResponseWriter supports flushing
+
+	for y0 := 0; y0 < acc.height; y0 += stripHeight {
+		y1 := min(y0+stripHeight, acc.height)
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", contentType(opts.Format))
+		header.Set("X-Strip-Y", strconv.Itoa(y0))
+		header.Set("X-Strip-Height", strconv.Itoa(y1-y0))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return fmt.Errorf("creating strip part at row %d: %w", y0, err)
+		}
+
+		// Render only this strip so the full-size RGBA result never exists in memory
+		if err := encodeResult(part, renderResult(acc, y0, y1, opts), opts); err != nil {
+			return fmt.Errorf("encoding strip at row %d: %w", y0, err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		slog.Debug("Streamed strip", "from_row", y0, "to_row", y1, "height", acc.height)
+	}
+
+	return mw.Close()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log/slog"
+	"runtime"
+	"sync"
+)
+
+// In a portrait burst the background stands still and gains detail from every
+// frame, while the person breathes, blinks and sways, and averaging them
+// leaves a soft double of their face. With subject=true, whatever moved
+// against the reference in any frame, as deghost tells it, is taken for the
+// subject: the region is grown to take in the still parts of the subject
+// between its moving edges, its holes are filled and it is fused from the one
+// frame sharpest there, while the background is fused from all of them.
+
+const (
+	subjectGrow    = 0.03  // How far the region that moved is grown and shrunk back to close it, as a share of the longer side of the frames
+	subjectFeather = 0.005 // Width of the blend between the subject and the background, likewise
+)
+
+// subjectMask returns how much of every pixel of the aligned frames, row by
+// row, belongs to the moving subject, from 0 in the background to 1 in the
+// subject, and the frame sharpest in the subject, which it is taken from; nil
+// when nothing moved. Pixels a frame's shift left uncovered do not count as
+// moved.
+func subjectMask(ctx context.Context, aligned []image.Image, shifts []image.Point, noise []float64) ([]float32, int) {
+	b := aligned[0].Bounds()
+	w, h := b.Dx(), b.Dy()
+	refLuma := lumaPlane(aligned[0])
+	moved := make([]bool, w*h)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i := 1; i < len(aligned); i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			diff, limit := ghostDifference(refLuma, aligned[i], w, h, ghostLimitFloor(noise, i))
+			covered := image.Rect(0, 0, w, h).Add(shifts[i]).Inset(1).Intersect(image.Rect(0, 0, w, h))
+			mu.Lock()
+			defer mu.Unlock()
+			for y := covered.Min.Y; y < covered.Max.Y; y++ {
+				for x := covered.Min.X; x < covered.Max.X; x++ {
+					if d := diff[y*w+x]; d > limit || -d > limit {
+						moved[y*w+x] = true
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, 0
+	}
+
+	grow := max(int(subjectGrow*float64(max(w, h))), 1)
+	feather := max(int(subjectFeather*float64(max(w, h))), 1)
+	subject := dilateMask(moved, w, h, grow)
+	fillHoles(subject, w, h)
+	subject = erodeMask(subject, w, h, grow-feather) // Short of the edge by the blend, which spreads as far out as in
+	area := 0
+	for _, in := range subject {
+		if in {
+			area++
+		}
+	}
+	if area == 0 {
+		slog.InfoContext(ctx, "No moving subject found, fusing every frame alike")
+		return nil, 0
+	}
+
+	// The frame whose subject is sharpest, by the variance of its Laplacian there
+	sharpest, best := 0, -1.0
+	for i, img := range aligned {
+		luma := lumaPlane(img)
+		sum, sumSq, n := 0.0, 0.0, 0.0
+		for y := 1; y < h-1; y++ {
+			for x := 1; x < w-1; x++ {
+				if !subject[y*w+x] {
+					continue
+				}
+				lap := luma[y*w+x-1] + luma[y*w+x+1] + luma[(y-1)*w+x] + luma[(y+1)*w+x] - 4*luma[y*w+x]
+				sum += lap
+				sumSq += lap * lap
+				n++
+			}
+		}
+		if n > 0 {
+			if v := sumSq/n - (sum/n)*(sum/n); v > best {
+				sharpest, best = i, v
+			}
+		}
+	}
+	slog.InfoContext(ctx, "Moving subject found", "share", float64(area)/float64(w*h), "sharpest_frame", sharpest)
+	return blurMask(dilateMask(subject, w, h, feather), w, h, feather), sharpest
+}
+
+// outsideSubject returns the weights of the pixels of a frame, nil for all 1,
+// with the subject of subjectMask left out of them
+func outsideSubject(weights, subject []float32) []float32 {
+	if weights == nil {
+		weights = make([]float32, len(subject))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	for i, s := range subject {
+		weights[i] *= 1 - s
+	}
+	return weights
+}
+
+// dilateMask returns mask, w pixels wide and h high, grown by r pixels in
+// every direction, to a square around every pixel set
+func dilateMask(mask []bool, w, h, r int) []bool {
+	if r <= 0 {
+		return mask
+	}
+	// Rows then columns: a pixel is set when any within r of it along the line is
+	rows := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		last := -r - 1 // The last pixel set so far along the line
+		for x := 0; x < w; x++ {
+			if mask[y*w+x] {
+				last = x
+			}
+			if x-last <= r {
+				rows[y*w+x] = true
+			}
+		}
+		next := w + r + 1 // The next pixel set along the line, going back
+		for x := w - 1; x >= 0; x-- {
+			if mask[y*w+x] {
+				next = x
+			}
+			if next-x <= r {
+				rows[y*w+x] = true
+			}
+		}
+	}
+	out := make([]bool, w*h)
+	for x := 0; x < w; x++ {
+		last := -r - 1
+		for y := 0; y < h; y++ {
+			if rows[y*w+x] {
+				last = y
+			}
+			if y-last <= r {
+				out[y*w+x] = true
+			}
+		}
+		next := h + r + 1
+		for y := h - 1; y >= 0; y-- {
+			if rows[y*w+x] {
+				next = y
+			}
+			if next-y <= r {
+				out[y*w+x] = true
+			}
+		}
+	}
+	return out
+}
+
+// erodeMask returns mask shrunk by r pixels, its pixels set only where the
+// square of them around is; the edge of the frame does not shrink it
+func erodeMask(mask []bool, w, h, r int) []bool {
+	inverse := make([]bool, w*h)
+	for i, in := range mask {
+		inverse[i] = !in
+	}
+	out := dilateMask(inverse, w, h, r)
+	for i := range out {
+		out[i] = !out[i]
+	}
+	return out
+}
+
+// fillHoles sets the pixels of mask that the unset ones along the edge of the
+// frame cannot reach through other unset ones
+func fillHoles(mask []bool, w, h int) {
+	reached := make([]bool, w*h)
+	var queue []int
+	visit := func(x, y int) {
+		if i := y*w + x; !mask[i] && !reached[i] {
+			reached[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for x := 0; x < w; x++ {
+		visit(x, 0)
+		visit(x, h-1)
+	}
+	for y := 0; y < h; y++ {
+		visit(0, y)
+		visit(w-1, y)
+	}
+	for len(queue) > 0 {
+		i := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		x, y := i%w, i/w
+		if x > 0 {
+			visit(x-1, y)
+		}
+		if x < w-1 {
+			visit(x+1, y)
+		}
+		if y > 0 {
+			visit(x, y-1)
+		}
+		if y < h-1 {
+			visit(x, y+1)
+		}
+	}
+	for i := range mask {
+		mask[i] = !reached[i]
+	}
+}
+
+// blurMask returns mask as 0 and 1 averaged over the square of side 2r+1
+// around every pixel, as far as it lies within the frame
+func blurMask(mask []bool, w, h, r int) []float32 {
+	rows := make([]float32, w*h)
+	for y := 0; y < h; y++ {
+		sum := 0
+		for x := -r; x < w; x++ {
+			if x+r < w && mask[y*w+x+r] {
+				sum++
+			}
+			if x-r-1 >= 0 && mask[y*w+x-r-1] {
+				sum--
+			}
+			if x >= 0 {
+				rows[y*w+x] = float32(sum) / float32(min(x+r, w-1)-max(x-r, 0)+1)
+			}
+		}
+	}
+	out := make([]float32, w*h)
+	for x := 0; x < w; x++ {
+		sum := float32(0)
+		for y := -r; y < h; y++ {
+			if y+r < h {
+				sum += rows[(y+r)*w+x]
+			}
+			if y-r-1 >= 0 {
+				sum -= rows[(y-r-1)*w+x]
+			}
+			if y >= 0 {
+				out[y*w+x] = sum / float32(min(y+r, h-1)-max(y-r, 0)+1)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempDirPrefix starts the name of every per-request upload directory. The
+// owning process ID follows, e.g. superres-pid4242-<request ID>-<random>, so a
+// sweep can tell directories of live servers from those a crash left behind.
+const tempDirPrefix = "superres-"
+
+// legacyTempDirAge is how long an upload directory without an owner in its name,
+// as created by earlier versions, is left alone before it is swept
+const legacyTempDirAge = time.Hour
+
+// tempDirs registers the upload directories this process owns
+var tempDirs = struct {
+	mu    sync.Mutex
+	owned map[string]bool
+}{owned: make(map[string]bool)}
+
+// tempRoot is the directory upload directories are created in
+func tempRoot() string {
+	if config.TempDir != "" {
+		return config.TempDir
+	}
+	return os.TempDir()
+}
+
+// createTempDir creates and registers the upload directory of a request
+func createTempDir(requestID string) (string, error) {
+	dir, err := os.MkdirTemp(config.TempDir, fmt.Sprintf("%spid%d-%s-", tempDirPrefix, os.Getpid(), requestID))
+	if err != nil {
+		return "", err
+	}
+	tempDirs.mu.Lock()
+	tempDirs.owned[dir] = true
+	tempDirs.mu.Unlock()
+	return dir, nil
+}
+
+// removeTempDir deletes an upload directory and drops it from the registry
+func removeTempDir(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		slog.Error("Error removing temporary directory", "path", dir, "error", err)
+		return // Left registered so shutdown tries again
+	}
+	tempDirs.mu.Lock()
+	delete(tempDirs.owned, dir)
+	tempDirs.mu.Unlock()
+}
+
+// removeOwnedTempDirs deletes the upload directories still registered, as when
+// the shutdown timeout ends requests that were reading their uploads
+func removeOwnedTempDirs() {
+	tempDirs.mu.Lock()
+	dirs := make([]string, 0, len(tempDirs.owned))
+	for dir := range tempDirs.owned {
+		dirs = append(dirs, dir)
+	}
+	tempDirs.mu.Unlock()
+	for _, dir := range dirs {
+		removeTempDir(dir)
+	}
+}
+
+// tempDirOwner returns the process ID recorded in an upload directory name
+func tempDirOwner(name string) (pid int, ok bool) {
+	rest, ok := strings.CutPrefix(name, tempDirPrefix+"pid")
+	if !ok {
+		return 0, false
+	}
+	digits, _, _ := strings.Cut(rest, "-")
+	pid, err := strconv.Atoi(digits)
+	return pid, err == nil
+}
+
+// sweepTempDirs removes upload directories whose owner is no longer running:
+// a server killed mid-job cannot clean up after itself. Directories of other
+// live servers sharing the temp root are kept, and so are this process's own.
+func sweepTempDirs() (removed int) {
+	root := tempRoot()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		slog.Error("Error listing temporary directory", "path", root, "error", err)
+		return 0
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), tempDirPrefix) {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		pid, ok := tempDirOwner(entry.Name())
+		switch {
+		case ok && pid == os.Getpid():
+			// Same ID as ours, as always in containers: orphaned unless registered
+			tempDirs.mu.Lock()
+			owned := tempDirs.owned[dir]
+			tempDirs.mu.Unlock()
+			if owned {
+				continue
+			}
+		case ok && processAlive(pid):
+			continue
+		case !ok:
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < legacyTempDirAge {
+				continue
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("Error removing orphaned temporary directory", "path", dir, "error", err)
+			continue
+		}
+		slog.Debug("Removed orphaned temporary directory", "path", dir)
+		removed++
+	}
+	return removed
+}
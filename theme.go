@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// themeCookie remembers the colour theme picked with the switch under the page title
+const themeCookie = "theme"
+
+// themes are the colour themes of the web UI; "auto" follows the device setting
+var themes = []struct {
+	Name  string
+	Label string
+}{
+	{"auto", "Automatic theme"},
+	{"light", "Light theme"},
+	{"dark", "Dark theme"},
+}
+
+// accentColorPattern matches the #rgb and #rrggbb colours -accent-color accepts
+var accentColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// requestTheme returns the theme picked with the switch, "auto" when none was
+func requestTheme(r *http.Request) string {
+	if c, err := r.Cookie(themeCookie); err == nil {
+		for _, t := range themes {
+			if t.Name == c.Value {
+				return c.Value
+			}
+		}
+	}
+	return "auto"
+}
+
+// accentCSS overrides the Bootstrap primary colour with the -accent-color, so
+// headings, links, primary buttons and progress bars take the organization's colour
+func accentCSS(color string) string {
+	if color == "" {
+		return ""
+	}
+	red, green, blue := colorChannels(color)
+	channels := fmt.Sprintf("%d,%d,%d", red, green, blue)
+	return fmt.Sprintf(`:root,[data-bs-theme]{--bs-primary:%[1]s;--bs-primary-rgb:%[2]s;--bs-link-color:%[1]s;--bs-link-color-rgb:%[2]s;--bs-link-hover-color:%[1]s;--bs-link-hover-color-rgb:%[2]s}`+
+		`.btn-primary,.btn-outline-primary{--bs-btn-border-color:%[1]s;--bs-btn-hover-bg:%[1]s;--bs-btn-hover-border-color:%[1]s;--bs-btn-active-bg:%[1]s;--bs-btn-active-border-color:%[1]s;--bs-btn-disabled-border-color:%[1]s}`+
+		`.btn-primary{--bs-btn-bg:%[1]s;--bs-btn-disabled-bg:%[1]s}.btn-outline-primary{--bs-btn-color:%[1]s;--bs-btn-disabled-color:%[1]s}`+
+		`.progress,.progress-stacked{--bs-progress-bar-bg:%[1]s}.form-check-input:checked{background-color:%[1]s;border-color:%[1]s}`, color, channels)
+}
+
+// colorChannels splits a #rgb or #rrggbb colour into its red, green and blue
+func colorChannels(color string) (red, green, blue uint8) {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, _ := strconv.ParseUint(hex, 16, 32)
+	return uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb)
+}
+
+// themeColor is the primary colour of the web UI: the -accent-color, or else
+// Bootstrap's blue
+func themeColor() string {
+	if config.AccentColor != "" {
+		return config.AccentColor
+	}
+	return "#0d6efd"
+}
+
+// pageHead renders the stylesheet of every page with the accent colour, a
+// script applying the colour theme before the page is drawn, so it never flashes,
+// and the links that make the web UI installable as an app
+func pageHead(r *http.Request) string {
+	theme := requestTheme(r)
+	apply := fmt.Sprintf("'%s'", theme)
+	if theme == "auto" {
+		apply = `matchMedia('(prefers-color-scheme: dark)').matches ? 'dark' : 'light'`
+	}
+	return `<style>` + bootstrapCSS + accentCSS(config.AccentColor) + `</style>` +
+		`<script>document.documentElement.setAttribute('data-bs-theme', ` + apply + `);</script>` +
+		appHead()
+}
+
+// brandLogo renders the -logo image above the page title, if one is configured
+func brandLogo() string {
+	if config.Logo == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<div class="text-center mb-3"><img src="%s" alt="" style="max-height:64px;max-width:100%%"></div>`, config.url("/logo"))
+}
+
+// themeSwitch renders links to the other colour themes
+func themeSwitch(r *http.Request) string {
+	current := requestTheme(r)
+	next := returnPath(r)
+	var links []string
+	for _, t := range themes {
+		if t.Name != current {
+			links = append(links, fmt.Sprintf(`<a href="%s?next=%s">%s</a>`, config.url("/theme/"+t.Name), next, tr(r, t.Label)))
+		}
+	}
+	return strings.Join(links, " &middot; ")
+}
+
+// themeHandler switches the colour theme and returns to the page the switch was used on
+func themeHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("theme")
+	known := false
+	for _, t := range themes {
+		known = known || t.Name == name
+	}
+	if !known {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No such theme"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     themeCookie,
+		Value:    name,
+		Path:     config.url("/"),
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		Secure:   config.tlsEnabled(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	redirectBack(w, r)
+}
+
+// logoHandler serves the -logo image
+func logoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeFile(w, r, config.Logo)
+}
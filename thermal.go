@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+)
+
+// Thermal cameras that record radiometric data store every pixel as a 16-bit
+// count from which the camera's software works out the temperature. With the
+// thermal option, such frames stay 16-bit through cropping and alignment and
+// the accumulator sums the counts themselves, in one plane: averaging is linear,
+// so the fused counts convert to temperatures as the frames' own do. Only the
+// rendering maps them to the colours of a palette. The mono16 option takes the
+// same path for the 16-bit grayscale frames of scientific cameras, such as those
+// on microscopes, rendered in gray.
+
+// thermalClip is the fraction of the fused pixels at each end of their range
+// left out of the render, so a few hot spots do not wash out the rest
+const thermalClip = 0.005
+
+// ironbowPalette runs from cold to hot through the colours thermal cameras
+// show, its stops evenly spaced
+var ironbowPalette = []color.RGBA{
+	{0, 0, 0, 0xff},
+	{32, 0, 140, 0xff},
+	{180, 0, 150, 0xff},
+	{255, 110, 0, 0xff},
+	{255, 220, 0, 0xff},
+	{255, 255, 255, 0xff},
+}
+
+// grayPalette renders the fused values of mono16 frames as they are, in gray
+var grayPalette = []color.RGBA{{0, 0, 0, 0xff}, {0xff, 0xff, 0xff, 0xff}}
+
+// radiometricPalette returns the colours the fused values of a job of opts are
+// rendered in when it keeps them at 16 bits
+func (opts processOptions) radiometricPalette() []color.RGBA {
+	if opts.Thermal {
+		return ironbowPalette
+	}
+	return grayPalette
+}
+
+// sixteenBitGray reports whether every frame is 16-bit grayscale, as mono16
+// needs to keep them at full depth
+func sixteenBitGray(images []image.Image) bool {
+	for _, img := range images {
+		if _, ok := img.(*image.Gray16); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkThermalFrames makes sure frames fused as thermal are radiometric: 8-bit
+// frames hold a rendering whose colours no longer track the temperature
+func checkThermalFrames(images []image.Image) *requestError {
+	other := 0
+	for _, img := range images {
+		if _, ok := img.(*image.Gray16); !ok {
+			other++
+		}
+	}
+	if other > 0 {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter thermal needs 16-bit grayscale frames, such as the radiometric TIFF or PNG a thermal camera's software exports; %d of the %d frames are not", other, len(images))}
+	}
+	return nil
+}
+
+// blankFrame returns an empty frame with bounds b to draw img into: 16-bit
+// when img is 16-bit grayscale or was drawn from one, or read back from the
+// PNG a queued job stages it as, so thermal frames keep their counts; RGBA
+// otherwise
+func blankFrame(img image.Image, b image.Rectangle) draw.Image {
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return image.NewRGBA64(b)
+	}
+	return image.NewRGBA(b)
+}
+
+// uncoveredColour is what shifting or turning a frame into frame leaves where
+// no pixel of it lands: black, or transparent for 16-bit frames, so the fusion
+// weighs those pixels out instead of averaging a count of 0 into the temperature
+func uncoveredColour(frame image.Image) color.Color {
+	if _, ok := frame.(*image.RGBA64); ok {
+		return color.Transparent
+	}
+	return color.Black
+}
+
+// radiometricSpan returns the fused counts that the ends of the palette stand
+// for: those thermalClip of the pixels are below and above
+func (acc *fusionAccumulator) radiometricSpan() [2]float64 {
+	histogram := make([]int, 1<<16)
+	total := 0
+	for y := range acc.height {
+		for x := range acc.width {
+			if acc.weights[y][x] > 0 {
+				histogram[min(int(acc.accR[y][x]/acc.weights[y][x]), 0xffff)]++
+				total++
+			}
+		}
+	}
+	span := [2]float64{0, 0xffff}
+	clip := int(float64(total) * thermalClip)
+	seen := 0
+	for v, n := range histogram {
+		if seen += n; seen > clip {
+			span[0] = float64(v)
+			break
+		}
+	}
+	seen = 0
+	for v := len(histogram) - 1; v >= 0; v-- {
+		if seen += histogram[v]; seen > clip {
+			span[1] = float64(v)
+			break
+		}
+	}
+	if span[1] <= span[0] { // A scene of one temperature
+		span[1] = span[0] + 1
+	}
+	return span
+}
+
+// paletteRows renders the fused counts of rows [y0, y1) in the colours of
+// acc.palette, stretched over acc.span or mapped with acc.tone
+func (acc *fusionAccumulator) paletteRows(y0, y1 int) *image.RGBA {
+	strip := image.NewRGBA(image.Rect(0, 0, acc.width, y1-y0))
+	steps := float64(len(acc.palette) - 1)
+	for y := y0; y < y1; y++ {
+		for x := 0; x < acc.width; x++ {
+			if acc.weights[y][x] == 0 {
+				strip.SetRGBA(x, y-y0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+				continue
+			}
+			t := (acc.accR[y][x]/acc.weights[y][x] - acc.span[0]) / (acc.span[1] - acc.span[0])
+			if acc.tone.operator != "" {
+				t = acc.tone.level(acc.accR[y][x] / acc.weights[y][x])
+			}
+			t = math.Min(math.Max(t, 0), 1) * steps
+			i := min(int(t), len(acc.palette)-2)
+			f := t - float64(i)
+			lo, hi := acc.palette[i], acc.palette[i+1]
+			mix := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + f*(float64(b)-float64(a)))) }
+			strip.SetRGBA(x, y-y0, color.RGBA{R: mix(lo.R, hi.R), G: mix(lo.G, hi.G), B: mix(lo.B, hi.B), A: 255})
+		}
+	}
+	return strip
+}
+
+// radiometricRows returns the fused counts of rows [y0, y1) as a 16-bit
+// grayscale strip positioned at (0, 0)
+func (acc *fusionAccumulator) radiometricRows(y0, y1 int) *image.Gray16 {
+	strip := image.NewGray16(image.Rect(0, 0, acc.width, y1-y0))
+	for y := y0; y < y1; y++ {
+		for x := 0; x < acc.width; x++ {
+			if acc.weights[y][x] > 0 {
+				v := math.Min(math.Max(math.Round(acc.accR[y][x]/acc.weights[y][x]), 0), 0xffff)
+				strip.SetGray16(x, y-y0, color.Gray16{Y: uint16(v)})
+			}
+		}
+	}
+	return strip
+}
+
+// radiometricAccumulator holds the fused counts of img, as radiometricRows
+// returns them, as an accumulation of one frame rendered in palette with the
+// tonemap operator
+func radiometricAccumulator(img image.Image, palette []color.RGBA, tonemap string) *fusionAccumulator {
+	bounds := img.Bounds()
+	acc := &fusionAccumulator{
+		width:       bounds.Dx(),
+		height:      bounds.Dy(),
+		radiometric: true,
+		palette:     palette,
+		accR:        make([][]float64, bounds.Dy()),
+		weights:     make([][]float64, bounds.Dy()),
+	}
+	for y := range acc.height {
+		acc.accR[y] = make([]float64, acc.width)
+		acc.weights[y] = make([]float64, acc.width)
+		for x := range acc.width {
+			v, _, _, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			acc.accR[y][x], acc.weights[y][x] = float64(v), 1
+		}
+	}
+	acc.span = acc.radiometricSpan()
+	acc.tone = acc.radiometricTone(tonemap)
+	return acc
+}
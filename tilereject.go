@@ -0,0 +1,113 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"image"
+	"log/slog"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// A reflection, a flicker of the light or a bird flying through spoils one
+// part of one frame, while the rest of it fuses as well as any. With
+// tile_reject set, the aligned frames are cut into tiles and, in every tile,
+// that percent of the frames that agree least with the rest there are left
+// out of the average. Whether a frame is kept is interpolated between the
+// centres of the tiles, so the frames fused change gradually instead of at
+// the tile edges.
+
+const (
+	rejectTile    = 32 // Side of the tiles frames are rejected in, in pixels of the frames
+	maxTileReject = 90 // Highest percent of the frames tile_reject may leave out of a tile
+)
+
+// tileMask tells for every tile of a frame whether it is fused, 1, or left out, 0
+type tileMask struct {
+	across, down int // Tiles in a row and in a column
+	kept         []float32
+}
+
+// weight returns how much of the frame's pixel (x, y) is fused, interpolating
+// between the centres of the tiles around it
+func (m *tileMask) weight(x, y int) float32 {
+	tx := min(max((float64(x)+0.5)/rejectTile-0.5, 0), float64(m.across-1))
+	ty := min(max((float64(y)+0.5)/rejectTile-0.5, 0), float64(m.down-1))
+	x0, y0 := int(tx), int(ty)
+	x1, y1 := min(x0+1, m.across-1), min(y0+1, m.down-1)
+	fx, fy := float32(tx-float64(x0)), float32(ty-float64(y0))
+	top := m.kept[y0*m.across+x0]*(1-fx) + m.kept[y0*m.across+x1]*fx
+	bottom := m.kept[y1*m.across+x0]*(1-fx) + m.kept[y1*m.across+x1]*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// rejectTiles returns for every aligned frame which of its tiles are fused:
+// in every tile the percent of the frames whose brightness there strays the
+// furthest from the mean of all of them, by the mean of the squared
+// differences, are left out, but never all of them. A frame that strays
+// stands out even when the mean includes it, so no median of the frames, held
+// in memory at once, is needed.
+func rejectTiles(ctx context.Context, aligned []image.Image, percent int) []*tileMask {
+	b := aligned[0].Bounds()
+	w, h := b.Dx(), b.Dy()
+	across, down := (w+rejectTile-1)/rejectTile, (h+rejectTile-1)/rejectTile
+	drop := min(int(math.Round(float64(len(aligned)*percent)/100)), len(aligned)-1)
+	masks := make([]*tileMask, len(aligned))
+	for i := range masks {
+		masks[i] = &tileMask{across: across, down: down, kept: make([]float32, across*down)}
+		for t := range masks[i].kept {
+			masks[i].kept[t] = 1
+		}
+	}
+	if drop == 0 {
+		return masks
+	}
+
+	mean := make([]float64, w*h)
+	for _, img := range aligned {
+		for j, v := range lumaPlane(img) {
+			mean[j] += v / float64(len(aligned))
+		}
+	}
+	strays := make([][]float64, len(aligned)) // By frame, then tile: the mean squared difference from the mean
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU()) // A few planes of brightness in memory at a time
+	for i, img := range aligned {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			strays[i] = make([]float64, across*down)
+			for j, v := range lumaPlane(img) {
+				d := v - mean[j]
+				strays[i][j/w/rejectTile*across+j%w/rejectTile] += d * d
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return masks
+	}
+
+	dropped := make([]int, len(aligned))
+	order := make([]int, len(aligned))
+	for t := 0; t < across*down; t++ {
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, c int) int { return cmp.Compare(strays[c][t], strays[a][t]) }) // Furthest first
+		for _, i := range order[:drop] {
+			masks[i].kept[t] = 0
+			dropped[i]++
+		}
+	}
+	for i, n := range dropped {
+		slog.InfoContext(ctx, "Tiles rejected", "frame", i, "tiles", n, "share", float64(n)/float64(across*down))
+	}
+	return masks
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	_ "embed" // Required for embedding
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/fs"
+	"log/slog"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+//go:embed static/viewer.js
+var viewerJS string
+
+// tileSize is the edge of the square tiles the viewer loads, in pixels
+const tileSize = 256
+
+// tilePyramids serializes generating the tiles of a result, so concurrent
+// viewers of a new result wait for one pass instead of each decoding it
+var tilePyramids = struct {
+	mu      sync.Mutex
+	pending map[string]*sync.Mutex
+}{pending: make(map[string]*sync.Mutex)}
+
+// tilesDir is where the tiles of a job's result are kept, beside the result
+func tilesDir(id string) string {
+	return resultPath(id + "_tiles")
+}
+
+// maxTileLevel is the level holding the full-resolution tiles. As in Deep Zoom,
+// level 0 is a single pixel and every level doubles the size of the one below.
+func maxTileLevel(width, height int) int {
+	return bits.Len(uint(max(width, height) - 1))
+}
+
+// ensureTiles generates the tile pyramid of a stored result unless it exists,
+// counting the tiles towards the result's storage
+func ensureTiles(j job) error {
+	tilePyramids.mu.Lock()
+	lock, ok := tilePyramids.pending[j.ID]
+	if !ok {
+		lock = new(sync.Mutex)
+		tilePyramids.pending[j.ID] = lock
+	}
+	tilePyramids.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	dir := tilesDir(j.ID)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	path, err := localResult(context.Background(), j)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("decoding result: %w", err)
+	}
+
+	// Write into a scratch directory so a half-built pyramid is never served
+	scratch, err := os.MkdirTemp(config.ResultsDir, j.ID+"_tiles-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	var size int64
+	level := image.Image(img)
+	for l := maxTileLevel(img.Bounds().Dx(), img.Bounds().Dy()); l >= 0; l-- {
+		n, err := writeTileLevel(filepath.Join(scratch, strconv.Itoa(l)), level)
+		if err != nil {
+			return err
+		}
+		size += n
+		b := level.Bounds()
+		half := image.NewRGBA(image.Rect(0, 0, (b.Dx()+1)/2, (b.Dy()+1)/2))
+		draw.BiLinear.Scale(half, half.Bounds(), level, b, draw.Src, nil)
+		level = half
+	}
+	if err := os.Rename(scratch, dir); err != nil {
+		return err
+	}
+	jobs.setResult(j.ID, j.Result, j.ResultSize+size)
+	syncSharedRecord(j.ID)
+	slog.Info("Generated result tiles", "job_id", j.ID, "bytes", size)
+	return nil
+}
+
+// writeTileLevel cuts one level of the pyramid into JPEG tiles named
+// <column>_<row>.jpg and returns the bytes written
+func writeTileLevel(dir string, img image.Image) (int64, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	b := img.Bounds()
+	var written int64
+	for y := b.Min.Y; y < b.Max.Y; y += tileSize {
+		for x := b.Min.X; x < b.Max.X; x += tileSize {
+			f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%d_%d.jpg", (x-b.Min.X)/tileSize, (y-b.Min.Y)/tileSize)))
+			if err != nil {
+				return written, err
+			}
+			tile := image.Rect(x, y, min(x+tileSize, b.Max.X), min(y+tileSize, b.Max.Y))
+			err = jpeg.Encode(f, subImage(img, tile), &jpeg.Options{Quality: 85})
+			if info, statErr := f.Stat(); statErr == nil {
+				written += info.Size()
+			}
+			if err := errors.Join(err, f.Close()); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// subImage returns the part of img inside r, copying it when img cannot share its pixels
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rectangle{Max: r.Size()})
+	draw.Copy(dst, image.Point{}, img, r, draw.Src, nil)
+	return dst
+}
+
+// storedResultSize reads the dimensions of a stored result from its header
+func storedResultSize(j job) (image.Config, error) {
+	path, err := localResult(context.Background(), j)
+	if err != nil {
+		return image.Config{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	size, _, err := image.DecodeConfig(f)
+	return size, err
+}
+
+// removeTiles deletes the tile pyramid of a job's result, if one was generated
+func removeTiles(id string) {
+	if err := os.RemoveAll(tilesDir(id)); err != nil {
+		slog.Error("Error removing result tiles", "job_id", id, "error", err)
+	}
+	tilePyramids.mu.Lock()
+	delete(tilePyramids.pending, id)
+	tilePyramids.mu.Unlock()
+}
+
+// tileHandler serves one tile of a stored result, generating the pyramid on first use
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := visibleJob(r)
+	if !ok || j.Result == "" {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No stored result with this ID"})
+		return
+	}
+	if j.Format == formatPDF {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "PDF results are downloaded, not viewed"})
+		return
+	}
+	// Rebuild the name from numbers so the path cannot leave the tile directory
+	level, err := strconv.Atoi(r.PathValue("level"))
+	name, found := strings.CutSuffix(r.PathValue("tile"), ".jpg")
+	col, row, _ := strings.Cut(name, "_")
+	x, errX := strconv.Atoi(col)
+	y, errY := strconv.Atoi(row)
+	if err != nil || !found || errX != nil || errY != nil || level < 0 || x < 0 || y < 0 {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No such tile"})
+		return
+	}
+	if err := ensureTiles(j); err != nil {
+		slog.ErrorContext(r.Context(), "Error generating result tiles", "job_id", j.ID, "error", err)
+		writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "tiles_failed", Message: "Error preparing the result for viewing"})
+		return
+	}
+	path := filepath.Join(tilesDir(j.ID), strconv.Itoa(level), fmt.Sprintf("%d_%d.jpg", x, y))
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No such tile"})
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400") // Tiles of a result never change
+	http.ServeFile(w, r, path)
+}
+
+// viewerPageHandler renders a zoomable, pannable view of a stored result that
+// loads only the tiles on screen, so very large results can be inspected at 1:1
+func viewerPageHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := visibleJob(r)
+	if !ok || j.Result == "" {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No stored result with this ID"})
+		return
+	}
+	if j.Format == formatPDF {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "PDF results are downloaded, not viewed"})
+		return
+	}
+	size, err := storedResultSize(j)
+	if err != nil {
+		writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "tiles_failed", Message: "Error reading the stored result"})
+		return
+	}
+
+	const viewerPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Result}} %s</title>
+	%s
+	<style>	html,body{height:100%%}
+	#viewer{touch-action:none;cursor:grab;background:#222}
+	</style>
+	</head>
+	<body class="d-flex flex-column">
+	<div class="d-flex align-items-center gap-2 p-2 bg-body-tertiary">
+	<a href="%s" class="btn btn-sm btn-outline-secondary">{{Back}}</a>
+	<button type="button" id="zoom-out" class="btn btn-sm btn-outline-primary">&minus;</button>
+	<button type="button" id="zoom-fit" class="btn btn-sm btn-outline-primary">{{Fit}}</button>
+	<button type="button" id="zoom-1" class="btn btn-sm btn-outline-primary">1:1</button>
+	<button type="button" id="zoom-in" class="btn btn-sm btn-outline-primary">+</button>
+	<span id="zoom-level" class="small text-muted"></span>
+	<a href="%s" download class="btn btn-sm btn-success ms-auto">{{Download}} %dx%d</a>
+	</div>
+	<canvas id="viewer" class="flex-grow-1 w-100" data-tiles="%s" data-width="%d" data-height="%d" data-tile-size="%d" data-max-level="%d"></canvas>
+	<script>%s</script>
+	</body>
+	</html>
+	`
+	link := config.url("/results/" + j.ID)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, localize(r, viewerPageHTML), requestLocale(r), j.ID, pageHead(r), config.url("/results"), link, size.Width, size.Height,
+		link+"/tiles", size.Width, size.Height, tileSize, maxTileLevel(size.Width, size.Height), viewerJS)
+}
+
+// thumbnailLevel is the pyramid level whose single tile shows a whole result
+// within one tile, used as its thumbnail in the gallery
+func thumbnailLevel(width, height int) int {
+	return min(maxTileLevel(width, height), bits.Len(tileSize)-1)
+}
+
+// thumbnailHandler serves a small preview of a stored result: the coarsest tile
+// still as large as a tile, so the gallery never loads full-size results
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := visibleJob(r)
+	if !ok || j.Result == "" {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "No stored result with this ID"})
+		return
+	}
+	if j.Format == formatPDF {
+		writePlainError(w, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: "PDF results are downloaded, not viewed"})
+		return
+	}
+	size, err := storedResultSize(j)
+	if err == nil {
+		err = ensureTiles(j)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generating result tiles", "job_id", j.ID, "error", err)
+		writePlainError(w, &requestError{Status: http.StatusInternalServerError, Code: "tiles_failed", Message: "Error preparing the result for viewing"})
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, filepath.Join(tilesDir(j.ID), strconv.Itoa(thumbnailLevel(size.Width, size.Height)), "0_0.jpg"))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serve runs server over plain HTTP, TLS with a static certificate, or TLS with
+// certificates obtained from Let's Encrypt, depending on the configured flags
+func serve(server *http.Server) error {
+	switch {
+	case config.AutocertHosts != "":
+		var hosts []string
+		for _, host := range strings.Split(config.AutocertHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...), // Never request certificates for unexpected SNI names
+			Cache:      autocert.DirCache(config.AutocertCache),
+			Email:      config.AutocertEmail,
+		}
+		server.TLSConfig = manager.TLSConfig()
+
+		// Answer HTTP-01 challenges and send plain HTTP visitors to HTTPS
+		if config.AutocertHTTP != "" {
+			go func() {
+				slog.Info("Serving ACME challenges and HTTPS redirects", "addr", config.AutocertHTTP)
+				if err := http.ListenAndServe(config.AutocertHTTP, manager.HTTPHandler(nil)); err != nil {
+					slog.Error("ACME HTTP listener stopped", "error", err)
+				}
+			}()
+		}
+
+		slog.Info("Obtaining Let's Encrypt certificates", "hosts", hosts)
+		return server.ListenAndServeTLS("", "") // Certificates come from TLSConfig.GetCertificate
+
+	case config.TLSCert != "" || config.TLSKey != "":
+		if config.TLSCert == "" || config.TLSKey == "" {
+			return errors.New("both -tls-cert and -tls-key must be set to enable TLS")
+		}
+		return server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+
+	default:
+		return server.ListenAndServe()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "math"
+
+// The fused counts of thermal and mono16 jobs span far more levels than an
+// 8-bit rendering shows. By default the rendering stretches them linearly
+// between the counts thermalClip of the pixels are below and above, clipping
+// the rest: a bright cell or a hot engine turns to a flat white patch. A tone
+// mapping operator compresses the counts above instead, so the brightest pixel
+// still shows its shape while the rest keeps its contrast.
+
+// Tone mapping operators of the tonemap parameter
+const (
+	tonemapReinhard = "reinhard" // Reinhard's global operator, with the brightest count as white
+	tonemapDrago    = "drago"    // Drago's adaptive logarithmic mapping
+	tonemapFilmic   = "filmic"   // Hable's filmic curve, a toe in the shadows and a shoulder in the highlights
+)
+
+// tonemapOperators are the accepted values of the tonemap parameter besides "",
+// which stretches the counts linearly
+var tonemapOperators = []string{tonemapReinhard, tonemapDrago, tonemapFilmic}
+
+// Constants of the operators
+const (
+	toneKey     = 0.18 // Middle gray the log-average count is mapped to, as Reinhard's key
+	dragoBias   = 0.85 // Bias of Drago's mapping: lower darkens the shadows, higher brightens them
+	filmicScale = 2.0  // Exposure the filmic curve is applied at
+)
+
+// toneCurve maps the fused counts of a radiometric accumulator to the 0-1 of
+// its palette with a tone mapping operator
+type toneCurve struct {
+	operator string  // One of tonemapOperators, "" for none
+	black    float64 // Count rendered black: the one thermalClip of the pixels are below
+	unit     float64 // Counts above black scaled by the key, so their log-average lands on toneKey
+	max      float64 // Brightest count above black, so scaled
+}
+
+// radiometricTone returns the curve operator maps the fused counts with, ""
+// for none, black at acc.span[0]
+func (acc *fusionAccumulator) radiometricTone(operator string) toneCurve {
+	c := toneCurve{operator: operator, black: acc.span[0]}
+	if operator == "" {
+		return c
+	}
+	logSum, n, brightest := 0.0, 0, 0.0
+	for y := range acc.height {
+		for x := range acc.width {
+			if acc.weights[y][x] > 0 {
+				v := math.Max(acc.accR[y][x]/acc.weights[y][x]-c.black, 0)
+				logSum += math.Log(1 + v)
+				brightest = math.Max(brightest, v)
+				n++
+			}
+		}
+	}
+	average := math.Max(math.Exp(logSum/float64(max(n, 1)))-1, 1)
+	c.unit = toneKey / average
+	c.max = math.Max(brightest*c.unit, 1e-6)
+	return c
+}
+
+// level returns where count v falls on the palette, 0-1
+func (c toneCurve) level(v float64) float64 {
+	l := math.Max(v-c.black, 0) * c.unit
+	switch c.operator {
+	case tonemapReinhard:
+		return math.Min(l*(1+l/(c.max*c.max))/(1+l), 1)
+	case tonemapDrago:
+		exponent := math.Log(dragoBias) / math.Log(0.5)
+		return math.Min(math.Log1p(l)/(math.Log10(1+c.max)*math.Log(2+8*math.Pow(l/c.max, exponent))), 1)
+	case tonemapFilmic:
+		return math.Min(hableCurve(filmicScale*l)/hableCurve(filmicScale*c.max), 1)
+	}
+	return 0
+}
+
+// hableCurve is the filmic curve John Hable made for Uncharted 2
+func hableCurve(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span is one timed operation of a trace, exported in the OpenTelemetry data model
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // Zero for a root span
+	name     string
+	kind     int // OTLP span kind: 1 internal, 2 server
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]any
+	failed string // Error message, empty when the operation succeeded
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the active span of ctx, or nil
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// startSpan begins a child of the span active in ctx, or a new trace when there is none
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	s := &span{name: name, kind: 1, start: time.Now()}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// setAttr attaches a key/value pair to the span
+func (s *span) setAttr(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+}
+
+// fail marks the span as failed with err
+func (s *span) fail(err error) {
+	s.mu.Lock()
+	s.failed = err.Error()
+	s.mu.Unlock()
+}
+
+// finish ends the span and hands it to the exporter
+func (s *span) finish() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	tracer.export(s)
+}
+
+// traceparent formats the span as a W3C traceparent header value
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// startStage opens a span for a pipeline stage and returns a function that ends
+// it and records the stage duration metric
+func startStage(ctx context.Context, stage string) (context.Context, func()) {
+	ctx, s := startSpan(ctx, stage)
+	return ctx, func() {
+		s.finish()
+		duration := s.end.Sub(s.start)
+		metrics.stageSeconds.observe(stage, duration.Seconds())
+		slog.DebugContext(ctx, "Stage finished", "stage", stage, "duration", duration)
+	}
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C traceparent header
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, traceID != [16]byte{} && parentID != [8]byte{}
+}
+
+// statusRecorder captures the response status and size for spans and access logs
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// traceRequests wraps every HTTP request in a server span, continuing the caller's
+// trace when a traceparent header is present and returning ours to the client
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := startSpan(r.Context(), r.Method+" "+r.URL.Path)
+		s.kind = 2
+		if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			s.traceID, s.parentID = traceID, parentID
+		}
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+		s.setAttr("client.address", r.RemoteAddr)
+		w.Header().Set("traceparent", s.traceparent())
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.setAttr("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			s.fail(fmt.Errorf("HTTP %d", rec.status))
+		}
+		s.finish()
+	})
+}
+
+// spanExporter batches finished spans and posts them to an OTLP/HTTP collector as JSON
+type spanExporter struct {
+	endpoint string
+	spans    chan *span
+	flushReq chan chan struct{}
+}
+
+// tracer is the active exporter; nil when -otlp-endpoint is not set and spans are dropped
+var tracer *spanExporter
+
+// startTracing starts exporting spans to endpoint, e.g. http://localhost:4318
+func startTracing(endpoint string) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	tracer = &spanExporter{
+		endpoint: endpoint,
+		spans:    make(chan *span, 4096),
+		flushReq: make(chan chan struct{}),
+	}
+	go tracer.loop()
+	slog.Info("Exporting traces", "endpoint", endpoint)
+}
+
+// export queues a finished span, dropping it when the exporter is disabled or backed up
+func (e *spanExporter) export(s *span) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+// flush sends every queued span before returning or giving up when ctx expires
+func (e *spanExporter) flush(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case e.flushReq <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *spanExporter) loop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-e.flushReq:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.send(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+// send posts a batch of spans using the OTLP JSON encoding
+func (e *spanExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	otlpSpans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed != "" {
+			o["status"] = map[string]any{"code": 2, "message": s.failed}
+		}
+		s.mu.Unlock()
+		otlpSpans = append(otlpSpans, o)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{
+				"service.name": "chicha-superresolution",
+			})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "chicha-superresolution"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		slog.Error("Error encoding spans", "error", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Error exporting spans", "count", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Trace collector rejected spans", "count", len(batch), "status", resp.Status)
+	}
+}
+
+// otlpAttributes converts attributes into the OTLP key/value list form
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	list := make([]map[string]any, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]any
+		switch value := value.(type) {
+		case string:
+			v = map[string]any{"stringValue": value}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, map[string]any{"key": key, "value": v})
+	}
+	return list
+}
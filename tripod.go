@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log/slog"
+	"math"
+)
+
+// Frames shot from a tripod barely move: searching each one over the full
+// range of the shift search takes most of the time of a job and, in a scene
+// with leaves or water moving in the wind, can lock onto what moved instead
+// of what stood still. The tripod align value searches a pixel around where
+// the frame already is, then takes the shift to a fraction of a pixel; none
+// fuses the frames where they are.
+const (
+	alignTripod = "tripod"
+	alignNone   = "none"
+)
+
+// tripodRadius is how far, in whole pixels, align=tripod searches for a frame
+// before taking the shift to a fraction of a pixel
+const tripodRadius = 1
+
+// alignTripodFrame moves img onto the reference, whose centre patch is ref:
+// it searches within tripodRadius of where the frame is, takes the shift to a
+// fraction of a pixel and moves the frame by it, returning the moved frame and
+// the move rounded to whole pixels
+func alignTripodFrame(ctx context.Context, ref grayPatch, img image.Image, i int) (image.Image, image.Point) {
+	frame := centerPatch(img, assessPatch)
+	dx, dy, _ := bestShift(ref, frame, 0, 0, tripodRadius)
+	x, y := refineShift(ref, frame, dx, dy) // Where the content of the frame lies from that of the reference
+	slog.InfoContext(ctx, "Tripod frame refined", "frame", i, "dx", -x, "dy", -y)
+	return transformFrame(img, -x, -y, 0), image.Pt(int(math.Round(-x)), int(math.Round(-y)))
+}
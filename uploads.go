@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of the resumable upload protocol, modeled on tus
+const (
+	uploadLengthHeader  = "Upload-Length"
+	uploadOffsetHeader  = "Upload-Offset"
+	uploadNameHeader    = "Upload-Name"
+	uploadExpiresHeader = "Upload-Expires"
+)
+
+// resumableUpload is a file sent in chunks through /api/v1/uploads. Its data file
+// is the source of truth for the offset, so bytes received before a dropped
+// connection or a restart are kept.
+type resumableUpload struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"-"`
+	Name    string    `json:"name"`
+	Length  int64     `json:"length"`
+	Offset  int64     `json:"offset"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	mu      sync.Mutex // Serializes chunks of the same upload
+	release func()     // Returns the upload's share of the disk budget
+}
+
+// uploadRecord is how an upload is saved next to its data
+type uploadRecord struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner,omitempty"`
+	Name    string    `json:"name"`
+	Length  int64     `json:"length"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// uploadStore tracks the resumable uploads in -upload-dir
+type uploadStore struct {
+	mu   sync.Mutex
+	byID map[string]*resumableUpload
+}
+
+var uploads = &uploadStore{byID: make(map[string]*resumableUpload)}
+
+// uploadDir is where resumable uploads are kept until they are used or expire
+func uploadDir() string {
+	if config.UploadDir != "" {
+		return config.UploadDir
+	}
+	return filepath.Join(tempRoot(), "chicha-sr-uploads")
+}
+
+func (u *resumableUpload) dataPath() string   { return filepath.Join(uploadDir(), u.ID+".part") }
+func (u *resumableUpload) recordPath() string { return filepath.Join(uploadDir(), u.ID+".json") }
+
+// save writes the upload's record; the caller holds u.mu or owns u exclusively
+func (u *resumableUpload) save() error {
+	data, err := json.Marshal(uploadRecord{ID: u.ID, Owner: u.Owner, Name: u.Name, Length: u.Length, Created: u.Created, Expires: u.Expires})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.recordPath(), data)
+}
+
+// setHeaders reports the upload's progress in the protocol headers
+func (u *resumableUpload) setHeaders(w http.ResponseWriter) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(u.Length, 10))
+	w.Header().Set(uploadExpiresHeader, u.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// load picks up the uploads left by the previous run, so clients can resume them
+func (s *uploadStore) load() error {
+	dir := uploadDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	records, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range records {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var rec uploadRecord
+		if err := json.Unmarshal(data, &rec); err != nil || !validRequestID(rec.ID) {
+			slog.Warn("Skipping unreadable upload record", "path", path, "error", err)
+			continue
+		}
+		u := &resumableUpload{ID: rec.ID, Owner: rec.Owner, Name: rec.Name, Length: rec.Length, Created: rec.Created, Expires: rec.Expires}
+		info, err := os.Stat(u.dataPath())
+		if err != nil {
+			slog.Warn("Skipping upload without data", "upload_id", u.ID, "error", err)
+			continue
+		}
+		u.Offset = min(info.Size(), u.Length)
+		u.release = forceReserveDisk(u.Length)
+		s.byID[u.ID] = u
+	}
+	if len(s.byID) > 0 {
+		slog.Info("Loaded resumable uploads", "count", len(s.byID), "path", dir)
+	}
+	return nil
+}
+
+// startSweeper removes expired uploads periodically
+func (s *uploadStore) startSweeper() {
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			s.sweep(time.Now())
+		}
+	}()
+}
+
+// sweep deletes the uploads that expired before now
+func (s *uploadStore) sweep(now time.Time) {
+	s.mu.Lock()
+	var expired []string
+	for id, u := range s.byID {
+		if now.After(u.Expires) {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range expired {
+		s.remove(id)
+	}
+	if len(expired) > 0 {
+		slog.Info("Removed expired uploads", "count", len(expired))
+	}
+}
+
+// get returns an upload of the caller; others' uploads are reported as missing
+func (s *uploadStore) get(r *http.Request, id string) (*resumableUpload, *requestError) {
+	s.mu.Lock()
+	u, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok && sharedStore != nil && validRequestID(id) {
+		// Completed uploads may have reached another instance
+		shared, err := fetchSharedUpload(r.Context(), id)
+		if err == nil {
+			s.mu.Lock()
+			if u, ok = s.byID[id]; !ok {
+				u, ok = shared, true
+				s.byID[id] = u
+			}
+			s.mu.Unlock()
+		} else if !errors.Is(err, errObjectNotFound) {
+			slog.ErrorContext(r.Context(), "Error reading upload record", "upload_id", id, "error", err)
+		}
+	}
+	if !ok || u.Owner != requestOwner(r) {
+		return nil, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf("No upload with ID %s; it may have expired", id)}
+	}
+	return u, nil
+}
+
+// remove deletes an upload and its files
+func (s *uploadStore) remove(id string) {
+	s.mu.Lock()
+	u, ok := s.byID[id]
+	delete(s.byID, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, path := range []string{u.dataPath(), u.recordPath()} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Error removing upload file", "path", path, "error", err)
+		}
+	}
+	if sharedStore != nil && u.Offset == u.Length {
+		ctx := context.Background()
+		if err := errors.Join(sharedStore.remove(ctx, uploadKey(id)), sharedStore.remove(ctx, uploadRecordKey(id))); err != nil {
+			slog.Error("Error removing upload from object storage", "upload_id", id, "error", err)
+		}
+	}
+	u.release()
+}
+
+// frames returns completed uploads of the caller as frames of a job
+func (s *uploadStore) frames(r *http.Request, ids []string) ([]uploadFrame, *requestError) {
+	var frames []uploadFrame
+	for _, id := range ids {
+		u, reqErr := s.get(r, id)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		u.mu.Lock()
+		complete := u.Offset == u.Length
+		u.mu.Unlock()
+		if !complete {
+			return nil, &requestError{Status: http.StatusConflict, Code: "upload_incomplete", Message: fmt.Sprintf("Upload %s has received %d of %d bytes; finish it before submitting the job", id, u.Offset, u.Length)}
+		}
+		frames = append(frames, uploadFrame{name: u.Name, size: u.Length, open: func() (io.ReadCloser, error) { return openUploadData(u) }})
+	}
+	return frames, nil
+}
+
+// keep stores a frame posted with a form as a completed upload of the caller, so
+// later requests can refer to it by ID like to a resumable upload
+func (s *uploadStore) keep(w http.ResponseWriter, r *http.Request, frame uploadFrame) (*resumableUpload, *requestError) {
+	release, reqErr := reserveDisk(w, frame.size)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	now := time.Now()
+	u := &resumableUpload{ID: newJobID() + newJobID(), Owner: requestOwner(r), Name: frame.name, Length: frame.size, Offset: frame.size, Created: now, Expires: now.Add(config.UploadExpiry), release: release}
+	src, err := frame.open()
+	if err == nil {
+		var dst *os.File
+		dst, err = os.OpenFile(u.dataPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_, err = io.Copy(dst, src)
+			err = errors.Join(err, dst.Close(), u.save())
+		}
+		src.Close()
+	}
+	if err != nil {
+		os.Remove(u.dataPath())
+		os.Remove(u.recordPath())
+		release()
+		slog.ErrorContext(r.Context(), "Error keeping uploaded frame", "file", frame.name, "error", err)
+		return nil, &requestError{Status: http.StatusInternalServerError, Code: "upload_save_failed", Message: "Error saving uploaded file"}
+	}
+	if err := shareUpload(r.Context(), u); err != nil {
+		slog.ErrorContext(r.Context(), "Error copying upload to object storage", "upload_id", u.ID, "error", err)
+	}
+	s.mu.Lock()
+	s.byID[u.ID] = u
+	s.mu.Unlock()
+	return u, nil
+}
+
+// frameUploadIDs returns the resumable uploads named in the submitted form:
+// repeated uploads fields, each of which may hold several IDs separated by whitespace
+func frameUploadIDs(r *http.Request) []string {
+	var ids []string
+	for _, field := range r.MultipartForm.Value["uploads"] {
+		ids = append(ids, strings.Fields(field)...)
+	}
+	return ids
+}
+
+// apiV1CreateUploadHandler starts a resumable upload of Upload-Length bytes
+func apiV1CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	if config.InMemory {
+		writeAPIErrorV1(w, &requestError{Status: http.StatusBadRequest, Code: "uploads_disabled", Message: "Resumable uploads store data on disk, which this server does not do in -in-memory mode"})
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get(uploadLengthHeader), 10, 64)
+	if err != nil || length <= 0 {
+		writeAPIErrorV1(w, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "Header Upload-Length must give the size of the file in bytes"})
+		return
+	}
+	if limit := liveConfig().MaxUploadMB << 20; limit > 0 && length > limit {
+		writeAPIErrorV1(w, uploadTooLarge())
+		return
+	}
+	name := r.Header.Get(uploadNameHeader)
+	if name == "" {
+		name = "upload"
+	}
+	if reqErr := validateFileName(name); reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	release, reqErr := reserveDisk(w, length)
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+
+	now := time.Now()
+	u := &resumableUpload{ID: newJobID() + newJobID(), Owner: requestOwner(r), Name: name, Length: length, Created: now, Expires: now.Add(config.UploadExpiry), release: release}
+	f, err := os.OpenFile(u.dataPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err == nil {
+		err = errors.Join(f.Close(), u.save())
+	}
+	if err != nil {
+		os.Remove(u.dataPath())
+		release()
+		slog.ErrorContext(r.Context(), "Error creating upload", "error", err)
+		writeAPIErrorV1(w, &requestError{Status: http.StatusInternalServerError, Code: "upload_save_failed", Message: "Error creating the upload"})
+		return
+	}
+	uploads.mu.Lock()
+	uploads.byID[u.ID] = u
+	uploads.mu.Unlock()
+	slog.InfoContext(r.Context(), "Resumable upload created", "upload_id", u.ID, "length", length)
+
+	u.setHeaders(w)
+	w.Header().Set("Location", config.url("/api/v1/uploads/"+u.ID))
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// apiV1UploadStatusHandler reports how much of an upload has arrived; HEAD gives
+// the same headers without the body
+func apiV1UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	u, reqErr := uploads.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.setHeaders(w)
+	writeJSON(w, http.StatusOK, u)
+}
+
+// apiV1UploadChunkHandler appends the request body at Upload-Offset. Whatever
+// arrives before a connection drops is kept, so the client resumes from the
+// offset HEAD reports.
+func apiV1UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	u, reqErr := uploads.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		writeAPIErrorV1(w, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "Header Upload-Offset must give the position of the chunk in bytes"})
+		return
+	}
+	if offset != u.Offset {
+		u.setHeaders(w)
+		writeAPIErrorV1(w, &requestError{Status: http.StatusConflict, Code: "offset_mismatch", Message: fmt.Sprintf("The upload continues at byte %d, not %d", u.Offset, offset)})
+		return
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY, 0)
+	if err == nil {
+		_, err = f.Seek(u.Offset, io.SeekStart)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error opening upload", "upload_id", u.ID, "error", err)
+		writeAPIErrorV1(w, &requestError{Status: http.StatusInternalServerError, Code: "upload_save_failed", Message: "Error storing the chunk"})
+		return
+	}
+	n, copyErr := io.Copy(f, http.MaxBytesReader(w, r.Body, u.Length-u.Offset))
+	closeErr := f.Close()
+	u.Offset += n
+	u.Expires = time.Now().Add(config.UploadExpiry)
+	if err := errors.Join(closeErr, u.save()); err != nil {
+		slog.ErrorContext(r.Context(), "Error storing upload chunk", "upload_id", u.ID, "error", err)
+	} else if u.Offset == u.Length {
+		if err := shareUpload(r.Context(), u); err != nil {
+			slog.ErrorContext(r.Context(), "Error copying upload to object storage", "upload_id", u.ID, "error", err)
+		}
+	}
+
+	u.setHeaders(w)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(copyErr, &maxBytesErr):
+		writeAPIErrorV1(w, &requestError{Status: http.StatusRequestEntityTooLarge, Code: "upload_too_large", Message: fmt.Sprintf("The chunk runs past the declared Upload-Length of %d bytes", u.Length)})
+	case copyErr != nil:
+		slog.InfoContext(r.Context(), "Upload chunk interrupted", "upload_id", u.ID, "offset", u.Offset, "error", copyErr)
+		writeAPIErrorV1(w, &requestError{Status: http.StatusBadRequest, Code: "upload_interrupted", Message: fmt.Sprintf("The chunk was cut short; resume at byte %d", u.Offset)})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiV1DeleteUploadHandler abandons an upload
+func apiV1DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-API-Version", apiVersion)
+	u, reqErr := uploads.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writeAPIErrorV1(w, reqErr)
+		return
+	}
+	uploads.remove(u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
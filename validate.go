@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register the GIF decoder
+	_ "image/jpeg" // Register the JPEG decoder
+	_ "image/png"  // Register the PNG decoder
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/tiff" // Register the TIFF decoder, for the 16-bit frames of thermal cameras
+)
+
+// supportedFormats lists the input formats the registered decoders accept, for error messages
+const supportedFormats = "JPEG, PNG, APNG, GIF, TIFF"
+
+// validateFileName rejects client-supplied names that could escape the temp directory
+// or confuse logs; only the base name of a valid file is ever used on disk
+func validateFileName(name string) *requestError {
+	bad := name == "" || name == "." || name == ".." || len(name) > 255 ||
+		strings.ContainsAny(name, `/\:`)
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			bad = true
+		}
+	}
+	if bad {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_filename", Message: fmt.Sprintf("File name %q is not allowed. Please rename the file and upload it again.", name)}
+	}
+	return nil
+}
+
+// sniffUpload checks an uploaded file by its content rather than its name: the
+// bytes must sniff as an image, a registered decoder must recognize the header,
+// and the declared dimensions must stay within the pixel limit
+func sniffUpload(frame uploadFrame) (format string, reqErr *requestError) {
+	file, err := frame.open()
+	if err != nil {
+		return "", &requestError{Status: http.StatusBadRequest, Code: "upload_read_failed", Message: fmt.Sprintf("Error reading uploaded file %s", frame.name)}
+	}
+	defer file.Close()
+	return sniffImage(frame.name, file)
+}
+
+// sniffImage applies the content checks of sniffUpload to a frame named name
+func sniffImage(name string, file io.Reader) (format string, reqErr *requestError) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("File %s is empty or unreadable.", name)}
+	}
+	head = head[:n]
+	if mimeType := http.DetectContentType(head); !strings.HasPrefix(mimeType, "image/") && !tiffHeader(head) { // Content sniffing does not know TIFF
+		return "", &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("File %s does not contain an image (detected %s). Supported formats are: %s", name, mimeType, supportedFormats)}
+	}
+
+	// Read only the header to learn the format and dimensions without allocating pixels
+	cfg, format, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), file))
+	if err != nil {
+		return "", &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("Unsupported format for file %s. Supported formats are: %s", name, supportedFormats)}
+	}
+	if reqErr := checkDimensions(name, cfg.Width, cfg.Height); reqErr != nil {
+		return "", reqErr
+	}
+	return format, nil
+}
+
+// checkDimensions guards against decompression bombs: small files that declare huge images
+func checkDimensions(name string, width, height int) *requestError {
+	cfg := liveConfig()
+	if width <= 0 || height <= 0 {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_image", Message: fmt.Sprintf("File %s declares an empty image.", name)}
+	}
+	if cfg.MaxMegapixels > 0 && float64(width)*float64(height) > cfg.MaxMegapixels*1e6 {
+		return &requestError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    "image_too_large",
+			Message: fmt.Sprintf("File %s is %dx%d pixels, above the %g megapixel limit per frame.", name, width, height, cfg.MaxMegapixels),
+		}
+	}
+	return nil
+}
+
+// imageFileName reports whether a file name has the extension of a frame format,
+// for listings where the content cannot be sniffed first
+func imageFileName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".apng", ".gif", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
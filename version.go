@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Build information, set when linking, as scripts/crosscompile.go does:
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Whatever is left empty is taken from the version control details the Go
+// toolchain records in the binary, when built inside the repository.
+var version, commit, buildDate string
+
+// buildInfo identifies the build of the running program, for bug reports
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"` // GOOS/GOARCH
+}
+
+// currentBuild gathers the build information once
+var currentBuild = sync.OnceValue(func() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case commit != "":
+				// Set when linking; the toolchain's details may be of another tree
+			case s.Key == "vcs.revision":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value // The commit time, the closest the toolchain records
+			case s.Key == "vcs.modified":
+				b.Modified = s.Value == "true"
+			}
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	return b
+})
+
+// String describes the build in one line, e.g. "123 (abc1234, 2026-10-15)"
+func (b buildInfo) String() string {
+	s := b.Version
+	var details []string
+	if b.Commit != "" {
+		c := b.Commit[:min(len(b.Commit), 7)]
+		if b.Modified {
+			c += "-dirty"
+		}
+		details = append(details, c)
+	}
+	if t, err := time.Parse(time.RFC3339, b.BuildDate); err == nil {
+		details = append(details, t.UTC().Format(time.DateOnly))
+	} else if b.BuildDate != "" {
+		details = append(details, b.BuildDate)
+	}
+	for i, d := range details {
+		if i == 0 {
+			s += " (" + d
+		} else {
+			s += ", " + d
+		}
+	}
+	if len(details) > 0 {
+		s += ")"
+	}
+	return s
+}
+
+// versionCommand prints the build information
+func versionCommand(args []string) int {
+	b := currentBuild()
+	fmt.Printf("chicha-superresolution %s %s %s\n", b, b.GoVersion, b.Platform)
+	return exitOK
+}
+
+// versionHandler serves the build information as JSON, without a login, so it
+// can be quoted in bug reports and checked by deployment tools
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentBuild())
+}
+
+// pageFooter renders the build under every page of the web UI
+func pageFooter(r *http.Request) string {
+	return fmt.Sprintf(`<footer class="text-center text-muted small pb-3"><a href="%s" class="text-reset">chicha-superresolution %s</a></footer>`,
+		config.url("/version"), html.EscapeString(currentBuild().String()))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchedBurst is a subfolder of the watched directory waiting to settle
+type watchedBurst struct {
+	signature string    // Names, sizes and times of its files when last looked at
+	since     time.Time // When the signature last changed
+	done      string    // Signature it was processed with, empty before
+}
+
+// watchCommand runs the watch-folder daemon: every new subfolder of frames
+// dropped into the watched directory is processed once its files stop changing,
+// and the result is written to the output directory
+func watchCommand(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s watch -output <dir> [flags] <dir>\n\nProcesses every subfolder of frames that appears in <dir>.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	output := fs.String("output", "", "directory the results are written to, named by -name (required)")
+	name := nameTemplateFlag(fs)
+	doneDir := fs.String("done-dir", "", "directory processed subfolders are moved to (empty leaves them in place)")
+	interval := fs.Duration("interval", 2*time.Second, "how often the directory is scanned")
+	settle := fs.Duration("settle", 10*time.Second, "how long a subfolder must stay unchanged before it is processed, so copies in progress are not picked up")
+	applyLogging := commandLogging(fs)
+	jsonEvents := jsonFlag(fs)
+	req := pipelineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return parseExit(err)
+	}
+	if fs.NArg() != 1 || *output == "" {
+		fs.Usage()
+		return exitBadInput
+	}
+	if err := applyLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if err := checkNameTemplate(*name); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	dir := fs.Arg(0)
+	for _, d := range []string{*output, *doneDir} {
+		if d == "" {
+			continue
+		}
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitInternal
+		}
+	}
+	if _, reqErr := req.options(1); reqErr != nil {
+		fmt.Fprintln(os.Stderr, reqErr.Message)
+		return exitBadInput
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	w := &watcher{dir: dir, output: *output, doneDir: *doneDir, name: *name, settle: *settle, req: *req, events: jsonEvents(false), bursts: map[string]*watchedBurst{}}
+	slog.Info("Watching for bursts", "dir", dir, "output", *output, "settle", *settle)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := w.scan(ctx); err != nil {
+			slog.Error("Error scanning the watched directory", "dir", dir, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped watching")
+			return exitOK
+		case <-ticker.C:
+		}
+	}
+}
+
+// watcher tracks the subfolders of a watched directory
+type watcher struct {
+	dir, output, doneDir string
+	name                 string // Template of result file names
+	settle               time.Duration
+	req                  superResolutionRequestV1
+	events               *commandEvents           // Nil without -json
+	bursts               map[string]*watchedBurst // By subfolder name
+}
+
+// scan looks at every subfolder once and processes those that have settled
+func (w *watcher) scan(ctx context.Context) error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(w.dir, name)
+		if !e.IsDir() || strings.HasPrefix(name, ".") || sameDir(path, w.output) || sameDir(path, w.doneDir) {
+			continue
+		}
+		seen[name] = true
+		signature, frames, err := burstSignature(path)
+		if err != nil {
+			slog.Warn("Error reading burst folder", "folder", path, "error", err)
+			continue
+		}
+		b := w.bursts[name]
+		if b == nil {
+			b = &watchedBurst{signature: signature, since: now}
+			if w.resultExists(name, frames) {
+				b.done = signature // Processed before this daemon started
+			}
+			w.bursts[name] = b
+		}
+		if b.signature != signature {
+			b.signature, b.since = signature, now
+		}
+		if frames == 0 || b.done == b.signature || now.Sub(b.since) < w.settle {
+			continue
+		}
+		b.done = b.signature
+		w.process(ctx, name)
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	for name := range w.bursts {
+		if !seen[name] {
+			delete(w.bursts, name)
+		}
+	}
+	return nil
+}
+
+// process runs one settled burst and writes its result, or the reason it
+// failed to <name>.error.txt beside where the result would be
+func (w *watcher) process(ctx context.Context, name string) {
+	folder := filepath.Join(w.dir, name)
+	start := time.Now()
+	slog.Info("Processing burst", "folder", folder)
+	err := func() error {
+		paths, err := burstFrames(folder)
+		if err != nil {
+			return err
+		}
+		run, err := runBurst(ctx, paths, videoClip{}, calibration{}, w.req, w.events, name, func(opts processOptions, n int) string {
+			return resultFileName(w.output, w.name, name, n, opts)
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info("Burst processed", "folder", folder, "frames", run.frames, "result", run.path, "duration", time.Since(start).Round(time.Millisecond))
+		w.events.emit("result", name, run.result)
+		return nil
+	}()
+	errorPath := filepath.Join(w.output, name+".error.txt")
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		slog.Error("Error processing burst", "folder", folder, "error", err)
+		w.events.emit("error", name, map[string]any{"error": err.Error()})
+		if writeErr := os.WriteFile(errorPath, []byte(err.Error()+"\n"), 0o644); writeErr != nil {
+			slog.Error("Error writing the failure report", "path", errorPath, "error", writeErr)
+		}
+		return
+	}
+	os.Remove(errorPath) // From an earlier attempt at the same folder
+	if w.doneDir != "" {
+		if err := os.Rename(folder, filepath.Join(w.doneDir, name)); err != nil {
+			slog.Error("Error moving processed burst", "folder", folder, "error", err)
+		}
+	}
+}
+
+// resultExists reports whether a result or failure report of the subfolder is
+// already in the output directory. Results named with {seq}, {date} or {time}
+// cannot be found again, so such folders are processed anew after a restart.
+func (w *watcher) resultExists(name string, frames int) bool {
+	paths := []string{filepath.Join(w.output, name+".error.txt")}
+	if opts, reqErr := w.req.options(max(frames, 1)); reqErr == nil && !strings.Contains(w.name, "{seq}") {
+		paths = append(paths, resultFileName(w.output, w.name, name, frames, opts))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// burstSignature summarizes the frames of a folder, so any file added, grown or
+// rewritten changes it, and counts them
+func burstSignature(dir string) (string, int, error) {
+	paths, err := burstFrames(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", 0, err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", filepath.Base(path), info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), len(paths), nil
+}
+
+// sameDir reports whether a and b name the same directory
+func sameDir(a, b string) bool {
+	if b == "" {
+		return false
+	}
+	ai, errA := os.Stat(a)
+	bi, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(ai, bi)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Events a completion callback reports
+const (
+	callbackDone   = "job.done"
+	callbackFailed = "job.failed"
+)
+
+// callbackEvent is the event reporting a job whose result was encoded with err
+func callbackEvent(err error) string {
+	if err != nil {
+		return callbackFailed
+	}
+	return callbackDone
+}
+
+// callbackRetryDelays are the waits before each further delivery attempt of a
+// callback whose receiver could not be reached or did not accept it
+var callbackRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// callbackClient delivers completion callbacks. Like fetchClient it dials no
+// private addresses unless -fetch-private is set, and it follows no redirects,
+// so a receiver cannot bounce the signed body somewhere else.
+var callbackClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicAddressesOnly,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// callbackPayload is the JSON body POSTed to a callback URL
+type callbackPayload struct {
+	Event     string    `json:"event"` // callbackDone or callbackFailed
+	Job       job       `json:"job"`
+	ResultURL string    `json:"result_url,omitempty"` // Where the stored result can be downloaded with the submitter's credentials
+	SentAt    time.Time `json:"sent_at"`              // Lets receivers refuse replayed deliveries
+}
+
+// checkCallbackURL validates the callback_url parameter
+func checkCallbackURL(raw string) *requestError {
+	if raw == "" {
+		return nil
+	}
+	if config.WebhookSecret == "" {
+		return &requestError{Status: http.StatusBadRequest, Code: "callbacks_disabled", Message: "This server does not send job callbacks. Please poll the job instead."}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Parameter callback_url must be an http or https URL, got %q", raw)}
+	}
+	return nil
+}
+
+// signCallback returns the X-Signature-256 value of body: its HMAC-SHA256 keyed
+// with -webhook-secret, as receivers recompute it to check the sender
+func signCallback(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyCallback reports the end of job id to callbackURL in the background,
+// retrying a few times; deliveries that still fail are only logged. resultURL
+// is passed on when the job left a stored result.
+func notifyCallback(ctx context.Context, callbackURL, event, id, resultURL string) {
+	record, ok := jobs.get(id)
+	if !ok {
+		return
+	}
+	if record.Result == "" {
+		resultURL = ""
+	}
+	body, err := json.Marshal(callbackPayload{Event: event, Job: record, ResultURL: resultURL, SentAt: time.Now().UTC()})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encoding job callback", "job_id", id, "error", err)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		for attempt := 0; ; attempt++ {
+			err := deliverCallback(ctx, callbackURL, event, body)
+			if err == nil {
+				slog.InfoContext(ctx, "Job callback delivered", "job_id", id, "event", event, "attempts", attempt+1)
+				return
+			}
+			if attempt == len(callbackRetryDelays) || errors.Is(err, errPrivateAddress) {
+				slog.ErrorContext(ctx, "Giving up on job callback", "job_id", id, "event", event, "attempts", attempt+1, "error", err)
+				return
+			}
+			slog.WarnContext(ctx, "Job callback failed, will retry", "job_id", id, "event", event, "retry_in", callbackRetryDelays[attempt], "error", err)
+			time.Sleep(callbackRetryDelays[attempt])
+		}
+	}()
+}
+
+// deliverCallback makes one delivery attempt; any response other than 2xx fails it
+func deliverCallback(ctx context.Context, callbackURL, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chicha-superresolution")
+	req.Header.Set("X-Event", event)
+	req.Header.Set("X-Signature-256", signCallback(body))
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
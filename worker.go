@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// workerCommand runs jobs from the shared queue of -queue-redis and serves
+// nothing, so processing can be scaled apart from the instances that take the
+// requests. It reads the same flags, environment variables and -config file as
+// the server.
+func workerCommand(args []string) int {
+	usage := fmt.Sprintf("Usage: %s worker -queue-redis <url> -s3-bucket <bucket> [flags]\n\nRuns jobs from the queue shared by the servers started with the same -queue-redis, without serving HTTP.\nOf the flags below it uses -workers, the -queue-redis and -s3-* settings, logging, tracing and -shutdown-timeout.\n\n", os.Args[0])
+	if err := parseFlags("worker", usage, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if err := setupLogging(config.LogLevel, config.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitBadInput
+	}
+	if config.QueueRedis == "" {
+		fmt.Fprintln(os.Stderr, "worker needs -queue-redis, the queue the servers put their jobs in")
+		return exitBadInput
+	}
+	if config.Workers == 0 {
+		fmt.Fprintln(os.Stderr, "-workers must be at least 1")
+		return exitBadInput
+	}
+
+	// Frames and results pass through the object store, but stored results are
+	// the servers' business, so none are loaded
+	store, err := newS3Store(config)
+	if err != nil {
+		fatal("Error connecting to object storage", "error", err)
+	}
+	sharedStore = store
+	queue, err := newJobQueue()
+	if err != nil {
+		fatal("Error connecting to the Redis job queue", "error", err)
+	}
+	if config.OTLPEndpoint != "" {
+		startTracing(config.OTLPEndpoint)
+	}
+	jobs.start(config.Workers, queue)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watchConfig(ctx)
+	<-ctx.Done()
+	stop() // A second signal kills the process immediately
+
+	slog.Info("Shutting down: taking no more jobs, waiting for running ones", "timeout", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	jobs.stopIntake()
+	if err := jobs.wait(ctx); err != nil {
+		slog.Warn("Shutdown timeout reached with jobs still running; their servers will report them as failed")
+	}
+	tracer.flush(ctx)
+	slog.Info("Worker stopped")
+	return exitOK
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	_ "embed" // Required for embedding
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log/slog"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+//go:embed static/workflow.js
+var workflowJS string
+
+// Stages of the step-by-step workflow after the upload, in order. Processing is
+// the last step and ends the workflow rather than being a stage of its own.
+const (
+	stageReview  = "review"  // Check how each frame lines up with the reference and pick the reference
+	stageOptions = "options" // Choose the processing options
+	stageConfirm = "confirm" // Look over the choices and start the job
+)
+
+var workflowStages = []string{stageReview, stageOptions, stageConfirm}
+
+// workflowFields are the form fields the stages save in a workflow
+var workflowFields = []string{"reference", "offsets", "preset", "roi", "fit", "many_frames", "scale", "algorithm", "kernel", "format", "lossless", "quality", "progressive", "chroma", "deconvolve", "denoise", "sharpen", "wavelet", "clahe", "keep", "tile_reject", "binarize", "thermal", "mono16", "tonemap", "film", "negative", "match_exposure", "deghost", "subject", "adaptive", "luma_only", "ycbcr", "input_space", "working_space", "output_space", "deterministic", "workspace"}
+
+// workflowPreviewWidth is the width of the copies of the frames the review stage
+// draws its overlays from, in pixels
+const workflowPreviewWidth = 320
+
+// workflow holds a burst between the steps of the step-by-step web flow: the
+// frames stay on the server as uploads, so each step is a page of its own rather
+// than one post doing everything. Workflows are kept in memory and expire with
+// their uploads.
+type workflow struct {
+	ID      string
+	Owner   string
+	Uploads []string      // Resumable uploads holding the frames, in upload order
+	Names   []string      // File names of the frames
+	Sizes   []image.Point // Sizes of the full frames
+	Small   []image.Image // Copies of the frames workflowPreviewWidth wide
+	Expires time.Time
+
+	mu      sync.Mutex
+	stage   string     // Furthest stage reached
+	options url.Values // Fields saved by the stages
+}
+
+// workflowStore tracks the workflows in progress
+type workflowStore struct {
+	mu   sync.Mutex
+	byID map[string]*workflow
+}
+
+var workflows = &workflowStore{byID: make(map[string]*workflow)}
+
+// get returns a workflow of the caller; others' workflows are reported as missing
+func (s *workflowStore) get(r *http.Request, id string) (*workflow, *requestError) {
+	s.mu.Lock()
+	wf, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok || wf.Owner != requestOwner(r) {
+		return nil, &requestError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf("No workflow with ID %s; it may have expired", id)}
+	}
+	return wf, nil
+}
+
+// remove drops a workflow and the uploads holding its frames
+func (s *workflowStore) remove(id string) {
+	s.mu.Lock()
+	wf, ok := s.byID[id]
+	delete(s.byID, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, upload := range wf.Uploads {
+		uploads.remove(upload)
+	}
+}
+
+// startSweeper removes expired workflows periodically
+func (s *workflowStore) startSweeper() {
+	go func() {
+		for now := range time.Tick(10 * time.Minute) {
+			s.mu.Lock()
+			var expired []string
+			for id, wf := range s.byID {
+				if now.After(wf.Expires) {
+					expired = append(expired, id)
+				}
+			}
+			s.mu.Unlock()
+			for _, id := range expired {
+				s.remove(id)
+			}
+		}
+	}()
+}
+
+// request returns a copy of r carrying the workflow's frames and saved fields as
+// its form, as though they had been posted to /upload
+func (wf *workflow) request(r *http.Request) *http.Request {
+	wf.mu.Lock()
+	values := url.Values{}
+	for name, v := range wf.options {
+		values[name] = slices.Clone(v)
+	}
+	wf.mu.Unlock()
+	values["uploads"] = wf.Uploads
+	form := r.Clone(r.Context())
+	form.Form, form.PostForm = values, values
+	form.MultipartForm = &multipart.Form{Value: values}
+	return form
+}
+
+// workflowButton renders the upload page's button starting the step-by-step
+// workflow, which keeps frames on disk and so is not offered in -in-memory mode
+func workflowButton(r *http.Request) string {
+	if config.InMemory {
+		return ""
+	}
+	return fmt.Sprintf(`<button type="submit" formaction="%s" class="btn btn-outline-primary" title="%s">%s</button>`,
+		config.url("/workflow"), tr(r, "Review the alignment and choose the options before processing"), tr(r, "Step by step"))
+}
+
+// workflowStartHandler keeps the frames posted from the upload page and opens
+// the first stage of a workflow on them
+func workflowStartHandler(w http.ResponseWriter, r *http.Request) {
+	if config.InMemory {
+		writePlainError(w, &requestError{Status: http.StatusBadRequest, Code: "workflow_disabled", Message: "The step-by-step workflow keeps frames on disk, which this server does not do in -in-memory mode"})
+		return
+	}
+	if reqErr := limitUploadSize(w, r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	if r.MultipartForm == nil {
+		writePlainError(w, &requestError{Status: http.StatusBadRequest, Code: "no_images", Message: "No valid images to process. Please upload supported formats only."})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files, closeArchives, reqErr := uploadFrames(uploadedFiles(r))
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	defer closeArchives()
+	if reqErr := checkUploadedFiles(files, 0); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	if reqErr := checkArchiveSize(files); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+
+	wf := &workflow{ID: newJobID() + newJobID(), Owner: requestOwner(r), Expires: time.Now().Add(config.UploadExpiry), stage: stageReview, options: url.Values{}}
+	for _, name := range workflowFields {
+		if value := r.FormValue(name); value != "" {
+			wf.options.Set(name, value)
+		}
+	}
+	reqErr = wf.keepFrames(w, r, files)
+	if reqErr != nil {
+		for _, upload := range wf.Uploads {
+			uploads.remove(upload)
+		}
+		writePlainError(w, reqErr)
+		return
+	}
+	workflows.mu.Lock()
+	workflows.byID[wf.ID] = wf
+	workflows.mu.Unlock()
+	slog.InfoContext(r.Context(), "Workflow started", "workflow_id", wf.ID, "frames", len(wf.Uploads))
+	http.Redirect(w, r, config.url("/workflow/"+wf.ID), http.StatusSeeOther)
+}
+
+// keepFrames checks and stores the frames as uploads and draws the small copies
+// the review stage works on
+func (wf *workflow) keepFrames(w http.ResponseWriter, r *http.Request, files []uploadFrame) *requestError {
+	for _, frame := range files {
+		if reqErr := validateFileName(frame.name); reqErr != nil {
+			return reqErr
+		}
+		if _, reqErr := sniffUpload(frame); reqErr != nil {
+			return reqErr
+		}
+		u, reqErr := uploads.keep(w, r, frame)
+		if reqErr != nil {
+			return reqErr
+		}
+		wf.Uploads = append(wf.Uploads, u.ID)
+		wf.Names = append(wf.Names, frame.name)
+
+		f, err := os.Open(u.dataPath())
+		if err != nil {
+			return &requestError{Status: http.StatusInternalServerError, Code: "upload_read_failed", Message: "Error opening uploaded file"}
+		}
+		img, _, _, err := decodeFrame(f)
+		f.Close()
+		if err != nil {
+			return &requestError{Status: http.StatusBadRequest, Code: "unsupported_format", Message: fmt.Sprintf("Unsupported format for file %s. Supported formats are: %s", frame.name, supportedFormats)}
+		}
+		b := img.Bounds()
+		small := image.NewRGBA(image.Rect(0, 0, workflowPreviewWidth, max(1, b.Dy()*workflowPreviewWidth/max(b.Dx(), 1))))
+		draw.BiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+		wf.Sizes = append(wf.Sizes, b.Size())
+		wf.Small = append(wf.Small, small)
+	}
+	if len(wf.Uploads) == 0 {
+		return &requestError{Status: http.StatusBadRequest, Code: "no_images", Message: "No valid images to process. Please upload supported formats only."}
+	}
+	return nil
+}
+
+// workflowPageHandler renders a stage of a workflow: the one asked for in the
+// stage query parameter when it has been reached, or the furthest one
+func workflowPageHandler(w http.ResponseWriter, r *http.Request) {
+	wf, reqErr := workflows.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	wf.mu.Lock()
+	stage := wf.stage
+	wf.mu.Unlock()
+	if asked := r.URL.Query().Get("stage"); slices.Index(workflowStages, asked) >= 0 && slices.Index(workflowStages, asked) <= slices.Index(workflowStages, stage) {
+		stage = asked
+	}
+	writeWorkflowPage(w, r, wf, stage, "")
+}
+
+// workflowStepHandler saves the fields posted by a stage and moves on to the stage
+// named in next. Options are checked before the confirmation stage, which shows
+// them again with the problem instead.
+func workflowStepHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	wf, reqErr := workflows.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	next := r.FormValue("next")
+	if !slices.Contains(workflowStages, next) {
+		writePlainError(w, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: fmt.Sprintf("Unknown workflow stage %q", next)})
+		return
+	}
+	wf.mu.Lock()
+	for _, name := range workflowFields {
+		if _, posted := r.Form[name]; posted {
+			wf.options.Set(name, r.FormValue(name))
+		}
+	}
+	wf.mu.Unlock()
+
+	if next == stageConfirm {
+		if reqErr := wf.checkOptions(r); reqErr != nil {
+			w.WriteHeader(reqErr.Status)
+			writeWorkflowPage(w, r, wf, stageOptions, reqErr.Message)
+			return
+		}
+	}
+	wf.mu.Lock()
+	if slices.Index(workflowStages, next) > slices.Index(workflowStages, wf.stage) {
+		wf.stage = next
+	}
+	wf.mu.Unlock()
+	http.Redirect(w, r, config.url("/workflow/"+wf.ID)+"?stage="+next, http.StatusSeeOther)
+}
+
+// checkOptions validates the saved fields as the job will
+func (wf *workflow) checkOptions(r *http.Request) *requestError {
+	form := wf.request(r)
+	req, reqErr := parseSuperResolutionRequestV1(form)
+	if reqErr != nil {
+		return reqErr
+	}
+	if _, reqErr := req.options(len(wf.Uploads)); reqErr != nil {
+		return reqErr
+	}
+	return checkWorkspaceAccess(form, req.Workspace)
+}
+
+// workflowProcessHandler runs the job on the workflow's frames and options. The
+// job removes the frames once it has used them, which ends the workflow; after a
+// failure they stay for another try.
+func workflowProcessHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	wf, reqErr := workflows.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	serveSuperResolution(w, wf.request(r), writePlainError, acceptsHTML(r))
+	if _, reqErr := uploads.get(r, wf.Uploads[0]); reqErr != nil {
+		workflows.remove(wf.ID)
+	}
+}
+
+// workflowDeleteHandler abandons a workflow, deleting its frames
+func workflowDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if reqErr := verifyCSRF(r); reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	wf, reqErr := workflows.get(r, r.PathValue("id"))
+	if reqErr != nil {
+		writePlainError(w, reqErr)
+		return
+	}
+	workflows.remove(wf.ID)
+	http.Redirect(w, r, config.url("/"), http.StatusSeeOther)
+}
+
+// writeWorkflowPage renders a stage of a workflow under a list of the steps, with
+// problem shown above the stage when it is not empty
+func writeWorkflowPage(w http.ResponseWriter, r *http.Request, wf *workflow, stage, problem string) {
+	const workflowPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Step by step}}</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Step by step}}</h1>
+	%s
+	%s
+	%s
+	<div class="bg-body p-4 rounded shadow">
+	%s
+	</div>
+	<form action="%s" method="post" class="text-center mt-3">
+	<input type="hidden" name="csrf_token" value="%s">
+	<button type="submit" class="btn btn-link text-danger">{{Discard these frames}}</button>
+	</form>
+	</div>
+	%s
+	<script>%s</script>
+	<script>%s</script>
+	%s
+	</body>
+	</html>
+	`
+	token := csrfToken(w, r) // Sets the cookie, so it must run before the header is written
+	if problem != "" {
+		problem = `<div class="alert alert-danger">` + html.EscapeString(tr(r, problem)) + `</div>`
+	}
+	var body string
+	switch stage {
+	case stageReview:
+		body = wf.reviewStage(r, token)
+	case stageOptions:
+		body = wf.optionsStage(r, token)
+	default:
+		body = wf.confirmStage(r, token)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(w, localize(r, workflowPageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), wf.steps(r, stage), problem, body,
+		config.url("/workflow/"+wf.ID+"/delete"), token, messagesScript(r), progressJS, workflowJS, pageFooter(r))
+}
+
+// steps renders the list of steps, linking the stages already reached
+func (wf *workflow) steps(r *http.Request, current string) string {
+	wf.mu.Lock()
+	reached := slices.Index(workflowStages, wf.stage)
+	wf.mu.Unlock()
+	labels := map[string]string{stageReview: "Review alignment", stageOptions: "Options", stageConfirm: "Confirm"}
+	var b strings.Builder
+	b.WriteString(`<ol class="nav nav-pills nav-fill mb-4">`)
+	fmt.Fprintf(&b, `<li class="nav-item"><span class="nav-link disabled">1. %s &#10003;</span></li>`, tr(r, "Upload"))
+	for i, stage := range workflowStages {
+		label := fmt.Sprintf("%d. %s", i+2, tr(r, labels[stage]))
+		switch {
+		case stage == current:
+			fmt.Fprintf(&b, `<li class="nav-item"><span class="nav-link active" aria-current="step">%s</span></li>`, label)
+		case i <= reached:
+			fmt.Fprintf(&b, `<li class="nav-item"><a class="nav-link" href="%s?stage=%s">%s</a></li>`, config.url("/workflow/"+wf.ID), stage, label)
+		default:
+			fmt.Fprintf(&b, `<li class="nav-item"><span class="nav-link disabled">%s</span></li>`, label)
+		}
+	}
+	fmt.Fprintf(&b, `<li class="nav-item"><span class="nav-link disabled">%d. %s</span></li></ol>`, len(workflowStages)+2, tr(r, "Process"))
+	return b.String()
+}
+
+// savedOption returns a field saved by an earlier stage
+func (wf *workflow) savedOption(name string) string {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	return wf.options.Get(name)
+}
+
+// reference returns the index of the chosen reference frame
+func (wf *workflow) reference() int {
+	reference, err := strconv.Atoi(wf.savedOption("reference"))
+	if err != nil || reference < 0 || reference >= len(wf.Uploads) {
+		return 0
+	}
+	return reference
+}
+
+// stageForm opens a form of a stage posting to the next one, or to the one its
+// submit buttons name when next is empty
+func (wf *workflow) stageForm(token, next string) string {
+	if next != "" {
+		next = fmt.Sprintf(`<input type="hidden" name="next" value="%s">`, next)
+	}
+	return fmt.Sprintf(`<form action="%s" method="post"><input type="hidden" name="csrf_token" value="%s">%s`,
+		config.url("/workflow/"+wf.ID), token, next)
+}
+
+// reviewStage shows every frame over the reference with its estimated shift and
+// lets the user pick another reference or move and turn a frame by hand
+func (wf *workflow) reviewStage(r *http.Request, token string) string {
+	reference := wf.reference()
+	saved := wf.savedOption("offsets")
+	manual, reqErr := parseFrameOffsets(saved, len(wf.Uploads), reference)
+	if reqErr != nil {
+		manual, saved = nil, "" // Set against another reference
+	}
+	scale := float64(wf.Small[reference].Bounds().Dx()) / float64(max(wf.Sizes[reference].X, 1))
+
+	var b strings.Builder
+	b.WriteString(wf.stageForm(token, ""))
+	fmt.Fprintf(&b, `<input type="hidden" name="offsets" value="%s">`, html.EscapeString(saved))
+	fmt.Fprintf(&b, `<p class="form-text">%s</p><div id="review" class="row g-3 mb-3" data-reference-src="%s" data-max-angle="%d">`,
+		tr(r, "Each frame is drawn in cyan over the reference in red, after moving it by the shift found: where they line up the overlay is grey, and coloured fringes show what does not. Frames with warnings will fuse poorly; move them by hand, start over without them or pick another reference."),
+		frameURL(wf.Small[reference]), maxNudgeAngle)
+	for i, name := range wf.Names {
+		checked, caption, nudge := "", "", ""
+		offset := frameOffset{}
+		if i == reference {
+			checked = " checked"
+			caption = tr(r, "Reference frame")
+		} else {
+			p := previewAlignment(wf.Small[reference], wf.Small[i], wf.Sizes[reference], wf.Sizes[i])
+			auto := frameOffset{DX: -p.DX, DY: -p.DY}
+			offset = auto
+			if wf.Sizes[i] == wf.Sizes[reference] {
+				caption = trf(r, "Shifted by %d, %d px", auto.DX, auto.DY)
+				automaticSrc := ""
+				if i < len(manual) && manual[i] != nil {
+					offset = *manual[i]
+					automaticSrc = wf.overlayURL(reference, i, auto, scale)
+				}
+				nudge = nudgeControls(r, i, auto, offset, scale, wf.Small[i], automaticSrc)
+			}
+			if p.Warning != "" {
+				caption += `<br><span class="text-warning-emphasis">` + tr(r, p.Warning) + `</span>`
+			}
+		}
+		fmt.Fprintf(&b, `<div class="col-6 col-md-4"><div class="card h-100"><img src="%s" class="card-img-top" alt="%s"><div class="card-body small">`,
+			wf.overlayURL(reference, i, offset, scale), html.EscapeString(name))
+		fmt.Fprintf(&b, `<div class="form-check"><input type="radio" name="reference" value="%d" id="reference-%d" class="form-check-input"%s><label for="reference-%d" class="form-check-label text-break">%s</label></div><div class="text-muted">%s</div>%s</div></div></div>`,
+			i, i, checked, i, html.EscapeString(name), caption, nudge)
+	}
+	fmt.Fprintf(&b, `</div><div class="d-grid gap-2"><button type="submit" name="next" value="%s" class="btn btn-success btn-lg">%s</button>`, stageOptions, tr(r, "Continue"))
+	fmt.Fprintf(&b, `<button type="submit" name="next" value="%s" class="btn btn-outline-secondary">%s</button></div></form>`, stageReview, tr(r, "Redraw against the chosen reference"))
+	return b.String()
+}
+
+// nudgeControls renders the arrows and fields moving and turning frame i by hand
+// over its overlay, starting at offset. The arrows move by one pixel of the
+// overlay; the fields and offsets are in pixels of the full frame. automaticSrc is
+// the overlay at the automatic offset auto when offset was set by hand.
+func nudgeControls(r *http.Request, i int, auto, offset frameOffset, scale float64, small image.Image, automaticSrc string) string {
+	open := ""
+	if automaticSrc != "" {
+		open = fmt.Sprintf(` open data-manual data-automatic-src="%s"`, automaticSrc)
+	}
+	step := max(1, int(math.Round(1/scale)))
+	var b strings.Builder
+	fmt.Fprintf(&b, `<details class="nudge mt-2" data-frame="%d" data-src="%s" data-scale="%g" data-step="%d"%s><summary>%s</summary>`,
+		i, frameURL(small), scale, step, open, tr(r, "Adjust by hand"))
+	b.WriteString(`<div class="btn-group btn-group-sm my-2" role="group">`)
+	for _, arrow := range []struct{ move, label, title string }{
+		{"-1,0,0", "&larr;", "Left"}, {"0,-1,0", "&uarr;", "Up"}, {"0,1,0", "&darr;", "Down"}, {"1,0,0", "&rarr;", "Right"},
+		{"0,0,-0.5", "&#10226;", "Turn anticlockwise"}, {"0,0,0.5", "&#10227;", "Turn clockwise"},
+	} {
+		fmt.Fprintf(&b, `<button type="button" class="btn btn-outline-secondary" data-move="%s" title="%s" aria-label="%s">%s</button>`, arrow.move, tr(r, arrow.title), tr(r, arrow.title), arrow.label)
+	}
+	b.WriteString(`</div><div class="row g-1">`)
+	for _, field := range []struct {
+		name, label string
+		value, auto string
+		step        string
+	}{
+		{"dx", "dx, px", strconv.Itoa(offset.DX), strconv.Itoa(auto.DX), "1"},
+		{"dy", "dy, px", strconv.Itoa(offset.DY), strconv.Itoa(auto.DY), "1"},
+		{"angle", "Rotation, °", strconv.FormatFloat(offset.Angle, 'f', -1, 64), "0", "0.1"},
+	} {
+		fmt.Fprintf(&b, `<div class="col-4"><label class="form-label mb-0" for="%s-%d">%s</label><input type="number" id="%s-%d" data-field="%s" value="%s" data-auto="%s" step="%s" class="form-control form-control-sm"></div>`,
+			field.name, i, tr(r, field.label), field.name, i, field.name, field.value, field.auto, field.step)
+	}
+	fmt.Fprintf(&b, `</div><button type="button" class="btn btn-link btn-sm px-0" data-automatic>%s</button></details>`, tr(r, "Back to automatic alignment"))
+	return b.String()
+}
+
+// frameURL embeds a small copy of a frame in a page
+func frameURL(img image.Image) string {
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	return dataURL("image/jpeg", buf.Bytes())
+}
+
+// overlayURL draws frame i over the reference as an anaglyph, the reference in
+// the red channel and the frame, moved by offset, in green and blue. scale is the
+// size of the small copies against the full frames.
+func (wf *workflow) overlayURL(reference, i int, offset frameOffset, scale float64) string {
+	ref := wf.Small[reference]
+	moved := transformFrame(wf.Small[i], float64(offset.DX)*scale, float64(offset.DY)*scale, offset.Angle)
+	b := ref.Bounds()
+	overlay := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			red := color.GrayModel.Convert(ref.At(x, y)).(color.Gray).Y
+			cyan := red
+			if image.Pt(x, y).In(moved.Bounds()) {
+				cyan = color.GrayModel.Convert(moved.At(x, y)).(color.Gray).Y
+			}
+			overlay.SetRGBA(x, y, color.RGBA{R: red, G: cyan, B: cyan, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, overlay, &jpeg.Options{Quality: 80})
+	return dataURL("image/jpeg", buf.Bytes())
+}
+
+// optionsStage offers the processing options with the saved choices filled in
+func (wf *workflow) optionsStage(r *http.Request, token string) string {
+	wf.mu.Lock()
+	saved, _ := json.Marshal(wf.options)
+	wf.mu.Unlock()
+	var b strings.Builder
+	b.WriteString(wf.stageForm(token, stageConfirm))
+	fmt.Fprintf(&b, `<div id="workflow-options" data-options="%s">%s%s</div>`, html.EscapeString(string(saved)), workspaceSelect(r), optionFields(r))
+	fmt.Fprintf(&b, `<div class="d-grid"><button type="submit" class="btn btn-success btn-lg">%s</button></div></form>`, tr(r, "Continue"))
+	return b.String()
+}
+
+// confirmStage sums up the choices and starts the job
+func (wf *workflow) confirmStage(r *http.Request, token string) string {
+	reference := wf.reference()
+	scale := wf.savedOption("scale")
+	if scale == "" {
+		scale = tr(r, "Auto")
+	} else {
+		scale += "x"
+	}
+	rows := [][2]string{
+		{tr(r, "Frames"), strconv.Itoa(len(wf.Uploads))},
+		{tr(r, "Reference frame"), wf.Names[reference]},
+		{tr(r, "Scale factor"), scale},
+	}
+	if offsets := wf.savedOption("offsets"); offsets != "" {
+		rows = append(rows, [2]string{tr(r, "Aligned by hand"), offsets})
+	}
+	for _, field := range []struct{ name, label string }{
+		{"preset", "Preset"}, {"algorithm", "Algorithm"}, {"kernel", "Interpolation"}, {"format", "Output format"}, {"lossless", "Lossless only (for archiving, JPEG refused)"},
+		{"roi", "Region of interest"}, {"fit", "Frames of another size"}, {"many_frames", "Bursts of many frames"}, {"quality", "JPEG quality"},
+		{"progressive", "Progressive JPEG"}, {"chroma", "JPEG chroma subsampling"}, {"deconvolve", "Deconvolve"}, {"denoise", "Denoise"}, {"sharpen", "Sharpen"},
+		{"wavelet", "Wavelet sharpening"}, {"clahe", "Local contrast"}, {"keep", "Sharpest frames kept, %"}, {"tile_reject", "Frames left out of every tile, %"},
+		{"binarize", "Black and white text (for documents)"}, {"thermal", "Thermal camera frames (16-bit radiometric TIFF or PNG)"}, {"mono16", "16-bit grayscale frames at full depth (microscope cameras)"},
+		{"tonemap", "Tone mapping of 16-bit results"},
+		{"film", "Passes of a film scanner (removes dust)"}, {"negative", "Scans of a negative"},
+		{"match_exposure", "Match the exposure of the frames"}, {"deghost", "Remove ghosts of moving people and cars"}, {"subject", "Keep a moving subject sharp (portraits)"},
+		{"adaptive", "Adapt to the noise of every frame"}, {"luma_only", "Fuse brightness only (about 3x faster)"},
+		{"ycbcr", "Fuse JPEG frames in Y'CbCr (faster)"},
+		{"input_space", "Colour space of the frames"}, {"working_space", "Fuse in"}, {"output_space", "Colour space of the result"},
+		{"deterministic", "Reproducible result (same frames, same bytes)"},
+	} {
+		if value := wf.savedOption(field.name); value != "" {
+			rows = append(rows, [2]string{tr(r, field.label), value})
+		}
+	}
+	var b strings.Builder
+	b.WriteString(`<table class="table"><tbody>`)
+	for _, row := range rows {
+		fmt.Fprintf(&b, `<tr><th scope="row">%s</th><td class="text-break">%s</td></tr>`, row[0], html.EscapeString(row[1]))
+	}
+	b.WriteString(`</tbody></table>`)
+	fmt.Fprintf(&b, `<form action="%s" method="post" enctype="multipart/form-data"><input type="hidden" name="csrf_token" value="%s">`, config.url("/workflow/"+wf.ID+"/process"), token)
+	fmt.Fprintf(&b, `<div class="d-grid"><button type="submit" class="btn btn-success btn-lg">%s</button></div></form>`, tr(r, "Process"))
+	fmt.Fprintf(&b, `<div id="progress" class="d-none mt-3" data-progress-url="%s" aria-live="polite">`, config.url("/progress/"))
+	fmt.Fprintf(&b, `<div class="d-flex justify-content-between mb-2"><strong id="progress-stage"></strong></div><div class="progress" role="progressbar" aria-label="%s" aria-valuemin="0" aria-valuemax="100"><div class="progress-bar progress-bar-striped progress-bar-animated" style="width:0%%"></div></div><div id="progress-detail" class="form-text mt-2"></div></div>`, tr(r, "Progress"))
+	return b.String()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workspace groups the jobs and results of a team. Its owner manages the member
+// list; members are the e-mail addresses of logged-in users or "key:<name>" for API keys.
+type workspace struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"` // Account that created the workspace, see requestOwner
+	Members []string  `json:"members"`
+	Created time.Time `json:"created"`
+}
+
+// workspaceStore holds the workspaces and persists them to a JSON file
+type workspaceStore struct {
+	mu    sync.Mutex
+	byID  map[string]*workspace
+	order []string // Workspace IDs in creation order
+	path  string   // JSON file the workspaces are saved to, empty for memory only
+}
+
+// workspaces is the process-wide workspace store
+var workspaces = &workspaceStore{byID: make(map[string]*workspace)}
+
+// load reads the workspaces saved at path
+func (s *workspaceStore) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*workspace
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parsing workspace store %s: %w", path, err)
+	}
+	for _, ws := range list {
+		s.byID[ws.ID] = ws
+		s.order = append(s.order, ws.ID)
+	}
+	slog.Info("Loaded workspaces", "count", len(list), "path", path)
+	return nil
+}
+
+// save writes the workspaces to the store file; the caller holds s.mu
+func (s *workspaceStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]*workspace, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, s.byID[id])
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// memberName is how the request's account appears in member lists
+func memberName(r *http.Request) string {
+	if u := userFromContext(r.Context()); u != nil {
+		return strings.ToLower(u.Email)
+	}
+	if k := apiKeyFromContext(r.Context()); k != nil {
+		return "key:" + k.Name
+	}
+	return ""
+}
+
+// isMember reports whether the request's account owns or belongs to ws
+func (ws *workspace) isMember(r *http.Request) bool {
+	if owner := requestOwner(r); owner != "" && owner == ws.Owner {
+		return true
+	}
+	name := memberName(r)
+	return name != "" && slices.Contains(ws.Members, name)
+}
+
+// get returns a copy of the workspace if the request's account may see it
+func (s *workspaceStore) get(r *http.Request, id string) (workspace, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ws, ok := s.byID[id]
+	if !ok || !ws.isMember(r) {
+		return workspace{}, false
+	}
+	c := *ws
+	c.Members = slices.Clone(ws.Members)
+	return c, true
+}
+
+// forRequest returns the workspaces the request's account belongs to
+func (s *workspaceStore) forRequest(r *http.Request) []workspace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []workspace{}
+	for _, id := range s.order {
+		if ws := s.byID[id]; ws.isMember(r) {
+			c := *ws
+			c.Members = slices.Clone(ws.Members)
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+var errWorkspaceNotFound = &requestError{Status: http.StatusNotFound, Code: "workspace_not_found", Message: "No workspace with this ID"}
+
+// modify applies change to a workspace owned by the request's account and saves the store
+func (s *workspaceStore) modify(r *http.Request, id string, change func(ws *workspace) *requestError) *requestError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ws, ok := s.byID[id]
+	if !ok || !ws.isMember(r) {
+		return errWorkspaceNotFound
+	}
+	if ws.Owner != requestOwner(r) {
+		return &requestError{Status: http.StatusForbidden, Code: "forbidden", Message: "Only the owner of a workspace can change it"}
+	}
+	if reqErr := change(ws); reqErr != nil {
+		return reqErr
+	}
+	return s.saveOrFail()
+}
+
+// saveOrFail saves the store, reporting a failure to the client; the caller holds s.mu
+func (s *workspaceStore) saveOrFail() *requestError {
+	if err := s.save(); err != nil {
+		slog.Error("Error saving workspace store", "error", err)
+		return &requestError{Status: http.StatusInternalServerError, Code: "store_failed", Message: "Error saving workspaces"}
+	}
+	return nil
+}
+
+// createWorkspace adds a workspace owned by the request's account
+func createWorkspace(r *http.Request) (*workspace, *requestError) {
+	owner := requestOwner(r)
+	if owner == "" {
+		return nil, &requestError{Status: http.StatusForbidden, Code: "forbidden", Message: "Workspaces require logging in or an API key"}
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		return nil, &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "Parameter name must be between 1 and 100 characters"}
+	}
+
+	ws := &workspace{ID: newJobID(), Name: name, Owner: owner, Members: []string{}, Created: time.Now()}
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	workspaces.byID[ws.ID] = ws
+	workspaces.order = append(workspaces.order, ws.ID)
+	if reqErr := workspaces.saveOrFail(); reqErr != nil {
+		return nil, reqErr
+	}
+	slog.InfoContext(r.Context(), "Workspace created", "workspace", ws.ID, "name", name)
+	return ws, nil
+}
+
+// deleteWorkspace removes a workspace; its jobs stay with their submitters
+func deleteWorkspace(r *http.Request, id string) *requestError {
+	return workspaces.modify(r, id, func(ws *workspace) *requestError {
+		delete(workspaces.byID, id)
+		workspaces.order = slices.DeleteFunc(workspaces.order, func(o string) bool { return o == id })
+		return nil
+	})
+}
+
+// addMember adds an e-mail address or "key:<name>" to a workspace
+func addMember(r *http.Request, id, member string) *requestError {
+	member = strings.ToLower(strings.TrimSpace(member))
+	if member == "" || (!strings.HasPrefix(member, "key:") && !strings.Contains(member, "@")) {
+		return &requestError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "A member is an e-mail address or key:<API key name>"}
+	}
+	return workspaces.modify(r, id, func(ws *workspace) *requestError {
+		if !slices.Contains(ws.Members, member) {
+			ws.Members = append(ws.Members, member)
+		}
+		return nil
+	})
+}
+
+// removeMember takes an e-mail address or "key:<name>" off a workspace
+func removeMember(r *http.Request, id, member string) *requestError {
+	member = strings.ToLower(strings.TrimSpace(member))
+	return workspaces.modify(r, id, func(ws *workspace) *requestError {
+		ws.Members = slices.DeleteFunc(ws.Members, func(m string) bool { return m == member })
+		return nil
+	})
+}
+
+// checkWorkspaceAccess verifies that a job may be submitted to the workspace id
+func checkWorkspaceAccess(r *http.Request, id string) *requestError {
+	if id == "" {
+		return nil
+	}
+	if _, ok := workspaces.get(r, id); !ok {
+		return errWorkspaceNotFound
+	}
+	return nil
+}
+
+// workspaceSelect renders the workspace picker of the upload form, or nothing
+// when the user belongs to no workspace
+func workspaceSelect(r *http.Request) string {
+	list := workspaces.forRequest(r)
+	if len(list) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<div class="mb-3"><label for="workspace" class="form-label">%s</label><select name="workspace" id="workspace" class="form-select"><option value="">%s</option>`, tr(r, "Share with workspace"), tr(r, "Only me")))
+	for _, ws := range list {
+		fmt.Fprintf(&b, `<option value="%s">%s</option>`, ws.ID, html.EscapeString(ws.Name))
+	}
+	b.WriteString(`</select></div>`)
+	return b.String()
+}
+
+// workspacesPageHandler lists the user's workspaces with forms to manage them
+func workspacesPageHandler(w http.ResponseWriter, r *http.Request) {
+	token := csrfToken(w, r)
+	form := func(action, fields, button, style string) string {
+		return fmt.Sprintf(`<form action="%s" method="post" class="d-inline"><input type="hidden" name="csrf_token" value="%s">%s<button type="submit" class="btn btn-sm %s">%s</button></form>`,
+			config.url(action), token, fields, style, button)
+	}
+
+	var cards strings.Builder
+	owner := requestOwner(r)
+	for _, ws := range workspaces.forRequest(r) {
+		base := "/workspaces/" + ws.ID
+		fmt.Fprintf(&cards, `<div class="card shadow-sm mb-3"><div class="card-body"><h5 class="card-title"><a href="%s">%s</a></h5>`,
+			config.url("/results?workspace="+ws.ID), html.EscapeString(ws.Name))
+		fmt.Fprintf(&cards, `<p class="card-text text-muted">ID %s &middot; %s</p><ul>`, ws.ID, trf(r, "%d members", len(ws.Members)))
+		for _, m := range ws.Members {
+			cards.WriteString(`<li>` + html.EscapeString(m))
+			if ws.Owner == owner {
+				cards.WriteString(" " + form(base+"/members/remove", fmt.Sprintf(`<input type="hidden" name="member" value="%s">`, html.EscapeString(m)), tr(r, "Remove"), "btn-link"))
+			}
+			cards.WriteString(`</li>`)
+		}
+		cards.WriteString(`</ul>`)
+		if ws.Owner == owner {
+			cards.WriteString(form(base+"/members", fmt.Sprintf(`<input type="text" name="member" placeholder="%s" class="form-control form-control-sm d-inline w-auto me-2" required>`, tr(r, "e-mail or key:name")), tr(r, "Add member"), "btn-outline-primary"))
+			cards.WriteString(" " + form(base+"/delete", "", tr(r, "Delete workspace"), "btn-outline-danger"))
+		}
+		cards.WriteString(`</div></div>`)
+	}
+
+	const workspacesPageHTML = `
+	<!DOCTYPE html>
+	<html lang="%s">
+	<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>{{Workspaces}}</title>
+	%s
+	</head>
+	<body class="bg-body-tertiary">
+	<div class="container py-5">
+	%s
+	<h1 class="mb-4 text-center text-primary">{{Workspaces}}</h1>
+	%s
+	%s
+	<div class="bg-body p-4 rounded shadow">%s</div>
+	</div>
+	%s
+	</body>
+	</html>
+	`
+	create := form("/workspaces", fmt.Sprintf(`<input type="text" name="name" placeholder="%s" class="form-control d-inline w-auto me-2" required>`, tr(r, "New workspace name")), tr(r, "Create"), "btn-success")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, localize(r, workspacesPageHTML), requestLocale(r), pageHead(r), brandLogo(), navBar(r), cards.String(), create, pageFooter(r))
+}
+
+// workspaceFormHandler wraps a workspace change submitted from the workspaces page
+func workspaceFormHandler(change func(r *http.Request) *requestError) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reqErr := verifyCSRF(r); reqErr != nil {
+			writePlainError(w, reqErr)
+			return
+		}
+		if reqErr := change(r); reqErr != nil {
+			writePlainError(w, reqErr)
+			return
+		}
+		http.Redirect(w, r, config.url("/workspaces"), http.StatusSeeOther)
+	}
+}
+
+// registerWorkspaceRoutes adds the workspace pages and API endpoints to mux
+func registerWorkspaceRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /workspaces", requireLogin(workspacesPageHandler))
+	mux.HandleFunc("POST /workspaces", requireLogin(workspaceFormHandler(func(r *http.Request) *requestError {
+		_, reqErr := createWorkspace(r)
+		return reqErr
+	})))
+	mux.HandleFunc("POST /workspaces/{id}/delete", requireLogin(workspaceFormHandler(func(r *http.Request) *requestError {
+		return deleteWorkspace(r, r.PathValue("id"))
+	})))
+	mux.HandleFunc("POST /workspaces/{id}/members", requireLogin(workspaceFormHandler(func(r *http.Request) *requestError {
+		return addMember(r, r.PathValue("id"), r.FormValue("member"))
+	})))
+	mux.HandleFunc("POST /workspaces/{id}/members/remove", requireLogin(workspaceFormHandler(func(r *http.Request) *requestError {
+		return removeMember(r, r.PathValue("id"), r.FormValue("member"))
+	})))
+
+	api := func(handler func(w http.ResponseWriter, r *http.Request) *requestError) http.HandlerFunc {
+		return requireAPIKey(writeAPIErrorV1, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-API-Version", apiVersion)
+			if reqErr := handler(w, r); reqErr != nil {
+				writeAPIErrorV1(w, reqErr)
+			}
+		})
+	}
+	mux.HandleFunc("GET /api/v1/workspaces", api(func(w http.ResponseWriter, r *http.Request) *requestError {
+		writeJSON(w, http.StatusOK, map[string]any{"workspaces": workspaces.forRequest(r)})
+		return nil
+	}))
+	mux.HandleFunc("POST /api/v1/workspaces", api(func(w http.ResponseWriter, r *http.Request) *requestError {
+		ws, reqErr := createWorkspace(r)
+		if reqErr == nil {
+			writeJSON(w, http.StatusCreated, ws)
+		}
+		return reqErr
+	}))
+	mux.HandleFunc("DELETE /api/v1/workspaces/{id}", api(func(w http.ResponseWriter, r *http.Request) *requestError {
+		reqErr := deleteWorkspace(r, r.PathValue("id"))
+		if reqErr == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return reqErr
+	}))
+	mux.HandleFunc("POST /api/v1/workspaces/{id}/members", api(func(w http.ResponseWriter, r *http.Request) *requestError {
+		reqErr := addMember(r, r.PathValue("id"), r.FormValue("member"))
+		if reqErr == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return reqErr
+	}))
+	mux.HandleFunc("DELETE /api/v1/workspaces/{id}/members/{member}", api(func(w http.ResponseWriter, r *http.Request) *requestError {
+		reqErr := removeMember(r, r.PathValue("id"), r.PathValue("member"))
+		if reqErr == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return reqErr
+	}))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// JPEG frames decode to Y'CbCr planes, which every step that reads them pixel
+// by pixel converts to RGB: shifting a frame into place, upscaling it and
+// summing it into the accumulator. With the ycbcr option, a JPEG frame that
+// is only shifted stays as decoded, its planes upscaled and summed as they
+// are, and the fused planes are converted to RGB once, when rendered. Frames
+// some other step has redrawn, such as a turned handheld frame or one whose
+// ghosts were replaced, make the whole burst take the RGB path.
+
+// ycbcrFrame is a JPEG frame in its Y'CbCr planes, moved by shift, which reads
+// black where no pixel of it lands as shiftImage does
+type ycbcrFrame struct {
+	planes *image.YCbCr
+	shift  image.Point
+}
+
+func (f *ycbcrFrame) ColorModel() color.Model { return color.YCbCrModel }
+func (f *ycbcrFrame) Bounds() image.Rectangle { return f.planes.Rect }
+
+func (f *ycbcrFrame) At(x, y int) color.Color {
+	p := image.Pt(x, y).Sub(f.shift)
+	if !p.In(f.planes.Rect) {
+		return color.Black
+	}
+	return f.planes.At(p.X, p.Y)
+}
+
+// planarShift moves img by o: a JPEG frame only shifted stays in its planes
+// when planar, see ycbcrFrame, and the rest is redrawn by o.apply
+func planarShift(img image.Image, o frameOffset, planar bool) image.Image {
+	if f, ok := img.(*image.YCbCr); ok && planar && o.Angle == 0 {
+		return &ycbcrFrame{planes: f, shift: image.Pt(o.DX, o.DY)}
+	}
+	return o.apply(img)
+}
+
+// planarFrames returns the aligned frames in their planes, the reference as
+// decoded, or nil when any of them is not a JPEG frame in its planes
+func planarFrames(aligned []image.Image) []*ycbcrFrame {
+	frames := make([]*ycbcrFrame, len(aligned))
+	for i, img := range aligned {
+		switch f := img.(type) {
+		case *ycbcrFrame:
+			frames[i] = f
+		case *image.YCbCr:
+			frames[i] = &ycbcrFrame{planes: f}
+		default:
+			return nil
+		}
+	}
+	return frames
+}
+
+// upscale returns the Y', Cb and Cr planes of f resampled to width x height
+// with kernel, each at the resolution of Y' as f.At reads it
+func (f *ycbcrFrame) upscale(width, height int, kernel draw.Interpolator) [][][]float32 {
+	b := f.planes.Rect
+	black := [3]uint8{0, 128, 128}
+	planes := make([][][]float32, 3)
+	for c := range planes {
+		pix, offset := f.planes.Cb, f.planes.COffset
+		switch c {
+		case 0:
+			pix, offset = f.planes.Y, f.planes.YOffset
+		case 2:
+			pix = f.planes.Cr
+		}
+		planes[c] = upscalePlane(b.Dx(), b.Dy(), width, height, kernel, func(y int, samples []uint8) {
+			sy := b.Min.Y + y - f.shift.Y
+			for x := range samples {
+				sx := b.Min.X + x - f.shift.X
+				if sx < b.Min.X || sx >= b.Max.X || sy < b.Min.Y || sy >= b.Max.Y {
+					samples[x] = black[c]
+					continue
+				}
+				samples[x] = pix[offset(sx, sy)]
+			}
+		})
+	}
+	return planes
+}
+
+// ycbcrRows renders the rows [y0, y1) of an accumulation of Y'CbCr planes into
+// an RGBA strip positioned at (0, 0), as renderRows does the RGB ones
+func (acc *fusionAccumulator) ycbcrRows(y0, y1 int) *image.RGBA {
+	strip := image.NewRGBA(image.Rect(0, 0, acc.width, y1-y0))
+	level := func(sum, weight float64) uint8 {
+		return uint8(math.Min(math.Max(math.Round(sum/weight), 0), 255))
+	}
+	for y := y0; y < y1; y++ {
+		for x := 0; x < acc.width; x++ {
+			w := acc.weights[y][x]
+			if w <= 0 {
+				strip.SetRGBA(x, y-y0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+				continue
+			}
+			r, g, b := color.YCbCrToRGB(level(acc.accR[y][x], w), level(acc.accG[y][x], w), level(acc.accB[y][x], w))
+			strip.SetRGBA(x, y-y0, color.RGBA{R: r, G: g, B: b, A: 255})
+		}
+	}
+	return strip
+}